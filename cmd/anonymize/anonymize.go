@@ -0,0 +1,322 @@
+/*
+Package main implements anonymize, rewriting pcaps so that datasets can be
+shared publicly without leaking information about the infrastructure they
+were collected on.
+
+Every unicast MAC address (of Ethernet, or the link-layer address of Linux
+cooked captures), and every IP address in -client (by default, all private,
+loopback and link-local networks), is pseudonymized ("pseudo"), mapped by a
+keyed hash to a locally administered MAC or an address in 10.0.0.0/8 or
+fd00::/8, or stripped to all zeros ("strip") with -mode.  Pseudonyms are the
+same for the same -key, e.g., to link the clients of several datasets, and
+unlinkable between runs without it.  IPv4, UDP and TCP checksums are updated
+for the new addresses.  Pcaps of link types other than Ethernet, Linux
+cooked capture (SLL), raw IP and loopback, which may have addresses that are
+not rewritten, are refused.
+
+The payload of every packet but DNS (port 53) is truncated to the headers up
+to TCP or UDP (or IP, or the link for, e.g., ARP), while the lengths on the wire are kept, as in a pcap captured
+with a small snaplen.  The pcaps in the data dir are written with the same
+names to -o.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+// snaplen is of the written pcaps, no less than of any captured packet
+const snaplen = 262144
+
+var (
+	output = flag.String("o", "", "the dir to write anonymized pcaps to")
+	mode   = flag.String("mode", "pseudo",
+		"pseudo(nymize) or strip addresses")
+	key = flag.String("key", "",
+		"the key for pseudonyms, the same for the same key (random if empty)")
+	clientNets = flag.String("client", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,"+
+		"100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,fc00::/7,fe80::/10,::1/128",
+		"comma-separated networks of the IP addresses to anonymize")
+	workerFactor = flag.Int("f", 2,
+		"the factor to multiply NumCPU with for creating workers")
+
+	clients []*net.IPNet
+	hashKey []byte
+)
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("anonymize")
+	provenance.Init("anonymize")
+	if len(flag.Args()) == 0 {
+		logging.Fatal("need to specify pcap dir")
+	}
+	if *output == "" || path.Clean(*output) == path.Clean(flag.Arg(0)) {
+		logging.Fatal("need to specify -o, other than the pcap dir")
+	}
+	if *mode != "pseudo" && *mode != "strip" {
+		logging.Fatalf("unknown mode %s (pseudo or strip)", *mode)
+	}
+	for _, cidr := range strings.Split(*clientNets, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			logging.Fatalf("failed to parse client network (%s)", err)
+		}
+		clients = append(clients, n)
+	}
+	hashKey = []byte(*key)
+	if *key == "" {
+		hashKey = make([]byte, 32)
+		if _, err := rand.Read(hashKey); err != nil {
+			logging.Fatalf("failed to generate key (%s)", err)
+		}
+	}
+	if err := os.MkdirAll(*output, 0755); err != nil {
+		logging.Fatalf("failed to create output dir (%s)", err)
+	}
+
+	files, err := ioutil.ReadDir(flag.Arg(0))
+	if err != nil {
+		logging.Fatalf("failed to read pcap dir (%s)", err)
+	}
+	work := make(chan string)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < runtime.NumCPU()**workerFactor; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range work {
+				if err := anonymizeFile(path.Join(flag.Arg(0), file),
+					path.Join(*output, file)); err != nil {
+					logging.Fatalf("failed to anonymize %s (%s)", file, err)
+				}
+			}
+		}()
+	}
+	n := 0
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".pcap") {
+			work <- f.Name()
+			n++
+		}
+	}
+	close(work)
+	wg.Wait()
+	logging.Infof("anonymized %d pcaps (%s) to %s", n, *mode, *output)
+}
+
+// anonymizeFile anonymizes every packet of the pcap in to out
+func anonymizeFile(in, out string) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r, err := pcapgo.NewReader(src)
+	if err != nil {
+		return err
+	}
+	switch r.LinkType() {
+	case layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeRaw,
+		layers.LinkTypeNull, layers.LinkTypeLoop:
+	default:
+		return fmt.Errorf("unsupported link type %s", r.LinkType())
+	}
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	w := pcapgo.NewWriter(dst)
+	if err = w.WriteFileHeader(snaplen, r.LinkType()); err != nil {
+		dst.Close()
+		return err
+	}
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			dst.Close()
+			return err
+		}
+		data = anonymize(data, r.LinkType())
+		ci.CaptureLength = len(data)
+		if err = w.WritePacket(ci, data); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	return dst.Close()
+}
+
+// anonymize rewrites the addresses of a packet in place, returning it
+// truncated to its headers unless DNS
+func anonymize(data []byte, link layers.LinkType) []byte {
+	p := gopacket.NewPacket(data, link, gopacket.NoCopy)
+	offset := func(l gopacket.Layer) int {
+		return len(data) - len(l.LayerContents()) - len(l.LayerPayload())
+	}
+	end := 0 // of the headers to keep, e.g., nothing of an unknown link
+
+	if eth, ok := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		off := offset(eth)
+		copy(data[off:off+6], macPseudonym(eth.DstMAC))
+		copy(data[off+6:off+12], macPseudonym(eth.SrcMAC))
+		end = off + len(eth.LayerContents()) // not, e.g., ARP with addresses
+	} else if sll, ok := p.Layer(layers.LayerTypeLinuxSLL).(*layers.LinuxSLL); ok {
+		// the address of the sender, in 8 bytes after packet type, link
+		// type and address length
+		if len(sll.Addr) > 0 {
+			off := offset(sll) + 6
+			copy(data[off:off+len(sll.Addr)], macPseudonym(sll.Addr))
+		}
+		end = offset(sll) + len(sll.LayerContents())
+	} else if loop, ok := p.Layer(layers.LayerTypeLoopback).(*layers.Loopback); ok {
+		end = offset(loop) + len(loop.LayerContents()) // no addresses
+	}
+
+	// the transport checksum covers the addresses (pseudo header)
+	var checksum []byte
+	transport, isUDP := false, false
+	if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		if udp.Checksum != 0 { // 0 is no checksum over IPv4
+			checksum = data[offset(udp)+6 : offset(udp)+8]
+		}
+		transport, isUDP = true, true
+		end = offset(udp) + len(udp.LayerContents())
+		if udp.SrcPort == 53 || udp.DstPort == 53 {
+			end = len(data)
+		}
+	} else if tcp, ok := p.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		checksum = data[offset(tcp)+16 : offset(tcp)+18]
+		transport = true
+		end = offset(tcp) + len(tcp.LayerContents())
+		if tcp.SrcPort == 53 || tcp.DstPort == 53 {
+			end = len(data)
+		}
+	}
+
+	if ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		off := offset(ip)
+		header := data[off+10 : off+12]
+		rewriteIP(data[off+12:off+16], header, checksum)
+		rewriteIP(data[off+16:off+20], header, checksum)
+		if !transport {
+			end = off + len(ip.LayerContents())
+		}
+	} else if ip, ok := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		off := offset(ip)
+		rewriteIP(data[off+8:off+24], checksum)
+		rewriteIP(data[off+24:off+40], checksum)
+		if !transport {
+			end = off + len(ip.LayerContents())
+		}
+	}
+	if isUDP && checksum != nil && checksum[0] == 0 && checksum[1] == 0 {
+		// 0 is no checksum, so a computed 0 is sent as all ones (RFC 768)
+		checksum[0], checksum[1] = 0xff, 0xff
+	}
+	return data[:end]
+}
+
+// rewriteIP anonymizes the address a in place if it is of a client,
+// updating the checksums that cover it (if not nil)
+func rewriteIP(a []byte, checksums ...[]byte) {
+	if !isClient(net.IP(a)) {
+		return
+	}
+	old := append([]byte(nil), a...)
+	copy(a, ipPseudonym(old))
+	for _, c := range checksums {
+		if c != nil {
+			updateChecksum(c, old, a)
+		}
+	}
+}
+
+func isClient(ip net.IP) bool {
+	for _, n := range clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipPseudonym returns the pseudonym of an IPv4 or IPv6 address, all zeros
+// with -mode strip
+func ipPseudonym(ip []byte) []byte {
+	p := make([]byte, len(ip))
+	if *mode == "strip" {
+		return p
+	}
+	h := pseudonym(ip)
+	if len(ip) == net.IPv4len {
+		p[0] = 10
+		copy(p[1:], h)
+	} else {
+		p[0] = 0xfd
+		copy(p[1:], h)
+	}
+	return p
+}
+
+// macPseudonym returns the pseudonym of a MAC, a locally administered
+// unicast address, all zeros with -mode strip.  Broadcast and multicast
+// addresses are kept.
+func macPseudonym(mac net.HardwareAddr) []byte {
+	p := make([]byte, len(mac))
+	if mac[0]&0x01 != 0 {
+		copy(p, mac)
+		return p
+	}
+	if *mode == "strip" {
+		return p
+	}
+	copy(p, pseudonym(mac))
+	p[0] = p[0]&0xfc | 0x02
+	return p
+}
+
+// pseudonym is the keyed hash of an address
+func pseudonym(addr []byte) []byte {
+	m := hmac.New(sha256.New, hashKey)
+	m.Write(addr)
+	return m.Sum(nil)
+}
+
+// updateChecksum updates an Internet checksum in place for a 16-bit aligned
+// field changing from old to new (RFC 1624)
+func updateChecksum(c, old, new []byte) {
+	sum := uint32(^(uint16(c[0])<<8 | uint16(c[1])))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^(uint16(old[i])<<8 | uint16(old[i+1])))
+		sum += uint32(uint16(new[i])<<8 | uint16(new[i+1]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	result := ^uint16(sum)
+	c[0], c[1] = byte(result>>8), byte(result)
+}
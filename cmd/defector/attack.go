@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pylls/defector/logging"
+)
+
+// baseAttack is a website fingerprinting attack trained on the training
+// instances of a fold, the base of the DefecTor attacks
+type baseAttack interface {
+	// classes returns the classes of the n closest training instances to
+	// test instance i, closest first, and the true class of i, ignoring
+	// monitored sites for which ignore is true.  An attack without
+	// neighbours returns its best class n times.
+	classes(i, n int, ignore ignoreSite) (classes []int, trueClass int)
+
+	// rank returns every class that is not ignored, most likely first, for
+	// top-k accuracy
+	rank(i int, ignore ignoreSite) []int
+
+	// closeWorld returns the attack to use when the monitored sites for
+	// which ignore is true cannot be the class, e.g., retrained without them
+	closeWorld(ignore ignoreSite) baseAttack
+}
+
+// knnAttack is Wa-kNN with weights learned by WLLCC
+type knnAttack struct {
+	feat, openfeat [][]float32
+	fold           int
+	weights        []float64
+}
+
+func (a *knnAttack) classes(i, n int, ignore ignoreSite) ([]int, int) {
+	return classify(i, a.feat, a.openfeat, a.weights, n, a.fold, ignore)
+}
+
+func (a *knnAttack) rank(i int, ignore ignoreSite) []int {
+	return rankByDistance(distances(i, a.feat, a.openfeat, a.weights, a.fold,
+		ignore), trueClass)
+}
+
+func (a *knnAttack) closeWorld(ignore ignoreSite) baseAttack {
+	if *lazy {
+		return a
+	}
+	return &knnAttack{
+		feat:     a.feat,
+		openfeat: a.openfeat,
+		fold:     a.fold,
+		weights:  wllcc(a.feat, a.openfeat, a.fold, ignore, newRand(a.fold)),
+	}
+}
+
+// trainAttack trains the -wf attack on the training instances of fold, for
+// Wa-kNN with the given weights if not nil
+func trainAttack(feat, openfeat [][]float32, fold int,
+	weights []float64) baseAttack {
+	switch *wfAttack {
+	case "waknn":
+		if weights != nil {
+			return &knnAttack{
+				feat:     feat,
+				openfeat: openfeat,
+				fold:     fold,
+				weights:  weights,
+			}
+		}
+		return &knnAttack{
+			feat:     feat,
+			openfeat: openfeat,
+			fold:     fold,
+			weights: wllcc(feat, openfeat, fold, func(int) bool {
+				return false // ignore nothing
+			}, newRand(fold)),
+		}
+	case "cumul":
+		return trainSVM(feat, openfeat, fold, newRand(fold))
+	case "kfp":
+		return trainKFP(feat, openfeat, fold, newRand(fold))
+	case "external":
+		a, err := trainExternal(feat, openfeat, fold)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		return a
+	}
+	logging.Fatalf("unknown attack %s", *wfAttack)
+	return nil
+}
+
+// sameClass is n copies of class, for attacks without neighbours
+func sameClass(class, n int) []int {
+	classes := make([]int, n)
+	for i := range classes {
+		classes[i] = class
+	}
+	return classes
+}
+
+// rankByDistance ranks classes by the distance to their closest instance,
+// where instances at math.MaxFloat64 are ignored and ties go to the lower
+// class
+func rankByDistance(distList []float64, class func(int) int) []int {
+	closest := make(map[int]float64)
+	for j, d := range distList {
+		if d == math.MaxFloat64 {
+			continue
+		}
+		if c, exists := closest[class(j)]; !exists || d < c {
+			closest[class(j)] = d
+		}
+	}
+	var classes []int
+	for c := range closest {
+		classes = append(classes, c)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if closest[classes[i]] != closest[classes[j]] {
+			return closest[classes[i]] < closest[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	return classes
+}
+
+// rankByScore ranks the classes with scores, the open world (*sites) being
+// the last, by score, skipping ignored monitored sites
+func rankByScore(scores []float64, ignore ignoreSite) []int {
+	var classes []int
+	for c := 0; c <= *sites; c++ {
+		if c == *sites || !ignore(c) {
+			classes = append(classes, c)
+		}
+	}
+	sort.SliceStable(classes, func(i, j int) bool {
+		return scores[classes[i]] > scores[classes[j]]
+	})
+	return classes
+}
+
+// trueClass is the class of instance i, where all open-world sites are the
+// class *sites
+func trueClass(i int) int {
+	if c := i / *instances; c < *sites {
+		return c
+	}
+	return *sites
+}
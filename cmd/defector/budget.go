@@ -0,0 +1,58 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// foldBudget limits how many folds run at once, and holds back new folds
+// while the heap is above maxHeap bytes (if not 0), unless none is running
+type foldBudget struct {
+	sync.Mutex
+	cond    *sync.Cond
+	running int
+	max     int
+	maxHeap uint64
+}
+
+func newFoldBudget(max int, maxHeap uint64) *foldBudget {
+	if max < 1 {
+		max = 1
+	}
+	b := &foldBudget{max: max, maxHeap: maxHeap}
+	b.cond = sync.NewCond(b)
+	return b
+}
+
+// acquire waits until another fold may start
+func (b *foldBudget) acquire() {
+	b.Lock()
+	defer b.Unlock()
+	for b.running >= b.max || (b.running > 0 && b.overHeap()) {
+		b.cond.Wait()
+	}
+	b.running++
+}
+
+// release is called when a fold is done
+func (b *foldBudget) release() {
+	b.Lock()
+	defer b.Unlock()
+	b.running--
+	b.cond.Broadcast()
+}
+
+func (b *foldBudget) overHeap() bool {
+	if b.maxHeap == 0 {
+		return false
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc <= b.maxHeap {
+		return false
+	}
+	// what is garbage doesn't count
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc > b.maxHeap
+}
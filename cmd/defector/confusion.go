@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// confusion is a sparse confusion matrix, (true, predicted) -> count
+type confusion map[[2]int]int
+
+// add counts a classification, where unmonitored (class *sites) is -1
+func (c confusion) add(trueclass, output int) {
+	if trueclass >= *sites {
+		trueclass = -1
+	}
+	if output >= *sites {
+		output = -1
+	}
+	c[[2]int{trueclass, output}]++
+}
+
+// perRep formats count, summed over the -simreps repetitions, as the mean
+// count per repetition
+func perRep(count int) string {
+	return strconv.FormatFloat(float64(count)/float64(*simReps), 'f', -1, 64)
+}
+
+// writeConfusionCSV writes the confusion matrix of attack at each pctPoint
+// with one line per non-zero cell, counted per -simreps repetition
+func writeConfusionCSV(location, attack string,
+	matrices []map[string]confusion, // pctPoint -> map["attack"] -> matrix
+	simPoints []simPoint) {
+	output := pointHeader() + ",true,predicted,count\n"
+	for i := 0; i < len(matrices); i++ {
+		c := matrices[i][attack]
+		var keys [][2]int
+		for key := range c {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i][0] != keys[j][0] {
+				return keys[i][0] < keys[j][0]
+			}
+			return keys[i][1] < keys[j][1]
+		})
+		for _, key := range keys {
+			output += fmt.Sprintf("%s,%d,%d,%s\n", simPoints[i].label(), key[0], key[1],
+				perRep(c[key]))
+		}
+	}
+
+	writeResults(output, location)
+}
+
+// writePerClassCSV writes the recall and precision of each site (-1 for
+// unmonitored) at each pctPoint from the confusion matrix of attack, with
+// the counts per -simreps repetition
+func writePerClassCSV(location, attack string,
+	matrices []map[string]confusion, // pctPoint -> map["attack"] -> matrix
+	simPoints []simPoint) {
+	output := pointHeader() + ",site,recall,precision,tp,fn,fp\n"
+	for i := 0; i < len(matrices); i++ {
+		tp := make(map[int]int)
+		fn := make(map[int]int)
+		fp := make(map[int]int)
+		for key, count := range matrices[i][attack] {
+			if key[0] == key[1] {
+				tp[key[0]] += count
+			} else {
+				fn[key[0]] += count
+				fp[key[1]] += count
+			}
+		}
+		for site := -1; site < *sites; site++ {
+			recall := float64(tp[site]) / float64(tp[site]+fn[site])
+			precision := float64(tp[site]) / float64(tp[site]+fp[site])
+			if math.IsNaN(recall) {
+				recall = 0
+			}
+			if math.IsNaN(precision) {
+				precision = 0
+			}
+			output += fmt.Sprintf("%s,%d,%.3f,%.3f,%s,%s,%s\n", simPoints[i].label(), site,
+				recall, precision, perRep(tp[site]), perRep(fn[site]), perRep(fp[site]))
+		}
+	}
+
+	writeResults(output, location)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attacker is the relays an attacker controls: by fingerprint, or by the
+// network prefixes of, e.g., an AS
+type attacker struct {
+	fingerprints map[string]bool // upper-case hex
+	prefixes     []*net.IPNet
+}
+
+// readAttacker reads an attacker file with one relay fingerprint (hex, with
+// or without spaces or a leading $) or CIDR prefix per line
+func readAttacker(name string) (*attacker, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open attacker file (%s)", err)
+	}
+	defer f.Close()
+	a := &attacker{fingerprints: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			_, prefix, err := net.ParseCIDR(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse prefix (%s)", err)
+			}
+			a.prefixes = append(a.prefixes, prefix)
+			continue
+		}
+		fp := strings.ToUpper(strings.Replace(strings.TrimPrefix(line, "$"),
+			" ", "", -1))
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("invalid fingerprint %q", line)
+		}
+		a.fingerprints[fp] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read attacker file (%s)", err)
+	}
+	return a, nil
+}
+
+func (a *attacker) controls(fingerprint string, ip net.IP) bool {
+	if a.fingerprints[fingerprint] {
+		return true
+	}
+	for _, p := range a.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// consensusFraction is the percentage of exit bandwidth of a consensus
+// that the attacker observes
+type consensusFraction struct {
+	validAfter        time.Time
+	pct               float64
+	exits, controlled int
+}
+
+// relay is a router entry in a consensus
+type relay struct {
+	fingerprint string
+	ip          net.IP
+	exit, guard bool
+	bandwidth   float64
+}
+
+// exitFraction computes the percentage of exit bandwidth controlled by a in
+// the consensus in name, full or microdescriptor.  Like path selection, the
+// bandwidth of an exit is weighted by Wee, or by Wed if it is also a guard.
+func exitFraction(name string, a *attacker) (c consensusFraction, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return c, fmt.Errorf("failed to open consensus (%s)", err)
+	}
+	defer f.Close()
+
+	var relays []relay
+	// router lines of microdescriptor consensuses have no descriptor digest
+	routerTokens, ipToken := 9, 6
+	weights := map[string]float64{"Wee": 10000, "Wed": 10000}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) == 0 {
+			continue
+		}
+		switch tokens[0] {
+		case "network-status-version":
+			if len(tokens) == 3 && tokens[2] == "microdesc" {
+				routerTokens, ipToken = 8, 5
+			}
+		case "valid-after":
+			if len(tokens) != 3 {
+				return c, fmt.Errorf("malformed valid-after in %s", name)
+			}
+			c.validAfter, err = time.Parse("2006-01-02 15:04:05",
+				tokens[1]+" "+tokens[2])
+			if err != nil {
+				return c, fmt.Errorf("failed to parse valid-after (%s)", err)
+			}
+		case "r":
+			if len(tokens) < routerTokens {
+				return c, fmt.Errorf("malformed router line %q", scanner.Text())
+			}
+			id, err := base64.RawStdEncoding.DecodeString(
+				strings.TrimRight(tokens[2], "="))
+			if err != nil {
+				return c, fmt.Errorf("failed to decode identity of %s (%s)",
+					tokens[1], err)
+			}
+			relays = append(relays, relay{
+				fingerprint: strings.ToUpper(hex.EncodeToString(id)),
+				ip:          net.ParseIP(tokens[ipToken]),
+			})
+		case "s":
+			if len(relays) == 0 {
+				continue
+			}
+			r := &relays[len(relays)-1]
+			for _, flag := range tokens[1:] {
+				switch flag {
+				case "Exit":
+					r.exit = true
+				case "Guard":
+					r.guard = true
+				}
+			}
+			for _, flag := range tokens[1:] {
+				if flag == "BadExit" {
+					r.exit = false
+				}
+			}
+		case "w":
+			if len(relays) == 0 {
+				continue
+			}
+			for _, kv := range tokens[1:] {
+				if strings.HasPrefix(kv, "Bandwidth=") {
+					bw, err := strconv.ParseFloat(strings.TrimPrefix(kv, "Bandwidth="), 64)
+					if err != nil {
+						return c, fmt.Errorf("failed to parse bandwidth (%s)", err)
+					}
+					relays[len(relays)-1].bandwidth = bw
+				}
+			}
+		case "bandwidth-weights":
+			for _, kv := range tokens[1:] {
+				parts := strings.SplitN(kv, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				if w, err := strconv.ParseFloat(parts[1], 64); err == nil {
+					weights[parts[0]] = w
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return c, fmt.Errorf("failed to read consensus %s (%s)", name, err)
+	}
+
+	var total, controlled float64
+	for _, r := range relays {
+		if !r.exit {
+			continue
+		}
+		bw := r.bandwidth * weights["Wee"]
+		if r.guard {
+			bw = r.bandwidth * weights["Wed"]
+		}
+		total += bw
+		c.exits++
+		if a.controls(r.fingerprint, r.ip) {
+			controlled += bw
+			c.controlled++
+		}
+	}
+	if total == 0 {
+		return c, fmt.Errorf("no exit bandwidth in consensus %s", name)
+	}
+	c.pct = 100 * controlled / total
+	return c, nil
+}
+
+// consensusPoints returns the observed percentages of exit bandwidth of the
+// consensuses matching the comma-separated globs in list, oldest first
+func consensusPoints(list, attackerFile string) ([]consensusFraction, error) {
+	a, err := readAttacker(attackerFile)
+	if err != nil {
+		return nil, err
+	}
+	var fractions []consensusFraction
+	for _, pattern := range strings.Split(list, ",") {
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid consensus pattern %s (%s)", pattern, err)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no consensus matches %s", pattern)
+		}
+		for _, name := range names {
+			c, err := exitFraction(name, a)
+			if err != nil {
+				return nil, err
+			}
+			fractions = append(fractions, c)
+		}
+	}
+	sort.SliceStable(fractions, func(i, j int) bool {
+		return fractions[i].validAfter.Before(fractions[j].validAfter)
+	})
+	return fractions, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pylls/defector/metrics"
+)
+
+// vote returns the most common class among the neighbours if at least
+// agree of them are of it, otherwise unmonitored, with ties going to the
+// class of the closest neighbour
+func vote(classes []int, agree int) int {
+	count := make(map[int]int)
+	for _, c := range classes {
+		count[c]++
+	}
+	best := *sites
+	for _, c := range classes { // closest first
+		if count[c] > count[best] {
+			best = c
+		}
+	}
+	if count[best] < agree {
+		return *sites
+	}
+	return best
+}
+
+// writeCurveCSV writes, for each attack at each pctPoint, one point on the
+// PR and ROC curves per required number of agreeing neighbours.  The TPR
+// of the ROC curve is the recall and the FPR is of unmonitored instances
+// only, FNP / (FNP + TN), so the curve stays within [0, 1].  The counts are
+// summed over the -simreps repetitions, so each point is of the mean counts.
+func writeCurveCSV(location string,
+	curves []map[string][]metrics.Confusion, // pctPoint -> map["attack"] -> [agree-1]metrics
+	simPoints []simPoint) {
+	output := pointHeader() + ",attack,agree,recall,precision,fpr\n"
+	for i := 0; i < len(curves); i++ {
+		var attacks []string
+		for attack := range curves[i] {
+			attacks = append(attacks, attack)
+		}
+		sort.Strings(attacks)
+		for _, attack := range attacks {
+			for v, m := range curves[i][attack] {
+				point := []metrics.Confusion{m}
+				openFPR := 0.0
+				if m.FNP+m.TN > 0 {
+					openFPR = float64(m.FNP) / float64(m.FNP+m.TN)
+				}
+				output += fmt.Sprintf("%s,%s,%d,%.3f,%.3f,%.3f\n", simPoints[i].label(),
+					attack, v+1, metrics.Recall(point), metrics.Precision(point), openFPR)
+			}
+		}
+	}
+
+	writeResults(output, location)
+}
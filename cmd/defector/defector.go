@@ -1,6 +1,6 @@
 /*
 Package main implements defector that runs two DefecTor attacks using:
- - the Wa-kNN website fingerprinting attack, and
+ - a website fingerprinting attack (Wa-kNN by default, see -wf), and
  - a list of observed websites from a simulated Tor network.
 
  For the Tor network simulation, given:
@@ -13,33 +13,33 @@ Package main implements defector that runs two DefecTor attacks using:
  network.  This simulated list is key the additional capability an attacker
  needs to launch DefecTor attacks beyond being in the position to launch
  a website fingerprinting attack.  Our paper shows that, e.g., Google observes
- on average 33% of all DNS traffic from the Tor exits.
+ on average 33% of all DNS traffic from the Tor exits.  See README.md for
+ the attacks, simulation options and results.
 */
 package main
 
 import (
 	"flag"
 	"fmt"
-	"log"
 	"math/rand"
+	"os"
+	"path"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
-)
 
-type metrics struct { // see http://www.cs.kau.se/pulls/hot/measurements/
-	tp  int // true positive
-	fpp int // false-positive-to-positive
-	fnp int // false-negative-to-positive
-	fn  int // false negative
-	tn  int // true negative
-}
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/features"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/metrics"
+	"github.com/pylls/defector/provenance"
+	"github.com/pylls/defector/split"
+)
 
 const (
-	// FeatNum is the number of extracted features to consider in Wa-kNN.
-	FeatNum int = 1225
 	// FeatureSuffix is the suffix of files containing features.
 	FeatureSuffix = ".feat"
 	// RecoPointsNum is the number of neighbours for distance learning.
@@ -47,6 +47,14 @@ const (
 )
 
 var (
+	// FeatNum is the number of extracted features to consider in Wa-kNN,
+	// set from the headers of the read feature files (if any).
+	FeatNum = features.WaKNN.Count
+
+	// featureFiles are the names of the read feature files, without suffix,
+	// of monitored and then open-world instances
+	featureFiles []string
+
 	// data to experiment on
 	mfolder = flag.String("mfolder", "alexa1kx100+100k-feat/",
 		"folder with cell traces for monitored sites")
@@ -55,24 +63,84 @@ var (
 	sites     = flag.Int("sites", 0, "number of sites")
 	instances = flag.Int("instances", 0, "number of instances")
 	open      = flag.Int("open", 0, "number of open-world sites")
-	roffset   = flag.Int("roffset", 0, "the offset to read monitored sites from")
+	openSweep = flag.String("opensweep", "",
+		"min,max,step of open-world sizes to experiment with, subsampling the features of -open max")
+	roffset    = flag.Int("roffset", 0, "the offset to read monitored sites from")
+	featureSet = flag.String("featureset", "",
+		"the required feature set of the features (if empty, any set)")
+	packFile = flag.String("pack", "",
+		"write the read features as packed float32 to this file and exit")
+	loadPackFile = flag.String("loadpack", "",
+		"memory-map features from a file written by -pack instead of reading folders")
+	groupsFile = flag.String("groups", "",
+		"a file of \"trace,site\" lines grouping traces, e.g., subpages, to also write site-level metrics")
+	monitoredFile = flag.String("monitored", "",
+		"a file with the monitored sites, one per line, instead of -sites sites from -roffset and -alexa")
+
+	// the base website fingerprinting attack
+	wfAttack = flag.String("wf", "waknn",
+		"the base WF attack: waknn, cumul (linear SVM, needs cumul-v1 features), kfp or external")
+	wfAddr = flag.String("wfaddr", "localhost:50051",
+		"the address of the gRPC scoring service for -wf external")
+	svmEpochs = flag.Int("svmepochs", 10, "passes over the training data for -wf cumul")
+	svmLambda = flag.Float64("svmlambda", 1e-4, "the regularization of -wf cumul")
+	trees     = flag.Int("trees", 100, "trees in the random forest of -wf kfp")
+	treeDepth = flag.Int("treedepth", 0, "the max depth of trees with -wf kfp (0 for any)")
 
 	// Wa-kNN-related
 	weightRounds = flag.Int("r", 2500, "rounds for WLLCC weight learning in kNN")
 	wKmin        = flag.Int("wKmin", 1, "the smallest k to test for with Wa-kNN")
 	wKmax        = flag.Int("wKmax", 2, "the biggest k to test for with Wa-kNN")
 	wKstep       = flag.Int("wKstep", 1, "the step size between wKmin and wKmax")
+	knnEps       = flag.Float64("knneps", 0,
+		"approximate kNN, neighbours may be up to 1+knneps times farther than exact ones")
+	saveWeightsFile = flag.String("saveweights", "",
+		"save the learned kNN-weights of each fold to this file")
+	loadWeightsFile = flag.String("loadweights", "",
+		"load kNN-weights learned for the same data, folds and -r instead of learning")
+	force = flag.Bool("force", false,
+		"use -loadweights learned on, or a -split of, another dataset, only warning about it")
 
 	// experiment tweaks
 	workerFactor = flag.Int("f", 1,
 		"the factor to multiply NumCPU with for creating workers")
 	folds = flag.Int("folds", 10,
 		"we perform k-fold cross-validation")
+	splitFile = flag.String("split", "",
+		"read the fold of every instance from this split manifest, e.g., from split, instead of -folds")
 	verboseOutput = flag.Bool("verbose", true, "print detailed result output")
 	lazy          = flag.Bool("lazy", true,
 		"don't recalculate kNN-weights for the close-the-world attack")
-	quiet = flag.Bool("quiet", false,
-		"don't print detailed progress (useful for not spamming docker log)")
+	parallelFolds = flag.Int("parallelfolds", 1,
+		"the number of folds to test at once, sharing the testing workers")
+	maxHeap = flag.Int("maxheap", 0,
+		"don't start another parallel fold while the heap is above this many MiB (0 for no limit)")
+	seed = flag.Int64("seed", 0,
+		"the seed for all randomness, to reproduce a run (0 for time)")
+	progressFile = flag.String("progress", "",
+		"periodically write the progress, ETA and metrics of finished folds as JSON to this file")
+	progressEvery = flag.Duration("progressevery", time.Minute,
+		"how often to log the progress and ETA of the run and write -progress")
+	writeConfusion = flag.Bool("confusion", false,
+		"write a sparse confusion matrix CSV per attack")
+	perClass = flag.Bool("perclass", false,
+		"write the recall and precision of each monitored site as CSV per attack")
+	topK = flag.Int("topk", 0,
+		"write the top-1 to top-k accuracy of the WF and close-the-world rankings as CSV")
+	bootstrap = flag.Int("bootstrap", 0,
+		"add 95% confidence intervals from this many bootstrap resamples of folds to the CSVs")
+	saveObservedFile = flag.String("saveobserved", "",
+		"save the observed sites (and exit caches) of every simulation of the Tor network to this file")
+	loadObservedFile = flag.String("loadobserved", "",
+		"load the simulations of the Tor network from a file written by -saveobserved instead of simulating")
+	simReps = flag.Int("simreps", 1,
+		"repeat the Tor network simulation this many times per fold, for the mean and 95% band of the metrics")
+	curve = flag.Int("curve", 0,
+		"write PR and ROC curves as CSV by requiring 1 to n of the n nearest neighbours to agree")
+	fusionList = flag.String("fusion", "",
+		"comma-separated strategies to combine WF and DNS with, besides hp: bayes, dnsfirst, weighted")
+	fusionWeight = flag.Float64("fusionweight", 0.5,
+		"the weight of DNS, versus the WF votes, for -fusion weighted")
 
 	// arguments for Tor simulation
 	pctMin = flag.Int("pmin", 0,
@@ -81,10 +149,34 @@ var (
 		"the maximum percentage of Tor exit bandwidth to compute for")
 	pctStep = flag.Int("pstep", 25,
 		"the step of percentage between pmin and pmax")
+	loadFile = flag.String("load", "",
+		"simulate at each \"label,rate\" line of web circuits per second in this file, e.g., per hour of day")
+	consensus = flag.String("consensus", "",
+		"comma-separated globs of Tor consensuses to compute the observed exit bandwidth of, instead of pmin to pmax")
+	attackerFile = flag.String("attacker", "",
+		"the relay fingerprints and network prefixes (e.g., of an AS) of the attacker, with -consensus")
 	dnsRecall = flag.Float64("dnsrecall", 0.947, // from 500kx5 run +common
 		"recall of mapping DNS requests to sites")
 	dnsPrecision = flag.Float64("dnsprecision", 0.984, // from 500kx5 run +common
 		"precision of mapping DNS requests to sites")
+	dns2siteFile = flag.String("dns2site-metrics", "",
+		"JSON from dns2site -metrics to set -dnsrecall and -dnsprecision from")
+	dns2siteClassifier = flag.String("dns2site-classifier", "unique",
+		"the classifier in -dns2site-metrics to use")
+	dnsFolder = flag.String("dnsfolder", "",
+		"joint mode: classify the .dns file of each instance, named as its features, with dns2site at -dns2siteaddr")
+	dns2siteAddr = flag.String("dns2siteaddr", "localhost:8080",
+		"the address of dns2site -load -serve for -dnsfolder")
+	dns2siteTimeout = flag.Duration("dns2sitetimeout", 30*time.Second,
+		"the timeout of each request to dns2site with -dnsfolder")
+	adversary = flag.String("adversary", "exit",
+		"where DNS is observed: exit, resolver or both (exits at -exitpct, the resolver at each pct)")
+	exitPct = flag.Float64("exitpct", 10,
+		"the percentage of Tor exit bandwidth observed at exits with -adversary both")
+	resolverRecall = flag.Float64("resolverrecall", 0.947,
+		"recall of mapping DNS requests to sites at a resolver")
+	resolverPrecision = flag.Float64("resolverprecision", 0.984,
+		"precision of mapping DNS requests to sites at a resolver")
 	useDNS2site = flag.Bool("usedns2site", true,
 		"use DNS mapping (fp) to site metrics in Tor simulation")
 	alexaRank = flag.Int("alexa", 1,
@@ -93,26 +185,144 @@ var (
 		"the size of the sliding window for observing DNS requests at exits (s)")
 	scaleTor = flag.Float64("scaletor", 1.0,
 		"simulate a bigger Tor network")
+	exitCache = flag.Bool("exitcache", false,
+		"only observe DNS of visits not answered from the caches of exits")
+	exits = flag.Int("exits", 10,
+		"the number of exits the attacker observes, with -exitcache")
+	cacheTTL = flag.Int("cachettl", 300,
+		"the TTL of the DNS of sites, clamped as by Tor, with -exitcache")
+	ttlFolder = flag.String("ttlfolder", "",
+		"the .dns files of the monitored instances, named as their features, for the TTL of each site with -exitcache")
 	simdist = flag.String("simdist", "conpl",
-		"distribution for sim. site visits in Tor: {con,real}pl or {con,real}uni")
+		"distribution for sim. site visits in Tor: {con,real}pl, {con,real}uni or file=<rank-frequency file>")
 )
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
-	flag.Parse()
+	start := time.Now()
+	provenance.RegisterFlags()
+	config.Parse("defector")
+	provenance.Init("defector")
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+	logging.Infof("seed %d", *seed)
+	for _, dir := range []string{*mfolder, *ofolder} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue // e.g., with -loadpack
+		}
+		if err := provenance.AddDataset(dir); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	if err := provenance.Update(); err != nil {
+		logging.Fatal(err)
+	}
+	if *monitoredFile != "" {
+		list, err := readMonitored(*monitoredFile)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		if *sites != 0 && *sites != len(list) {
+			logging.Fatalf("-sites %d but %d sites in %s", *sites, len(list),
+				*monitoredFile)
+		}
+		*sites = len(list)
+		setMonitored(list)
+		logging.Infof("monitoring the %d sites in %s", *sites, *monitoredFile)
+	}
 	if *sites == 0 || *instances == 0 {
-		log.Println("missing sites and instances")
+		logging.Info("missing sites and instances")
 		flag.Usage()
 		return
 	}
 
-	// can traces be split into k samples?
-	if *instances%*folds != 0 || *open%*folds != 0 {
-		log.Fatalf("error: k (%d) has to fold instances (%d) and open (%d) evenly",
-			*folds, *instances, *open)
+	dnsSource := fmt.Sprintf("-dnsrecall %.3f -dnsprecision %.3f",
+		*dnsRecall, *dnsPrecision)
+	if *dns2siteFile != "" {
+		var err error
+		*dnsRecall, *dnsPrecision, dnsSource, err = readDNS2siteMetrics(
+			*dns2siteFile, *dns2siteClassifier)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("using dns2site recall %.3f and precision %.3f from %s",
+			*dnsRecall, *dnsPrecision, dnsSource)
 	}
 
-	var simfunc func() int
+	if *dnsFolder != "" && (*dns2siteFile != "" || !*useDNS2site) {
+		logging.Fatal("-dnsfolder replaces -dns2site-metrics and needs -usedns2site")
+	}
+	if *simReps < 1 {
+		logging.Fatal("-simreps must be at least 1")
+	}
+	if *exitCache && *exits < 1 {
+		logging.Fatal("-exits must be at least 1 with -exitcache")
+	}
+	if *consensus != "" && *attackerFile == "" {
+		logging.Fatal("-consensus needs -attacker")
+	}
+	switch *adversary {
+	case "exit", "resolver", "both":
+	default:
+		logging.Fatalf("unknown adversary %s (exit, resolver or both)", *adversary)
+	}
+
+	switch *wfAttack {
+	case "waknn", "kfp":
+	case "external":
+		if err := dialExternal(*wfAddr); err != nil {
+			logging.Fatal(err)
+		}
+		fallthrough
+	case "cumul":
+		// no neighbours, so every k is the same
+		*wKmin, *wKmax = 1, 1
+	default:
+		logging.Fatalf("unknown attack %s (waknn, cumul, kfp or external)", *wfAttack)
+	}
+	if *wfAttack != "waknn" && (*saveWeightsFile != "" || *loadWeightsFile != "") {
+		logging.Fatal("-saveweights and -loadweights need -wf waknn")
+	}
+	selectedFusions, err := getFusions(*fusionList)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if *fusionWeight < 0 || *fusionWeight > 1 {
+		logging.Fatal("-fusionweight must be in [0, 1]")
+	}
+
+	// the open-world sizes to experiment with, reading the biggest
+	opens := []int{*open}
+	if *openSweep != "" {
+		var err error
+		if opens, err = parseSweep(*openSweep); err != nil {
+			logging.Fatal(err)
+		}
+		if *saveWeightsFile != "" || *loadWeightsFile != "" {
+			logging.Fatal("-saveweights and -loadweights are for one -open, not -opensweep")
+		}
+		*open = opens[len(opens)-1]
+	}
+
+	var foldSplit *split.Split
+	if *splitFile != "" {
+		if foldSplit, err = readSplit(*splitFile); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("testing in the %d folds of %s", *folds, *splitFile)
+	}
+
+	// can traces be split into k samples? (any split is fine)
+	for _, n := range opens {
+		if foldSplit == nil && (*instances%*folds != 0 || n%*folds != 0) {
+			logging.Fatalf("error: k (%d) has to fold instances (%d) and open (%d) evenly",
+				*folds, *instances, n)
+		}
+	}
+
+	var simfunc func(*rand.Rand) int
+	simName := *simdist // for the names of result files
 	switch *simdist {
 	case "conpl":
 		// parameter for xmin=0.01, a conservative choice  we
@@ -133,198 +343,622 @@ func main() {
 		simfunc = getUniformRand(173676692)
 
 	default:
-		log.Fatalf("invalid simdist argument")
+		if !strings.HasPrefix(*simdist, "file=") {
+			logging.Fatalf("invalid simdist argument")
+		}
+		file := strings.TrimPrefix(*simdist, "file=")
+		var err error
+		if simfunc, err = getEmpiricalRand(file); err != nil {
+			logging.Fatal(err)
+		}
+		simName = "file-" + strings.TrimSuffix(path.Base(file), path.Ext(file))
 	}
 
-	// pctPoints is the percentage of Tor exit bandwidth the attacker observes
-	var pctPoints []int
-	for i := *pctMin; i <= *pctMax; i += *pctStep {
-		pctPoints = append(pctPoints, i)
+	// pcts are the percentages of Tor exit bandwidth the attacker observes
+	var pcts []float64
+	if *consensus != "" {
+		fractions, err := consensusPoints(*consensus, *attackerFile)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		for _, c := range fractions {
+			logging.Infof("consensus %s: attacker has %d of %d exits, %.3f%% of exit bandwidth",
+				c.validAfter.Format(time.RFC3339), c.controlled, c.exits, c.pct)
+			pcts = append(pcts, c.pct)
+		}
+	} else {
+		for i := *pctMin; i <= *pctMax; i += *pctStep {
+			pcts = append(pcts, float64(i))
+		}
+	}
+	logging.Infof("computing for %v percentage of Tor exit bandwidth", pcts)
+	simPoints, err := getSimPoints(pcts, *loadFile)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	// sims is pctPoint -> [folds][simreps]simulation
+	sims := make([][][]simulation, len(simPoints))
+	if *loadObservedFile != "" {
+		if sims, err = loadObservations(*loadObservedFile, simPoints); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("loaded the simulations of the Tor network from %s",
+			*loadObservedFile)
+	} else {
+		for i := range sims {
+			sims[i] = make([][]simulation, *folds)
+		}
 	}
-	log.Printf("computing for %d percentage of Tor exit bandwidth", pctPoints)
 
 	// read cells from datadir
-	log.Println("attempting to read WF features...")
-	feat, openfeat := readFeatures()
-	log.Printf("read %d sites with %d instances (in total %d points)",
+	var feat, openfeat [][]float32
+	if *loadPackFile != "" {
+		var err error
+		if feat, openfeat, err = loadPack(*loadPackFile); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("mapped WF features from %s", *loadPackFile)
+	} else {
+		logging.Info("attempting to read WF features...")
+		feat, openfeat = readFeatures()
+	}
+	if *packFile != "" {
+		if err := writePack(*packFile, feat, openfeat); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("packed %d instances to %s", len(feat)+len(openfeat), *packFile)
+		return
+	}
+	if foldSplit != nil {
+		if testFolds, err = splitFolds(foldSplit, featureFiles); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	logging.Infof("read %d sites with %d instances (in total %d points)",
 		*sites, *instances, len(feat))
-	log.Printf("read %d sites for open world", len(openfeat))
+	logging.Infof("read %d sites for open world", len(openfeat))
+	logging.Infof("features are %s with %d features", *featureSet, FeatNum)
+	if *wfAttack == "cumul" && *featureSet != features.CUMUL.Name {
+		logging.Fatalf("-wf cumul needs %s features", features.CUMUL.Name)
+	}
+	if *groupsFile != "" {
+		if groups, err = readGroups(*groupsFile); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("grouped the traces into %d sites", len(groups.names))
+	}
+	if *exitCache && *ttlFolder != "" {
+		if siteTTLs, err = readSiteTTLs(*ttlFolder); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("read the TTL of %d of %d monitored sites", len(siteTTLs), *sites)
+	}
+	if *dnsFolder != "" {
+		if jointClasses, err = classifyJoint(*dnsFolder, *dns2siteAddr, *dns2siteTimeout); err != nil {
+			logging.Fatal(err)
+		}
+		*dnsRecall, *dnsPrecision = jointMetrics(jointClasses)
+		*resolverRecall, *resolverPrecision = *dnsRecall, *dnsPrecision
+		dnsSource = fmt.Sprintf("joint: .dns files in %s classified by dns2site at %s",
+			*dnsFolder, *dns2siteAddr)
+		logging.Infof("classified the DNS of every instance, dns2site recall %.3f and precision %.3f",
+			*dnsRecall, *dnsPrecision)
+	}
+
+	simmode := "perfect"
+	if *useDNS2site {
+		simmode = "dns2site"
+	}
+	if *wfAttack != "waknn" { // keep the names of Wa-kNN results
+		simmode += "-" + *wfAttack
+	}
+	if *adversary != "exit" {
+		simmode += "-" + *adversary
+	}
+	if !*useDNS2site {
+		dnsSource = ""
+	}
 
-	testPerFold := (*sites**instances + *open) / *folds
+	setup := experimentSetup{
+		feat:      feat,
+		simPoints: simPoints,
+		sims:      sims,
+		simfunc:   simfunc,
+		fusions:   selectedFusions,
+		dnsSource: dnsSource,
+		simmode:   simmode,
+		simName:   simName,
+	}
+
+	total := 0
+	for _, n := range opens {
+		total += len(simPoints) * testedInstances(*sites**instances+n)
+	}
+	prog := newRunProgress(total, len(opens)*len(simPoints)**folds)
+	stopProgress := make(chan struct{})
+	if *progressEvery > 0 {
+		go prog.report(*progressEvery, *progressFile, stopProgress)
+	}
 
-	// calculate global weights for kNN in parallel (they don't change per fold)
-	globalWeights := make([][]float64, *folds)
+	var sweep []sweepResults
+	for _, n := range opens {
+		if *openSweep != "" {
+			logging.Infof("experimenting with an open world of %d sites", n)
+		}
+		sweep = append(sweep, experimentOpen(setup, openfeat[:n], start, prog))
+		start = time.Now()
+	}
+	close(stopProgress)
+	if *progressFile != "" {
+		if err := prog.write(*progressFile, true); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	if *saveObservedFile != "" {
+		if err := saveObservations(*saveObservedFile, sims, simPoints); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("saved the simulations of the Tor network to %s", *saveObservedFile)
+	}
+	if *openSweep != "" {
+		writeSweepCSV(fmt.Sprintf("%dx%d+%d-%d-%s-a%d-w%d-r%d-s%.1f-%s-opensweep.csv",
+			*sites, *instances, opens[0], opens[len(opens)-1], simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName),
+			sweep, simPoints)
+	}
+}
+
+// experimentSetup is what the experiments with each open-world size of
+// -opensweep share
+type experimentSetup struct {
+	feat      [][]float32
+	simPoints []simPoint
+	// sims is pctPoint -> [folds][simreps]simulation, simulated by the first
+	// experiment to need them unless loaded
+	sims             [][][]simulation
+	simfunc          func(*rand.Rand) int
+	fusions          []fusion
+	dnsSource        string
+	simmode, simName string // for the names of result files
+}
+
+// experimentOpen trains the attacks, tests them at every pctPoint and writes
+// the results, with the open world openfeat
+func experimentOpen(setup experimentSetup, openfeat [][]float32,
+	start time.Time, prog *runProgress) sweepResults {
+	feat, simPoints, sims := setup.feat, setup.simPoints, setup.sims
+	simmode, simName := setup.simmode, setup.simName
+	open := len(openfeat)
+	// train the base attack for each fold in parallel, e.g., global weights
+	// for kNN (they don't change per fold)
+	var weights [][]float64
+	dataset := datasetHash(feat, openfeat)
+	trainStart := time.Now()
+	if *loadWeightsFile != "" {
+		var err error
+		if weights, err = loadWeights(*loadWeightsFile, dataset); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("loaded kNN-weights for each fold from %s", *loadWeightsFile)
+	}
+	bases := make([]baseAttack, *folds)
 	wg := new(sync.WaitGroup)
 	for fold := 0; fold < *folds; fold++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			globalWeights[i] = wllcc(feat, openfeat, i, func(int) bool {
-				return false // ignore nothing
-			})
+			var w []float64
+			if weights != nil {
+				w = weights[i]
+			}
+			bases[i] = trainAttack(feat, openfeat, i, w)
 		}(fold)
 	}
 	wg.Wait()
-	log.Printf("determined global kNN-weights for each fold")
+	trainTime := time.Since(trainStart)
+	logging.Infof("trained %s for each fold", *wfAttack)
+	if *saveWeightsFile != "" && *loadWeightsFile == "" {
+		weights = make([][]float64, *folds)
+		for fold, base := range bases {
+			weights[fold] = base.(*knnAttack).weights
+		}
+		if err := saveWeights(*saveWeightsFile, dataset, weights); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("saved kNN-weights for each fold to %s", *saveWeightsFile)
+	}
 
 	// results is pctPoint -> map["attack"] -> [folds]metrics
-	results := make([]map[string][]metrics, len(pctPoints))
-	for pctIndex := 0; pctIndex < len(pctPoints); pctIndex++ {
-		results[pctIndex] = make(map[string][]metrics)
+	results := make([]map[string][]metrics.Confusion, len(simPoints))
+	// repResults is pctPoint -> map["attack"] -> [simreps][folds]metrics
+	repResults := make([]map[string][][]metrics.Confusion, len(simPoints))
+	// matrices is pctPoint -> map["attack"] -> confusion matrix, and topk
+	// and curves below, are summed over the -simreps repetitions and
+	// written per repetition
+	matrices := make([]map[string]confusion, len(simPoints))
+	// topk is pctPoint -> map["ranking"] -> hits at [rank]
+	topk := make([]map[string][]int, len(simPoints))
+	// curves is pctPoint -> map["attack"] -> [agreeing neighbours-1]metrics
+	curves := make([]map[string][]metrics.Confusion, len(simPoints))
+	// siteResults is pctPoint -> map["attack"] -> site-level outcomes, with
+	// -groups
+	siteResults := make([]map[string]siteOutcomes, len(simPoints))
+	for pctIndex := 0; pctIndex < len(simPoints); pctIndex++ {
+		results[pctIndex] = make(map[string][]metrics.Confusion)
+		repResults[pctIndex] = make(map[string][][]metrics.Confusion)
+		matrices[pctIndex] = make(map[string]confusion)
+		topk[pctIndex] = make(map[string][]int)
+		curves[pctIndex] = make(map[string][]metrics.Confusion)
+		siteResults[pctIndex] = make(map[string]siteOutcomes)
+	}
+
+	// start workers, shared by all folds
+	jobs := make(chan testJob)
+	for i := 0; i < runtime.NumCPU()**workerFactor; i++ {
+		go func() {
+			for j := range jobs {
+				j.out <- test(j.i, j.seens, j.evidence, j.base, setup.fusions)
+			}
+		}()
+	}
+	logging.Infof("spawned %d testing workers", runtime.NumCPU()**workerFactor)
+
+	var resultsLock sync.Mutex
+	// foldsDone is pctPoint -> [folds]finished, for partial metrics
+	foldsDone := make([][]bool, len(simPoints))
+	for pctIndex := range foldsDone {
+		foldsDone[pctIndex] = make([]bool, *folds)
+	}
+	prog.startTesting(open, simPoints)
+	budget := newFoldBudget(*parallelFolds, uint64(*maxHeap)<<20)
+	foldsWG := new(sync.WaitGroup)
+	for pctIndex := 0; pctIndex < len(simPoints); pctIndex++ {
 		for fold := 0; fold < *folds; fold++ {
-			log.Printf("starting fold %d/%d for x-axis point %d/%d",
-				fold+1, *folds, pctIndex+1, len(pctPoints))
-
-			// simulate the Tor network and get observed sites
-			observed := simTorNetwork(pctPoints[pctIndex], *window, simfunc)
-			log.Printf("\tsimulated Tor network (has %.2f of monitored sites)",
-				float64(len(observed))/float64(*sites))
-
-			// start workers
-			workerIn := make(chan int)
-			workerOut := make(chan map[string]metrics,
-				(*sites**instances+*open) / *folds + 1000)
-			wg := new(sync.WaitGroup)
-			for i := 0; i < runtime.NumCPU()**workerFactor; i++ {
-				wg.Add(1)
+			budget.acquire()
+			foldsWG.Add(1)
+			go func(pctIndex, fold int) {
+				defer foldsWG.Done()
+				defer budget.release()
+				logging.Infof("starting fold %d/%d for x-axis point %d/%d",
+					fold+1, *folds, pctIndex+1, len(simPoints))
+				foldStart := time.Now()
+
+				// simulate the Tor network and get observed sites, -simreps times,
+				// unless loaded or simulated for another open-world size
+				points := observationPoints(simPoints[pctIndex].pct)
+				if sims[pctIndex][fold] == nil {
+					sims[pctIndex][fold] = make([]simulation, *simReps)
+					for rep := range sims[pctIndex][fold] {
+						sims[pctIndex][fold][rep] = simulate(points,
+							simPoints[pctIndex].rate, setup.simfunc, repRand(rep, pctIndex, fold))
+					}
+				}
+				for _, sim := range sims[pctIndex][fold] {
+					logging.Infof("\tsimulated Tor network (has %.2f of monitored sites)",
+						float64(len(sim.observed))/float64(*sites))
+				}
+
+				// for each testing instance
+				var testing []int
+				for i := 0; i < *sites**instances+open; i++ {
+					if instanceForTesting(i, fold) {
+						testing = append(testing, i)
+					}
+				}
+				out := make(chan []testResult)
 				go func() {
-					defer wg.Done()
-					for j := range workerIn {
-						workerOut <- test(j, genSeenFunc(j, pctPoints[pctIndex], observed),
-							fold, globalWeights[fold],
-							feat, openfeat)
+					for _, i := range testing {
+						seens := make([]func(int) bool, *simReps)
+						evidence := make([]dnsEvidence, *simReps)
+						for rep := range seens {
+							sim := sims[pctIndex][fold][rep]
+							seens[rep] = genSeenFunc(i, points, sim.observed, sim.caches,
+								repRand(rep, pctIndex, fold, i))
+							evidence[rep] = newDNSEvidence(points, sim.observed)
+						}
+						jobs <- testJob{
+							i:        i,
+							seens:    seens,
+							evidence: evidence,
+							base:     bases[fold],
+							out:      out,
+						}
 					}
 				}()
-			}
-			log.Printf("\tspawned %d testing workers", runtime.NumCPU()**workerFactor)
-
-			// for each testing instance
-			testing := 0
-			for i := 0; i < *sites**instances+*open; i++ {
-				if instanceForTesting(i, fold) {
-					workerIn <- i
-					testing++
-					if !*quiet {
-						fmt.Printf("\r\t\t\ttesting %d/%d", testing, testPerFold)
+				fresults := make([][]testResult, len(testing))
+				for t := range fresults {
+					fresults[t] = <-out
+					prog.add(1)
+					if *parallelFolds == 1 {
+						eta := time.Duration(float64(time.Since(foldStart)) /
+							float64(t+1) * float64(len(fresults)-t-1))
+						logging.Progress("\t\t\ttesting %d/%d, fold ETA %s", t+1,
+							len(fresults), eta.Round(time.Second))
 					}
 				}
-			}
-			if !*quiet {
-				fmt.Println("")
-			}
-
-			close(workerIn)
-			wg.Wait()
-			close(workerOut)
+				if *parallelFolds == 1 {
+					logging.EndProgress()
+				}
 
-			// save results
-			for res := range workerOut {
-				for attack, m := range res {
-					_, exists := results[pctIndex][attack]
-					if !exists {
-						results[pctIndex][attack] = make([]metrics, *folds)
+				// save results
+				resultsLock.Lock()
+				defer resultsLock.Unlock()
+				for _, reps := range fresults {
+					for rep, res := range reps {
+						for attack, m := range res.metrics {
+							_, exists := results[pctIndex][attack]
+							if !exists {
+								results[pctIndex][attack] = make([]metrics.Confusion, *folds)
+								matrices[pctIndex][attack] = make(confusion)
+								repResults[pctIndex][attack] = make([][]metrics.Confusion, *simReps)
+								for r := range repResults[pctIndex][attack] {
+									repResults[pctIndex][attack][r] = make([]metrics.Confusion, *folds)
+								}
+							}
+							results[pctIndex][attack][fold].Add(m)
+							repResults[pctIndex][attack][rep][fold].Add(m)
+							matrices[pctIndex][attack].add(res.trueclass, res.output[attack])
+							if groups != nil {
+								if siteResults[pctIndex][attack] == nil {
+									siteResults[pctIndex][attack] = make(siteOutcomes)
+								}
+								siteResults[pctIndex][attack].add(rep, res.instance,
+									res.output[attack])
+							}
+						}
+						for ranking, r := range res.ranks {
+							if topk[pctIndex][ranking] == nil {
+								topk[pctIndex][ranking] = make([]int, *topK+1)
+							}
+							if r >= 0 && r < *topK {
+								topk[pctIndex][ranking][r]++
+							}
+							topk[pctIndex][ranking][*topK]++ // tested
+						}
+						for attack, m := range res.curve {
+							if curves[pctIndex][attack] == nil {
+								curves[pctIndex][attack] = make([]metrics.Confusion, *curve)
+							}
+							for v := range m {
+								curves[pctIndex][attack][v].Add(m[v])
+							}
+						}
 					}
-					addResult(&results[pctIndex][attack][fold], &m)
 				}
-			}
+				foldsDone[pctIndex][fold] = true
+				prog.foldDone(pctIndex, time.Since(foldStart),
+					partialMetrics(results[pctIndex], foldsDone[pctIndex]))
+			}(pctIndex, fold)
 		}
 	}
+	foldsWG.Wait()
+	close(jobs)
+	prog.stopTesting()
 
 	// results
 	output := make(map[string]string)
 	var attacks []string
 	for attack := range results[0] {
 		attacks = append(attacks, attack)
-		output[attack] = "pct,recall,precision,f1score,fpr,accuracy\n"
+		output[attack] = pointHeader() + ",recall,precision,f1score,fpr,accuracy\n"
 	}
 	sort.Strings(attacks) // for deterministic output
 
-	for i := 0; i < len(pctPoints); i++ {
+	for i := 0; i < len(simPoints); i++ {
 		for attack, m := range results[i] {
-			output[attack] += fmt.Sprintf("%d,%.3f,%.3f,%.3f,%.3f,%.3f\n",
-				pctPoints[i], recall(m), precision(m), f1score(m), fpr(m), accuracy(m))
+			output[attack] += fmt.Sprintf("%s,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+				simPoints[i].label(), metrics.Recall(m), metrics.Precision(m), metrics.F1(m), metrics.FPR(m), metrics.Accuracy(m))
 			if *verboseOutput {
 				for j := 0; j < len(m); j++ {
 					output[attack] += fmt.Sprintf("\ttp%d,fpp%d,fnp%d,fn%d,tn%d\n",
-						m[j].tp, m[j].fpp, m[j].fnp, m[j].fn, m[j].tn)
+						m[j].TP, m[j].FPP, m[j].FNP, m[j].FN, m[j].TN)
 				}
 			}
 		}
 	}
 
-	fout := fmt.Sprintf("%s: wfdns for %dx%d+%d with a%d w%d r%d s%.2f\n\n",
-		time.Now().String(), *sites, *instances, *open,
-		*alexaRank, *window, *weightRounds, *scaleTor)
 	for i := 0; i < len(attacks); i++ {
-		log.Printf("%s attack", attacks[i])
+		logging.Infof("%s attack", attacks[i])
 		fmt.Printf("%s\n", output[attacks[i]])
-
-		fout += fmt.Sprintf("%s attack\n%s\n", attacks[i], output[attacks[i]])
 	}
-	simmode := "perfect"
-	if *useDNS2site {
-		simmode = "dns2site"
+	if err := writeJSONResults(fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s.json",
+		*sites, *instances, open, simmode,
+		*alexaRank, *window, *weightRounds, *scaleTor, simName),
+		experiment{
+			Start:        start,
+			End:          time.Now(),
+			Seconds:      time.Since(start).Seconds(),
+			TrainSeconds: trainTime.Seconds(),
+			Dataset:      dataset,
+			DNS2site:     setup.dnsSource,
+		}, open, results, repResults, attacks, simPoints); err != nil {
+		logging.Fatal(err)
 	}
-	writeResults(fout,
-		fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s.log",
-			*sites, *instances, *open, simmode,
-			*alexaRank, *window, *weightRounds, *scaleTor, *simdist))
 
-	writeTorpctCSV(recall,
+	writeTorpctCSV(metrics.Recall,
 		fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-%s.csv",
-			*sites, *instances, *open, simmode,
-			*alexaRank, *window, *weightRounds, *scaleTor, *simdist, "recall"),
-		results, attacks, pctPoints)
-	writeTorpctCSV(precision,
+			*sites, *instances, open, simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName, "recall"),
+		results, repResults, attacks, simPoints)
+	writeTorpctCSV(metrics.Precision,
 		fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-%s.csv",
-			*sites, *instances, *open, simmode,
-			*alexaRank, *window, *weightRounds, *scaleTor, *simdist, "precision"),
-		results, attacks, pctPoints)
+			*sites, *instances, open, simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName, "precision"),
+		results, repResults, attacks, simPoints)
+	writeTorpctCSV(metrics.F1,
+		fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-%s.csv",
+			*sites, *instances, open, simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName, "f1score"),
+		results, repResults, attacks, simPoints)
+	if *writeConfusion {
+		for _, attack := range attacks {
+			writeConfusionCSV(fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-%s-confusion.csv",
+				*sites, *instances, open, simmode,
+				*alexaRank, *window, *weightRounds, *scaleTor, simName, attack),
+				attack, matrices, simPoints)
+		}
+	}
+	if *perClass {
+		for _, attack := range attacks {
+			writePerClassCSV(fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-%s-perclass.csv",
+				*sites, *instances, open, simmode,
+				*alexaRank, *window, *weightRounds, *scaleTor, simName, attack),
+				attack, matrices, simPoints)
+		}
+	}
+	if *topK > 0 {
+		writeTopKCSV(fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-topk.csv",
+			*sites, *instances, open, simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName),
+			topk, simPoints)
+	}
+	if *curve > 0 {
+		writeCurveCSV(fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-curve.csv",
+			*sites, *instances, open, simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName),
+			curves, simPoints)
+	}
+	if groups != nil {
+		writeSitesCSV(fmt.Sprintf("%dx%d+%d-%s-a%d-w%d-r%d-s%.1f-%s-sites.csv",
+			*sites, *instances, open, simmode,
+			*alexaRank, *window, *weightRounds, *scaleTor, simName),
+			siteResults, attacks, simPoints)
+	}
+
+	return sweepResults{open: open, results: results, repResults: repResults,
+		attacks: attacks}
 }
 
-func test(i int, seenSite func(int) bool, // test-specific
-	fold int, globalWeight []float64, // fold-specific
-	feat, openfeat [][]float64) (result map[string]metrics) {
-	result = make(map[string]metrics)
+// testJob is an instance to test in a fold, with a seen function and DNS
+// evidence per repetition of the simulation and the results sent to out
+type testJob struct {
+	i        int
+	seens    []func(int) bool
+	evidence []dnsEvidence
+	base     baseAttack
+	out      chan<- []testResult
+}
 
+// testResult is the outcome of testing one instance with every attack
+type testResult struct {
+	metrics   map[string]metrics.Confusion   // attack -> metrics
+	output    map[string]int                 // attack -> predicted class
+	ranks     map[string]int                 // ranking -> rank of the true class, -1 if none
+	curve     map[string][]metrics.Confusion // attack -> [agreeing neighbours-1]metrics
+	trueclass int
+	instance  int
+}
+
+// test instance i with every attack for each seen function, i.e., each
+// repetition of the simulation.  The WF attack is the same for all, and for
+// a lazy Wa-kNN the distances to the training instances are only computed
+// once for the close-the-world attack of every repetition.
+func test(i int, seens []func(int) bool, evidence []dnsEvidence, // test-specific
+	base baseAttack, // fold-specific
+	fusions []fusion) []testResult {
 	// kNN classification
-	wKclasses, trueclass := classify(i, feat, openfeat,
-		globalWeight, *wKmax, fold, func(int) bool { return false })
-
-	// close the world classification
-	ctwIgnoreFunc := func(s int) bool {
-		return s < *sites && !seenSite(s) // ignore monitored sites we didn't see
-	}
-	ctwWeights := globalWeight
-	if !*lazy {
-		ctwWeights = wllcc(feat, openfeat, fold, ctwIgnoreFunc)
-	}
-	ctwClasses, _ := classify(i, feat, openfeat,
-		ctwWeights, *folds, fold, ctwIgnoreFunc)
-
-	for k := *wKmin; k <= *wKmax; k += *wKstep {
-		n := fmt.Sprintf("k%s-", strconv.Itoa(k))
-
-		// kNN
-		classkNN := getkNNClass(wKclasses, trueclass, k)
-		result[n+"wf"] = getResult(classkNN, trueclass)
-
-		// ctw
-		classCTW := getkNNClass(ctwClasses, trueclass, k)
-		result[n+"ctw"] = getResult(classCTW, trueclass)
-
-		// for getting higher precision (HP),
-		// if kNN says a trace is a monitored site, then confirm that we
-		// observed the site in the DNS data. If not, set as unmonitored.
-		// This trades reduced FNP for increased FN.
-		hpClass := classkNN
-		if classkNN < *sites {
-			if !seenSite(hpClass) {
-				hpClass = *sites
+	wKclasses, trueclass := base.classes(i, maxInt(*wKmax, *curve),
+		func(int) bool { return false })
+	var wfRank []int
+	if *topK > 0 {
+		wfRank = base.rank(i, func(int) bool { return false })
+	}
+	knn, cached := base.(*knnAttack)
+	cached = cached && *lazy && len(seens) > 1
+	var sorted []int
+	if cached {
+		sorted = knn.sortedNeighbours(i)
+	}
+
+	results := make([]testResult, len(seens))
+	for rep, seenSite := range seens {
+		result := testResult{
+			metrics:   make(map[string]metrics.Confusion),
+			output:    make(map[string]int),
+			trueclass: trueclass,
+			instance:  i,
+		}
+
+		// close the world classification
+		ctwIgnoreFunc := func(s int) bool {
+			return s < *sites && !seenSite(s) // ignore monitored sites we didn't see
+		}
+		var ctwClasses, ctwRank []int
+		if cached {
+			ctwClasses = knn.neighbourClasses(sorted, maxInt(*folds, *curve),
+				ctwIgnoreFunc)
+			if *topK > 0 {
+				ctwRank = knn.neighbourRank(sorted, ctwIgnoreFunc)
+			}
+		} else {
+			ctw := base.closeWorld(ctwIgnoreFunc)
+			ctwClasses, _ = ctw.classes(i, maxInt(*folds, *curve), ctwIgnoreFunc)
+			if *topK > 0 {
+				ctwRank = ctw.rank(i, ctwIgnoreFunc)
+			}
+		}
+
+		// top-k, where the true class is among the k most likely classes
+		if *topK > 0 {
+			result.ranks = map[string]int{
+				"wf":  rankOf(trueclass, wfRank),
+				"ctw": rankOf(trueclass, ctwRank),
+			}
+		}
+
+		// PR and ROC curves, by how many of the nearest neighbours must agree
+		if *curve > 0 {
+			result.curve = map[string][]metrics.Confusion{
+				"wf":  make([]metrics.Confusion, *curve),
+				"ctw": make([]metrics.Confusion, *curve),
+				"hp":  make([]metrics.Confusion, *curve),
+			}
+			for v := 1; v <= *curve; v++ {
+				classWF := vote(wKclasses[:*curve], v)
+				result.curve["wf"][v-1] = getResult(classWF, trueclass)
+				result.curve["ctw"][v-1] = getResult(vote(ctwClasses[:*curve], v),
+					trueclass)
+				if classWF < *sites && !seenSite(classWF) {
+					classWF = *sites
+				}
+				result.curve["hp"][v-1] = getResult(classWF, trueclass)
 			}
 		}
-		result[n+"hp"] = getResult(hpClass, trueclass)
-	}
 
-	return
+		for k := *wKmin; k <= *wKmax; k += *wKstep {
+			n := fmt.Sprintf("k%s-", strconv.Itoa(k))
+
+			// kNN
+			classkNN := getkNNClass(wKclasses, trueclass, k)
+			result.metrics[n+"wf"] = getResult(classkNN, trueclass)
+			result.output[n+"wf"] = classkNN
+
+			// ctw
+			classCTW := getkNNClass(ctwClasses, trueclass, k)
+			result.metrics[n+"ctw"] = getResult(classCTW, trueclass)
+			result.output[n+"ctw"] = classCTW
+
+			// for getting higher precision (HP),
+			// if kNN says a trace is a monitored site, then confirm that we
+			// observed the site in the DNS data. If not, set as unmonitored.
+			// This trades reduced FNP for increased FN.
+			hpClass := classkNN
+			if classkNN < *sites {
+				if !seenSite(hpClass) {
+					hpClass = *sites
+				}
+			}
+			result.metrics[n+"hp"] = getResult(hpClass, trueclass)
+			result.output[n+"hp"] = hpClass
+
+			// other strategies to combine WF and DNS, reported side by side
+			for _, f := range fusions {
+				class := f.classify(wKclasses, k, seenSite, evidence[rep])
+				result.metrics[n+f.name] = getResult(class, trueclass)
+				result.output[n+f.name] = class
+			}
+		}
+		results[rep] = result
+	}
+	return results
 }
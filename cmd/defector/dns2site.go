@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/metrics"
+)
+
+// dns2siteMetrics is the part of a dns2site -metrics file we use
+type dns2siteMetrics struct {
+	Time        time.Time `json:"time"`
+	Args        []string  `json:"args"`
+	Classifiers map[string]struct {
+		Recall    float64 `json:"recall"`
+		Precision float64 `json:"precision"`
+	} `json:"classifiers"`
+}
+
+// readDNS2siteMetrics returns the recall and precision of classifier in the
+// dns2site metrics file name, and a line on which run produced them
+func readDNS2siteMetrics(name, classifier string) (recall, precision float64,
+	provenance string, err error) {
+	d, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("failed to read dns2site metrics (%s)", err)
+	}
+	var m dns2siteMetrics
+	if err = json.Unmarshal(d, &m); err != nil {
+		return 0, 0, "", fmt.Errorf("failed to parse dns2site metrics (%s)", err)
+	}
+	c, exists := m.Classifiers[classifier]
+	if !exists {
+		return 0, 0, "", fmt.Errorf("no classifier %q in dns2site metrics %s",
+			classifier, name)
+	}
+	provenance = fmt.Sprintf("%s classifier in %s (run %s: dns2site %s)",
+		classifier, name, m.Time.Format(time.RFC3339), strings.Join(m.Args, " "))
+	return c.Recall, c.Precision, provenance, nil
+}
+
+// jointClasses are, in joint mode (-dnsfolder), the class dns2site
+// classified the .dns file of each instance as, -1 if not a monitored site
+var jointClasses []int
+
+// classifyJoint classifies the .dns file in dir of every instance, named as
+// its feature file, with dns2site -serve at addr, and returns the class of
+// each instance.  Each request times out after timeout.
+func classifyJoint(dir, addr string, timeout time.Duration) ([]int, error) {
+	client := &http.Client{Timeout: timeout}
+	classes := make([]int, len(featureFiles))
+	errs := make(chan error, len(featureFiles))
+	work := make(chan int)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < runtime.NumCPU()**workerFactor; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				site, err := classifyDNS(client, dir, featureFiles[i], addr)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				classes[i] = -1
+				if class, monitored := monitoredClass(site); monitored {
+					classes[i] = class
+				}
+			}
+		}()
+	}
+	for i := range featureFiles {
+		if len(errs) > 0 {
+			break // e.g., dns2site timed out, so do not wait for every instance
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+// readDNSFile reads the .dns (or .dns.gz) file name in dir
+func readDNSFile(dir, name string) ([]byte, error) {
+	d, err := ioutil.ReadFile(path.Join(dir, name+".dns"))
+	if os.IsNotExist(err) {
+		d, err = gzfile.ReadFile(path.Join(dir, name+".dns.gz"))
+	}
+	return d, err
+}
+
+// classifyDNS returns the site dns2site at addr classifies the .dns (or
+// .dns.gz) file name in dir as, -1 for unmonitored
+func classifyDNS(client *http.Client, dir, name, addr string) (int, error) {
+	d, err := readDNSFile(dir, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read .dns of %s (%s)", name, err)
+	}
+	resp, err := client.Post("http://"+addr+"/classify", "text/plain",
+		bytes.NewReader(d))
+	if err != nil {
+		return 0, fmt.Errorf("failed to classify .dns of %s (%s)", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("failed to classify .dns of %s (%s: %s)", name,
+			resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var c struct {
+		Site int `json:"site"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return 0, fmt.Errorf("failed to parse classification of %s (%s)", name, err)
+	}
+	return c.Site, nil
+}
+
+// jointMetrics returns the recall and precision of the joint
+// classifications, as dns2site computes them
+func jointMetrics(classes []int) (recall, precision float64) {
+	var m metrics.Confusion
+	for i, class := range classes {
+		if class == -1 {
+			class = *sites
+		}
+		m.Add(getResult(class, trueClass(i)))
+	}
+	return m.Recall(), m.Precision()
+}
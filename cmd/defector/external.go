@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/pylls/defector/logging"
+)
+
+// externalAttack delegates classification to a user-provided gRPC service,
+// e.g., wrapping a Deep Fingerprinting CNN in an ONNX runtime, while we
+// keep doing the folding, Tor simulation and DefecTor attacks.  To not need
+// generated protobuf code on either side, messages are JSON (the gRPC
+// content type is "application/grpc+json").  The service implements:
+//
+//	/defector.Score/Train    trainRequest    -> trainReply
+//	/defector.Score/Classify classifyRequest -> classifyReply
+//
+// Train is called once per fold before any Classify in that fold.
+type externalAttack struct {
+	feat, openfeat [][]float32
+	fold           int
+}
+
+// instance is an instance of a site: its name (as in "<name>.feat"), class
+// (*sites for the open world) and features
+type instance struct {
+	Name     string    `json:"name"`
+	Class    int       `json:"class"`
+	Features []float32 `json:"features"`
+}
+
+type trainRequest struct {
+	Fold    int        `json:"fold"`
+	Classes int        `json:"classes"` // monitored sites + 1
+	Train   []instance `json:"train"`
+}
+
+type trainReply struct{}
+
+type classifyRequest struct {
+	Fold     int      `json:"fold"`
+	Instance instance `json:"instance"` // with class -1
+}
+
+// classifyReply has a score per class, higher is more likely
+type classifyReply struct {
+	Scores []float64 `json:"scores"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) String() string {
+	return "json"
+}
+
+// externalConn is the connection to -wfaddr, shared by all folds
+var externalConn *grpc.ClientConn
+
+func dialExternal(addr string) (err error) {
+	externalConn, err = grpc.Dial(addr, grpc.WithInsecure(),
+		grpc.WithCodec(jsonCodec{}))
+	if err != nil {
+		return fmt.Errorf("failed to dial external classifier %s (%s)", addr, err)
+	}
+	return nil
+}
+
+func trainExternal(feat, openfeat [][]float32, fold int) (*externalAttack,
+	error) {
+	a := &externalAttack{feat: feat, openfeat: openfeat, fold: fold}
+	req := trainRequest{Fold: fold, Classes: *sites + 1}
+	for i := range feat {
+		if !instanceForTesting(i, fold) {
+			req.Train = append(req.Train, a.instance(i, trueClass(i)))
+		}
+	}
+	for i := range openfeat {
+		if !instanceForTesting(len(feat)+i, fold) {
+			req.Train = append(req.Train, a.instance(len(feat)+i, *sites))
+		}
+	}
+	var reply trainReply
+	err := grpc.Invoke(context.Background(), "/defector.Score/Train", &req,
+		&reply, externalConn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to train external classifier for fold %d (%s)",
+			fold, err)
+	}
+	return a, nil
+}
+
+// instance returns instance i as in classify(), with class
+func (a *externalAttack) instance(i, class int) instance {
+	return instance{Name: featureFiles[i], Class: class,
+		Features: instanceFeatures(a.feat, a.openfeat, i)}
+}
+
+func (a *externalAttack) classes(i, n int, ignore ignoreSite) ([]int, int) {
+	scores := a.scores(i)
+	best := *sites // the open world is never ignored
+	for c := 0; c < *sites; c++ {
+		if !ignore(c) && scores[c] > scores[best] {
+			best = c
+		}
+	}
+	return sameClass(best, n), trueClass(i)
+}
+
+func (a *externalAttack) rank(i int, ignore ignoreSite) []int {
+	return rankByScore(a.scores(i), ignore)
+}
+
+// scores asks the service for the score of each class of instance i
+func (a *externalAttack) scores(i int) []float64 {
+	req := classifyRequest{Fold: a.fold, Instance: a.instance(i, -1)}
+	var reply classifyReply
+	err := grpc.Invoke(context.Background(), "/defector.Score/Classify", &req,
+		&reply, externalConn)
+	if err != nil {
+		logging.Fatalf("failed to classify %s externally (%s)", req.Instance.Name, err)
+	}
+	if len(reply.Scores) != *sites+1 {
+		logging.Fatalf("expected %d scores from the external classifier, got %d",
+			*sites+1, len(reply.Scores))
+	}
+	return reply.Scores
+}
+
+func (a *externalAttack) closeWorld(ignore ignoreSite) baseAttack {
+	return a // classes() already only picks from sites not ignored
+}
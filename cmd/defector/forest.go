@@ -0,0 +1,205 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// kfpAttack is the k-fingerprinting attack by Hayes and Danezis: a random
+// forest is trained on the training instances of a fold, and each instance
+// is then represented by the leaves it ends up in.  The neighbours of a test
+// instance are the training instances that share the most leaves with it.
+type kfpAttack struct {
+	feat, openfeat [][]float32
+	forest         []tree
+	train          []int   // instances as in classify(), open world after feat
+	leaves         [][]int // of the training instances
+}
+
+// tree is a CART decision tree, the root is nodes[0]
+type tree struct {
+	nodes []treeNode
+}
+
+type treeNode struct {
+	leaf        bool
+	feature     int
+	threshold   float64 // go left if less or equal
+	left, right int
+}
+
+func trainKFP(feat, openfeat [][]float32, fold int,
+	rng *rand.Rand) *kfpAttack {
+	a := &kfpAttack{feat: feat, openfeat: openfeat}
+	for i := range feat {
+		if !instanceForTesting(i, fold) {
+			a.train = append(a.train, i)
+		}
+	}
+	for i := range openfeat {
+		if !instanceForTesting(len(feat)+i, fold) {
+			a.train = append(a.train, len(feat)+i)
+		}
+	}
+	if len(a.train) == 0 {
+		return a
+	}
+
+	for t := 0; t < *trees; t++ {
+		// bootstrap sample
+		sample := make([]int, len(a.train))
+		for i := range sample {
+			sample[i] = a.train[rng.Intn(len(a.train))]
+		}
+		var tr tree
+		tr.grow(a, sample, 0, rng)
+		a.forest = append(a.forest, tr)
+	}
+	for _, i := range a.train {
+		a.leaves = append(a.leaves, a.leavesOf(i))
+	}
+	return a
+}
+
+// grow adds a node for the instances in sample, splitting it on the best
+// of sqrt(FeatNum) random features by Gini impurity, returning its index
+func (t *tree) grow(a *kfpAttack, sample []int, depth int,
+	rng *rand.Rand) int {
+	index := len(t.nodes)
+	t.nodes = append(t.nodes, treeNode{leaf: true})
+	if len(sample) < 2 || (*treeDepth > 0 && depth >= *treeDepth) ||
+		pure(sample) {
+		return index
+	}
+
+	classes := *sites + 1
+	left := make([]int, classes)
+	total := make([]int, classes)
+	for _, i := range sample {
+		total[trueClass(i)]++
+	}
+	var totalSq float64
+	for _, n := range total {
+		totalSq += float64(n * n)
+	}
+
+	feature := func(i, f int) float64 {
+		return float64(instanceFeatures(a.feat, a.openfeat, i)[f])
+	}
+	bestGini := math.Inf(1)
+	bestFeature, bestThreshold := -1, 0.0
+	sorted := append([]int(nil), sample...)
+	for _, f := range rng.Perm(FeatNum)[:int(math.Max(1, math.Sqrt(float64(FeatNum))))] {
+		sort.Slice(sorted, func(i, j int) bool {
+			return feature(sorted[i], f) < feature(sorted[j], f)
+		})
+		for c := range left {
+			left[c] = 0
+		}
+		// sums of squared class counts, for Gini = 1 - sum/n^2
+		leftSq, rightSq := 0.0, totalSq
+		for k := 0; k < len(sorted)-1; k++ {
+			c := trueClass(sorted[k])
+			leftSq += float64(2*left[c] + 1)
+			rightSq -= float64(2*(total[c]-left[c]) - 1)
+			left[c]++
+
+			v, next := feature(sorted[k], f), feature(sorted[k+1], f)
+			if v == next {
+				continue
+			}
+			nl, nr := float64(k+1), float64(len(sorted)-k-1)
+			gini := nl*(1-leftSq/(nl*nl)) + nr*(1-rightSq/(nr*nr))
+			if gini < bestGini {
+				bestGini = gini
+				bestFeature = f
+				bestThreshold = (v + next) / 2
+			}
+		}
+	}
+	if bestFeature == -1 { // all features are constant
+		return index
+	}
+
+	var l, r []int
+	for _, i := range sample {
+		if feature(i, bestFeature) <= bestThreshold {
+			l = append(l, i)
+		} else {
+			r = append(r, i)
+		}
+	}
+	t.nodes[index] = treeNode{feature: bestFeature, threshold: bestThreshold}
+	t.nodes[index].left = t.grow(a, l, depth+1, rng)
+	t.nodes[index].right = t.grow(a, r, depth+1, rng)
+	return index
+}
+
+func pure(sample []int) bool {
+	for _, i := range sample {
+		if trueClass(i) != trueClass(sample[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// leavesOf returns the leaf of instance i in each tree
+func (a *kfpAttack) leavesOf(i int) []int {
+	features := instanceFeatures(a.feat, a.openfeat, i)
+	leaves := make([]int, len(a.forest))
+	for t, tr := range a.forest {
+		n := 0
+		for !tr.nodes[n].leaf {
+			if float64(features[tr.nodes[n].feature]) <= tr.nodes[n].threshold {
+				n = tr.nodes[n].left
+			} else {
+				n = tr.nodes[n].right
+			}
+		}
+		leaves[t] = n
+	}
+	return leaves
+}
+
+func (a *kfpAttack) classes(i, n int, ignore ignoreSite) (classes []int,
+	trueclass int) {
+	distList := a.distances(i, ignore)
+	for k := 0; k < n; k++ {
+		_, index := getMin(distList)
+		classes = append(classes, trueClass(a.train[index]))
+		distList[index] = math.MaxFloat64
+	}
+	return classes, trueClass(i)
+}
+
+func (a *kfpAttack) rank(i int, ignore ignoreSite) []int {
+	return rankByDistance(a.distances(i, ignore), func(j int) int {
+		return trueClass(a.train[j])
+	})
+}
+
+// distances returns the distance from i to the training instances, the
+// number of trees with a different leaf, with ignored sites at
+// math.MaxFloat64
+func (a *kfpAttack) distances(i int, ignore ignoreSite) []float64 {
+	leaves := a.leavesOf(i)
+	distList := make([]float64, len(a.train))
+	for j, train := range a.train {
+		if ignore(trueClass(train)) {
+			distList[j] = math.MaxFloat64
+			continue
+		}
+		for t := range leaves {
+			if leaves[t] != a.leaves[j][t] {
+				distList[j]++
+			}
+		}
+	}
+	return distList
+}
+
+func (a *kfpAttack) closeWorld(ignore ignoreSite) baseAttack {
+	return a // classes() already skips ignored sites
+}
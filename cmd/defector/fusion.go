@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fusion is a strategy to combine the k nearest neighbours of the WF attack
+// with the monitored sites seen in DNS, as an alternative to the hp rule of
+// downgrading an unseen monitored site to unmonitored
+type fusion struct {
+	name     string
+	classify func(neighbours []int, k int, seen func(int) bool, e dnsEvidence) int
+}
+
+// fusions are the strategies selectable with -fusion
+var fusions = []fusion{
+	{"bayes", fuseBayes},
+	{"dnsfirst", fuseDNSFirst},
+	{"weighted", fuseWeighted},
+}
+
+// getFusions returns the strategies in list, comma-separated
+func getFusions(list string) (selected []fusion, err error) {
+	if list == "" {
+		return nil, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		found := false
+		for _, f := range fusions {
+			if f.name == name {
+				selected = append(selected, f)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown fusion strategy %s (bayes, dnsfirst or weighted)",
+				name)
+		}
+	}
+	return
+}
+
+// dnsEvidence is what seeing the DNS of a monitored site says about a
+// visit in a simulation of the Tor network
+type dnsEvidence struct {
+	visit float64 // the probability of seeing the target's visit
+	other float64 // the probability of seeing a site due to others' visits
+}
+
+// newDNSEvidence estimates the evidence of DNS at points, where observed are
+// the monitored sites seen due to others' visits
+func newDNSEvidence(points []observationPoint,
+	observed map[int]bool) (e dnsEvidence) {
+	missed := 1.0
+	for _, p := range points {
+		q := p.pct / 100
+		if *useDNS2site {
+			q *= p.recall
+		}
+		missed *= 1 - q
+	}
+	e.visit = 1 - missed
+	// smoothed, so that neither seeing nor not seeing a site is certain
+	e.other = (float64(len(observed)) + 0.5) / (float64(*sites) + 1)
+	return
+}
+
+// votes counts the classes of the k nearest neighbours, returning the
+// classes in order of their closest neighbour
+func votes(neighbours []int, k int) (classes []int, count map[int]int) {
+	count = make(map[int]int)
+	for _, c := range neighbours[:minInt(k, len(neighbours))] {
+		if count[c] == 0 {
+			classes = append(classes, c)
+		}
+		count[c]++
+	}
+	return
+}
+
+// fuseBayes picks the class with the highest posterior, from the votes of
+// the neighbours (smoothed) as prior and the likelihood of the DNS seen if
+// the visit was to the class.  A visit to a monitored site makes it more
+// likely to be seen, while DNS says nothing about which unmonitored site
+// was visited.  Only classes voted for, and unmonitored, are considered.
+func fuseBayes(neighbours []int, k int, seen func(int) bool,
+	e dnsEvidence) int {
+	classes, count := votes(neighbours, k)
+	smoothing := 1 / (float64(*sites) + 1)
+	best, bestPost := *sites, float64(count[*sites])+smoothing
+	for _, c := range classes {
+		if c >= *sites {
+			continue
+		}
+		likelihood := 1 - e.visit // unseen
+		if seen(c) {
+			likelihood = (e.visit + (1-e.visit)*e.other) / e.other
+		}
+		if post := (float64(count[c]) + smoothing) * likelihood; post > bestPost {
+			best, bestPost = c, post
+		}
+	}
+	return best
+}
+
+// fuseDNSFirst narrows the candidates to the monitored sites seen in DNS,
+// and picks the one of the closest neighbour among the k nearest, i.e., the
+// WF attack must confirm the DNS, else unmonitored
+func fuseDNSFirst(neighbours []int, k int, seen func(int) bool,
+	e dnsEvidence) int {
+	for _, c := range neighbours[:minInt(k, len(neighbours))] {
+		if c < *sites && seen(c) {
+			return c
+		}
+	}
+	return *sites
+}
+
+// fuseWeighted picks the class with the highest weighted vote, the share of
+// the k nearest neighbours weighted by 1-w and the DNS by w: 1 for a seen
+// monitored site, 0 for an unseen one and 0.5 for unmonitored, where DNS
+// says nothing
+func fuseWeighted(neighbours []int, k int, seen func(int) bool,
+	e dnsEvidence) int {
+	classes, count := votes(neighbours, k)
+	w := *fusionWeight
+	score := func(c int) float64 {
+		dns := 0.5
+		if c < *sites {
+			dns = 0
+			if seen(c) {
+				dns = 1
+			}
+		}
+		return (1-w)*float64(count[c])/float64(k) + w*dns
+	}
+	best, bestScore := *sites, score(*sites)
+	for _, c := range classes {
+		if s := score(c); c < *sites && s > bestScore {
+			best, bestScore = c, s
+		}
+	}
+	return best
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// siteGroups group the instances by site, e.g., the subpages of a site,
+// with -groups
+type siteGroups struct {
+	names     []string // of each site
+	instance  []int    // instance -> site
+	class     []int    // monitored class -> site
+	monitored []bool   // site -> if its instances are monitored
+}
+
+// groups are the sites of the instances, nil without -groups
+var groups *siteGroups
+
+// readGroups reads "trace,site" lines in file, where the trace is the name
+// of a feature file without suffix, e.g., "5-3", and groups the instances
+// by site.  Traces not in file are grouped by the site of their name.
+func readGroups(file string) (*siteGroups, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open groups file (%s)", err)
+	}
+	defer f.Close()
+	site := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Split(line, ",")
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed groups line %q", line)
+		}
+		site[strings.TrimSpace(tokens[0])] = strings.TrimSpace(tokens[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read groups file (%s)", err)
+	}
+
+	g := &siteGroups{
+		instance: make([]int, len(featureFiles)),
+		class:    make([]int, *sites),
+	}
+	index := make(map[string]int)
+	for i, name := range featureFiles {
+		s, exists := site[name]
+		if !exists {
+			s = name[:strings.Index(name, "-")]
+		}
+		if _, exists = index[s]; !exists {
+			index[s] = len(g.names)
+			g.names = append(g.names, s)
+			g.monitored = append(g.monitored, trueClass(i) < *sites)
+		}
+		g.instance[i] = index[s]
+		if g.monitored[index[s]] != (trueClass(i) < *sites) {
+			return nil, fmt.Errorf("site %s in %s has both monitored and open-world traces",
+				s, file)
+		}
+		if c := trueClass(i); c < *sites {
+			if i%*instances == 0 {
+				g.class[c] = index[s]
+			} else if g.class[c] != index[s] {
+				return nil, fmt.Errorf("the instances of %s are of different sites in %s",
+					name[:strings.Index(name, "-")], file)
+			}
+		}
+	}
+	return g, nil
+}
+
+// siteOutcomes are, for each site tested in a repetition of the
+// simulation, if any of its traces was classified as the site when
+// monitored, or as any monitored site when not
+type siteOutcomes map[[2]int]bool // (rep, site) -> detected or flagged
+
+// add the classification of instance i as output
+func (o siteOutcomes) add(rep, i, output int) {
+	s := groups.instance[i]
+	hit := output < *sites
+	if groups.monitored[s] {
+		hit = hit && groups.class[output] == s
+	}
+	o[[2]int{rep, s}] = o[[2]int{rep, s}] || hit
+}
+
+// rates returns the share of monitored sites detected and unmonitored sites
+// flagged, averaged over the repetitions
+func (o siteOutcomes) rates() (monitored, detected, unmonitored,
+	flagged float64) {
+	for key, hit := range o {
+		if groups.monitored[key[1]] {
+			monitored++
+			if hit {
+				detected++
+			}
+		} else {
+			unmonitored++
+			if hit {
+				flagged++
+			}
+		}
+	}
+	reps := float64(*simReps)
+	return monitored / reps, detected / reps, unmonitored / reps, flagged / reps
+}
+
+// writeSitesCSV writes the site-level metrics of every attack at each
+// pctPoint, where a site is detected if any of its traces is classified as
+// it and an unmonitored site is a false positive if any of its traces is
+// classified as monitored
+func writeSitesCSV(location string,
+	outcomes []map[string]siteOutcomes, // pctPoint -> map["attack"] -> outcomes
+	attacks []string, simPoints []simPoint) {
+	output := pointHeader() + ",attack,sites,detected,recall,unmonitored,flagged,fpr\n"
+	for i := range outcomes {
+		for _, attack := range attacks {
+			m, d, u, f := outcomes[i][attack].rates()
+			output += fmt.Sprintf("%s,%s,%.0f,%.1f,%.3f,%.0f,%.1f,%.3f\n",
+				simPoints[i].label(), attack, m, d, d/m, u, f, f/u)
+		}
+	}
+	writeResults(output, location)
+}
@@ -3,50 +3,48 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/metrics"
 )
 
-func addResult(base, result *metrics) {
-	base.fn += result.fn
-	base.fnp += result.fnp
-	base.fpp += result.fpp
-	base.tn += result.tn
-	base.tp += result.tp
+// newRand returns randomness for a part of the experiment, e.g., a fold,
+// that is the same for a -seed no matter how work is scheduled
+func newRand(parts ...int) *rand.Rand {
+	s := *seed
+	for _, p := range parts {
+		s = s*1000003 + int64(p) + 1
+	}
+	return rand.New(rand.NewSource(s))
 }
 
-func getResult(output, trueclass int) (m metrics) {
-	if output == trueclass {
-		if trueclass < *sites {
-			// found the right monitored site
-			m.tp++
-		} else {
-			// correctly identified an unmonitored site
-			m.tn++
-		}
-	} else {
-		if output == *sites {
-			// false negative: said unmonitored for a monitored
-			m.fn++
-		} else {
-			if trueclass == *sites {
-				// classifier said an unmonitored site was monitored
-				m.fnp++
-			} else {
-				// classifier said the wrong monitored site
-				m.fpp++
-			}
-		}
-	}
-	return
+func getResult(output, trueclass int) metrics.Confusion {
+	return metrics.Classify(output, trueclass, *sites)
 }
 
+// instanceForTesting returns if instance i, counting the open world after
+// the monitored instances, is tested in fold
 func instanceForTesting(i, fold int) bool {
+	if testFolds != nil {
+		return testFolds[i] == fold
+	}
 	foldSize := *instances / *folds
 	// the instances at [fold*foldSize,(fold+1)*foldSize) are for testing
 	return i%*instances >= fold*foldSize && i%*instances < (fold+1)*foldSize
 }
 
+// instanceFeatures returns the features of instance i, counting the open
+// world after the monitored instances as in classify()
+func instanceFeatures(feat, openfeat [][]float32, i int) []float32 {
+	if i < len(feat) {
+		return feat[i]
+	}
+	return openfeat[i-len(feat)]
+}
+
 func getMaxInt(f []int) (val int, index int) {
 	index = 0
 	val = f[0]
@@ -59,73 +57,25 @@ func getMaxInt(f []int) (val int, index int) {
 	return
 }
 
-// recall = TPR = TP / (TP + FN + FPP)
-func recall(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].tp) / float64(data[i].tp+data[i].fn+data[i].fpp)
-		if !math.IsNaN(d) {
-			p += d
-		}
-	}
-	return p / float64(len(data))
-}
-
-// precision = TP / (TP + FPP + FNP)
-func precision(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].tp) / float64(data[i].tp+data[i].fpp+data[i].fnp)
-		if !math.IsNaN(d) {
-			p += d
-		}
-	}
-	return p / float64(len(data))
-}
-
-// FPR = FP / non-monitored elements = (FPP + FNP) / (TN + FNP)
-func fpr(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].fpp+data[i].fnp) / float64(data[i].tn+data[i].fnp)
-		if !math.IsNaN(d) {
-			p += d
-		}
-	}
-	return p / float64(len(data))
-}
-
-// f1 = 2 * [(precision*recall) / (precision + recall)]
-func f1score(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		precision := float64(data[i].tp) / float64(data[i].tp+data[i].fpp+data[i].fnp)
-		recall := float64(data[i].tp) / float64(data[i].tp+data[i].fn+data[i].fpp)
-		if !math.IsNaN(precision) && !math.IsNaN(recall) {
-			p += 2 * ((precision * recall) / (precision + recall))
-		}
+func writeResults(results, name string) {
+	err := ioutil.WriteFile(name, []byte(results), 0666)
+	if err != nil {
+		logging.Fatalf("failed to write %s (%s)", name, err)
 	}
-	return p / float64(len(data))
 }
 
-// accuracy = (TP + TN) / (everything)
-func accuracy(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].tp+data[i].tn) /
-			float64(data[i].fn+data[i].fnp+data[i].fpp+data[i].tn+data[i].tp)
-		if !math.IsNaN(d) {
-			p += d
-		}
+func maxInt(a, b int) int {
+	if a > b {
+		return a
 	}
-	return p / float64(len(data))
+	return b
 }
 
-func writeResults(results, name string) {
-	err := ioutil.WriteFile(name, []byte(results), 0666)
-	if err != nil {
-		log.Fatalf("failed to write %s (%s)", name, err)
+func minInt(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
 }
 
 func getMaxOccurance(values []int) (value, count int) {
@@ -145,23 +95,65 @@ func getMaxOccurance(values []int) (value, count int) {
 	return
 }
 
-func writeTorpctCSV(metric func(data []metrics) float64,
+// bootstrapCI returns the 95% confidence interval of metric over the folds
+// by the percentiles of -bootstrap resamples of the folds with replacement.
+// Resamples where metric is undefined (NaN), e.g., precision when no fold
+// drawn classified anything as monitored, are skipped, and the interval is
+// NaN only if every resample is.
+func bootstrapCI(metric func(data []metrics.Confusion) float64, data []metrics.Confusion,
+	rng *rand.Rand) (lo, hi float64) {
+	values := make([]float64, 0, *bootstrap)
+	resample := make([]metrics.Confusion, len(data))
+	for b := 0; b < *bootstrap; b++ {
+		for i := range resample {
+			resample[i] = data[rng.Intn(len(data))]
+		}
+		if v := metric(resample); !math.IsNaN(v) {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	sort.Float64s(values)
+	return values[int(0.025*float64(len(values)-1))],
+		values[int(0.975*float64(len(values)-1))]
+}
+
+func writeTorpctCSV(metric func(data []metrics.Confusion) float64,
 	location string,
-	results []map[string][]metrics, // pctPoint -> map["attack"] -> [folds]metrics
-	attacks []string, pctPoints []int) {
+	results []map[string][]metrics.Confusion, // pctPoint -> map["attack"] -> [folds]metrics
+	repResults []map[string][][]metrics.Confusion, // pctPoint -> map["attack"] -> [simreps][folds]metrics
+	attacks []string, simPoints []simPoint) {
 
 	// headers
-	output := "pct"
+	output := pointHeader()
 	for i := 0; i < len(attacks); i++ {
 		output += "," + attacks[i]
+		if *bootstrap > 0 {
+			output += "," + attacks[i] + "-lo," + attacks[i] + "-hi"
+		}
+		if *simReps > 1 {
+			output += "," + attacks[i] + "-simlo," + attacks[i] + "-simhi"
+		}
 	}
 	output += "\n"
 
 	// content
 	for i := 0; i < len(results); i++ {
-		output += fmt.Sprintf("%d", pctPoints[i])
+		output += simPoints[i].label()
 		for j := 0; j < len(attacks); j++ {
-			output += fmt.Sprintf(",%.3f", metric(results[i][attacks[j]]))
+			output += fmt.Sprintf(",%.3f", repMetric(metric, results[i][attacks[j]],
+				repResults[i][attacks[j]]))
+			if *bootstrap > 0 {
+				// the same resamples for every attack and metric at a pctPoint
+				lo, hi := bootstrapCI(metric, results[i][attacks[j]], newRand(i))
+				output += fmt.Sprintf(",%.3f,%.3f", lo, hi)
+			}
+			if *simReps > 1 {
+				_, lo, hi := simBand(metric, repResults[i][attacks[j]])
+				output += fmt.Sprintf(",%.3f,%.3f", lo, hi)
+			}
 		}
 		output += "\n"
 	}
@@ -2,22 +2,20 @@ package main
 
 import (
 	"io/ioutil"
-	"log"
 	"math"
 	"math/rand"
 	"path"
 	"strconv"
 	"strings"
+
+	"github.com/pylls/defector/features"
+	"github.com/pylls/defector/logging"
 )
 
 type ignoreSite func(int) bool
 
-func dist(f1, f2, weight []float64) (d float64) {
-	for i := 0; i < FeatNum; i++ {
-		if f1[i] != -1 && f2[i] != -1 {
-			d += weight[i] * math.Abs(f1[i]-f2[i])
-		}
-	}
+func dist(f1, f2 []float32, weight []float64) (d float64) {
+	d, _ = distWithin(f1, f2, weight, math.Inf(1))
 	return
 }
 
@@ -33,16 +31,18 @@ func getMin(f []float64) (val float64, index int) {
 	return
 }
 
-func readFeatures() (feat, openfeat [][]float64) {
+func readFeatures() (feat, openfeat [][]float32) {
 	// flag all sites we read
 	done := make(map[int]bool)
+	var openFiles []string
 
 	// monitored sites
 	for i := 0; i < *sites; i++ {
-		site := *roffset + i + 1
+		site := monitoredSite(i)
 		for j := 0; j < *instances; j++ {
-			feat = append(feat,
-				read(path.Join(*mfolder, strconv.Itoa(site)+"-"+strconv.Itoa(j)+FeatureSuffix)))
+			name := strconv.Itoa(site) + "-" + strconv.Itoa(j)
+			feat = append(feat, read(path.Join(*mfolder, name+FeatureSuffix)))
+			featureFiles = append(featureFiles, name)
 		}
 		done[site] = true
 	}
@@ -51,11 +51,13 @@ func readFeatures() (feat, openfeat [][]float64) {
 	for i := 1; true; i++ {
 		_, taken := done[i]
 		if !taken {
-			openfeat = append(openfeat,
-				read(path.Join(*ofolder, strconv.Itoa(i)+"-0"+FeatureSuffix)))
+			name := strconv.Itoa(i) + "-0"
+			openfeat = append(openfeat, read(path.Join(*ofolder, name+FeatureSuffix)))
+			openFiles = append(openFiles, name)
 			done[i] = true
 
 			if len(done) >= *sites+*open {
+				featureFiles = append(featureFiles, openFiles...)
 				return
 			}
 		}
@@ -64,20 +66,46 @@ func readFeatures() (feat, openfeat [][]float64) {
 	return
 }
 
-func read(filename string) (feat []float64) {
+func read(filename string) (feat []float32) {
 	d, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("failed to find file to read features for filename %s (%s)", filename, err)
+		logging.Fatalf("failed to find file to read features for filename %s (%s)", filename, err)
+	}
+
+	// files from fext start with a header naming the feature set, older files
+	// are always Wa-kNN features
+	setName, count := features.WaKNN.Name, features.WaKNN.Count
+	if strings.HasPrefix(string(d), features.HeaderPrefix) {
+		end := strings.Index(string(d), "\n")
+		if end == -1 {
+			end = len(d)
+		}
+		setName, count, err = features.ParseHeader(string(d[:end]))
+		if err != nil {
+			logging.Fatalf("failed to read features for filename %s (%s)", filename, err)
+		}
+		d = d[end:]
+	}
+	if *featureSet == "" {
+		*featureSet = setName
+		FeatNum = count
+	} else if setName != *featureSet {
+		logging.Fatalf("expected feature set %s, got %s for filename %s",
+			*featureSet, setName, filename)
 	}
 
 	// extract features
-	for _, f := range strings.Split(string(d), " ") {
-		if f == "'X'" {
+	for _, f := range strings.Fields(string(d)) {
+		if f == features.Missing {
 			feat = append(feat, -1)
-		} else if f != "" {
-			feat = append(feat, parseFeatureString(f))
+		} else {
+			feat = append(feat, float32(parseFeatureString(f)))
 		}
 	}
+	if len(feat) != count {
+		logging.Fatalf("expected %d features, got %d for filename %s",
+			count, len(feat), filename)
+	}
 	return
 }
 
@@ -93,11 +121,12 @@ func parseFeatureString(c string) float64 {
 	return val
 }
 
-func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []float64) {
+func wllcc(feat, openfeat [][]float32, fold int, ignore ignoreSite,
+	rng *rand.Rand) (weight []float64) {
 	weight = make([]float64, FeatNum)
 	// start with random weights between [0.5, 1.5]
 	for i := 0; i < FeatNum; i++ {
-		weight[i] = rand.Float64() + 0.5
+		weight[i] = rng.Float64() + 0.5
 	}
 
 	distList := make([]float64, len(feat)+len(openfeat))
@@ -105,7 +134,7 @@ func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []fl
 	recoBadList := make([]int, RecoPointsNum)
 
 	var ctr int
-	sitePerm := rand.Perm(*sites) // random permutation of all sites
+	sitePerm := rng.Perm(*sites) // random permutation of all sites
 	// perform WeightRounds number of rounds of weight learning
 	for round := 0; round < *weightRounds; round++ {
 		// i is the instance of a monitored site used for distance calculations
@@ -113,7 +142,7 @@ func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []fl
 		for {
 			// assume that we learn more from different sites than different
 			// instances of the same site
-			i = sitePerm[ctr%(len(sitePerm))]**instances + rand.Intn(*instances)
+			i = sitePerm[ctr%(len(sitePerm))]**instances + rng.Intn(*instances)
 			ctr++
 			if !instanceForTesting(i, fold) {
 				break // only learn on training instances
@@ -134,7 +163,7 @@ func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []fl
 		}
 		// and the distance to all open sites
 		for j := 0; j < len(openfeat); j++ {
-			if instanceForTesting(j, fold) || ignore(len(feat)+(j / *instances)) {
+			if instanceForTesting(len(feat)+j, fold) || ignore(len(feat)+(j / *instances)) {
 				distList[len(feat)+j] = math.MaxFloat64
 			} else {
 				distList[len(feat)+j] = dist(feat[i], openfeat[j], weight)
@@ -182,7 +211,7 @@ func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []fl
 			// calculate maxgood for the feature (d_{f_i})
 			var maxGood float64
 			for k := 0; k < RecoPointsNum; k++ {
-				n := math.Abs(feat[i][j] - feat[recoGoodList[k]][j])
+				n := math.Abs(float64(feat[i][j]) - float64(feat[recoGoodList[k]][j]))
 				if feat[i][j] == -1 || feat[recoGoodList[k]][j] == -1 {
 					n = 0
 				}
@@ -196,13 +225,14 @@ func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []fl
 				var n float64
 				if recoBadList[k] < len(feat) {
 					// monitored
-					n = math.Abs(feat[i][j] - feat[recoBadList[k]][j])
+					n = math.Abs(float64(feat[i][j]) - float64(feat[recoBadList[k]][j]))
 					if feat[i][j] == -1 || feat[recoBadList[k]][j] == -1 {
 						n = 0
 					}
 				} else {
 					// open
-					n = math.Abs(feat[i][j] - openfeat[recoBadList[k]-len(feat)][j])
+					n = math.Abs(float64(feat[i][j]) -
+						float64(openfeat[recoBadList[k]-len(feat)][j]))
 					if feat[i][j] == -1 || openfeat[recoBadList[k]-len(feat)][j] == -1 {
 						n = 0
 					}
@@ -251,16 +281,33 @@ func wllcc(feat, openfeat [][]float64, fold int, ignore ignoreSite) (weight []fl
 	return
 }
 
-func classify(test int, feat, openfeat [][]float64, weight []float64,
+func classify(test int, feat, openfeat [][]float32, weight []float64,
 	neighbours, fold int, ignore ignoreSite) (classes []int, trueClass int) {
-	// support classifying an open-world instance
-	var testfeat []float64
-	if test < len(feat) {
-		testfeat = feat[test]
-	} else {
-		testfeat = openfeat[test-len(feat)]
+	for _, index := range nearest(test, feat, openfeat, weight, neighbours,
+		fold, ignore) {
+		class := index / *instances
+		if class > *sites {
+			// we use the last class to represent all open-world sites
+			class = *sites
+		}
+		classes = append(classes, class)
+	}
+
+	trueClass = test / *instances
+	if trueClass > *sites {
+		trueClass = *sites
 	}
 
+	return
+}
+
+// distances returns the distance from test to all training instances, with
+// testing instances of the fold and ignored sites at math.MaxFloat64
+func distances(test int, feat, openfeat [][]float32, weight []float64,
+	fold int, ignore ignoreSite) []float64 {
+	// support classifying an open-world instance
+	testfeat := instanceFeatures(feat, openfeat, test)
+
 	distList := make([]float64, len(feat)+len(openfeat))
 	for i := 0; i < len(feat); i++ {
 		if instanceForTesting(i, fold) || ignore(i / *instances) {
@@ -272,32 +319,14 @@ func classify(test int, feat, openfeat [][]float64, weight []float64,
 	}
 
 	for i := 0; i < len(openfeat); i++ {
-		if instanceForTesting(i, fold) || ignore(len(feat)+i) {
+		if instanceForTesting(len(feat)+i, fold) || ignore(len(feat)+i) {
 			distList[len(feat)+i] = math.MaxFloat64
 		} else {
 			// distance to all open-world sites
 			distList[len(feat)+i] = dist(testfeat, openfeat[i], weight)
 		}
 	}
-
-	for i := 0; i < neighbours; i++ {
-		_, index := getMin(distList)
-		class := index / *instances
-		if class > *sites {
-			// we use the last class to represent all open-world sites
-			class = *sites
-		}
-		classes = append(classes, class)
-
-		distList[index] = math.MaxFloat64
-	}
-
-	trueClass = test / *instances
-	if trueClass > *sites {
-		trueClass = *sites
-	}
-
-	return
+	return distList
 }
 
 func getkNNClass(classes []int, trueclass, k int) (out int) {
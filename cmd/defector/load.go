@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// simPoint is a point on the x-axis of the experiment: the percentage of
+// Tor exit bandwidth the attacker observes, and the load of the network
+// then, with the label of the load from -load
+type simPoint struct {
+	pct  float64
+	rate float64 // web circuits per second
+	load string
+}
+
+// label is the first columns of the point in CSVs, see pointHeader
+func (p simPoint) label() string {
+	if *loadFile == "" {
+		return fmt.Sprintf("%.4g", p.pct)
+	}
+	return fmt.Sprintf("%.4g,%s", p.pct, p.load)
+}
+
+// pointHeader is the header of the first columns of CSVs
+func pointHeader() string {
+	if *loadFile == "" {
+		return "pct"
+	}
+	return "pct,load"
+}
+
+// getSimPoints returns a point for every percentage, at the constant
+// webCircuitRate, or with a load file for every percentage at every load
+func getSimPoints(pcts []float64, loadFile string) ([]simPoint, error) {
+	var points []simPoint
+	if loadFile == "" {
+		for _, pct := range pcts {
+			points = append(points, simPoint{pct: pct, rate: webCircuitRate})
+		}
+		return points, nil
+	}
+
+	f, err := os.Open(loadFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open load file (%s)", err)
+	}
+	defer f.Close()
+	var loads []simPoint
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, ",")
+		if i == -1 {
+			return nil, fmt.Errorf("malformed load line %q", line)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(line[i+1:]), 64)
+		if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+			return nil, fmt.Errorf("invalid rate in load line %q", line)
+		}
+		label := strings.TrimSpace(line[:i])
+		if strings.Contains(label, ",") {
+			return nil, fmt.Errorf("malformed load line %q", line)
+		}
+		loads = append(loads, simPoint{rate: rate, load: label})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read load file (%s)", err)
+	}
+	if len(loads) == 0 {
+		return nil, fmt.Errorf("no load in %s", loadFile)
+	}
+	for _, pct := range pcts {
+		for _, l := range loads {
+			l.pct = pct
+			points = append(points, l)
+		}
+	}
+	return points, nil
+}
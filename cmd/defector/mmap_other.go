@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "io/ioutil"
+
+// mapFile reads name, where memory-mapping is not supported
+func mapFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// monitoredSites are the sites in -monitored, in order, where the site of
+// index i is the class i.  Without -monitored, the monitored sites are
+// -sites sites after -roffset, ranked from -alexa in the simulation.
+var monitoredSites []int
+
+// monitoredIndex maps sites to their index in monitoredSites
+var monitoredIndex map[int]int
+
+// readMonitored reads a site per line in file, as in the names of feature
+// files and ranked by popularity, skipping # comments and blank lines
+func readMonitored(file string) (sites []int, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open monitored file (%s)", err)
+	}
+	defer f.Close()
+
+	listed := make(map[int]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		site, err := strconv.Atoi(line)
+		if err != nil || site < 1 {
+			return nil, fmt.Errorf("invalid monitored site %q", line)
+		}
+		if listed[site] {
+			return nil, fmt.Errorf("monitored site %d listed twice", site)
+		}
+		listed[site] = true
+		sites = append(sites, site)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read monitored file (%s)", err)
+	}
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("no sites in monitored file %s", file)
+	}
+	return sites, nil
+}
+
+// setMonitored makes sites the monitored sites
+func setMonitored(sites []int) {
+	monitoredSites = sites
+	monitoredIndex = make(map[int]int, len(sites))
+	for i, site := range sites {
+		monitoredIndex[site] = i
+	}
+}
+
+// monitoredSite returns the site of the feature files of monitored class i
+func monitoredSite(i int) int {
+	if monitoredSites != nil {
+		return monitoredSites[i]
+	}
+	return *roffset + i + 1
+}
+
+// monitoredClass returns the class of site, as numbered in the names of
+// feature files, and if it is monitored
+func monitoredClass(site int) (int, bool) {
+	if monitoredSites != nil {
+		i, ok := monitoredIndex[site]
+		return i, ok
+	}
+	if i := site - *roffset - 1; i >= 0 && i < *sites {
+		return i, true
+	}
+	return -1, false
+}
+
+// monitoredRank returns the class of the site of popularity rank in the
+// simulation and if it is monitored
+func monitoredRank(rank int) (int, bool) {
+	if monitoredSites != nil {
+		i, ok := monitoredIndex[rank]
+		return i, ok
+	}
+	if *alexaRank <= rank && rank < *sites+*alexaRank {
+		return rank - *alexaRank, true // sites are indexed from 0
+	}
+	return -1, false
+}
@@ -0,0 +1,107 @@
+package main
+
+import "math"
+
+// distBlock is the number of features summed between checks of the bound
+// in distWithin, small enough to give up early and big enough to not check
+// all the time
+const distBlock = 32
+
+// distWithin is dist, but gives up with ok false as soon as the distance is
+// above bound, which is exact for non-negative weights.  The features are
+// summed in the same order as in dist(), so distances are the same.
+func distWithin(f1, f2 []float32, weight []float64,
+	bound float64) (d float64, ok bool) {
+	f1, f2, weight = f1[:FeatNum], f2[:FeatNum], weight[:FeatNum]
+	for start := 0; start < FeatNum; start += distBlock {
+		end := start + distBlock
+		if end > FeatNum {
+			end = FeatNum
+		}
+		// equal lengths let the compiler drop the bounds checks in the loop
+		a, b, w := f1[start:end], f2[start:end], weight[start:end]
+		b, w = b[:len(a)], w[:len(a)]
+		for i := range a {
+			if a[i] != -1 && b[i] != -1 {
+				d += w[i] * math.Abs(float64(a[i])-float64(b[i]))
+			}
+		}
+		if d > bound {
+			return d, false
+		}
+	}
+	return d, true
+}
+
+// neighbour is a training instance and its distance to a test instance
+type neighbour struct {
+	index int
+	dist  float64
+}
+
+// nearest returns the indices of the n closest training instances to test,
+// closest first and with ties to the lowest index, as repeatedly taking the
+// minimum of distances() but in one pass, without computing the full
+// distance to instances that cannot be among the n closest.  With -knneps
+// above 0 the search is approximate: every returned neighbour is at most
+// 1+eps times farther away than the exact one at its position.
+func nearest(test int, feat, openfeat [][]float32, weight []float64,
+	n, fold int, ignore ignoreSite) []int {
+	testfeat := instanceFeatures(feat, openfeat, test)
+	// a partial sum is only a lower bound of the distance for non-negative
+	// weights, which WLLCC keeps
+	bounded := true
+	for _, w := range weight[:FeatNum] {
+		if w < 0 {
+			bounded = false
+			break
+		}
+	}
+
+	best := make([]neighbour, 0, n+1)
+	consider := func(index int, f []float32) {
+		bound := math.Inf(1)
+		if bounded && len(best) == n {
+			bound = best[n-1].dist / (1 + *knnEps)
+		}
+		d, ok := distWithin(testfeat, f, weight, bound)
+		if !ok || (len(best) == n && d >= best[n-1].dist) {
+			return
+		}
+		// after any neighbour at the same distance, it has a lower index
+		k := len(best)
+		for k > 0 && best[k-1].dist > d {
+			k--
+		}
+		best = append(best, neighbour{})
+		copy(best[k+1:], best[k:])
+		best[k] = neighbour{index: index, dist: d}
+		if len(best) > n {
+			best = best[:n]
+		}
+	}
+	for i := 0; i < len(feat); i++ {
+		if !instanceForTesting(i, fold) && !ignore(i / *instances) {
+			consider(i, feat[i])
+		}
+	}
+	for i := 0; i < len(openfeat); i++ {
+		if !instanceForTesting(len(feat)+i, fold) && !ignore(len(feat)+i) {
+			consider(len(feat)+i, openfeat[i])
+		}
+	}
+
+	indices := make([]int, 0, n)
+	taken := make(map[int]bool)
+	for _, b := range best {
+		indices = append(indices, b.index)
+		taken[b.index] = true
+	}
+	// too few training instances, fill up like distances() at math.MaxFloat64
+	for i := 0; len(indices) < n && i < len(feat)+len(openfeat); i++ {
+		if !taken[i] {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+)
+
+// simulation is one simulation of the Tor network for a fold: the observed
+// monitored sites and the exit caches (nil without -exitcache) of each
+// observation point
+type simulation struct {
+	observed map[int]bool
+	caches   []*exitCaches
+}
+
+// simulate the Tor network at every observation point
+func simulate(points []observationPoint, rate float64,
+	getSite func(*rand.Rand) int, rng *rand.Rand) simulation {
+	s := simulation{
+		observed: make(map[int]bool),
+		caches:   make([]*exitCaches, len(points)),
+	}
+	for k, p := range points {
+		var o map[int]bool
+		o, s.caches[k] = simTorNetwork(p, rate, *window, getSite, rng)
+		for site := range o {
+			s.observed[site] = true
+		}
+	}
+	return s
+}
+
+// savedObservations are the simulations of a run, to audit them or to test
+// other attacks under identical simulated network conditions
+type savedObservations struct {
+	Seed      int64        `json:"seed"`
+	Sites     int          `json:"sites"`
+	Alexa     int          `json:"alexa"`
+	Monitored []int        `json:"monitored,omitempty"` // -monitored
+	Folds     int          `json:"folds"`
+	SimReps   int          `json:"simreps"`
+	Points    []savedPoint `json:"points"`
+}
+
+type savedPoint struct {
+	Pct   float64      `json:"pct"`
+	Load  string       `json:"load,omitempty"`
+	Rate  float64      `json:"rate"`
+	Folds [][]savedSim `json:"folds"` // [fold][rep]
+}
+
+type savedSim struct {
+	Observed []int          `json:"observed"`         // sites, from 0
+	Caches   []*savedCaches `json:"caches,omitempty"` // per observation point
+}
+
+type savedCaches struct {
+	TTL     float64         `json:"ttl"`
+	TTLs    map[int]float64 `json:"ttls,omitempty"` // site -> TTL, -ttlfolder
+	Seconds float64         `json:"seconds"`
+	Misses  []savedMisses   `json:"misses"`
+}
+
+// savedMisses are the times site was resolved at exit
+type savedMisses struct {
+	Exit  int       `json:"exit"`
+	Site  int       `json:"site"`
+	Times []float64 `json:"times"`
+}
+
+// saveObservations writes sims, pctPoint -> [folds][simreps]simulation, to
+// name as JSON
+func saveObservations(name string, sims [][][]simulation,
+	simPoints []simPoint) error {
+	s := savedObservations{
+		Seed:      *seed,
+		Sites:     *sites,
+		Alexa:     *alexaRank,
+		Monitored: monitoredSites,
+		Folds:     *folds,
+		SimReps:   *simReps,
+	}
+	for i, p := range simPoints {
+		sp := savedPoint{Pct: p.pct, Load: p.load, Rate: p.rate,
+			Folds: make([][]savedSim, len(sims[i]))}
+		for fold, reps := range sims[i] {
+			for _, sim := range reps {
+				sp.Folds[fold] = append(sp.Folds[fold], sim.save())
+			}
+		}
+		s.Points = append(s.Points, sp)
+	}
+
+	d, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode observations (%s)", err)
+	}
+	if err = ioutil.WriteFile(name, d, 0666); err != nil {
+		return fmt.Errorf("failed to write observations %s (%s)", name, err)
+	}
+	return nil
+}
+
+func (s simulation) save() (saved savedSim) {
+	saved.Observed = []int{} // not null in JSON
+	for site := range s.observed {
+		saved.Observed = append(saved.Observed, site)
+	}
+	sort.Ints(saved.Observed)
+	if !*exitCache {
+		return
+	}
+	for _, c := range s.caches {
+		sc := &savedCaches{TTL: c.ttl, TTLs: c.ttls, Seconds: c.seconds}
+		for key, times := range c.misses {
+			sc.Misses = append(sc.Misses, savedMisses{
+				Exit: key[0], Site: key[1], Times: times})
+		}
+		sort.Slice(sc.Misses, func(i, j int) bool {
+			if sc.Misses[i].Exit != sc.Misses[j].Exit {
+				return sc.Misses[i].Exit < sc.Misses[j].Exit
+			}
+			return sc.Misses[i].Site < sc.Misses[j].Site
+		})
+		saved.Caches = append(saved.Caches, sc)
+	}
+	return
+}
+
+// loadObservations returns the simulations in name, pctPoint ->
+// [folds][simreps]simulation, if they were saved for the same points,
+// folds, repetitions and monitored sites as now
+func loadObservations(name string,
+	simPoints []simPoint) ([][][]simulation, error) {
+	d, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read observations (%s)", err)
+	}
+	var s savedObservations
+	if err = json.Unmarshal(d, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse observations %s (%s)", name, err)
+	}
+	switch {
+	case s.Sites != *sites || s.Alexa != *alexaRank:
+		return nil, fmt.Errorf("observations in %s are for %d sites from rank %d, not %d from %d",
+			name, s.Sites, s.Alexa, *sites, *alexaRank)
+	case fmt.Sprint(s.Monitored) != fmt.Sprint(monitoredSites):
+		return nil, fmt.Errorf("observations in %s are for other -monitored sites",
+			name)
+	case s.Folds != *folds || s.SimReps != *simReps:
+		return nil, fmt.Errorf("observations in %s are for %d folds and %d simreps, not %d and %d",
+			name, s.Folds, s.SimReps, *folds, *simReps)
+	case len(s.Points) != len(simPoints):
+		return nil, fmt.Errorf("observations in %s are for %d points, not %d",
+			name, len(s.Points), len(simPoints))
+	}
+
+	sims := make([][][]simulation, len(simPoints))
+	for i, p := range s.Points {
+		if p.Pct != simPoints[i].pct || p.Load != simPoints[i].load {
+			return nil, fmt.Errorf("observations in %s are for %s, not %s",
+				name, simPoint{pct: p.Pct, load: p.Load}.label(), simPoints[i].label())
+		}
+		points := len(observationPoints(p.Pct))
+		if len(p.Folds) != *folds {
+			return nil, fmt.Errorf("observations in %s have %d folds for %s",
+				name, len(p.Folds), simPoints[i].label())
+		}
+		sims[i] = make([][]simulation, *folds)
+		for fold, reps := range p.Folds {
+			if len(reps) != *simReps {
+				return nil, fmt.Errorf("observations in %s have %d simreps for %s",
+					name, len(reps), simPoints[i].label())
+			}
+			for _, saved := range reps {
+				sim := simulation{
+					observed: make(map[int]bool),
+					caches:   make([]*exitCaches, points),
+				}
+				for _, site := range saved.Observed {
+					sim.observed[site] = true
+				}
+				if *exitCache && len(saved.Caches) != points {
+					return nil, fmt.Errorf("observations in %s have %d exit caches, not %d (-exitcache)",
+						name, len(saved.Caches), points)
+				}
+				if *exitCache {
+					for k, sc := range saved.Caches {
+						sim.caches[k] = &exitCaches{
+							ttl:     sc.TTL,
+							ttls:    sc.TTLs,
+							seconds: sc.Seconds,
+							misses:  make(map[[2]int][]float64),
+						}
+						for _, m := range sc.Misses {
+							sim.caches[k].misses[[2]int{m.Exit, m.Site}] = m.Times
+						}
+					}
+				}
+				sims[i][fold] = append(sims[i][fold], sim)
+			}
+		}
+	}
+	return sims, nil
+}
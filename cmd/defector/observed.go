@@ -1,82 +1,328 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"math"
 	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/dnsfile"
+)
+
+// the TTLs of DNS answers cached by Tor exits are clamped to [min, max]
+const (
+	torMinTTL = 60
+	torMaxTTL = 30 * 60
 )
 
-func simTorNetwork(obsPct, seconds int,
-	getSite func() int) (observed map[int]bool) {
+// observationPoint is where the adversary observes DNS: the DNS traffic of
+// pct percent of the exit bandwidth at the exits or at a resolver, with the
+// recall and precision of mapping it to sites there
+type observationPoint struct {
+	name              string
+	pct               float64
+	recall, precision float64
+}
+
+// observationPoints returns where the -adversary observes DNS for the
+// percentage pct of the experiment
+func observationPoints(pct float64) []observationPoint {
+	exit := observationPoint{name: "exit", pct: pct,
+		recall: *dnsRecall, precision: *dnsPrecision}
+	resolver := observationPoint{name: "resolver", pct: pct,
+		recall: *resolverRecall, precision: *resolverPrecision}
+	switch *adversary {
+	case "resolver":
+		return []observationPoint{resolver}
+	case "both":
+		exit.pct = *exitPct
+		return []observationPoint{exit, resolver}
+	}
+	return []observationPoint{exit}
+}
+
+func simTorNetwork(p observationPoint, rate float64, seconds int,
+	getSite func(*rand.Rand) int, rng *rand.Rand) (observed map[int]bool,
+	cache *exitCaches) {
 	observed = make(map[int]bool)
-	obsFrac := float64(obsPct) / float64(100)
-	n := siteCount(seconds, obsFrac)
+	obsFrac := p.pct / 100
+	n := siteCount(rate, seconds, obsFrac)
 
 	if *useDNS2site {
 		// precision is primarly false-negative-to-positive, resulting in extra
 		// monitored (identified) sites
 		// and we assume we monitor most websites in DNS-to-Site FP
-		n += int(float64(n) * (1 - *dnsPrecision))
+		n += int(float64(n) * (1 - p.precision))
+	}
+
+	if *exitCache {
+		return simExitCaches(p, n, seconds, getSite, rng)
 	}
 
 	for i := 0; i < n; i++ {
-		site := getSite() // [1, infinity)
+		site := getSite(rng) // [1, infinity)
 
 		if *useDNS2site {
 			// recall: the client visited a site, but we didn't detect it
-			if rand.Float64() >= *dnsRecall {
+			if rng.Float64() >= p.recall {
 				continue
 			}
 		}
 
 		// only append site that is monitored
-		if *alexaRank <= site && site < *sites+*alexaRank {
-			observed[site-*alexaRank] = true // sites are indexed from 0
+		if index, monitored := monitoredRank(site); monitored {
+			observed[index] = true
+		}
+	}
+
+	return
+}
+
+// exitCaches are the times monitored sites were resolved, i.e., not
+// answered from the cache, at each of the -exits exits the attacker observes
+type exitCaches struct {
+	ttl     float64         // of sites without a TTL of their own
+	ttls    map[int]float64 // site -> TTL, with -ttlfolder
+	seconds float64
+	misses  map[[2]int][]float64 // (exit, site) -> times, in order
+}
+
+// siteTTLs are, with -ttlfolder, the TTL of the domain of each monitored
+// site that has one
+var siteTTLs map[int]int
+
+// readSiteTTLs returns the TTL of the domain of each monitored site: the
+// median over its instances of the TTL of the first domain, i.e., the site
+// itself, in their .dns (or .dns.gz) files in dir, named as their feature
+// files.  Sites without any .dns file have none.
+func readSiteTTLs(dir string) (map[int]int, error) {
+	ttls := make(map[int][]int)
+	for i := 0; i < *sites**instances; i++ {
+		d, err := readDNSFile(dir, featureFiles[i])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read .dns of %s (%s)", featureFiles[i], err)
+		}
+		s := dnsfile.NewScanner(bytes.NewReader(d))
+		if s.Scan() {
+			ttls[i / *instances] = append(ttls[i / *instances], s.Request().TTL)
+		}
+		if err = s.Err(); err != nil {
+			return nil, fmt.Errorf("failed to parse .dns of %s (%s)", featureFiles[i], err)
+		}
+	}
+	median := make(map[int]int, len(ttls))
+	for site, t := range ttls {
+		sort.Ints(t)
+		median[site] = t[len(t)/2]
+	}
+	return median, nil
+}
+
+// clampTTL clamps ttl as Tor does when caching answers at exits
+func clampTTL(ttl int) float64 {
+	if ttl < torMinTTL {
+		return torMinTTL
+	} else if ttl > torMaxTTL {
+		return torMaxTTL
+	}
+	return float64(ttl)
+}
+
+// ttlOf returns the TTL site is cached for
+func (c *exitCaches) ttlOf(site int) float64 {
+	if ttl, ok := c.ttls[site]; ok {
+		return ttl
+	}
+	return c.ttl
+}
+
+// simExitCaches simulates n visits spread over the observed exits in the
+// window of seconds, and the visits in the longest TTL before the window
+// that fill the caches of the exits.  Only visits not answered from the
+// cache of their exit, for the TTL of the site, are observed DNS.
+func simExitCaches(p observationPoint, n, seconds int,
+	getSite func(*rand.Rand) int,
+	rng *rand.Rand) (observed map[int]bool, cache *exitCaches) {
+	cache = &exitCaches{
+		ttl:     clampTTL(*cacheTTL),
+		seconds: float64(seconds),
+		misses:  make(map[[2]int][]float64),
+	}
+	longest := cache.ttl
+	if siteTTLs != nil {
+		cache.ttls = make(map[int]float64, len(siteTTLs))
+		for site, ttl := range siteTTLs {
+			cache.ttls[site] = clampTTL(ttl)
+			longest = math.Max(longest, cache.ttls[site])
+		}
+	}
+
+	// visits to monitored sites, at the same rate before the window
+	visits := make(map[[2]int][]float64)
+	total := n + int(float64(n)*longest/float64(seconds))
+	for i := 0; i < total; i++ {
+		site := getSite(rng)
+		t := rng.Float64()*(float64(seconds)+longest) - longest
+		exit := rng.Intn(*exits)
+		if index, monitored := monitoredRank(site); monitored {
+			key := [2]int{exit, index}
+			visits[key] = append(visits[key], t)
 		}
 	}
 
+	observed = make(map[int]bool)
+	for key, times := range visits {
+		sort.Float64s(times)
+		expires := math.Inf(-1)
+		for _, t := range times {
+			if t < expires {
+				continue // answered from the cache
+			}
+			expires = t + cache.ttlOf(key[1])
+			cache.misses[key] = append(cache.misses[key], t)
+			if t >= 0 && (!*useDNS2site || rng.Float64() < p.recall) {
+				observed[key[1]] = true
+			}
+		}
+	}
 	return
 }
 
-func genSeenFunc(i, obsPct int, observed map[int]bool) func(int) bool {
+// cached is true if site is in the cache of exit at t
+func (c *exitCaches) cached(exit, site int, t float64) bool {
+	for _, m := range c.misses[[2]int{exit, site}] {
+		if m <= t && t < m+c.ttlOf(site) {
+			return true
+		}
+	}
+	return false
+}
+
+// genSeenFunc returns if a site is observed when testing instance i: if
+// observed in the simulated network, or if our target's visit to it is
+// observed at one of the observation points, with the cache of each.  In
+// joint mode, the visit is to the site dns2site classified its DNS as.
+func genSeenFunc(i int, points []observationPoint, observed map[int]bool,
+	caches []*exitCaches, rng *rand.Rand) func(int) bool {
 	visitedSite := (i / *instances)
 	if visitedSite >= *sites {
 		visitedSite = -1 // unmonitored
 	}
+	mappedSite := visitedSite
+	if jointClasses != nil {
+		mappedSite = jointClasses[i]
+	}
 
-	// flip based on pct if we should include our site or not
-	visited := (rand.Intn(100) < obsPct && visitedSite >= 0) &&
-		(!*useDNS2site || rand.Float64() < *dnsRecall) // perfect or dns2site
+	visited := false
+	for k, p := range points {
+		var seen bool
+		if jointClasses != nil {
+			// flip based on pct if we observe the DNS of the visit at all
+			seen = rng.Float64()*100 < p.pct && mappedSite >= 0
+		} else {
+			// flip based on pct if we should include our site or not
+			seen = (rng.Float64()*100 < p.pct && visitedSite >= 0) &&
+				(!*useDNS2site || rng.Float64() < p.recall) // perfect or dns2site
+		}
+		if caches[k] != nil && seen && visitedSite >= 0 {
+			// the visit is at an observed exit, at some time in the window
+			seen = !caches[k].cached(rng.Intn(*exits), visitedSite,
+				rng.Float64()*caches[k].seconds)
+		}
+		visited = visited || seen
+	}
 
 	return func(site int) bool {
 		_, obs := observed[site]
 		// we observed the site in the network due to someone else browsing it
 		// at the same time OR due to observing our target visiting the site
-		return obs || (visited && site == visitedSite)
+		return obs || (visited && site == mappedSite)
 	}
 }
 
-func siteCount(seconds int, obsFrac float64) int {
-	// this is based on 700k active web circuits / 10 min from Jansen and Johnson,
-	// which should be an upper limit for the number of different websites visited
-	// over Tor in the same timeframe.
-	return int(math.Ceil(1166.67*float64(seconds)*obsFrac) * *scaleTor)
+// webCircuitRate is based on 700k active web circuits / 10 min from Jansen
+// and Johnson, which should be an upper limit for the number of different
+// websites visited over Tor in the same timeframe.
+const webCircuitRate = 1166.67
+
+func siteCount(rate float64, seconds int, obsFrac float64) int {
+	return int(math.Ceil(rate*float64(seconds)*obsFrac) * *scaleTor)
 }
 
-func genPowerLawRand(alpha float64) func() int {
+func genPowerLawRand(alpha float64) func(*rand.Rand) int {
 	oneOverOneMinusAlpha := 1 / (1 - alpha)
-	return func() int {
-		r := rand.Float64()
+	return func(rng *rand.Rand) int {
+		r := rng.Float64()
 		for r > 0.9999999999999999 {
 			//avoid input values that would lead to outputs above maxint
-			r = rand.Float64()
+			r = rng.Float64()
 		}
 
 		return int(math.Ceil(math.Pow(alpha*(1.0-r), oneOverOneMinusAlpha)))
 	}
 }
 
-func getUniformRand(max int) func() int {
-	return func() int {
-		return rand.Intn(max) + 1
+func getUniformRand(max int) func(*rand.Rand) int {
+	return func(rng *rand.Rand) int {
+		return rng.Intn(max) + 1
+	}
+}
+
+// getEmpiricalRand samples ranks from an empirical rank-frequency table with
+// "rank,frequency" lines in file, e.g., fitted from real traffic, where
+// ranks missing in the file are never visited
+func getEmpiricalRand(file string) (func(*rand.Rand) int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rank-frequency file (%s)", err)
+	}
+	defer f.Close()
+
+	var ranks []int
+	var cumulative []float64 // of frequencies, in the order of the file
+	total := 0.0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Split(line, ",")
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed rank-frequency line %q", line)
+		}
+		rank, err := strconv.Atoi(strings.TrimSpace(tokens[0]))
+		if err != nil || rank < 1 {
+			return nil, fmt.Errorf("invalid rank in %q", line)
+		}
+		freq, err := strconv.ParseFloat(strings.TrimSpace(tokens[1]), 64)
+		if err != nil || freq < 0 || math.IsInf(freq, 0) || math.IsNaN(freq) {
+			return nil, fmt.Errorf("invalid frequency of rank %d in %q", rank, line)
+		}
+		total += freq
+		ranks = append(ranks, rank)
+		cumulative = append(cumulative, total)
 	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rank-frequency file (%s)", err)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no visits in rank-frequency file %s", file)
+	}
+
+	return func(rng *rand.Rand) int {
+		i := sort.SearchFloat64s(cumulative, rng.Float64()*total)
+		for cumulative[i] == 0 || (i > 0 && cumulative[i] == cumulative[i-1]) {
+			i++ // ranks with frequency 0 are never visited
+		}
+		return ranks[i]
+	}, nil
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"unsafe"
+)
+
+// A pack is the features of a dataset as packed float32, so it can be
+// memory-mapped instead of parsed: a header, the features of every instance
+// (monitored and then open world, as read by readFeatures), and the names
+// of their feature files, one per line.  Floats are little-endian.
+const (
+	packMagic      = "defector-pack-v1"
+	packSetLen     = 32 // bytes for the name of the feature set
+	packHeaderSize = len(packMagic) + 5*4 + packSetLen
+)
+
+type packHeader struct {
+	sites, instances, open, roffset, count int
+	featureSet                             string
+}
+
+// writePack writes the features read by readFeatures to name
+func writePack(name string, feat, openfeat [][]float32) error {
+	if len(*featureSet) > packSetLen {
+		return fmt.Errorf("failed to pack, feature set name %s is too long",
+			*featureSet)
+	}
+	var b bytes.Buffer
+	b.WriteString(packMagic)
+	for _, v := range []int{*sites, *instances, *open, *roffset, FeatNum} {
+		binary.Write(&b, binary.LittleEndian, uint32(v))
+	}
+	set := make([]byte, packSetLen)
+	copy(set, *featureSet)
+	b.Write(set)
+	for _, features := range [][][]float32{feat, openfeat} {
+		for _, f := range features {
+			binary.Write(&b, binary.LittleEndian, f)
+		}
+	}
+	b.WriteString(strings.Join(featureFiles, "\n"))
+
+	if err := ioutil.WriteFile(name, b.Bytes(), 0666); err != nil {
+		return fmt.Errorf("failed to write pack %s (%s)", name, err)
+	}
+	return nil
+}
+
+// loadPack memory-maps the pack in name (or reads it, if memory-mapping is
+// not supported) for the dataset of the flags
+func loadPack(name string) (feat, openfeat [][]float32, err error) {
+	d, err := mapFile(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open pack (%s)", err)
+	}
+	if len(d) < packHeaderSize || string(d[:len(packMagic)]) != packMagic {
+		return nil, nil, fmt.Errorf("%s is not a pack", name)
+	}
+	var h packHeader
+	for i, v := range []*int{&h.sites, &h.instances, &h.open, &h.roffset,
+		&h.count} {
+		*v = int(binary.LittleEndian.Uint32(d[len(packMagic)+4*i:]))
+	}
+	set := d[packHeaderSize-packSetLen : packHeaderSize]
+	if i := bytes.IndexByte(set, 0); i != -1 {
+		set = set[:i]
+	}
+	h.featureSet = string(set)
+	if h.sites != *sites || h.instances != *instances || h.open != *open ||
+		h.roffset != *roffset {
+		return nil, nil, fmt.Errorf("pack %s is for %dx%d+%d (offset %d), not %dx%d+%d (offset %d)",
+			name, h.sites, h.instances, h.open, h.roffset,
+			*sites, *instances, *open, *roffset)
+	}
+	if *featureSet != "" && *featureSet != h.featureSet {
+		return nil, nil, fmt.Errorf("expected feature set %s, got %s in pack %s",
+			*featureSet, h.featureSet, name)
+	}
+	*featureSet = h.featureSet
+	FeatNum = h.count
+
+	n := *sites**instances + *open
+	end := packHeaderSize + 4*n*FeatNum
+	if len(d) < end {
+		return nil, nil, fmt.Errorf("pack %s is truncated", name)
+	}
+	all := floats(d[packHeaderSize:end])
+	for i := 0; i < n; i++ {
+		f := all[i*FeatNum : (i+1)*FeatNum : (i+1)*FeatNum]
+		if i < *sites**instances {
+			feat = append(feat, f)
+		} else {
+			openfeat = append(openfeat, f)
+		}
+	}
+	featureFiles = strings.Split(string(d[end:]), "\n")
+	if len(featureFiles) != n {
+		return nil, nil, fmt.Errorf("pack %s has %d names for %d instances",
+			name, len(featureFiles), n)
+	}
+	for i := 0; i < *sites; i++ {
+		if site := monitoredSite(i); featureFiles[i**instances] !=
+			fmt.Sprintf("%d-0", site) {
+			return nil, nil, fmt.Errorf("pack %s has %s, not site %d, as monitored site %d",
+				name, featureFiles[i**instances], site, i)
+		}
+	}
+	return
+}
+
+// floats is d as float32 without copying, if the machine is little-endian
+func floats(d []byte) []float32 {
+	if len(d) == 0 {
+		return nil
+	}
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		return unsafe.Slice((*float32)(unsafe.Pointer(&d[0])), len(d)/4)
+	}
+	f := make([]float32, len(d)/4)
+	for i := range f {
+		f[i] = math.Float32frombits(binary.LittleEndian.Uint32(d[4*i:]))
+	}
+	return f
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/metrics"
+)
+
+// runProgress tracks the tested instances and finished folds of a run, for
+// ETAs, and the metrics of the finished folds, for the -progress file.  It
+// is safe for concurrent use.
+type runProgress struct {
+	sync.Mutex
+	start             time.Time
+	testing           time.Duration // spent testing before the current open world
+	testStart         time.Time     // of the current open world, zero if training
+	open              int
+	tested, total     int
+	folds, totalFolds int
+	partial           []partialPoint
+}
+
+// partialPoint is the metrics of the finished folds at a point, as in the
+// JSON results
+type partialPoint struct {
+	Pct     float64               `json:"pct"`
+	Load    string                `json:"load,omitempty"`
+	Folds   int                   `json:"folds"`
+	Attacks map[string]repMetrics `json:"attacks"`
+}
+
+// progressDoc is what is written to the -progress file
+type progressDoc struct {
+	Time       time.Time      `json:"time"`
+	State      string         `json:"state"` // training, testing or done
+	Open       int            `json:"open"`
+	Tested     int            `json:"tested"`
+	Total      int            `json:"total"`
+	Folds      int            `json:"folds"`
+	TotalFolds int            `json:"total_folds"`
+	Seconds    float64        `json:"seconds"`
+	ETASeconds float64        `json:"eta_seconds"` // -1 until known
+	Partial    []partialPoint `json:"partial,omitempty"`
+}
+
+// newRunProgress tracks a run testing total instances in totalFolds folds,
+// over every point and open-world size
+func newRunProgress(total, totalFolds int) *runProgress {
+	return &runProgress{start: time.Now(), total: total, totalFolds: totalFolds}
+}
+
+// startTesting marks the start of testing an open world of open sites
+// after training, with one partial point per simulation point
+func (p *runProgress) startTesting(open int, points []simPoint) {
+	p.Lock()
+	defer p.Unlock()
+	p.open = open
+	p.testStart = time.Now()
+	p.partial = make([]partialPoint, len(points))
+	for i, point := range points {
+		p.partial[i] = partialPoint{Pct: point.pct, Load: point.load}
+	}
+}
+
+// stopTesting marks the end of testing an open world
+func (p *runProgress) stopTesting() {
+	p.Lock()
+	defer p.Unlock()
+	p.testing += time.Since(p.testStart)
+	p.testStart = time.Time{}
+}
+
+// add marks n more instances as tested
+func (p *runProgress) add(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.tested += n
+}
+
+// foldDone marks a fold at point pctIndex as finished, with metrics of all
+// finished folds at the point, and logs the ETA of the run
+func (p *runProgress) foldDone(pctIndex int, took time.Duration,
+	attacks map[string]repMetrics) {
+	p.Lock()
+	defer p.Unlock()
+	p.folds++
+	p.partial[pctIndex].Folds++
+	p.partial[pctIndex].Attacks = attacks
+	logging.Infof("finished %d/%d folds (this one in %s), ETA %s", p.folds,
+		p.totalFolds, took.Round(time.Second), formatETA(p.eta()))
+}
+
+// eta estimates the time left from the testing rate so far, ignoring time
+// spent training, or -1 if nothing is tested yet
+func (p *runProgress) eta() time.Duration {
+	spent := p.testing
+	if !p.testStart.IsZero() {
+		spent += time.Since(p.testStart)
+	}
+	if p.tested == 0 || spent == 0 {
+		return -1
+	}
+	return time.Duration(float64(spent) / float64(p.tested) *
+		float64(p.total-p.tested))
+}
+
+func formatETA(eta time.Duration) string {
+	if eta < 0 {
+		return "unknown"
+	}
+	return eta.Round(time.Second).String()
+}
+
+// log logs how far the run has come
+func (p *runProgress) log() {
+	p.Lock()
+	defer p.Unlock()
+	logging.Infof("progress: tested %d/%d (%.1f%%) in %d/%d folds, ETA %s",
+		p.tested, p.total, float64(p.tested)/float64(p.total)*100, p.folds,
+		p.totalFolds, formatETA(p.eta()))
+}
+
+// write writes the progress to name, replacing it at once so that a poller
+// never reads a partial file
+func (p *runProgress) write(name string, done bool) error {
+	p.Lock()
+	doc := progressDoc{
+		Time:       time.Now(),
+		State:      "testing",
+		Open:       p.open,
+		Tested:     p.tested,
+		Total:      p.total,
+		Folds:      p.folds,
+		TotalFolds: p.totalFolds,
+		Seconds:    time.Since(p.start).Seconds(),
+		ETASeconds: p.eta().Seconds(),
+		Partial:    p.partial,
+	}
+	if p.testStart.IsZero() {
+		doc.State = "training"
+	}
+	if doc.ETASeconds < 0 {
+		doc.ETASeconds = -1
+	}
+	if done {
+		doc.State, doc.ETASeconds = "done", 0
+	}
+	d, err := json.MarshalIndent(doc, "", "  ")
+	p.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode progress (%s)", err)
+	}
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, d, 0666); err != nil {
+		return fmt.Errorf("failed to write progress (%s)", err)
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("failed to write progress (%s)", err)
+	}
+	return nil
+}
+
+// report logs the progress and writes the -progress file every interval
+// until stop is closed
+func (p *runProgress) report(interval time.Duration, file string,
+	stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.log()
+			if file != "" {
+				if err := p.write(file, false); err != nil {
+					logging.Warnf("%s", err)
+				}
+			}
+		}
+	}
+}
+
+// partialMetrics averages the metrics of each attack over the finished
+// folds in done
+func partialMetrics(results map[string][]metrics.Confusion,
+	done []bool) map[string]repMetrics {
+	partial := make(map[string]repMetrics)
+	for attack, m := range results {
+		var finished []metrics.Confusion
+		for fold, d := range done {
+			if d {
+				finished = append(finished, m[fold])
+			}
+		}
+		partial[attack] = repMetrics{
+			Recall:    metrics.Recall(finished),
+			Precision: metrics.Precision(finished),
+			F1:        metrics.F1(finished),
+			FPR:       metrics.FPR(finished),
+			Accuracy:  metrics.Accuracy(finished),
+		}
+	}
+	return partial
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pylls/defector/metrics"
+)
+
+// experiment is the JSON results document of a run, with everything needed
+// to know how the results were produced
+type experiment struct {
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Seconds      float64           `json:"seconds"`
+	TrainSeconds float64           `json:"train_seconds"` // of all folds
+	Args         []string          `json:"args"`
+	Flags        map[string]string `json:"flags"` // all, set or not
+	Seed         int64             `json:"seed"`
+	WF           string            `json:"wf"`
+	Monitored    string            `json:"monitored"`
+	Sites        []int             `json:"sites,omitempty"` // -monitored
+	Open         string            `json:"open"`
+	FeatureSet   string            `json:"feature_set"`
+	Dataset      string            `json:"dataset"`            // datasetHash()
+	DNS2site     string            `json:"dns2site,omitempty"` // source of metrics
+	Points       []experimentPoint `json:"points"`
+}
+
+// experimentPoint is the results of every attack at a percentage of Tor
+// exit bandwidth
+type experimentPoint struct {
+	Pct     float64                  `json:"pct"`
+	Load    string                   `json:"load,omitempty"` // label in -load
+	Rate    float64                  `json:"rate"`           // web circuits/s
+	Attacks map[string]attackResults `json:"attacks"`
+}
+
+// attackResults are averaged over the folds, as in the CSVs, and with
+// -simreps over the repetitions of the simulation, each in Reps, while the
+// counts of Folds are summed over repetitions
+type attackResults struct {
+	Recall    float64       `json:"recall"`
+	Precision float64       `json:"precision"`
+	F1        float64       `json:"f1"`
+	FPR       float64       `json:"fpr"`
+	Accuracy  float64       `json:"accuracy"`
+	Folds     []foldMetrics `json:"folds"`
+	Reps      []repMetrics  `json:"reps,omitempty"`
+}
+
+// repMetrics are averaged over the folds of a repetition of the simulation
+type repMetrics struct {
+	Recall    float64 `json:"recall"`
+	Precision float64 `json:"precision"`
+	F1        float64 `json:"f1"`
+	FPR       float64 `json:"fpr"`
+	Accuracy  float64 `json:"accuracy"`
+}
+
+type foldMetrics struct {
+	TP  int `json:"tp"`
+	FPP int `json:"fpp"`
+	FNP int `json:"fnp"`
+	FN  int `json:"fn"`
+	TN  int `json:"tn"`
+}
+
+// writeJSONResults fills in the flags and results of e, of an open world of
+// open sites, and writes it to name
+func writeJSONResults(name string, e experiment, open int,
+	results []map[string][]metrics.Confusion, // pctPoint -> map["attack"] -> [folds]metrics
+	repResults []map[string][][]metrics.Confusion, // pctPoint -> map["attack"] -> [simreps][folds]metrics
+	attacks []string, simPoints []simPoint) error {
+	e.Args = os.Args[1:]
+	e.Flags = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		e.Flags[f.Name] = f.Value.String()
+	})
+	e.Flags["open"] = strconv.Itoa(open) // of this experiment with -opensweep
+	e.Seed = *seed
+	e.WF = *wfAttack
+	e.Monitored = *mfolder
+	e.Sites = monitoredSites
+	e.Open = *ofolder
+	e.FeatureSet = *featureSet
+	for i := 0; i < len(results); i++ {
+		p := experimentPoint{
+			Pct:     simPoints[i].pct,
+			Load:    simPoints[i].load,
+			Rate:    simPoints[i].rate,
+			Attacks: make(map[string]attackResults),
+		}
+		for _, attack := range attacks {
+			m, reps := results[i][attack], repResults[i][attack]
+			r := attackResults{
+				Recall:    repMetric(metrics.Recall, m, reps),
+				Precision: repMetric(metrics.Precision, m, reps),
+				F1:        repMetric(metrics.F1, m, reps),
+				FPR:       repMetric(metrics.FPR, m, reps),
+				Accuracy:  repMetric(metrics.Accuracy, m, reps),
+			}
+			for _, f := range m {
+				r.Folds = append(r.Folds, foldMetrics{
+					TP: f.TP, FPP: f.FPP, FNP: f.FNP, FN: f.FN, TN: f.TN})
+			}
+			if *simReps > 1 {
+				for _, rm := range reps {
+					r.Reps = append(r.Reps, repMetrics{
+						Recall:    metrics.Recall(rm),
+						Precision: metrics.Precision(rm),
+						F1:        metrics.F1(rm),
+						FPR:       metrics.FPR(rm),
+						Accuracy:  metrics.Accuracy(rm),
+					})
+				}
+			}
+			p.Attacks[attack] = r
+		}
+		e.Points = append(e.Points, p)
+	}
+
+	d, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode results (%s)", err)
+	}
+	if err = ioutil.WriteFile(name, d, 0666); err != nil {
+		return fmt.Errorf("failed to write results %s (%s)", name, err)
+	}
+	return nil
+}
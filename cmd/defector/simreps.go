@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/pylls/defector/metrics"
+)
+
+// repRand is newRand for a repetition of the Tor network simulation, where
+// the first repetition gets the same randomness as without -simreps
+func repRand(rep int, parts ...int) *rand.Rand {
+	if rep == 0 {
+		return newRand(parts...)
+	}
+	return newRand(append(parts, -rep)...)
+}
+
+// simBand returns the mean of metric over the repetitions of the Tor
+// network simulation and its 95% band, by the percentiles of repetitions
+func simBand(metric func(data []metrics.Confusion) float64,
+	reps [][]metrics.Confusion) (mean, lo, hi float64) {
+	values := make([]float64, len(reps))
+	for r := range reps {
+		values[r] = metric(reps[r])
+		mean += values[r]
+	}
+	sort.Float64s(values)
+	// rounded, so few repetitions give the min and max
+	return mean / float64(len(values)),
+		values[int(math.Round(0.025*float64(len(values)-1)))],
+		values[int(math.Round(0.975*float64(len(values)-1)))]
+}
+
+// repMetric is metric of the results of an attack at a pctPoint, the mean
+// over the repetitions of the simulation with -simreps
+func repMetric(metric func(data []metrics.Confusion) float64, results []metrics.Confusion,
+	reps [][]metrics.Confusion) float64 {
+	if *simReps > 1 {
+		mean, _, _ := simBand(metric, reps)
+		return mean
+	}
+	return metric(results)
+}
+
+// sortedNeighbours returns the training instances of the fold sorted by
+// distance to test instance i, closest first and with ties to the lowest
+// index as by nearest(), so the close-the-world classes for every
+// repetition of the simulation are taken from one computation of the
+// distances with neighbourClasses
+func (a *knnAttack) sortedNeighbours(i int) []int {
+	distList := distances(i, a.feat, a.openfeat, a.weights, a.fold,
+		func(int) bool { return false })
+	var sorted []int
+	for j, d := range distList {
+		if d != math.MaxFloat64 {
+			sorted = append(sorted, j)
+		}
+	}
+	sort.SliceStable(sorted, func(x, y int) bool {
+		return distList[sorted[x]] < distList[sorted[y]]
+	})
+	return sorted
+}
+
+// neighbourClasses is classes() of the n closest instances in sorted that
+// are not ignored, filled up as by nearest() if there are too few
+func (a *knnAttack) neighbourClasses(sorted []int, n int,
+	ignore ignoreSite) []int {
+	indices := make([]int, 0, n)
+	taken := make(map[int]bool)
+	for _, j := range sorted {
+		if len(indices) == n {
+			break
+		}
+		if (j < len(a.feat) && !ignore(j / *instances)) ||
+			(j >= len(a.feat) && !ignore(j)) {
+			indices = append(indices, j)
+			taken[j] = true
+		}
+	}
+	for j := 0; len(indices) < n && j < len(a.feat)+len(a.openfeat); j++ {
+		if !taken[j] {
+			indices = append(indices, j)
+		}
+	}
+
+	classes := make([]int, len(indices))
+	for k, j := range indices {
+		classes[k] = trueClass(j)
+	}
+	return classes
+}
+
+// neighbourRank is rank() of the classes in sorted that are not ignored
+func (a *knnAttack) neighbourRank(sorted []int, ignore ignoreSite) []int {
+	var classes []int
+	ranked := make(map[int]bool)
+	for _, j := range sorted {
+		class := trueClass(j)
+		if ranked[class] || (j < len(a.feat) && ignore(j / *instances)) ||
+			(j >= len(a.feat) && ignore(j)) {
+			continue
+		}
+		ranked[class] = true
+		classes = append(classes, class)
+	}
+	return classes
+}
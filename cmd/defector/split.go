@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+	"github.com/pylls/defector/split"
+)
+
+// testFolds is the fold each instance, as in featureFiles, is tested in with
+// -split (split.Train for never), or nil to fold by the index of instances
+var testFolds []int
+
+// readSplit reads the split manifest in file and sets -folds from it,
+// refusing a split of another dataset than -mfolder unless -force
+func readSplit(file string) (*split.Split, error) {
+	s, err := split.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	// the dataset is only comparable when one folder has all samples
+	if info, err := os.Stat(*mfolder); s.Dataset != "" && *mfolder == *ofolder &&
+		err == nil && info.IsDir() {
+		dataset, err := provenance.SampleHash(*mfolder)
+		if err != nil {
+			return nil, err
+		}
+		if s.Dataset != dataset {
+			if !*force {
+				return nil, fmt.Errorf("the split %s is of another dataset than %s (use -force)",
+					file, *mfolder)
+			}
+			logging.Warnf("the split %s is of another dataset than %s, using it anyway",
+				file, *mfolder)
+		}
+	}
+	*folds = s.Folds
+	return s, nil
+}
+
+// splitFolds returns the fold each of the named instances is tested in by
+// split s, where every instance must be in s
+func splitFolds(s *split.Split, names []string) ([]int, error) {
+	tested := make([]int, len(names))
+	for i, name := range names {
+		fold, ok := s.Fold(name)
+		if !ok {
+			return nil, fmt.Errorf("instance %s is not in the split", name)
+		}
+		tested[i] = fold
+	}
+	return tested, nil
+}
+
+// testedInstances returns how many of the first n instances are tested in
+// some fold
+func testedInstances(n int) int {
+	if testFolds == nil {
+		return n
+	}
+	tested := 0
+	for _, fold := range testFolds[:n] {
+		if fold != split.Train {
+			tested++
+		}
+	}
+	return tested
+}
+
+// foldsHash is a hash of the fold each instance is tested in with -split,
+// or empty when folding by the index of instances
+func foldsHash() string {
+	if testFolds == nil {
+		return ""
+	}
+	h := sha256.New()
+	b := make([]byte, 8)
+	for _, fold := range testFolds {
+		binary.LittleEndian.PutUint64(b, uint64(int64(fold)))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// svmAttack is the CUMUL attack by Panchenko et al., but with a linear
+// multi-class SVM (Crammer and Singer) instead of an RBF kernel, trained
+// with Pegasos-style stochastic subgradient descent on the training
+// instances of a fold.  Features are scaled to [-1, 1].
+type svmAttack struct {
+	feat, openfeat [][]float32
+	min, scale     []float64
+	w              [][]float64 // per class (open world is *sites)
+	b              []float64
+}
+
+func trainSVM(feat, openfeat [][]float32, fold int,
+	rng *rand.Rand) *svmAttack {
+	a := &svmAttack{feat: feat, openfeat: openfeat}
+	var train []int // instances as in classify(), open world after feat
+	for i := range feat {
+		if !instanceForTesting(i, fold) {
+			train = append(train, i)
+		}
+	}
+	for i := range openfeat {
+		if !instanceForTesting(len(feat)+i, fold) {
+			train = append(train, len(feat)+i)
+		}
+	}
+
+	// scale by the training instances
+	a.min = make([]float64, FeatNum)
+	a.scale = make([]float64, FeatNum)
+	max := make([]float64, FeatNum)
+	for j := 0; j < FeatNum; j++ {
+		a.min[j], max[j] = math.Inf(1), math.Inf(-1)
+	}
+	for _, i := range train {
+		for j, v := range instanceFeatures(a.feat, a.openfeat, i) {
+			a.min[j] = math.Min(a.min[j], float64(v))
+			max[j] = math.Max(max[j], float64(v))
+		}
+	}
+	for j := range a.scale {
+		if max[j] > a.min[j] {
+			a.scale[j] = 2 / (max[j] - a.min[j])
+		}
+	}
+
+	a.w = make([][]float64, *sites+1)
+	for c := range a.w {
+		a.w[c] = make([]float64, FeatNum)
+	}
+	a.b = make([]float64, *sites+1)
+	if len(train) == 0 {
+		return a
+	}
+
+	// w = s*v, so the regularization step is O(1)
+	s := 1.0
+	x := make([]float64, FeatNum)
+	scores := make([]float64, *sites+1)
+	t := 0
+	for epoch := 0; epoch < *svmEpochs; epoch++ {
+		for _, p := range rng.Perm(len(train)) {
+			t++
+			i := train[p]
+			y := trueClass(i)
+			a.scaled(i, x)
+			eta := 1 / (*svmLambda * float64(t+1))
+			s *= 1 - eta**svmLambda
+			for c := range scores {
+				scores[c] = s*dot(a.w[c], x) + a.b[c]
+			}
+			// the highest scoring wrong class
+			r := -1
+			for c := range scores {
+				if c != y && (r == -1 || scores[c] > scores[r]) {
+					r = c
+				}
+			}
+			if scores[y]-scores[r] < 1 {
+				for j := range x {
+					a.w[y][j] += eta / s * x[j]
+					a.w[r][j] -= eta / s * x[j]
+				}
+				a.b[y] += eta
+				a.b[r] -= eta
+			}
+			if s < 1e-9 {
+				a.rescale(s)
+				s = 1
+			}
+		}
+	}
+	a.rescale(s)
+	return a
+}
+
+// scaled writes the scaled features of instance i to x
+func (a *svmAttack) scaled(i int, x []float64) {
+	for j, v := range instanceFeatures(a.feat, a.openfeat, i) {
+		x[j] = (float64(v)-a.min[j])*a.scale[j] - 1
+	}
+}
+
+func (a *svmAttack) rescale(s float64) {
+	for c := range a.w {
+		for j := range a.w[c] {
+			a.w[c][j] *= s
+		}
+	}
+}
+
+func (a *svmAttack) classes(i, n int, ignore ignoreSite) ([]int, int) {
+	x := make([]float64, FeatNum)
+	a.scaled(i, x)
+	best := *sites // the open world is never ignored
+	bestScore := dot(a.w[best], x) + a.b[best]
+	for c := 0; c < *sites; c++ {
+		if ignore(c) {
+			continue
+		}
+		if score := dot(a.w[c], x) + a.b[c]; score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return sameClass(best, n), trueClass(i)
+}
+
+func (a *svmAttack) rank(i int, ignore ignoreSite) []int {
+	x := make([]float64, FeatNum)
+	a.scaled(i, x)
+	scores := make([]float64, *sites+1)
+	for c := range scores {
+		scores[c] = dot(a.w[c], x) + a.b[c]
+	}
+	return rankByScore(scores, ignore)
+}
+
+func (a *svmAttack) closeWorld(ignore ignoreSite) baseAttack {
+	return a // classes() already only picks from sites not ignored
+}
+
+func dot(a, b []float64) (d float64) {
+	for i := range a {
+		d += a[i] * b[i]
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/metrics"
+)
+
+// sweepResults are the results of an open-world size of -opensweep
+type sweepResults struct {
+	open       int
+	results    []map[string][]metrics.Confusion   // pctPoint -> map["attack"] -> [folds]metrics
+	repResults []map[string][][]metrics.Confusion // pctPoint -> map["attack"] -> [simreps][folds]metrics
+	attacks    []string
+}
+
+// parseSweep parses "min,max,step" into min, min+step, ... up to max
+func parseSweep(sweep string) (values []int, err error) {
+	tokens := strings.Split(sweep, ",")
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("malformed sweep %q, need min,max,step", sweep)
+	}
+	var v [3]int
+	for i, t := range tokens {
+		if v[i], err = strconv.Atoi(strings.TrimSpace(t)); err != nil {
+			return nil, fmt.Errorf("failed to parse sweep %q (%s)", sweep, err)
+		}
+	}
+	min, max, step := v[0], v[1], v[2]
+	if min < 0 || max < min || step < 1 {
+		return nil, fmt.Errorf("invalid sweep %q", sweep)
+	}
+	for n := min; n <= max; n += step {
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+// writeSweepCSV writes the metrics of every attack at every point for each
+// open-world size of the sweep, a row each
+func writeSweepCSV(location string, sweep []sweepResults,
+	simPoints []simPoint) {
+	output := "open," + pointHeader() + ",attack,recall,precision,f1score,fpr,accuracy\n"
+	for _, s := range sweep {
+		for i := range simPoints {
+			for _, attack := range s.attacks {
+				m, reps := s.results[i][attack], s.repResults[i][attack]
+				output += fmt.Sprintf("%d,%s,%s,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+					s.open, simPoints[i].label(), attack,
+					repMetric(metrics.Recall, m, reps), repMetric(metrics.Precision, m, reps),
+					repMetric(metrics.F1, m, reps), repMetric(metrics.FPR, m, reps),
+					repMetric(metrics.Accuracy, m, reps))
+			}
+		}
+	}
+	writeResults(output, location)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// rankOf is the index of class in ranked, -1 if not ranked
+func rankOf(class int, ranked []int) int {
+	for r, c := range ranked {
+		if c == class {
+			return r
+		}
+	}
+	return -1
+}
+
+// writeTopKCSV writes the top-1 to top-k accuracy of each ranking at each
+// pctPoint, where topk[i][ranking] is the hits at each rank followed by the
+// number of tested instances, summed over the -simreps repetitions as
+// every repetition tests the same instances
+func writeTopKCSV(location string, topk []map[string][]int, simPoints []simPoint) {
+	output := pointHeader() + ",ranking"
+	for k := 1; k <= *topK; k++ {
+		output += fmt.Sprintf(",top%d", k)
+	}
+	output += "\n"
+	for i := 0; i < len(topk); i++ {
+		var rankings []string
+		for ranking := range topk[i] {
+			rankings = append(rankings, ranking)
+		}
+		sort.Strings(rankings)
+		for _, ranking := range rankings {
+			hits := topk[i][ranking]
+			output += fmt.Sprintf("%s,%s", simPoints[i].label(), ranking)
+			cumulative := 0
+			for k := 0; k < *topK; k++ {
+				cumulative += hits[k]
+				output += fmt.Sprintf(",%.3f",
+					float64(cumulative)/float64(hits[*topK]))
+			}
+			output += "\n"
+		}
+	}
+
+	writeResults(output, location)
+}
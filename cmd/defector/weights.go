@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"github.com/pylls/defector/logging"
+)
+
+// savedWeights are the learned Wa-kNN weights of every fold, only valid for
+// the same dataset, folds and rounds of weight learning
+type savedWeights struct {
+	Dataset      string      `json:"dataset"` // datasetHash()
+	FeatureSet   string      `json:"feature_set"`
+	Folds        int         `json:"folds"`
+	Split        string      `json:"split,omitempty"` // foldsHash()
+	WeightRounds int         `json:"weight_rounds"`
+	Weights      [][]float64 `json:"weights"` // per fold
+}
+
+// datasetHash is a hash of the features of all instances, in order, and
+// how they were picked
+func datasetHash(feat, openfeat [][]float32) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %d %d %d %s\n", *sites, *instances, len(openfeat), *roffset,
+		*featureSet)
+	b := make([]byte, 4)
+	for _, features := range [][][]float32{feat, openfeat} {
+		for _, f := range features {
+			for _, v := range f {
+				binary.LittleEndian.PutUint32(b, math.Float32bits(v))
+				h.Write(b)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func saveWeights(name, dataset string, weights [][]float64) error {
+	d, err := json.Marshal(savedWeights{
+		Dataset:      dataset,
+		FeatureSet:   *featureSet,
+		Folds:        *folds,
+		Split:        foldsHash(),
+		WeightRounds: *weightRounds,
+		Weights:      weights,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode weights (%s)", err)
+	}
+	if err = ioutil.WriteFile(name, d, 0666); err != nil {
+		return fmt.Errorf("failed to write weights %s (%s)", name, err)
+	}
+	return nil
+}
+
+// loadWeights returns the weights per fold in name, if they were learned
+// for dataset with the same folds (and -split) and rounds as now
+func loadWeights(name, dataset string) ([][]float64, error) {
+	d, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read weights (%s)", err)
+	}
+	var s savedWeights
+	if err = json.Unmarshal(d, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse weights %s (%s)", name, err)
+	}
+	switch {
+	case s.Dataset != dataset && !*force:
+		return nil, fmt.Errorf("weights in %s are for another dataset (use -force)", name)
+	case s.Folds != *folds || len(s.Weights) != *folds:
+		return nil, fmt.Errorf("weights in %s are for %d folds, not %d",
+			name, s.Folds, *folds)
+	case s.Split != foldsHash():
+		return nil, fmt.Errorf("weights in %s are for other folds than -split", name)
+	case s.WeightRounds != *weightRounds:
+		return nil, fmt.Errorf("weights in %s are from %d rounds, not %d",
+			name, s.WeightRounds, *weightRounds)
+	}
+	if s.Dataset != dataset {
+		logging.Warnf("weights in %s are for another dataset, using them anyway", name)
+	}
+	for fold, w := range s.Weights {
+		if len(w) != FeatNum {
+			return nil, fmt.Errorf("weights in %s for fold %d have %d features, not %d",
+				name, fold, len(w), FeatNum)
+		}
+	}
+	return s.Weights, nil
+}
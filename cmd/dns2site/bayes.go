@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+
+	"github.com/pylls/defector/intern"
+)
+
+// bayesModel is a multinomial Naive Bayes model over the domains present
+// in a sample, with a class per monitored site and a background class (-1)
+// for all unmonitored sites, estimated from the open world.  Only present
+// domains count, so sites with few training samples are not penalized for
+// every domain they lack.  It is saved with -save as a savedBayes.
+type bayesModel struct {
+	Classes    map[int]*bayesClass
+	Vocabulary map[uint32]bool // all domains in training
+	Samples    int
+}
+
+type bayesClass struct {
+	Samples int
+	Domains map[uint32]int // samples with the domain
+	Total   int            // sum of Domains
+}
+
+// p is P(domain | class) with Laplace smoothing
+func (m *bayesModel) p(c *bayesClass, domain uint32) float64 {
+	return (float64(c.Domains[domain]) + 1) /
+		(float64(c.Total) + float64(len(m.Vocabulary)))
+}
+
+func getBayes(data map[int][]sample,
+	forTesting func(int, int) bool,
+	unmonitored func(int) bool) *bayesModel {
+	m := &bayesModel{
+		Classes:    make(map[int]*bayesClass),
+		Vocabulary: make(map[uint32]bool),
+	}
+	for site, samples := range data {
+		class := site
+		if unmonitored(site) {
+			class = -1
+		}
+		for samp, s := range samples {
+			if forTesting(site, samp) {
+				continue
+			}
+			c, exists := m.Classes[class]
+			if !exists {
+				c = &bayesClass{Domains: make(map[uint32]int)}
+				m.Classes[class] = c
+			}
+			c.Samples++
+			m.Samples++
+			for _, domain := range s.domains {
+				c.Domains[domain]++
+				c.Total++
+				m.Vocabulary[domain] = true
+			}
+		}
+	}
+	return m
+}
+
+// posteriors returns P(class | domains) for every class, where domains not
+// in the vocabulary are ignored.  The prior of a class is its share of the
+// training samples, times its -prior factor.
+func (m *bayesModel) posteriors(domains intern.Set) map[int]float64 {
+	logs := make(map[int]float64)
+	max := math.Inf(-1)
+	for class, c := range m.Classes {
+		l := math.Log(float64(c.Samples) / float64(m.Samples) * prior.factor(class))
+		for _, d := range domains {
+			if m.Vocabulary[d] {
+				l += math.Log(m.p(c, d))
+			}
+		}
+		logs[class] = l
+		if l > max {
+			max = l
+		}
+	}
+
+	// normalize with the log-sum-exp trick
+	var sum float64
+	for _, l := range logs {
+		sum += math.Exp(l - max)
+	}
+	post := make(map[int]float64)
+	for class, l := range logs {
+		post[class] = math.Exp(l-max) / sum
+	}
+	return post
+}
+
+// classifyBayes picks the most probable class, which is unmonitored (-1) if
+// the background class wins, scored by its posterior probability
+func classifyBayes(domains intern.Set, fps fingerprints) (class int,
+	score float64) {
+	if fps.bayes == nil || len(fps.bayes.Classes) == 0 {
+		return -1, 0
+	}
+	return best(fps.bayes.posteriors(domains))
+}
+
+// scoreBayes is the posterior probability of every monitored site
+func scoreBayes(domains intern.Set,
+	fps fingerprints) (scores map[int]float64) {
+	scores = make(map[int]float64)
+	if fps.bayes == nil || len(fps.bayes.Classes) == 0 {
+		return
+	}
+	for class, p := range fps.bayes.posteriors(domains) {
+		if class != -1 {
+			scores[class] = p
+		}
+	}
+	return
+}
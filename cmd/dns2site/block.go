@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/metrics"
+)
+
+// readBlocklist reads the domains to block from name, with a domain per
+// line (where empty lines and lines starting with # are ignored) or as a
+// CSV file with a header with a "domain" column, e.g., gain.csv or
+// discriminating.csv of dnsstats.  If top is positive, only the first top
+// domains are read.
+func readBlocklist(name string, top int) (map[string]bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blocklist (%s)", err)
+	}
+	defer f.Close()
+
+	var list []string
+	scanner := bufio.NewScanner(f)
+	column := -1 // of the domain in a CSV file
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+		if first && strings.Contains(line, ",") {
+			header, err := csv.NewReader(strings.NewReader(line)).Read()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse blocklist header (%s)", err)
+			}
+			for i, h := range header {
+				if strings.TrimSpace(h) == "domain" {
+					column = i
+				}
+			}
+			if column == -1 {
+				return nil, fmt.Errorf("blocklist %s has no domain column", name)
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if column >= 0 {
+			record, err := csv.NewReader(strings.NewReader(line)).Read()
+			if err != nil || column >= len(record) {
+				return nil, fmt.Errorf("failed to parse blocklist line %q", line)
+			}
+			line = record[column]
+		}
+		list = append(list, strings.TrimSuffix(strings.ToLower(line), "."))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocklist (%s)", err)
+	}
+	if top > 0 && len(list) > top {
+		list = list[:top]
+	}
+	blocked := make(map[string]bool)
+	for _, domain := range list {
+		blocked[domain] = true
+	}
+	return blocked, nil
+}
+
+// blockDomains returns a copy of data without the requests for blocked
+// domains, and the number of requests removed
+func blockDomains(data map[int][]sample, blocked map[string]bool) (map[int][]sample, int) {
+	out := make(map[int][]sample, len(data))
+	removed := 0
+	for site, samples := range data {
+		out[site] = make([]sample, len(samples))
+		for i, s := range samples {
+			b := sample{name: s.name, epoch: s.epoch, index: s.index}
+			for _, req := range s.requests {
+				if blocked[strings.TrimSuffix(strings.ToLower(req.domain), ".")] {
+					removed++
+					continue
+				}
+				b.requests = append(b.requests, req)
+			}
+			internSample(&b)
+			out[site][i] = b
+		}
+	}
+	return out, removed
+}
+
+// blockImpact evaluates the classifiers again on data without the blocked
+// domains, on the same folds, and logs the impact on how many monitored
+// sites have unique domains and on the results of each classifier
+func blockImpact(data map[int][]sample, blocked map[string]bool,
+	classifiers []classifier, results [][]metrics.Confusion,
+	forFold, notTraining func(int) func(int, int) bool,
+	notTrained func(int, int) bool, unmonitored func(int) bool) {
+	without, removed := blockDomains(data, blocked)
+	total, empty := 0, 0
+	for _, samples := range data {
+		for _, s := range samples {
+			total += len(s.requests)
+		}
+	}
+	for _, samples := range without {
+		for _, s := range samples {
+			if len(s.domains) == 0 {
+				empty++
+			}
+		}
+	}
+	logging.Infof("blocking removed %d of %d requests, %d samples have no domains left",
+		removed, total, empty)
+	_, before := getUniqueDomainsToSite(data, notTrained, unmonitored)
+	_, after := getUniqueDomainsToSite(without, notTrained, unmonitored)
+	logging.Infof("%d of %d monitored sites have unique domains, %d with blocking",
+		len(before), *sites, len(after))
+
+	logging.Infof("performing %d-fold cross-validation with blocking", *folds)
+	blockedResults, _ := crossValidate(without, classifiers, forFold, notTraining,
+		unmonitored)
+	for i, c := range classifiers {
+		r, b := results[i], blockedResults[i]
+		logging.Infof("%s with blocking: %.3f recall (%+.3f), %.3f precision (%+.3f), %.3f FPR (%+.3f), %.3f accuracy (%+.3f)",
+			c.name, metrics.Recall(b), metrics.Recall(b)-metrics.Recall(r),
+			metrics.Precision(b), metrics.Precision(b)-metrics.Precision(r),
+			metrics.FPR(b), metrics.FPR(b)-metrics.FPR(r),
+			metrics.Accuracy(b), metrics.Accuracy(b)-metrics.Accuracy(r))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+)
+
+// writeConfusion writes dir/<name>.confusion.csv, a sparse confusion matrix
+// of the true and predicted site of every test sample, where unmonitored
+// sites are -1, with one line per non-zero cell
+func writeConfusion(dir, name string, results []scored, threshold float64,
+	unmonitoredSite func(int) bool) error {
+	cells := make(map[[2]int]int)
+	for _, r := range results {
+		trueclass, class := r.site, r.class
+		if unmonitoredSite(trueclass) {
+			trueclass = -1
+		}
+		if r.score < threshold {
+			class = -1
+		}
+		cells[[2]int{trueclass, class}]++
+	}
+
+	var keys [][2]int
+	for key := range cells {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	out := "true,predicted,count\n"
+	for _, key := range keys {
+		out += fmt.Sprintf("%d,%d,%d\n", key[0], key[1], cells[key])
+	}
+	file := path.Join(dir, name+".confusion.csv")
+	if err := ioutil.WriteFile(file, []byte(out), 0666); err != nil {
+		return fmt.Errorf("failed to write %s (%s)", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/pylls/defector/intern"
+)
+
+// defense models simple DNS-level defenses applied to the observed domains
+// of a visit before classification: stripping the rarest domains (e.g., by
+// not resolving them over DNS) and padding with dummy lookups of domains
+// drawn from a popularity distribution
+type defense struct {
+	strip int                // rarest domains to remove
+	pad   int                // dummy domains to add
+	idf   map[uint32]float64 // of the domains in training
+
+	// the domains in training, most popular first, and the cumulative
+	// weight of drawing each of them
+	vocabulary []uint32
+	cumulative []float64
+}
+
+// newDefense returns nil if there is nothing to do.  dist is "uniform" over
+// the domains seen in training, "df" proportional to the fraction of sites a
+// domain is on, or "zipf" with exponent alpha over domains ranked by that
+// fraction.
+func newDefense(strip, pad int, dist string, alpha float64,
+	fps fingerprints) (*defense, error) {
+	if strip <= 0 && pad <= 0 {
+		return nil, nil
+	}
+	d := &defense{strip: strip, pad: pad, idf: fps.idf}
+	if pad <= 0 {
+		return d, nil
+	}
+
+	for domain := range fps.idf {
+		d.vocabulary = append(d.vocabulary, domain)
+	}
+	sort.Slice(d.vocabulary, func(i, j int) bool {
+		a, b := fps.idf[d.vocabulary[i]], fps.idf[d.vocabulary[j]]
+		if a != b {
+			return a < b
+		}
+		return domainIDs.Name(d.vocabulary[i]) < domainIDs.Name(d.vocabulary[j])
+	})
+	var sum float64
+	for i, domain := range d.vocabulary {
+		switch dist {
+		case "uniform":
+			sum++
+		case "df":
+			sum += math.Exp(-fps.idf[domain])
+		case "zipf":
+			sum += math.Pow(float64(i+1), -alpha)
+		default:
+			return nil, fmt.Errorf("unknown padding distribution %q (uniform, df or zipf)",
+				dist)
+		}
+		d.cumulative = append(d.cumulative, sum)
+	}
+	return d, nil
+}
+
+// apply strips and then pads domains, returning a new set
+func (d *defense) apply(domains intern.Set, rng *rand.Rand) intern.Set {
+	if d == nil {
+		return domains
+	}
+	kept := append([]uint32(nil), domains...)
+	if d.strip > 0 {
+		// rarest first, where domains not seen in training are the rarest
+		sort.Slice(kept, func(i, j int) bool {
+			a, b := d.rarity(kept[i]), d.rarity(kept[j])
+			if a != b {
+				return a > b
+			}
+			return domainIDs.Name(kept[i]) < domainIDs.Name(kept[j])
+		})
+		if d.strip < len(kept) {
+			kept = kept[d.strip:]
+		} else {
+			kept = nil
+		}
+	}
+
+	if n := len(d.cumulative); n > 0 {
+		for i := 0; i < d.pad; i++ {
+			r := rng.Float64() * d.cumulative[n-1]
+			kept = append(kept, d.vocabulary[sort.SearchFloat64s(d.cumulative, r)])
+		}
+	}
+	return intern.NewSet(kept)
+}
+
+// rarity is the IDF of domain, or +Inf if it was not seen in training
+func (d *defense) rarity(domain uint32) float64 {
+	if idf, exists := d.idf[domain]; exists {
+		return idf
+	}
+	return math.Inf(1)
+}
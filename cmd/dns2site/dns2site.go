@@ -1,7 +1,8 @@
 /*
 Package main implements a naive dns2site classifier and evalutes it.  Observing
 DNS requests is surprisingly useful for determining visited websites.
-The tool operates on ".dns" files from the extractdns tool.
+The tool operates on ".dns" files from the extractdns tool.  See README.md
+for the classifiers, how they are evaluated and the files written.
 */
 package main
 
@@ -9,49 +10,59 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/domains"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/intern"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/metrics"
+	"github.com/pylls/defector/provenance"
+	"github.com/pylls/defector/split"
 )
 
 type sample struct {
+	name     string // site-instance, e.g., 1-0, or site-instance-epoch
+	epoch    int
+	index    int // of the sample among those of its site in its epoch
 	requests []request
+	domains  intern.Set // distinct domains of the requests
 }
 
 type request struct {
 	domain string
+	id     uint32 // of domain in domainIDs, once interned
 	ttl    int
 	ips    []string
+	time   float64 // seconds since the epoch, 0 if unknown (v1 .dns)
 }
 
 type fingerprints struct {
-	uniqueDomainToSite map[string]int
-	commonDomains      map[int][]string
-}
-
-type metrics struct {
-	// see http://www.cs.kau.se/pulls/hot/measurements/
-	tp  int // true positive
-	fpp int // false-positive-to-positive
-	fnp int // false-negative-to-positive
-	fn  int // false negative
-	tn  int // true negative
+	uniqueDomainToSite map[uint32]int
+	commonDomains      map[int]intern.Set
+	profiles           map[int]intern.Set // all domains of a site
+	sketches           map[int]minHash    // of profiles, with -minhash
+	idf                map[uint32]float64 // inverse site frequency
+	bayes              *bayesModel
+	index              *siteIndex // of the above, for classification
 }
 
 type work struct {
-	reqs []request
-	site int
+	reqs   []request
+	site   int
+	sample int
 }
 
-const (
-	torMinTTL = 60
-	torMaxTTL = 30 * 60
-)
-
 var (
 	torTTL    = flag.Bool("t", true, "set the DNS TTL to Tor [min,max]")
+	torMinTTL = flag.Int("ttlmin", 60, "the min TTL of Tor, with -t")
+	torMaxTTL = flag.Int("ttlmax", 30*60, "the max TTL of Tor, with -t")
 	sites     = flag.Int("sites", 1000, "max sites to load")
 	instances = flag.Int("instances", 0, "number of instances per site")
 	open      = flag.Int("open", -1, "number of open-world sites")
@@ -59,64 +70,411 @@ var (
 
 	useCommon = flag.Bool("common", false,
 		"use common domains in classification")
+	excludeFile = flag.String("exclude", "",
+		"file with glob or re: patterns of domains to ignore, one per line")
+	collapseMode = flag.String("collapse", "",
+		"collapse subdomains: \"label\" strips the leading label, \"digits\" digit runs")
+	saveFile = flag.String("save", "",
+		"after cross-validation, train on all data and save the fingerprints")
+	loadFile = flag.String("load", "",
+		"classify all data with saved fingerprints instead of cross-validation")
+	simMeasure = flag.String("similarity", "jaccard",
+		"the similarity of domain sets for the jaccard classifier: jaccard or overlap")
+	simThreshold = flag.Float64("simthreshold", 0.5,
+		"the minimum similarity for the jaccard classifier to pick a site")
+	tfidfThreshold = flag.Float64("tfidfthreshold", 0.5,
+		"the minimum cosine similarity for the tfidf classifier to pick a site")
+	bayesThreshold = flag.Float64("bayesthreshold", 0,
+		"the minimum posterior probability for the bayes classifier to pick a site")
+	classifierList = flag.String("classifier", "unique,jaccard,tfidf,bayes",
+		"comma-separated classifiers to evaluate: unique, jaccard, tfidf, bayes")
+	prDir = flag.String("prdir", "",
+		"write a precision-recall curve over thresholds per classifier to this folder")
+	siteDir = flag.String("sitedir", "",
+		"write the per-site results of each fold per classifier to this folder")
+	confusionDir = flag.String("confusion", "",
+		"write a sparse confusion matrix per classifier to this folder")
+	serveAddr = flag.String("serve", "",
+		"with -load, serve classifications by the first -classifier over HTTP on this address")
+	folds = flag.Int("folds", 0,
+		"the number of folds for cross-validation (0 for one per sample)")
+	splitFile = flag.String("split", "",
+		"read the fold of every sample from this split manifest, e.g., from split")
+	force = flag.Bool("force", false,
+		"use a -split of another dataset, only warning about it")
+	seed = flag.Int64("seed", 0,
+		"the seed for randomness, e.g., folding open-world sites (0 for time)")
+	observeMode = flag.String("observe", "",
+		"at test time, only observe uncached domains: \"flat\" or \"ttl\" (if empty, all)")
+	observeP = flag.Float64("observep", 0.5,
+		"the probability of observing a domain with -observe flat")
+	cacheRate = flag.Float64("cacherate", 0.01,
+		"lookups/s at the exit of a domain on every site with -observe ttl")
+	streamFiles = flag.String("stream", "",
+		"comma-separated .dns files to merge into a stream and classify per window")
+	windowSize = flag.Float64("window", 10,
+		"the size in seconds of the windows to classify with -stream")
+	windowStep = flag.Float64("step", 5,
+		"the seconds between the start of windows with -stream")
+	streamDir = flag.String("streamdir", "",
+		"write the classes of each window of -stream per classifier to this folder")
+	multiLabel = flag.Bool("multilabel", false,
+		"also output every site at or above the threshold, with multi-label metrics")
+	metricsFile = flag.String("metrics", "",
+		"write the metrics of each classifier as JSON to this file, e.g., for defector")
+	priorSpec = flag.String("prior", "",
+		"weigh scores by popularity: \"rank\" (site i is rank i) or a site,popularity file")
+	priorWeight = flag.Float64("priorweight", 0.1,
+		"the exponent of the relative popularity of a site with -prior")
+	bloomFP = flag.Float64("bloom", 0,
+		"find unique domains with a Bloom filter of open-world domains with this FP rate (0 for exact)")
+	minHashes = flag.Int("minhash", 0,
+		"estimate similarity for -classifier jaccard with MinHash sketches of this many hashes (0 for exact)")
+	stripCount = flag.Int("strip", 0,
+		"defense: remove the k rarest domains of each test sample")
+	padCount = flag.Int("pad", 0,
+		"defense: add k dummy domains to each test sample")
+	padDist = flag.String("paddist", "df",
+		"the distribution of -pad domains: uniform, df (by site frequency) or zipf")
+	padAlpha = flag.Float64("padalpha", 1,
+		"the exponent of -paddist zipf")
+	trainEpochList = flag.String("trainepochs", "",
+		"train on the samples of these epochs, e.g., 0,2-4 (with -testepochs)")
+	testEpochList = flag.String("testepochs", "",
+		"test on the samples of these epochs, e.g., 3 (with -trainepochs)")
+	openSample = flag.Bool("opensample", false,
+		"sample the open-world sites by power-law popularity instead of taking the first")
+	tiePolicy = flag.String("ties", "rank",
+		"how to pick among sites with the same best score: rank, reject or popularity")
+	blockFile = flag.String("block", "",
+		"evaluate again without the domains in this file, one per line or a CSV with a domain column")
+	blockTop = flag.Int("blocktop", 0,
+		"with -block, only block the first domains of the file (0 means all)")
+	stalenessFile = flag.String("staleness", "",
+		"train on each epoch and test on it and every later one, writing the metrics to this CSV file")
 	sampleCount int
+	domainIDs   = intern.New() // of every domain of samples and fingerprints
+	prior       *popularityPrior
+	obs         *observer
+	exclude     *domains.Exclusions
+	collapse    *domains.Collapser
+	trainEpochs epoch.Set // nil if all
+	testEpochs  epoch.Set
+	byEpoch     bool // read -instances samples per epoch
+	blocked     map[string]bool
+	openWorld   map[int]bool // with -opensample, the unmonitored sites to read
 )
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
-	flag.Parse()
-	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify data dir")
+	provenance.RegisterFlags()
+	config.Parse("dns2site")
+	provenance.Init("dns2site")
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rand.Seed(*seed)
+	if err := provenance.Update(); err != nil {
+		logging.Fatal(err)
+	}
+	if *bloomFP < 0 || *bloomFP >= 1 {
+		logging.Fatal("-bloom must be in [0, 1)")
+	}
+	switch *padDist {
+	case "uniform", "df", "zipf":
+	default:
+		logging.Fatalf("unknown padding distribution %q (uniform, df or zipf)", *padDist)
+	}
+	if err := checkTiePolicy(*tiePolicy); err != nil {
+		logging.Fatal(err)
+	}
+	logging.Infof("breaking ties by %s", *tiePolicy)
+	if *streamFiles != "" && (*windowSize <= 0 || *windowStep <= 0) {
+		logging.Fatal("-window and -step must be positive")
+	}
+	if len(flag.Args()) == 0 && *serveAddr == "" &&
+		(*streamFiles == "" || *loadFile == "") {
+		logging.Fatal("need to specify data dir")
+	}
+	var err error
+	if *excludeFile != "" {
+		if exclude, err = domains.ReadExclusions(*excludeFile); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("excluding domains matching %s", *excludeFile)
+	}
+	if collapse, err = domains.NewCollapser(*collapseMode); err != nil {
+		logging.Fatal(err)
+	}
+	if *blockFile != "" {
+		if blocked, err = readBlocklist(*blockFile, *blockTop); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("evaluating the impact of blocking %d domains of %s",
+			len(blocked), *blockFile)
+	}
+	if trainEpochs, err = epoch.Parse(*trainEpochList); err != nil {
+		logging.Fatal(err)
 	}
-	log.Printf("getting list of files in %s", flag.Arg(0))
+	if testEpochs, err = epoch.Parse(*testEpochList); err != nil {
+		logging.Fatal(err)
+	}
+	if (trainEpochs == nil) != (testEpochs == nil) {
+		logging.Fatal("need to specify both -trainepochs and -testepochs")
+	}
+	byEpoch = trainEpochs != nil || *stalenessFile != ""
+	if byEpoch && *splitFile != "" {
+		logging.Fatal("-split does not support epochs")
+	}
+	if trainEpochs != nil && *stalenessFile == "" {
+		logging.Infof("training on epochs %s, testing on epochs %s",
+			*trainEpochList, *testEpochList)
+	}
+	if obs, err = newObserver(*observeMode, *observeP, *cacheRate); err != nil {
+		logging.Fatal(err)
+	}
+	if prior, err = newPrior(*priorSpec, *priorWeight); err != nil {
+		logging.Fatal(err)
+	}
+	if prior != nil {
+		logging.Infof("weighing scores by %s popularity to the power of %.2f",
+			*priorSpec, *priorWeight)
+	}
+	classifiers, err := getClassifiers(*classifierList)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	for _, c := range classifiers {
+		// every class has a positive posterior, so all would be labels
+		if *multiLabel && c.name == "bayes" && *bayesThreshold <= 0 {
+			logging.Fatal("-multilabel with bayes needs a positive -bayesthreshold, e.g., 0.1")
+		}
+	}
+	var loaded fingerprints
+	if *loadFile != "" {
+		loaded, *sites, err = loadFingerprints(*loadFile)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("loaded fingerprints of %d monitored sites from %s",
+			*sites, *loadFile)
+	}
+	if *serveAddr != "" {
+		if *loadFile == "" {
+			logging.Fatal("need to -load fingerprints to serve")
+		}
+		serve(*serveAddr, loaded, classifiers[0])
+		return
+	}
+	var stream []streamed
+	if *streamFiles != "" {
+		if stream, err = readStream(strings.Split(*streamFiles, ",")); err != nil {
+			logging.Fatal(err)
+		}
+		if *loadFile != "" {
+			err = classifyStream(stream, loaded, classifiers,
+				func(site int) bool { return site > *sites })
+			if err != nil {
+				logging.Fatal(err)
+			}
+			return
+		}
+	}
+	logging.Infof("getting list of files in %s", flag.Arg(0))
 	files, er := ioutil.ReadDir(flag.Arg(0))
 	if er != nil {
-		log.Fatalf("failed to read data dir (%s)", er)
+		logging.Fatalf("failed to read data dir (%s)", er)
 	}
 
-	log.Printf("mapping: unique domains and common domains [%v] with %d votes",
+	logging.Infof("mapping: unique domains and common domains [%v] with %d votes",
 		*useCommon, *k)
 
 	if *open == -1 {
-		log.Printf("estimating open-world to match powerlaw and %dx%d monitored",
+		logging.Infof("estimating open-world to match powerlaw and %dx%d monitored",
 			*sites, *instances)
 		estimateOpenSize()
-		log.Printf("estimated open-world %d", *open)
+		logging.Infof("estimated open-world %d", *open)
 	}
 
-	log.Printf("attempting to read %dx%d+%d sites", *sites, *instances, *open)
+	if *openSample {
+		openWorld = sampleOpenWorld(files, *open, rand.New(rand.NewSource(*seed)))
+		logging.Infof("sampled %d open-world sites by popularity (seed %d)",
+			len(openWorld), *seed)
+	}
+	logging.Infof("attempting to read %dx%d+%d sites", *sites, *instances, *open)
 	data := readData(files)
+	logging.Infof("read %d distinct domains", domainIDs.Len())
+	if before, after := collapse.Stats(); collapse.Mode() != "" {
+		logging.Infof("collapsed %d distinct domains into %d (%s)", before, after,
+			collapse.Mode())
+	}
 	if len(data) < *sites+*open {
-		log.Fatalf("expected to read %d sites, got %d", *sites, len(data))
+		logging.Fatalf("expected to read %d sites, got %d", *sites, len(data))
 	}
 
-	// k-fold cross validation of data
-	log.Printf("performing %d-fold cross-validation", sampleCount)
-	results := make([]metrics, sampleCount)
-
 	unmonitored := func(site int) bool { // unmonitored function
 		return site > *sites
 	}
 
-	for fold := 0; fold < sampleCount; fold++ {
-		log.Printf("starting fold %d", fold+1)
-		forTesting := func(site, sampl int) bool {
-			return (!unmonitored(site) && sampl == fold) ||
-				(unmonitored(site) && site%sampleCount == fold)
+	notTrained := func(site, sampl int) bool { // with epochs, only train epochs
+		return !trainEpochs.Has(data[site][sampl].epoch)
+	}
+	if *streamFiles != "" {
+		logging.Infof("training on all samples")
+		fps := training(data, notTrained, unmonitored)
+		if err = classifyStream(stream, fps, classifiers, unmonitored); err != nil {
+			logging.Fatal(err)
 		}
-		log.Printf("\ttraining...")
-		fps := training(data, forTesting, unmonitored)
-		log.Printf("\ttesting...")
-		results[fold] = testing(data, fps, forTesting, unmonitored)
+		return
 	}
-	log.Printf("%.3f recall, %.3f precision, %.3f FPR, %.3f accuracy",
-		recall(results), precision(results), fpr(results), accuracy(results))
-	for i := 0; i < len(results); i++ {
-		log.Printf("\ttp%d,fpp%d,fnp%d,fn%d,tn%d\n",
-			results[i].tp, results[i].fpp, results[i].fnp,
-			results[i].fn, results[i].tn)
+
+	if *loadFile != "" {
+		logging.Infof("classifying all samples")
+		results := make([][]metrics.Confusion, len(classifiers))
+		for i, c := range classifiers {
+			result := testing(data, loaded, func(site, sampl int) bool {
+				return testEpochs.Has(data[site][sampl].epoch)
+			}, c)
+			results[i] = []metrics.Confusion{evaluate(result, c.threshold(), unmonitored)}
+			logResults(c.name, results[i])
+			if *multiLabel {
+				logMultiLabel(c.name, evaluateMultiLabel(result, unmonitored))
+			}
+		}
+		if *metricsFile != "" {
+			if err = writeRunMetrics(*metricsFile, classifiers, results); err != nil {
+				logging.Fatal(err)
+			}
+		}
+		return
+	}
+
+	// k-fold cross validation of data
+	if *folds == 0 {
+		*folds = sampleCount
+	}
+	openFold := assignFolds(data, *folds, unmonitored,
+		rand.New(rand.NewSource(*seed)))
+	forFold := func(fold int) func(int, int) bool {
+		return func(site, sampl int) bool {
+			return (!unmonitored(site) && sampl%*folds == fold) ||
+				(unmonitored(site) && openFold[site] == fold)
+		}
+	}
+	notTrainingFold := forFold
+	if trainEpochs != nil {
+		forFold, notTrainingFold = epochFolds(data, trainEpochs, testEpochs,
+			openFold, unmonitored)
+	}
+	if *splitFile != "" {
+		s, err := split.Read(*splitFile)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		dataset, err := provenance.SampleHash(flag.Arg(0))
+		if err != nil {
+			logging.Fatal(err)
+		}
+		if s.Dataset != "" && s.Dataset != dataset {
+			if !*force {
+				logging.Fatalf("the split %s is of another dataset than %s (use -force)",
+					*splitFile, flag.Arg(0))
+			}
+			logging.Warnf("the split %s is of another dataset than %s, using it anyway",
+				*splitFile, flag.Arg(0))
+		}
+		if forFold, err = splitFolds(data, s); err != nil {
+			logging.Fatal(err)
+		}
+		notTrainingFold = forFold
+		*folds = s.Folds
+		logging.Infof("read the folds from %s (seed %d)", *splitFile, s.Seed)
+	}
+	if *stalenessFile != "" {
+		logging.Infof("evaluating staleness with %d-fold cross-validation (seed %d)",
+			*folds, *seed)
+		err = staleness(*stalenessFile, data, classifiers, openFold, unmonitored)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote metrics per pair of epochs to %s", *stalenessFile)
+		return
+	}
+	logging.Infof("performing %d-fold cross-validation (seed %d)", *folds, *seed)
+	results, outputs := crossValidate(data, classifiers, forFold, notTrainingFold,
+		unmonitored)
+	for i, c := range classifiers {
+		logResults(c.name, results[i])
+		var all []scored
+		for _, out := range outputs[i] {
+			all = append(all, out...)
+		}
+		if *multiLabel {
+			logMultiLabel(c.name, evaluateMultiLabel(all, unmonitored))
+		}
+		if *prDir != "" {
+			if err = writePRCurve(*prDir, c.name, all, unmonitored); err != nil {
+				logging.Fatal(err)
+			}
+		}
+		if *confusionDir != "" {
+			err = writeConfusion(*confusionDir, c.name, all, c.threshold(),
+				unmonitored)
+			if err != nil {
+				logging.Fatal(err)
+			}
+		}
+		if *siteDir != "" {
+			err = writeSiteCSV(*siteDir, c.name, outputs[i], c.threshold(),
+				unmonitored)
+			if err != nil {
+				logging.Fatal(err)
+			}
+		}
 	}
 
+	if blocked != nil {
+		blockImpact(data, blocked, classifiers, results, forFold, notTrainingFold,
+			notTrained, unmonitored)
+	}
+
+	if *metricsFile != "" {
+		if err = writeRunMetrics(*metricsFile, classifiers, results); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote metrics to %s", *metricsFile)
+	}
+
+	if *saveFile != "" {
+		logging.Infof("training on all samples")
+		fps := training(data, notTrained, unmonitored)
+		if err = saveFingerprints(*saveFile, fps); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("saved fingerprints to %s", *saveFile)
+	}
+}
+
+// crossValidate evaluates the classifiers on the samples of each fold, trained
+// on the samples not in notTraining of the fold, returning the results and
+// the scored outputs per classifier and fold
+func crossValidate(data map[int][]sample, classifiers []classifier,
+	forFold, notTraining func(int) func(int, int) bool,
+	unmonitored func(int) bool) (results [][]metrics.Confusion, outputs [][][]scored) {
+	results = make([][]metrics.Confusion, len(classifiers))
+	outputs = make([][][]scored, len(classifiers))
+	for fold := 0; fold < *folds; fold++ {
+		logging.Infof("starting fold %d", fold+1)
+		forTesting := forFold(fold)
+		logging.Infof("\ttraining...")
+		fps := training(data, notTraining(fold), unmonitored)
+		for i, c := range classifiers {
+			logging.Infof("\ttesting %s...", c.name)
+			out := testing(data, fps, forTesting, c)
+			results[i] = append(results[i], evaluate(out, c.threshold(), unmonitored))
+			outputs[i] = append(outputs[i], out)
+		}
+	}
+	return
 }
 
 func training(data map[int][]sample,
@@ -125,31 +483,62 @@ func training(data map[int][]sample,
 	uniqueDomainToSite, siteHasUnique := getUniqueDomainsToSite(data,
 		forTesting, unmonitored)
 	fps.uniqueDomainToSite = uniqueDomainToSite
+	fps.profiles = getProfiles(data, forTesting, unmonitored)
+	if *minHashes > 0 {
+		fps.sketches = getSketches(fps.profiles, *minHashes)
+	}
+	fps.idf = getIDF(data, forTesting)
+	fps.bayes = getBayes(data, forTesting, unmonitored)
 	if *useCommon {
 		fps.commonDomains = getCommonDomains(data, siteHasUnique,
 			forTesting, unmonitored)
 	}
+	fps.index = newSiteIndex(fps)
 	return
 }
 
+// scored is the output of a classifier for a test sample of site: the most
+// likely class and its score, before any threshold is applied
+type scored struct {
+	site, class int
+	score       float64
+	labels      []int // with -multilabel, all sites at or above the threshold
+}
+
 func testing(data map[int][]sample, fps fingerprints,
-	forTesting func(int, int) bool,
-	unmonitoredSite func(int) bool) (result metrics) {
+	forTesting func(int, int) bool, c classifier) (result []scored) {
+	def, err := newDefense(*stripCount, *padCount, *padDist, *padAlpha, fps)
+	if err != nil {
+		logging.Fatal(err)
+	}
+
 	// create workers
 	wIn := make(chan work)
-	wOut := make(chan metrics, len(data)*sampleCount)
+	total := 0
+	for _, samples := range data {
+		total += len(samples)
+	}
+	wOut := make(chan scored, total)
 	wg := new(sync.WaitGroup)
 	for i := 0; i < runtime.NumCPU(); i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for work := range wIn {
-				wOut <- outcome(work.site,
-					classify(getDomains(work.reqs), fps), unmonitoredSite)
+				// deterministic for a seed, no matter the scheduling
+				rng := rand.New(rand.NewSource(*seed ^
+					int64(work.site)<<20 ^ int64(work.sample)))
+				domains := def.apply(obs.observe(work.reqs, fps, rng), rng)
+				class, score := c.classify(domains, fps)
+				out := scored{site: work.site, class: class, score: score}
+				if *multiLabel {
+					out.labels = labels(c.scores(domains, fps), c.threshold())
+				}
+				wOut <- out
 			}
 		}()
 	}
-	log.Printf("\t\tspawned %d testing workers", runtime.NumCPU())
+	logging.Infof("\t\tspawned %d testing workers", runtime.NumCPU())
 
 	// give out work
 	testing := 0
@@ -157,99 +546,159 @@ func testing(data map[int][]sample, fps fingerprints,
 		for si, sampl := range samples {
 			if forTesting(site, si) {
 				wIn <- work{
-					reqs: sampl.requests,
-					site: site,
+					reqs:   sampl.requests,
+					site:   site,
+					sample: si,
 				}
 				testing++
-				fmt.Printf("\r\t\t testing %d", testing)
+				logging.Progress("\t\t testing %d", testing)
 			}
 		}
 	}
-	fmt.Println("")
+	logging.EndProgress()
 
 	// wait and put together result
 	close(wIn)
 	wg.Wait()
 	close(wOut)
 	for res := range wOut {
-		addResult(&result, res)
+		result = append(result, res)
 	}
 
 	return
 }
 
-func classify(domains map[string]bool, fps fingerprints) (class int) {
-	votes := make(map[int]int)
-	// any unqiue domains?
-	for domain := range domains {
-		site, exists := fps.uniqueDomainToSite[domain]
-		if exists {
-			votes[site]++
+// evaluate applies threshold to scored outputs: a class with a score below
+// it is unmonitored
+func evaluate(results []scored, threshold float64,
+	unmonitoredSite func(int) bool) (m metrics.Confusion) {
+	for _, r := range results {
+		class := r.class
+		if r.score < threshold {
+			class = -1
 		}
+		m.Add(outcome(r.site, class, unmonitoredSite))
 	}
+	return
+}
 
-	// all common domains for a site? only if we didn't find _one_ unique site
-	if *useCommon && len(votes) != 1 {
-		for site, common := range fps.commonDomains {
-			allFound := true
-			for _, d := range common {
-				_, exists := domains[d]
-				if !exists {
-					allFound = false
-					break
-				}
-			}
-			if allFound {
-				votes[site]++
+// classifier returns the most likely class of the observed domains, -1 for
+// unmonitored, and a score where higher is more confident.  A class with a
+// score below the threshold of the classifier is unmonitored.
+type classifier struct {
+	name      string
+	classify  func(intern.Set, fingerprints) (int, float64)
+	threshold func() float64
+	scores    func(intern.Set, fingerprints) map[int]float64 // per site
+}
+
+// allClassifiers are the available classifiers, the ones picked with
+// -classifier are evaluated side by side on the same folds
+var allClassifiers = []classifier{
+	{"unique", classify, func() float64 { return float64(*k) }, scoreVotes},
+	{"jaccard", classifyJaccard, func() float64 { return *simThreshold },
+		scoreJaccard},
+	{"tfidf", classifyTFIDF, func() float64 { return *tfidfThreshold },
+		scoreTFIDF},
+	{"bayes", classifyBayes, func() float64 { return *bayesThreshold },
+		scoreBayes},
+}
+
+func getClassifiers(list string) (classifiers []classifier, err error) {
+	for _, name := range strings.Split(list, ",") {
+		found := false
+		for _, c := range allClassifiers {
+			if c.name == strings.TrimSpace(name) {
+				classifiers = append(classifiers, c)
+				found = true
 			}
 		}
+		if !found {
+			return nil, fmt.Errorf("unknown classifier %q", name)
+		}
 	}
+	return
+}
 
-	return getClass(votes)
+func logResults(name string, results []metrics.Confusion) {
+	logging.Infof("%s: %.3f recall, %.3f precision, %.3f FPR, %.3f accuracy", name,
+		metrics.Recall(results), metrics.Precision(results), metrics.FPR(results),
+		metrics.Accuracy(results))
+	for i := 0; i < len(results); i++ {
+		logging.Infof("\ttp%d,fpp%d,fnp%d,fn%d,tn%d",
+			results[i].TP, results[i].FPP, results[i].FNP,
+			results[i].FN, results[i].TN)
+	}
 }
 
-func getClass(votes map[int]int) int {
-	maxVote := -1
-	maxSite := -1
-	for site, vote := range votes {
-		if vote > maxVote {
-			maxSite = site
-			maxVote = vote
+// classify is the site with the most votes, the score is its votes
+func classify(domains intern.Set, fps fingerprints) (class int,
+	score float64) {
+	return best(scoreVotes(domains, fps))
+}
+
+// scoreVotes is the votes of every site with any
+func scoreVotes(domains intern.Set,
+	fps fingerprints) (scores map[int]float64) {
+	scores = make(map[int]float64)
+	for site, v := range vote(domains, fps) {
+		scores[site] = float64(v)
+	}
+	return prior.weigh(scores)
+}
+
+// best is the site with the highest score, picked by -ties among sites with
+// the same score, or -1 without scores
+func best(scores map[int]float64) (class int, score float64) {
+	var tied []int
+	for site, s := range scores {
+		if len(tied) == 0 || s > score {
+			score = s
+			tied = append(tied[:0], site)
+		} else if s == score {
+			tied = append(tied, site)
 		}
 	}
-	if maxSite == -1 || maxVote < *k {
-		return -1
+	switch len(tied) {
+	case 0:
+		return -1, 0
+	case 1:
+		return tied[0], score
 	}
-	return maxSite
+	sort.Ints(tied)
+	return breakTie(tied), score
 }
 
-func outcome(trueclass, output int,
-	unmonitoredSite func(int) bool) (m metrics) {
-	if unmonitoredSite(trueclass) {
-		trueclass = -1
+// vote returns the votes for each site given the observed domains
+func vote(domains intern.Set, fps fingerprints) (votes map[int]int) {
+	votes = make(map[int]int)
+	// any unqiue domains?
+	for _, domain := range domains {
+		site, exists := fps.uniqueDomainToSite[domain]
+		if exists {
+			votes[site]++
+		}
 	}
 
-	if output == trueclass {
-		if trueclass > 0 {
-			// found the right monitored site
-			m.tp++
-		} else {
-			// correctly identified an unmonitored site
-			m.tn++
-		}
-	} else { // wrong :(
-		if output == -1 {
-			// false negative: said unmonitored for a monitored
-			m.fn++
-		} else {
-			if trueclass == -1 {
-				// classifier said an unmonitored site was monitored
-				m.fnp++
-			} else {
-				// classifier said the wrong monitored site
-				m.fpp++
+	// all common domains for a site? only if we didn't find _one_ unique site
+	if *useCommon && len(votes) != 1 {
+		for site, found := range shared(fps.index.common, domains) {
+			if found == len(fps.commonDomains[site]) {
+				votes[site]++
 			}
 		}
+		for _, site := range fps.index.anyCommon {
+			votes[site]++
+		}
 	}
+
 	return
 }
+
+func outcome(trueclass, output int,
+	unmonitoredSite func(int) bool) metrics.Confusion {
+	if unmonitoredSite(trueclass) {
+		trueclass = -1
+	}
+	return metrics.Classify(output, trueclass, -1)
+}
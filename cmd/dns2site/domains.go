@@ -0,0 +1,41 @@
+package main
+
+import "github.com/pylls/defector/intern"
+
+// internSample interns the domains of the requests of s and sets the
+// domains of s.  The IPs are dropped since they are not used for
+// classification.
+func internSample(s *sample) {
+	internRequests(s.requests)
+	for i := range s.requests {
+		s.requests[i].ips = nil
+	}
+	s.domains = getDomains(s.requests)
+}
+
+// internRequests sets the ID of the domain of every request in domainIDs,
+// sharing the string of each domain
+func internRequests(reqs []request) {
+	for i := range reqs {
+		reqs[i].id = domainIDs.ID(reqs[i].domain)
+		reqs[i].domain = domainIDs.Name(reqs[i].id)
+	}
+}
+
+// getDomains returns the set of domains of interned requests
+func getDomains(reqs []request) intern.Set {
+	ids := make([]uint32, len(reqs))
+	for i, r := range reqs {
+		ids[i] = r.id
+	}
+	return intern.NewSet(ids)
+}
+
+// domainSet interns domains, e.g., from a request to classify, as a set
+func domainSet(domains []string) intern.Set {
+	ids := make([]uint32, len(domains))
+	for i, d := range domains {
+		ids[i] = domainIDs.ID(d)
+	}
+	return intern.NewSet(ids)
+}
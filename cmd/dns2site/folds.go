@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/split"
+)
+
+// assignFolds assigns each unmonitored site in data to one of folds,
+// stratified by rank: the sites are taken in order of their index (rank) in
+// blocks of folds sites, and every block is randomly spread over all folds.
+// Each fold so gets a similar mix of popular and unpopular sites, unlike
+// folding by site index modulo folds.
+func assignFolds(data map[int][]sample, folds int, unmonitored func(int) bool,
+	rng *rand.Rand) map[int]int {
+	var open []int
+	for site := range data {
+		if unmonitored(site) {
+			open = append(open, site)
+		}
+	}
+	sort.Ints(open)
+
+	assigned := make(map[int]int)
+	for start := 0; start < len(open); start += folds {
+		perm := rng.Perm(folds)
+		for i := start; i < start+folds && i < len(open); i++ {
+			assigned[open[i]] = perm[i-start]
+		}
+	}
+	return assigned
+}
+
+// splitFolds returns for each fold of split s which samples in data to test,
+// where every sample must be in s
+func splitFolds(data map[int][]sample,
+	s *split.Split) (func(int) func(int, int) bool, error) {
+	for _, samples := range data {
+		for _, sam := range samples {
+			if _, ok := s.Fold(sam.name); !ok {
+				return nil, fmt.Errorf("sample %s is not in the split", sam.name)
+			}
+		}
+	}
+	return func(fold int) func(int, int) bool {
+		return func(site, sampl int) bool {
+			f, _ := s.Fold(data[site][sampl].name)
+			return f == fold
+		}
+	}, nil
+}
+
+// epochFolds returns for each fold which samples in data to test and which
+// not to train on, when training on the train epochs and testing on the test
+// epochs: the samples of the test epochs are spread over folds by their
+// index in their epoch, and unmonitored sites as folded in openFold are not
+// trained on in any epoch in the fold they are tested in
+func epochFolds(data map[int][]sample, train, test epoch.Set, openFold map[int]int,
+	unmonitored func(int) bool) (forTesting, notTraining func(int) func(int, int) bool) {
+	forTesting = func(fold int) func(int, int) bool {
+		return func(site, sampl int) bool {
+			s := data[site][sampl]
+			return test.Has(s.epoch) &&
+				((!unmonitored(site) && s.index%*folds == fold) ||
+					(unmonitored(site) && openFold[site] == fold))
+		}
+	}
+	notTraining = func(fold int) func(int, int) bool {
+		tested := forTesting(fold)
+		return func(site, sampl int) bool {
+			return tested(site, sampl) || !train.Has(data[site][sampl].epoch) ||
+				(unmonitored(site) && openFold[site] == fold)
+		}
+	}
+	return
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"flag"
-	"log"
+	"io"
 	"math"
 	"math/rand"
 	"os"
@@ -11,58 +10,63 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/deckarep/golang-set"
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/intern"
+	"github.com/pylls/defector/logging"
 )
 
+// readData reads the samples of the -trainepochs and -testepochs, at most
+// -instances per epoch of each monitored site and one per epoch of each
+// unmonitored site
 func readData(files []os.FileInfo) (data map[int][]sample) {
 	data = make(map[int][]sample)
+	count := make(map[[2]int]int) // samples per site and epoch
 	for i := 0; i < len(files); i++ {
-		if !files[i].IsDir() && strings.HasSuffix(files[i].Name(), ".dns") {
+		if !files[i].IsDir() && (strings.HasSuffix(files[i].Name(), ".dns") ||
+			strings.HasSuffix(files[i].Name(), ".dns.gz")) {
 			site, err := strconv.Atoi(files[i].Name()[:strings.Index(files[i].Name(),
 				"-")])
 			if err != nil {
-				log.Fatalf("failed to parse site index from file %s (%s)",
+				logging.Fatalf("failed to parse site index from file %s (%s)",
 					files[i].Name(), err)
 			}
-			if site > *sites+*open || // max sites to read
-				(site <= *sites && len(data[site]) >= *instances) ||
-				(site > *sites && len(data[site]) > 0) {
+			epoch, err := epoch.OfFile(files[i].Name())
+			if err != nil {
+				logging.Fatal(err)
+			}
+			if !trainEpochs.Has(epoch) && !testEpochs.Has(epoch) {
+				continue
+			}
+			key := [2]int{site, 0}
+			if byEpoch {
+				key[1] = epoch
+			}
+			if (openWorld == nil && site > *sites+*open) || // max sites to read
+				(openWorld != nil && site > *sites && !openWorld[site]) ||
+				(site <= *sites && count[key] >= *instances) ||
+				(site > *sites && count[key] > 0) {
 				continue
 			}
 
-			f, err := os.Open(path.Join(flag.Arg(0), files[i].Name()))
+			f, err := gzfile.Open(path.Join(flag.Arg(0), files[i].Name()))
 			if err != nil {
-				log.Fatalf("failed to open file (%s)", err)
+				logging.Fatalf("failed to open file (%s)", err)
 			}
 
-			scanner := bufio.NewScanner(f)
 			var sam sample
-			for scanner.Scan() {
-				// format is: domain,ttl<,ip>
-				// where there are 0 or more ",ip"
-				tokens := strings.Split(scanner.Text(), ",")
-				ttl, err := strconv.Atoi(tokens[1])
-				if err != nil {
-					log.Fatalf("failed to parse TTL (%s)", err)
-				}
-				if *torTTL && ttl < torMinTTL {
-					ttl = torMinTTL
-				} else if *torTTL && ttl > torMaxTTL {
-					ttl = torMaxTTL
-				}
-				var ips []string
-				for j := 2; j < len(tokens); j++ {
-					ips = append(ips, tokens[j])
-				}
-				sam.requests = append(sam.requests, request{
-					domain: tokens[0],
-					ttl:    ttl,
-					ips:    ips,
-				})
+			sam.name = files[i].Name()[:strings.Index(files[i].Name(), ".")]
+			sam.epoch, sam.index = epoch, count[key]
+			sam.requests, err = readRequests(f)
+			if err != nil {
+				logging.Fatalf("failed to read file %s (%s)", files[i].Name(), err)
 			}
+			internSample(&sam)
 			data[site] = append(data[site], sam)
-			if len(data[site]) > sampleCount {
-				sampleCount = len(data[site])
+			count[key]++
+			if count[key] > sampleCount {
+				sampleCount = count[key]
 			}
 			f.Close()
 		}
@@ -70,16 +74,48 @@ func readData(files []os.FileInfo) (data map[int][]sample) {
 	return
 }
 
+// readRequests parses a v1 or v2 .dns file, skipping excluded domains and
+// collapsing and clamping the TTLs of the rest.  Requests in v1 files have
+// no time.
+func readRequests(r io.Reader) ([]request, error) {
+	return scanRequests(dnsfile.NewScanner(r))
+}
+
+func scanRequests(s *dnsfile.Scanner) (reqs []request, err error) {
+	for s.Scan() {
+		r := s.Request()
+		if exclude.Excluded(r.Domain) {
+			continue
+		}
+		ttl := r.TTL
+		if *torTTL && ttl < *torMinTTL {
+			ttl = *torMinTTL
+		} else if *torTTL && ttl > *torMaxTTL {
+			ttl = *torMaxTTL
+		}
+		reqs = append(reqs, request{
+			domain: collapse.Collapse(r.Domain),
+			ttl:    ttl,
+			ips:    r.IPs,
+			time:   r.Time,
+		})
+	}
+	return reqs, s.Err()
+}
+
+// getSeenSites returns the sites each domain ID is seen on, once per
+// training sample with the domain
 func getSeenSites(data map[int][]sample,
-	forTesting func(int, int) bool) (seen map[string][]int) {
+	forTesting func(int, int) bool) (seen map[uint32][]int) {
 	// domain -> sites seen on
-	seen = make(map[string][]int)
+	seen = make(map[uint32][]int)
 	for site, samples := range data {
 		for samp, s := range samples {
-			for _, req := range s.requests {
-				if !forTesting(site, samp) {
-					seen[req.domain] = append(seen[req.domain], site)
-				}
+			if forTesting(site, samp) {
+				continue
+			}
+			for _, id := range s.domains {
+				seen[id] = append(seen[id], site)
 			}
 		}
 	}
@@ -88,14 +124,22 @@ func getSeenSites(data map[int][]sample,
 
 func getUniqueDomainsToSite(data map[int][]sample,
 	forTesting func(int, int) bool,
-	unmonitored func(int) bool) (uniqueDomainToSite map[string]int,
+	unmonitored func(int) bool) (uniqueDomainToSite map[uint32]int,
 	siteHasUnique map[int]bool) {
-	// domain -> sites seen on
-	seen := getSeenSites(data, forTesting)
+	// domain -> sites seen on, with -bloom only monitored sites
+	seen := getSeenSites(data, func(site, samp int) bool {
+		return forTesting(site, samp) || (*bloomFP > 0 && unmonitored(site))
+	})
+	var open *bloomFilter
+	if *bloomFP > 0 {
+		open = getOpenBloom(data, forTesting, unmonitored)
+		logging.Infof("\t\tBloom filter of open-world domains is %.1f KiB",
+			float64(open.bytes())/1024)
+	}
 
 	// determine if each domain is unique or not
-	uniqueDomainToSite = make(map[string]int)
-	for domain, sites := range seen {
+	uniqueDomainToSite = make(map[uint32]int)
+	for id, sites := range seen {
 		if !unmonitored(sites[0]) { // no need to map unmonitored sites
 			isUnique := true
 			for _, site := range sites {
@@ -104,8 +148,8 @@ func getUniqueDomainsToSite(data map[int][]sample,
 					break
 				}
 			}
-			if isUnique {
-				uniqueDomainToSite[domain] = sites[0]
+			if isUnique && (open == nil || !open.has(domainIDs.Name(id))) {
+				uniqueDomainToSite[id] = sites[0]
 			}
 		}
 	}
@@ -117,77 +161,58 @@ func getUniqueDomainsToSite(data map[int][]sample,
 	return
 }
 
+// getOpenBloom returns a Bloom filter with the domains of the training
+// samples of unmonitored sites, with a false positive rate of -bloom
+func getOpenBloom(data map[int][]sample,
+	forTesting func(int, int) bool,
+	unmonitored func(int) bool) *bloomFilter {
+	n := 0 // at most this many distinct domains
+	for site, samples := range data {
+		for samp, s := range samples {
+			if unmonitored(site) && !forTesting(site, samp) {
+				n += len(s.domains)
+			}
+		}
+	}
+	b := newBloom(n, *bloomFP)
+	for site, samples := range data {
+		for samp, s := range samples {
+			if unmonitored(site) && !forTesting(site, samp) {
+				for _, id := range s.domains {
+					b.add(domainIDs.Name(id))
+				}
+			}
+		}
+	}
+	return b
+}
+
+// getCommonDomains returns, for each monitored site without unique domains,
+// the domains found in all of its training samples
 func getCommonDomains(data map[int][]sample,
 	hasUnique map[int]bool,
 	forTesting func(int, int) bool,
-	unmonitored func(int) bool) (common map[int][]string) {
-	// site -> list of domains found in all samples
-	common = make(map[int][]string)
+	unmonitored func(int) bool) (common map[int]intern.Set) {
+	common = make(map[int]intern.Set)
 	for site, samples := range data {
 		_, unique := hasUnique[site]
 		if !unmonitored(site) && !unique { // only care about monitored w/o unique
 			first := true
-			c := mapset.NewSet()
+			var c intern.Set
 			for samp, s := range samples {
 				if !forTesting(site, samp) {
-					domains := mapset.NewSet()
-					for _, req := range s.requests {
-						domains.Add(req.domain)
-					}
 					if first {
-						c = domains
+						c = s.domains
 						first = false
 					} else {
-						domains = domains.Intersect(c)
+						c = c.Intersect(s.domains)
 					}
 				}
 			}
-			for domain := range c.Iter() {
-				common[site] = append(common[site], domain.(string))
-			}
-		}
-	}
-
-	return
-}
-
-func addResult(base *metrics, result metrics) {
-	base.fn += result.fn
-	base.fnp += result.fnp
-	base.fpp += result.fpp
-	base.tn += result.tn
-	base.tp += result.tp
-}
-
-// recall = TPR = TP / (TP + FN + FPP)
-func recall(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].tp) / float64(data[i].tp+data[i].fn+data[i].fpp)
-		if !math.IsNaN(d) {
-			p += d
-		}
-	}
-	return p / float64(len(data))
-}
-
-// precision = TP / (TP + FPP + FNP)
-func precision(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].tp) / float64(data[i].tp+data[i].fpp+data[i].fnp)
-		if !math.IsNaN(d) {
-			p += d
+			common[site] = c
 		}
 	}
-	return p / float64(len(data))
-}
 
-func getDomains(req []request) (domains map[string]bool) {
-	domains = make(map[string]bool)
-	for _, r := range req {
-		domains[r.domain] = true
-	}
 	return
 }
 
@@ -210,7 +235,7 @@ func estimateOpenSize() {
 
 func powerlawRand() int {
 	// parameters for xmin=0.01, a conservative choice to fit out data
-	alpha := 1.13487087527372
+	alpha := powerlawAlpha
 	oneOverOneMinusAlpha := -7.414499223575910
 	r := rand.Float64()
 	for r > 0.9999999999999999 {
@@ -220,28 +245,3 @@ func powerlawRand() int {
 
 	return int(math.Ceil(math.Pow(alpha*(1.0-r), oneOverOneMinusAlpha)))
 }
-
-// FPR = FP / non-monitored elements = (FPP + FNP) / (TN + FNP)
-func fpr(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].fpp+data[i].fnp) / float64(data[i].tn+data[i].fnp)
-		if !math.IsNaN(d) {
-			p += d
-		}
-	}
-	return p / float64(len(data))
-}
-
-// accuracy = (TP + TN) / (everything)
-func accuracy(data []metrics) float64 {
-	var p float64
-	for i := 0; i < len(data); i++ {
-		d := float64(data[i].tp+data[i].tn) /
-			float64(data[i].fn+data[i].fnp+data[i].fpp+data[i].tn+data[i].tp)
-		if !math.IsNaN(d) {
-			p += d
-		}
-	}
-	return p / float64(len(data))
-}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+
+	"github.com/pylls/defector/intern"
+)
+
+// siteIndex is an inverted index of fingerprints, from each domain to the
+// monitored sites whose fingerprints have it, so that a test sample is only
+// compared to the sites it shares a domain with rather than to every site,
+// which matters for large worlds
+type siteIndex struct {
+	profiles  map[uint32][]int // domain to the sites with it in their profile
+	norms     map[int]float64  // the squared norm of the IDF of each profile
+	common    map[uint32][]int // domain to the sites with it as a common domain
+	anyCommon []int            // sites without common domains, always all found
+}
+
+func newSiteIndex(fps fingerprints) *siteIndex {
+	index := &siteIndex{
+		profiles: make(map[uint32][]int),
+		norms:    make(map[int]float64, len(fps.profiles)),
+		common:   make(map[uint32][]int),
+	}
+	for site, profile := range fps.profiles {
+		for _, d := range profile {
+			index.profiles[d] = append(index.profiles[d], site)
+			index.norms[site] += fps.idf[d] * fps.idf[d]
+		}
+	}
+	for site, common := range fps.commonDomains {
+		if len(common) == 0 {
+			index.anyCommon = append(index.anyCommon, site)
+		}
+		for _, d := range common {
+			index.common[d] = append(index.common[d], site)
+		}
+	}
+	return index
+}
+
+// shared counts, for every site of the postings of any of domains, how many
+// of domains it has
+func shared(postings map[uint32][]int, domains intern.Set) map[int]int {
+	count := make(map[int]int)
+	for _, d := range domains {
+		for _, site := range postings[d] {
+			count[site]++
+		}
+	}
+	return count
+}
+
+// cosine is the weighted cosine similarity of the observed domains to the
+// profile of each site sharing a domain with them, where observed is the
+// squared norm of the IDF of the observed domains
+func (index *siteIndex) cosine(domains intern.Set, observed float64,
+	idf map[uint32]float64) map[int]float64 {
+	dot := make(map[int]float64)
+	for _, d := range domains {
+		w := idf[d] * idf[d]
+		for _, site := range index.profiles[d] {
+			dot[site] += w
+		}
+	}
+	for site := range dot {
+		if index.norms[site] == 0 { // only domains on every site
+			delete(dot, site)
+			continue
+		}
+		dot[site] /= math.Sqrt(observed * index.norms[site])
+	}
+	return dot
+}
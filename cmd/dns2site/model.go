@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"os"
+
+	"github.com/pylls/defector/intern"
+)
+
+// savedFingerprints is the on-disk form of trained fingerprints, a gzipped
+// gob, with domains as names since IDs are only valid within a run.
+// Monitored is the number of monitored sites it was trained on.
+type savedFingerprints struct {
+	Monitored          int
+	UniqueDomainToSite map[string]int
+	CommonDomains      map[int][]string
+	Profiles           map[int]map[string]bool
+	Sketches           map[int]minHash
+	IDF                map[string]float64
+	Bayes              *savedBayes
+}
+
+// savedBayes is the on-disk form of a bayesModel
+type savedBayes struct {
+	Classes    map[int]*savedBayesClass
+	Vocabulary map[string]bool
+	Samples    int
+}
+
+type savedBayesClass struct {
+	Samples int
+	Domains map[string]int
+	Total   int
+}
+
+// names returns the names of the domains of set
+func names(set intern.Set) []string {
+	n := make([]string, len(set))
+	for i, id := range set {
+		n[i] = domainIDs.Name(id)
+	}
+	return n
+}
+
+// toSaved returns fps with domains as names
+func toSaved(fps fingerprints) savedFingerprints {
+	s := savedFingerprints{
+		Monitored:          *sites,
+		UniqueDomainToSite: make(map[string]int, len(fps.uniqueDomainToSite)),
+		CommonDomains:      make(map[int][]string, len(fps.commonDomains)),
+		Profiles:           make(map[int]map[string]bool, len(fps.profiles)),
+		Sketches:           fps.sketches,
+		IDF:                make(map[string]float64, len(fps.idf)),
+	}
+	for id, site := range fps.uniqueDomainToSite {
+		s.UniqueDomainToSite[domainIDs.Name(id)] = site
+	}
+	for site, common := range fps.commonDomains {
+		s.CommonDomains[site] = names(common)
+	}
+	for site, profile := range fps.profiles {
+		s.Profiles[site] = make(map[string]bool, len(profile))
+		for _, domain := range names(profile) {
+			s.Profiles[site][domain] = true
+		}
+	}
+	for id, idf := range fps.idf {
+		s.IDF[domainIDs.Name(id)] = idf
+	}
+	if m := fps.bayes; m != nil {
+		s.Bayes = &savedBayes{
+			Classes:    make(map[int]*savedBayesClass, len(m.Classes)),
+			Vocabulary: make(map[string]bool, len(m.Vocabulary)),
+			Samples:    m.Samples,
+		}
+		for id := range m.Vocabulary {
+			s.Bayes.Vocabulary[domainIDs.Name(id)] = true
+		}
+		for class, c := range m.Classes {
+			sc := &savedBayesClass{Samples: c.Samples, Total: c.Total,
+				Domains: make(map[string]int, len(c.Domains))}
+			for id, n := range c.Domains {
+				sc.Domains[domainIDs.Name(id)] = n
+			}
+			s.Bayes.Classes[class] = sc
+		}
+	}
+	return s
+}
+
+// fromSaved returns the fingerprints of s, interning its domains
+func fromSaved(s savedFingerprints) (fps fingerprints) {
+	fps.uniqueDomainToSite = make(map[uint32]int, len(s.UniqueDomainToSite))
+	for domain, site := range s.UniqueDomainToSite {
+		fps.uniqueDomainToSite[domainIDs.ID(domain)] = site
+	}
+	if s.CommonDomains != nil {
+		fps.commonDomains = make(map[int]intern.Set, len(s.CommonDomains))
+		for site, common := range s.CommonDomains {
+			fps.commonDomains[site] = domainSet(common)
+		}
+	}
+	fps.profiles = make(map[int]intern.Set, len(s.Profiles))
+	for site, profile := range s.Profiles {
+		var domains []string
+		for domain := range profile {
+			domains = append(domains, domain)
+		}
+		fps.profiles[site] = domainSet(domains)
+	}
+	fps.sketches = s.Sketches
+	fps.idf = make(map[uint32]float64, len(s.IDF))
+	for domain, idf := range s.IDF {
+		fps.idf[domainIDs.ID(domain)] = idf
+	}
+	if s.Bayes != nil {
+		fps.bayes = &bayesModel{
+			Classes:    make(map[int]*bayesClass, len(s.Bayes.Classes)),
+			Vocabulary: make(map[uint32]bool, len(s.Bayes.Vocabulary)),
+			Samples:    s.Bayes.Samples,
+		}
+		for domain := range s.Bayes.Vocabulary {
+			fps.bayes.Vocabulary[domainIDs.ID(domain)] = true
+		}
+		for class, sc := range s.Bayes.Classes {
+			c := &bayesClass{Samples: sc.Samples, Total: sc.Total,
+				Domains: make(map[uint32]int, len(sc.Domains))}
+			for domain, n := range sc.Domains {
+				c.Domains[domainIDs.ID(domain)] = n
+			}
+			fps.bayes.Classes[class] = c
+		}
+	}
+	fps.index = newSiteIndex(fps)
+	return
+}
+
+func saveFingerprints(name string, fps fingerprints) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create fingerprints file (%s)", err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(toSaved(fps))
+	if err != nil {
+		return fmt.Errorf("failed to encode fingerprints (%s)", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("failed to write fingerprints (%s)", err)
+	}
+	return f.Close()
+}
+
+func loadFingerprints(name string) (fps fingerprints, monitored int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return fps, 0, fmt.Errorf("failed to open fingerprints file (%s)", err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return fps, 0, fmt.Errorf("failed to read fingerprints (%s)", err)
+	}
+	var s savedFingerprints
+	if err = gob.NewDecoder(r).Decode(&s); err != nil {
+		return fps, 0, fmt.Errorf("failed to decode fingerprints (%s)", err)
+	}
+	return fromSaved(s), s.Monitored, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/pylls/defector/logging"
+)
+
+// labels returns every site with a positive score of at least threshold,
+// highest score first
+func labels(scores map[int]float64, threshold float64) (sites []int) {
+	for site, s := range scores {
+		if s > 0 && s >= threshold {
+			sites = append(sites, site)
+		}
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if scores[sites[i]] != scores[sites[j]] {
+			return scores[sites[i]] > scores[sites[j]]
+		}
+		return sites[i] < sites[j]
+	})
+	return
+}
+
+// multiMetrics evaluates sets of predicted monitored sites against the sets
+// of monitored sites actually visited, e.g., in a window of a stream
+type multiMetrics struct {
+	n          int     // number of sets
+	exact      int     // predicted set is the visited set
+	tp, fp, fn int     // over all labels, for micro-averages
+	precision  float64 // sums over sets, for example-based averages
+	recall     float64
+	f1         float64
+}
+
+// add the predicted set of a visited set.  Precision is 1 if nothing is
+// predicted, recall is 1 if nothing monitored was visited.
+func (m *multiMetrics) add(visited, predicted map[int]bool) {
+	m.n++
+	both := 0
+	for site := range predicted {
+		if visited[site] {
+			both++
+		}
+	}
+	m.tp += both
+	m.fp += len(predicted) - both
+	m.fn += len(visited) - both
+	if both == len(visited) && both == len(predicted) {
+		m.exact++
+	}
+
+	p, r, f := 1.0, 1.0, 1.0
+	if len(predicted) > 0 {
+		p = float64(both) / float64(len(predicted))
+	}
+	if len(visited) > 0 {
+		r = float64(both) / float64(len(visited))
+	}
+	if len(visited)+len(predicted) > 0 {
+		f = 2 * float64(both) / float64(len(visited)+len(predicted))
+	}
+	m.precision += p
+	m.recall += r
+	m.f1 += f
+}
+
+// evaluateMultiLabel compares the labels of test samples to their site,
+// where an unmonitored site was visiting no monitored site
+func evaluateMultiLabel(results []scored,
+	unmonitoredSite func(int) bool) (m multiMetrics) {
+	for _, r := range results {
+		visited := make(map[int]bool)
+		if !unmonitoredSite(r.site) {
+			visited[r.site] = true
+		}
+		predicted := make(map[int]bool)
+		for _, site := range r.labels {
+			predicted[site] = true
+		}
+		m.add(visited, predicted)
+	}
+	return
+}
+
+func logMultiLabel(name string, m multiMetrics) {
+	if m.n == 0 {
+		return
+	}
+	logging.Infof("%s multi-label: %.3f exact match, %.3f precision, %.3f recall, %.3f F1 (example-based)",
+		name, float64(m.exact)/float64(m.n), m.precision/float64(m.n),
+		m.recall/float64(m.n), m.f1/float64(m.n))
+	logging.Infof("\t%.3f precision, %.3f recall (micro), %.2f labels per set, tp%d,fp%d,fn%d",
+		float64(m.tp)/float64(m.tp+m.fp), float64(m.tp)/float64(m.tp+m.fn),
+		float64(m.tp+m.fp)/float64(m.n), m.tp, m.fp, m.fn)
+}
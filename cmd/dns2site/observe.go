@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/pylls/defector/intern"
+)
+
+// observer models what an exit-level adversary sees of the DNS requests of
+// a visit: only requests not answered from the resolver's cache
+type observer struct {
+	mode string  // "" (everything), "flat" or "ttl"
+	p    float64 // flat: probability of observing a domain
+	rate float64 // ttl: lookups/s at the exit of a domain on every site
+}
+
+func newObserver(mode string, p, rate float64) (*observer, error) {
+	switch mode {
+	case "", "flat", "ttl":
+	default:
+		return nil, fmt.Errorf("unknown observation model %q (flat or ttl)", mode)
+	}
+	return &observer{mode: mode, p: p, rate: rate}, nil
+}
+
+// pObserve returns the probability that a request for domain with ttl is
+// not cached.  With "ttl", other clients of the exit look up the domain as a
+// Poisson process with a rate proportional to the fraction of sites the
+// domain is on (estimated from the IDF in training), so the domain is cached
+// with probability 1-exp(-rate*ttl).
+func (o *observer) pObserve(domain uint32, ttl int, fps fingerprints) float64 {
+	switch o.mode {
+	case "flat":
+		return o.p
+	case "ttl":
+		idf, known := fps.idf[domain]
+		if !known {
+			return 1 // not seen in training, assume rare and uncached
+		}
+		return math.Exp(-o.rate * math.Exp(-idf) * float64(ttl))
+	}
+	return 1
+}
+
+// observe returns the observed domains of interned reqs, each domain
+// dropped at random according to the model and its lowest TTL in reqs
+func (o *observer) observe(reqs []request, fps fingerprints,
+	rng *rand.Rand) intern.Set {
+	domains := getDomains(reqs)
+	if o.mode == "" {
+		return domains
+	}
+	ttls := make(map[uint32]int, len(domains))
+	for _, r := range reqs {
+		if t, exists := ttls[r.id]; !exists || r.ttl < t {
+			ttls[r.id] = r.ttl
+		}
+	}
+	observed := domains[:0]
+	for _, d := range domains { // in order, so deterministic for rng
+		if rng.Float64() < o.pObserve(d, ttls[d], fps) {
+			observed = append(observed, d)
+		}
+	}
+	return observed
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/epoch"
+)
+
+// powerlawAlpha is the exponent of the power-law popularity of sites, fit
+// with xmin=0.01 (see powerlawRand)
+const powerlawAlpha = 1.13487087527372
+
+// powerlawWeight is the probability that powerlawRand returns rank
+func powerlawWeight(rank int) float64 {
+	// P(rank <= x) = 1 - x^(1-alpha)/alpha, and 0 below xmin
+	below := math.Min(powerlawAlpha, math.Pow(float64(rank-1), 1-powerlawAlpha))
+	return (below - math.Pow(float64(rank), 1-powerlawAlpha)) / powerlawAlpha
+}
+
+// sampleOpenWorld picks n of the unmonitored sites with data in files,
+// weighted by their popularity by the power-law model, as the distinct sites
+// of visits drawn with powerlawRand until n sites with data are seen, using
+// weighted sampling without replacement (Efraimidis and Spirakis)
+func sampleOpenWorld(files []os.FileInfo, n int, rng *rand.Rand) map[int]bool {
+	available := make(map[int]bool)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !(strings.HasSuffix(name, ".dns") ||
+			strings.HasSuffix(name, ".dns.gz")) || !strings.Contains(name, "-") {
+			continue
+		}
+		site, err := strconv.Atoi(name[:strings.Index(name, "-")])
+		if err != nil || site <= *sites {
+			continue
+		}
+		if epoch, err := epoch.OfFile(name); err != nil ||
+			(!trainEpochs.Has(epoch) && !testEpochs.Has(epoch)) {
+			continue
+		}
+		available[site] = true
+	}
+	candidates := make([]int, 0, len(available))
+	for site := range available {
+		candidates = append(candidates, site)
+	}
+	sort.Ints(candidates)
+
+	// the n sites with the largest keys u^(1/weight), as logarithms
+	key := make(map[int]float64, len(candidates))
+	for _, site := range candidates {
+		key[site] = math.Log(1-rng.Float64()) / powerlawWeight(site)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return key[candidates[i]] > key[candidates[j]]
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	open := make(map[int]bool, len(candidates))
+	for _, site := range candidates {
+		open[site] = true
+	}
+	return open
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/pylls/defector/metrics"
+)
+
+// writePRCurve writes dir/<name>.pr.csv with the metrics when using each
+// distinct score in results as the threshold
+func writePRCurve(dir, name string, results []scored,
+	unmonitoredSite func(int) bool) error {
+	var thresholds []float64
+	seen := make(map[float64]bool)
+	for _, r := range results {
+		if r.class != -1 && !seen[r.score] {
+			seen[r.score] = true
+			thresholds = append(thresholds, r.score)
+		}
+	}
+	sort.Float64s(thresholds)
+
+	out := "threshold,tp,fpp,fnp,fn,tn,recall,precision,fpr\n"
+	for _, t := range thresholds {
+		m := evaluate(results, t, unmonitoredSite)
+		ms := []metrics.Confusion{m}
+		out += fmt.Sprintf("%g,%d,%d,%d,%d,%d,%f,%f,%f\n", t, m.TP, m.FPP,
+			m.FNP, m.FN, m.TN, metrics.Recall(ms), metrics.Precision(ms),
+			metrics.FPR(ms))
+	}
+	file := path.Join(dir, name+".pr.csv")
+	if err := ioutil.WriteFile(file, []byte(out), 0666); err != nil {
+		return fmt.Errorf("failed to write %s (%s)", file, err)
+	}
+	return nil
+}
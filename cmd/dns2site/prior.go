@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// popularityPrior weighs the scores of monitored sites by how popular they
+// are, so unlikely sites need stronger evidence to be picked.  The score of a
+// site is multiplied by (popularity/max popularity)^weight.
+type popularityPrior struct {
+	weight     float64
+	popularity map[int]float64 // nil for rank
+	max, min   float64
+}
+
+// newPrior returns nil for "", a Zipf prior where site i has popularity 1/i
+// (site i is rank i) for "rank", or else reads "site,popularity" lines from
+// the file spec, where sites not in the file are as popular as the least
+// popular site in it
+func newPrior(spec string, weight float64) (*popularityPrior, error) {
+	switch spec {
+	case "":
+		return nil, nil
+	case "rank":
+		return &popularityPrior{weight: weight}, nil
+	}
+
+	f, err := os.Open(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open popularity file (%s)", err)
+	}
+	defer f.Close()
+	p := &popularityPrior{
+		weight:     weight,
+		popularity: make(map[int]float64),
+		min:        math.Inf(1),
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Split(line, ",")
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed popularity line %q", line)
+		}
+		site, err := strconv.Atoi(tokens[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse site (%s)", err)
+		}
+		pop, err := strconv.ParseFloat(tokens[1], 64)
+		if err != nil || pop <= 0 {
+			return nil, fmt.Errorf("invalid popularity of site %d in %q", site, line)
+		}
+		p.popularity[site] = pop
+		p.max = math.Max(p.max, pop)
+		p.min = math.Min(p.min, pop)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read popularity file (%s)", err)
+	}
+	if len(p.popularity) == 0 {
+		return nil, fmt.Errorf("no sites in popularity file %s", spec)
+	}
+	return p, nil
+}
+
+// factor is what to multiply the score of site with, 1 without a prior
+func (p *popularityPrior) factor(site int) float64 {
+	if p == nil || site < 1 {
+		return 1
+	}
+	if p.popularity == nil {
+		return math.Pow(float64(site), -p.weight)
+	}
+	pop, exists := p.popularity[site]
+	if !exists {
+		pop = p.min
+	}
+	return math.Pow(pop/p.max, p.weight)
+}
+
+// relative is the popularity of site relative to the most popular site, by
+// rank without a prior, where the background class (-1) is the most popular
+func (p *popularityPrior) relative(site int) float64 {
+	if site < 1 {
+		return 1
+	}
+	if p == nil || p.popularity == nil {
+		return 1 / float64(site)
+	}
+	pop, exists := p.popularity[site]
+	if !exists {
+		pop = p.min
+	}
+	return pop / p.max
+}
+
+// weigh multiplies every score by the factor of its site, in place
+func (p *popularityPrior) weigh(scores map[int]float64) map[int]float64 {
+	if p != nil {
+		for site := range scores {
+			scores[site] *= p.factor(site)
+		}
+	}
+	return scores
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pylls/defector/metrics"
+	"github.com/pylls/defector/provenance"
+)
+
+// runMetrics are the results of a run for other tools, e.g., defector
+// -dns2site-metrics, with what is needed to know which run produced them
+type runMetrics struct {
+	Time        time.Time                    `json:"time"`
+	Args        []string                     `json:"args"`
+	Data        string                       `json:"data"`
+	Dataset     string                       `json:"dataset"`                // provenance.SampleHash of Data
+	Fingerprint string                       `json:"fingerprints,omitempty"` // -load
+	Sites       int                          `json:"sites"`
+	Instances   int                          `json:"instances"`
+	Open        int                          `json:"open"`
+	OpenSample  bool                         `json:"open_sample,omitempty"`
+	Folds       int                          `json:"folds"`
+	Seed        int64                        `json:"seed"`
+	Observe     string                       `json:"observe,omitempty"`
+	TrainEpochs string                       `json:"train_epochs,omitempty"`
+	TestEpochs  string                       `json:"test_epochs,omitempty"`
+	Ties        string                       `json:"ties"`
+	Classifiers map[string]classifierMetrics `json:"classifiers"`
+}
+
+// classifierMetrics are averaged over folds, with the counts summed
+type classifierMetrics struct {
+	Threshold float64 `json:"threshold"`
+	Recall    float64 `json:"recall"`
+	Precision float64 `json:"precision"`
+	FPR       float64 `json:"fpr"`
+	Accuracy  float64 `json:"accuracy"`
+	TP        int     `json:"tp"`
+	FPP       int     `json:"fpp"`
+	FNP       int     `json:"fnp"`
+	FN        int     `json:"fn"`
+	TN        int     `json:"tn"`
+}
+
+// writeRunMetrics writes the metrics of each classifier, results[i] being
+// the metrics of classifiers[i] per fold, as JSON to name
+func writeRunMetrics(name string, classifiers []classifier,
+	results [][]metrics.Confusion) error {
+	dataset, err := provenance.SampleHash(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	r := runMetrics{
+		Time:        time.Now(),
+		Args:        os.Args[1:],
+		Data:        flag.Arg(0),
+		Dataset:     dataset,
+		Fingerprint: *loadFile,
+		Sites:       *sites,
+		Instances:   *instances,
+		Open:        *open,
+		Folds:       len(results[0]),
+		Seed:        *seed,
+		Observe:     *observeMode,
+		TrainEpochs: *trainEpochList,
+		TestEpochs:  *testEpochList,
+		Ties:        *tiePolicy,
+		OpenSample:  *openSample,
+		Classifiers: make(map[string]classifierMetrics),
+	}
+	for i, c := range classifiers {
+		m := classifierMetrics{
+			Threshold: c.threshold(),
+			Recall:    metrics.Recall(results[i]),
+			Precision: metrics.Precision(results[i]),
+			FPR:       metrics.FPR(results[i]),
+			Accuracy:  metrics.Accuracy(results[i]),
+		}
+		sum := metrics.Sum(results[i])
+		m.TP, m.FPP, m.FNP, m.FN, m.TN = sum.TP, sum.FPP, sum.FNP, sum.FN, sum.TN
+		r.Classifiers[c.name] = m
+	}
+
+	d, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics (%s)", err)
+	}
+	if err = ioutil.WriteFile(name, d, 0666); err != nil {
+		return fmt.Errorf("failed to write metrics %s (%s)", name, err)
+	}
+	return nil
+}
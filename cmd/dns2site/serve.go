@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/logging"
+)
+
+// classifyRequest is either a list of observed domains or the contents of a
+// v1 or v2 .dns file, where a line may also be only a domain
+type classifyRequest struct {
+	Domains []string `json:"domains"`
+	DNS     string   `json:"dns"`
+}
+
+type classifyResponse struct {
+	Classifier string          `json:"classifier"`
+	Site       int             `json:"site"`       // -1 for unmonitored
+	Confidence float64         `json:"confidence"` // the score of the classifier
+	Scores     map[int]float64 `json:"scores"`     // per site
+	Ties       string          `json:"ties"`       // the -ties policy
+}
+
+// serve exposes fps over HTTP, classified by c: POST a classifyRequest as
+// JSON to /classify, or a .dns file as text/plain, to get a classifyResponse
+// back
+func serve(addr string, fps fingerprints, c classifier) {
+	http.HandleFunc("/classify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		var req classifyRequest
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				req.DNS += scanner.Text() + "\n"
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "failed to parse request: "+err.Error(),
+				http.StatusBadRequest)
+			return
+		}
+
+		s := dnsfile.NewScanner(strings.NewReader(strings.TrimSpace(req.DNS)))
+		s.BareDomains = true
+		reqs, err := scanRequests(s)
+		if err != nil {
+			http.Error(w, "failed to parse .dns: "+err.Error(),
+				http.StatusBadRequest)
+			return
+		}
+		for _, d := range req.Domains {
+			if !exclude.Excluded(d) {
+				reqs = append(reqs, request{domain: collapse.Collapse(d)})
+			}
+		}
+		internRequests(reqs)
+
+		domains := getDomains(reqs)
+		resp := classifyResponse{
+			Classifier: c.name,
+			Scores:     c.scores(domains, fps),
+			Ties:       *tiePolicy,
+		}
+		resp.Site, resp.Confidence = c.classify(domains, fps)
+		if resp.Confidence < c.threshold() {
+			resp.Site = -1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logging.Warnf("failed to write response (%s)", err)
+		}
+	})
+
+	logging.Infof("serving classifications by %s on http://%s/classify", c.name, addr)
+	logging.Fatal(http.ListenAndServe(addr, nil))
+}
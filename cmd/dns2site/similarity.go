@@ -0,0 +1,80 @@
+package main
+
+import "github.com/pylls/defector/intern"
+
+// getProfiles returns, for each monitored site, the union of the domains of
+// its training samples
+func getProfiles(data map[int][]sample,
+	forTesting func(int, int) bool,
+	unmonitored func(int) bool) (profiles map[int]intern.Set) {
+	profiles = make(map[int]intern.Set)
+	for site, samples := range data {
+		if unmonitored(site) {
+			continue
+		}
+		var ids []uint32
+		for samp, s := range samples {
+			if !forTesting(site, samp) {
+				ids = append(ids, s.domains...)
+			}
+		}
+		profiles[site] = intern.NewSet(ids)
+	}
+	return
+}
+
+// similarity of two domain sets A and B of sizes a and b with intersection
+// domains in common, either the Jaccard index |A∩B|/|A∪B| or the overlap
+// coefficient |A∩B|/min(|A|,|B|)
+func similarity(a, b, intersection int) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if *simMeasure == "overlap" {
+		min := a
+		if b < min {
+			min = b
+		}
+		return float64(intersection) / float64(min)
+	}
+	return float64(intersection) / float64(a+b-intersection)
+}
+
+// classifyJaccard is a nearest-neighbor classifier: the observed domains
+// are compared to the profile of every monitored site they share a domain
+// with, and the most similar site is the class, scored by its similarity
+func classifyJaccard(domains intern.Set, fps fingerprints) (class int,
+	score float64) {
+	return best(scoreJaccard(domains, fps))
+}
+
+// scoreJaccard is the similarity of the observed domains to the profile of
+// every monitored site sharing a domain with them, or of every monitored
+// site estimated from MinHash sketches with -minhash
+func scoreJaccard(domains intern.Set,
+	fps fingerprints) (scores map[int]float64) {
+	scores = make(map[int]float64, len(fps.profiles))
+	if fps.sketches != nil {
+		var observed minHash
+		for site, sketch := range fps.sketches {
+			if observed.Sig == nil { // as many hashes as in training
+				observed = newMinHash(domains, len(sketch.Sig))
+			}
+			scores[site] = observed.similarity(sketch)
+		}
+		return prior.weigh(scores)
+	}
+	for site, n := range shared(fps.index.profiles, domains) {
+		scores[site] = similarity(len(domains), len(fps.profiles[site]), n)
+	}
+	return prior.weigh(scores)
+}
+
+// getSketches returns a MinHash sketch of n hashes of every profile
+func getSketches(profiles map[int]intern.Set, n int) map[int]minHash {
+	sketches := make(map[int]minHash, len(profiles))
+	for site, profile := range profiles {
+		sketches[site] = newMinHash(profile, n)
+	}
+	return sketches
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/pylls/defector/metrics"
+)
+
+// writeSiteCSV writes dir/<name>.sites.csv with the outcomes of the test
+// samples of each monitored site in each fold
+func writeSiteCSV(dir, name string, folds [][]scored, threshold float64,
+	unmonitoredSite func(int) bool) error {
+	perSite := make(map[int][]metrics.Confusion)
+	for fold, results := range folds {
+		for _, r := range results {
+			if unmonitoredSite(r.site) {
+				continue
+			}
+			if perSite[r.site] == nil {
+				perSite[r.site] = make([]metrics.Confusion, len(folds))
+			}
+			m := evaluate([]scored{r}, threshold, unmonitoredSite)
+			perSite[r.site][fold].Add(m)
+		}
+	}
+
+	var sites []int
+	for site := range perSite {
+		sites = append(sites, site)
+	}
+	sort.Ints(sites)
+	out := "site,fold,tp,fn,fpp\n"
+	for _, site := range sites {
+		for fold, m := range perSite[site] {
+			out += fmt.Sprintf("%d,%d,%d,%d,%d\n", site, fold+1, m.TP, m.FN, m.FPP)
+		}
+	}
+	file := path.Join(dir, name+".sites.csv")
+	if err := ioutil.WriteFile(file, []byte(out), 0666); err != nil {
+		return fmt.Errorf("failed to write %s (%s)", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/pylls/defector/intern"
+)
+
+// hash64 is the 64-bit FNV-1a hash of s, mixed with seed
+func hash64(s string, seed uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64() ^ seed)
+}
+
+// mix64 is the splitmix64 finalizer, spreading the bits of FNV-1a
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// bloomFilter is a set of domains that may wrongly say a domain is in it,
+// at a configured rate, but never the other way around
+type bloomFilter struct {
+	bits []uint64
+	k    int // hashes per domain
+}
+
+// newBloom sizes a filter for n domains with false positive rate p
+func newBloom(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (int(m)+63)/64), k: k}
+}
+
+// locations are the bits of domain, by double hashing
+func (b *bloomFilter) locations(domain string, f func(word int, bit uint64) bool) bool {
+	h1, h2 := hash64(domain, 0), hash64(domain, 1)
+	m := uint64(len(b.bits) * 64)
+	for i := 0; i < b.k; i++ {
+		loc := (h1 + uint64(i)*h2) % m
+		if !f(int(loc/64), 1<<(loc%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(domain string) {
+	b.locations(domain, func(word int, bit uint64) bool {
+		b.bits[word] |= bit
+		return true
+	})
+}
+
+func (b *bloomFilter) has(domain string) bool {
+	return b.locations(domain, func(word int, bit uint64) bool {
+		return b.bits[word]&bit != 0
+	})
+}
+
+// bytes is the size of the filter
+func (b *bloomFilter) bytes() int {
+	return len(b.bits) * 8
+}
+
+// minHash is a sketch of a set of domains: the smallest hash of any domain
+// in it for each of len(Sig) hash functions, and the size of the set.  The
+// Jaccard index of two sets is estimated by the share of equal minimums,
+// with a standard error of at most 1/sqrt(2*len(Sig)).  Fields are exported
+// for saving with -save.
+type minHash struct {
+	Sig  []uint64
+	Size int
+}
+
+// newMinHash returns a sketch of n hashes of domains, hashing their names so
+// that sketches saved with -save are comparable in later runs
+func newMinHash(domains intern.Set, n int) minHash {
+	m := minHash{Sig: make([]uint64, n), Size: len(domains)}
+	for i := range m.Sig {
+		m.Sig[i] = math.MaxUint64
+	}
+	for _, id := range domains {
+		h := hash64(domainIDs.Name(id), 0)
+		for i := range m.Sig {
+			if v := mix64(h ^ uint64(i+1)*0x9e3779b97f4a7c15); v < m.Sig[i] {
+				m.Sig[i] = v
+			}
+		}
+	}
+	return m
+}
+
+// jaccard estimates the Jaccard index of the sets of a and b
+func (a minHash) jaccard(b minHash) float64 {
+	if a.Size == 0 || b.Size == 0 || len(a.Sig) != len(b.Sig) {
+		return 0
+	}
+	equal := 0
+	for i := range a.Sig {
+		if a.Sig[i] == b.Sig[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(a.Sig))
+}
+
+// similarity estimates similarity() of the sets of a and b, where the
+// overlap coefficient is derived from the estimated Jaccard index J as
+// |A∩B| = J(|A|+|B|)/(1+J)
+func (a minHash) similarity(b minHash) float64 {
+	j := a.jaccard(b)
+	if *simMeasure != "overlap" || j == 0 {
+		return j
+	}
+	min := a.Size
+	if b.Size < min {
+		min = b.Size
+	}
+	return math.Min(1, j*float64(a.Size+b.Size)/(1+j)/float64(min))
+}
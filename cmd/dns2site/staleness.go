@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/metrics"
+)
+
+// staleness trains on each epoch in data and tests on it and every later
+// epoch, with the folds of openFold, and logs how the metrics of each
+// classifier decay with the gap between the epochs.  The metrics of every
+// pair of epochs are written to name as CSV.
+func staleness(name string, data map[int][]sample, classifiers []classifier,
+	openFold map[int]int, unmonitored func(int) bool) error {
+	seen := make(map[int]bool)
+	var epochs []int
+	for _, samples := range data {
+		for _, s := range samples {
+			if !seen[s.epoch] {
+				seen[s.epoch] = true
+				epochs = append(epochs, s.epoch)
+			}
+		}
+	}
+	sort.Ints(epochs)
+
+	out := "classifier,train,test,gap,tp,fpp,fnp,fn,tn,recall,precision,fpr,accuracy\n"
+	byGap := make([]map[int][]metrics.Confusion, len(classifiers))
+	for i := range byGap {
+		byGap[i] = make(map[int][]metrics.Confusion)
+	}
+	for i, train := range epochs {
+		for _, test := range epochs[i:] {
+			if !trainEpochs.Has(train) || !testEpochs.Has(test) {
+				continue
+			}
+			logging.Infof("training on epoch %d, testing on epoch %d", train, test)
+			forFold, notTraining := epochFolds(data, epoch.Set{train: true},
+				epoch.Set{test: true}, openFold, unmonitored)
+			results := make([][]metrics.Confusion, len(classifiers))
+			for fold := 0; fold < *folds; fold++ {
+				fps := training(data, notTraining(fold), unmonitored)
+				for ci, c := range classifiers {
+					result := testing(data, fps, forFold(fold), c)
+					results[ci] = append(results[ci], evaluate(result, c.threshold(),
+						unmonitored))
+				}
+			}
+			for ci, c := range classifiers {
+				r := results[ci]
+				byGap[ci][test-train] = append(byGap[ci][test-train], r...)
+				m := metrics.Sum(r)
+				out += fmt.Sprintf("%s,%d,%d,%d,%d,%d,%d,%d,%d,%f,%f,%f,%f\n", c.name,
+					train, test, test-train, m.TP, m.FPP, m.FNP, m.FN, m.TN,
+					metrics.Recall(r), metrics.Precision(r), metrics.FPR(r),
+					metrics.Accuracy(r))
+			}
+		}
+	}
+
+	for ci, c := range classifiers {
+		gaps := make([]int, 0, len(byGap[ci]))
+		for gap := range byGap[ci] {
+			gaps = append(gaps, gap)
+		}
+		sort.Ints(gaps)
+		for _, gap := range gaps {
+			r := byGap[ci][gap]
+			logging.Infof("%s: %d epochs apart, %.3f recall, %.3f precision, %.3f FPR, %.3f accuracy",
+				c.name, gap, metrics.Recall(r), metrics.Precision(r), metrics.FPR(r),
+				metrics.Accuracy(r))
+		}
+	}
+	if err := ioutil.WriteFile(name, []byte(out), 0666); err != nil {
+		return fmt.Errorf("failed to write %s (%s)", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/intern"
+	"github.com/pylls/defector/logging"
+)
+
+// streamed is a request in a stream and the site of the file it is from, 0
+// if the file name has no site
+type streamed struct {
+	request
+	site int
+}
+
+// readStream merges .dns files into one stream of requests ordered by time.
+// Only v2 files have times, so requests of v1 files are all at time 0 and
+// v1 and v2 files cannot be mixed.
+func readStream(files []string) (stream []streamed, err error) {
+	timed := false
+	for i, name := range files {
+		site := 0
+		base := path.Base(name)
+		if i := strings.Index(base, "-"); i > 0 {
+			site, _ = strconv.Atoi(base[:i])
+		}
+		f, err := gzfile.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stream file (%s)", err)
+		}
+		s := dnsfile.NewScanner(f)
+		reqs, err := scanRequests(s)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stream file %s (%s)", name, err)
+		}
+		if i == 0 {
+			timed = s.Timed()
+		} else if s.Timed() != timed {
+			return nil, fmt.Errorf("stream file %s is not of the same version as %s: "+
+				"v1 and v2 .dns files cannot be mixed", name, files[0])
+		}
+		internRequests(reqs)
+		for _, r := range reqs {
+			stream = append(stream, streamed{request: r, site: site})
+		}
+	}
+	sort.SliceStable(stream, func(i, j int) bool {
+		return stream[i].time < stream[j].time
+	})
+	return
+}
+
+// window is the domains requested in [start, end) of a stream and the sites
+// they were requested for
+type window struct {
+	start, end float64
+	domains    intern.Set
+	sites      map[int]bool
+}
+
+// slide returns the windows of size seconds every step seconds over the
+// stream, which must be ordered by time
+func slide(stream []streamed, size, step float64) (windows []window) {
+	if len(stream) == 0 {
+		return
+	}
+	first := 0
+	for start := stream[0].time; start <= stream[len(stream)-1].time; start += step {
+		w := window{
+			start: start,
+			end:   start + size,
+			sites: make(map[int]bool),
+		}
+		for first < len(stream) && stream[first].time < w.start {
+			first++
+		}
+		var ids []uint32
+		for i := first; i < len(stream) && stream[i].time < w.end; i++ {
+			ids = append(ids, stream[i].id)
+			w.sites[stream[i].site] = true
+		}
+		w.domains = intern.NewSet(ids)
+		if len(w.domains) > 0 {
+			windows = append(windows, w)
+		}
+	}
+	return
+}
+
+// classifyMany finds all monitored sites visited in a window, even if their
+// visits interleave: after a site is found, the domains of its profile are
+// removed and the rest classified again, until no monitored site is found
+func classifyMany(domains intern.Set, fps fingerprints,
+	c classifier) (classes []int, scores []float64) {
+	rest := domains
+	found := make(map[int]bool)
+	for len(rest) > 0 {
+		class, score := c.classify(rest, fps)
+		if class == -1 || score < c.threshold() || found[class] {
+			break
+		}
+		found[class] = true
+		classes = append(classes, class)
+		scores = append(scores, score)
+		left := rest.Minus(fps.profiles[class])
+		if len(left) == len(rest) { // nothing removed
+			break
+		}
+		rest = left
+	}
+	return
+}
+
+// classifyStream classifies every window of the stream with each
+// classifier, finding sites with classifyMany or, with -multilabel, as all
+// sites at or above the threshold.  How many of the monitored sites visited
+// in the windows were found is logged, and the classes of each window are
+// written to <classifier>.stream.csv in -streamdir.
+func classifyStream(stream []streamed, fps fingerprints,
+	classifiers []classifier, unmonitored func(int) bool) error {
+	windows := slide(stream, *windowSize, *windowStep)
+	logging.Infof("classifying %d windows of %.1fs every %.1fs over %d requests",
+		len(windows), *windowSize, *windowStep, len(stream))
+	for _, c := range classifiers {
+		var m multiMetrics
+		out := "start,end,sites,classes,scores\n"
+		for _, w := range windows {
+			var classes []int
+			var scores []float64
+			if *multiLabel {
+				all := c.scores(w.domains, fps)
+				classes = labels(all, c.threshold())
+				for _, class := range classes {
+					scores = append(scores, all[class])
+				}
+			} else {
+				classes, scores = classifyMany(w.domains, fps, c)
+			}
+			predicted := make(map[int]bool)
+			for _, class := range classes {
+				predicted[class] = true
+			}
+			visited := make(map[int]bool)
+			var sites []int
+			for site := range w.sites {
+				if site > 0 && !unmonitored(site) {
+					visited[site] = true
+					sites = append(sites, site)
+				}
+			}
+			m.add(visited, predicted)
+
+			sort.Ints(sites)
+			var s []string
+			for _, score := range scores {
+				s = append(s, strconv.FormatFloat(score, 'f', 4, 64))
+			}
+			out += fmt.Sprintf("%.3f,%.3f,%s,%s,%s\n", w.start, w.end,
+				joinInts(sites), joinInts(classes), strings.Join(s, " "))
+		}
+		logging.Infof("%s: %d found, %d wrong, %d missed monitored sites in windows",
+			c.name, m.tp, m.fp, m.fn)
+		logMultiLabel(c.name, m)
+
+		if *streamDir != "" {
+			file := path.Join(*streamDir, c.name+".stream.csv")
+			if err := ioutil.WriteFile(file, []byte(out), 0666); err != nil {
+				return fmt.Errorf("failed to write %s (%s)", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// joinInts joins ints with spaces, to fit a list in a CSV column
+func joinInts(ints []int) string {
+	s := make([]string, len(ints))
+	for i, n := range ints {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, " ")
+}
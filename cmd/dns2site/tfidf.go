@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+
+	"github.com/pylls/defector/intern"
+)
+
+// getIDF returns the inverse site frequency log(N/n) of every domain, where
+// N is the number of sites and n the number of sites the domain is on, in
+// the training samples of all sites (monitored or not)
+func getIDF(data map[int][]sample,
+	forTesting func(int, int) bool) (idf map[uint32]float64) {
+	seen := getSeenSites(data, forTesting)
+	sites := make(map[int]bool)
+	df := make(map[uint32]int)
+	for id, s := range seen {
+		distinct := make(map[int]bool)
+		for _, site := range s {
+			distinct[site] = true
+			sites[site] = true
+		}
+		df[id] = len(distinct)
+	}
+	idf = make(map[uint32]float64)
+	for domain, n := range df {
+		idf[domain] = math.Log(float64(len(sites)) / float64(n))
+	}
+	return
+}
+
+// classifyTFIDF weights each domain by its inverse site frequency, so rare
+// domains count more and ubiquitous ones (e.g., CDNs) less, and picks the
+// monitored site with the highest cosine similarity to the observed domains,
+// scored by that similarity.  Domains not seen in training are ignored.
+func classifyTFIDF(domains intern.Set, fps fingerprints) (class int,
+	score float64) {
+	return best(scoreTFIDF(domains, fps))
+}
+
+// scoreTFIDF is the weighted cosine similarity of the observed domains to
+// the profile of every monitored site sharing a domain with them
+func scoreTFIDF(domains intern.Set,
+	fps fingerprints) (scores map[int]float64) {
+	var observed float64
+	for _, d := range domains {
+		observed += fps.idf[d] * fps.idf[d]
+	}
+	if observed == 0 {
+		return make(map[int]float64)
+	}
+	return prior.weigh(fps.index.cosine(domains, observed, fps.idf))
+}
@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+
+// tiePolicies are the ways to pick the class among sites with the same best
+// score: "rank" picks the lowest site (the highest ranked), "reject" none
+// (unmonitored), and "popularity" the most popular site by -prior (by rank
+// without one)
+var tiePolicies = []string{"rank", "reject", "popularity"}
+
+func checkTiePolicy(policy string) error {
+	for _, p := range tiePolicies {
+		if p == policy {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown tie-breaking policy %q (rank, reject or popularity)", policy)
+}
+
+// breakTie picks the class among tied sites, sorted in increasing order, by
+// -ties
+func breakTie(tied []int) int {
+	switch *tiePolicy {
+	case "reject":
+		return -1
+	case "popularity":
+		class := tied[0]
+		for _, site := range tied[1:] {
+			if prior.relative(site) > prior.relative(class) {
+				class = site
+			}
+		}
+		return class
+	}
+	return tied[0]
+}
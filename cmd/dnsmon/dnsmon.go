@@ -0,0 +1,221 @@
+/*
+Package main implements dnsmon, monitoring DNS in real time to find the
+websites visited by clients, the operational version of evaluating dns2site
+offline.  The fingerprints are served by dns2site:
+
+	dns2site -load fps.gob.gz -serve localhost:8080
+	dnsmon -i eth0 -classify http://localhost:8080/classify
+
+DNS is sniffed on the interface -i, read from the pcap -r (e.g., to replay a
+capture), or read as dnstap from the Frame Streams socket -dnstap of a
+resolver, a path of a Unix socket or a host:port for TCP.  The source of a
+domain is the client: of a query its source address, of a response its
+destination address, and with dnstap the query address.  Resolvers should
+log client messages, as messages to authoritative servers are from the
+resolver itself.
+
+For every source, the distinct domains it looked up within a sliding window
+of the last -window seconds are kept, and every time a new domain is added,
+the window is classified.  A monitored site is logged as a match, and
+written to the -o CSV, unless it is the site last matched for the source
+within the window.  Times are of the observed packets, so that a replayed
+capture is classified as it happened.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+var (
+	iface      = flag.String("i", "", "the interface to sniff DNS on")
+	readFile   = flag.String("r", "", "the pcap to read DNS from")
+	dnstapAddr = flag.String("dnstap", "",
+		"the Frame Streams socket (path, or host:port for TCP) to read dnstap from")
+	snaplen     = flag.Int("snaplen", 65535, "the snaplen when sniffing")
+	classifyURL = flag.String("classify", "http://localhost:8080/classify",
+		"the URL of dns2site -serve to classify windows with")
+	windowSize = flag.Float64("window", 10,
+		"the seconds of DNS to keep per source and classify")
+	output = flag.String("o", "", "write every match as CSV to this file")
+)
+
+// observation is domains looked up by a source at a time
+type observation struct {
+	time    float64 // seconds since the epoch
+	source  string
+	domains []string
+}
+
+// window is the recent domains of a source
+type window struct {
+	seen      map[string]float64 // domain -> last seen
+	site      int                // last matched, -1 if none
+	matchedAt float64
+}
+
+type classifyResponse struct {
+	Site       int     `json:"site"`
+	Confidence float64 `json:"confidence"`
+}
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("dnsmon")
+	provenance.Init("dnsmon")
+	inputs := 0
+	for _, in := range []string{*iface, *readFile, *dnstapAddr} {
+		if in != "" {
+			inputs++
+		}
+	}
+	if inputs != 1 {
+		logging.Fatal("need to specify one of -i, -r and -dnstap")
+	}
+	if *windowSize <= 0 {
+		logging.Fatal("-window must be positive")
+	}
+	var csv *os.File
+	if *output != "" {
+		var err error
+		if csv, err = os.Create(*output); err != nil {
+			logging.Fatalf("failed to create output file (%s)", err)
+		}
+		defer csv.Close()
+		fmt.Fprintln(csv, "time,source,site,confidence,domains")
+	}
+
+	obs := make(chan observation, 1024)
+	go func() {
+		var err error
+		switch {
+		case *iface != "":
+			err = sniff(*iface, obs)
+		case *readFile != "":
+			err = replay(*readFile, obs)
+		default:
+			err = listenDNSTap(*dnstapAddr, obs)
+		}
+		if err != nil {
+			logging.Fatal(err)
+		}
+		close(obs)
+	}()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	windows := make(map[string]*window)
+	observed, matches := 0, 0
+	for o := range obs {
+		observed++
+		if observed%10000 == 0 { // forget idle sources
+			for source, w := range windows {
+				if w.prune(o.time); len(w.seen) == 0 {
+					delete(windows, source)
+				}
+			}
+		}
+		w, exists := windows[o.source]
+		if !exists {
+			w = &window{seen: make(map[string]float64), site: -1}
+			windows[o.source] = w
+		}
+		w.prune(o.time)
+		added := false
+		for _, d := range o.domains {
+			if _, seen := w.seen[d]; !seen {
+				added = true
+			}
+			w.seen[d] = o.time
+		}
+		if !added {
+			continue
+		}
+
+		resp, err := classify(client, w.domains())
+		if err != nil {
+			logging.Warnf("failed to classify window of %s (%s)", o.source, err)
+			continue
+		}
+		if resp.Site == -1 ||
+			(resp.Site == w.site && o.time-w.matchedAt <= *windowSize) {
+			continue
+		}
+		w.site, w.matchedAt = resp.Site, o.time
+		matches++
+		logging.Infof("%s visited site %d (confidence %.2f, %d domains)",
+			o.source, resp.Site, resp.Confidence, len(w.seen))
+		if csv != nil {
+			fmt.Fprintf(csv, "%.6f,%s,%d,%.3f,%d\n", o.time, o.source,
+				resp.Site, resp.Confidence, len(w.seen))
+		}
+	}
+	logging.Infof("done, %d observations, %d matches", observed, matches)
+}
+
+// prune forgets the domains last seen before the window ending at now
+func (w *window) prune(now float64) {
+	for d, t := range w.seen {
+		if t < now-*windowSize {
+			delete(w.seen, d)
+		}
+	}
+}
+
+func (w *window) domains() (domains []string) {
+	for d := range w.seen {
+		domains = append(domains, d)
+	}
+	return
+}
+
+// classify asks dns2site -serve for the site of domains
+func classify(client *http.Client, domains []string) (resp classifyResponse,
+	err error) {
+	body, err := json.Marshal(map[string][]string{"domains": domains})
+	if err != nil {
+		return
+	}
+	r, err := client.Post(*classifyURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("classifier returned %s", r.Status)
+	}
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	return
+}
+
+// dnsDomains returns the distinct domains of the questions and answers of
+// a DNS message
+func dnsDomains(dns *layers.DNS) (domains []string) {
+	seen := make(map[string]bool)
+	add := func(name []byte) {
+		d := strings.TrimSuffix(strings.ToLower(string(name)), ".")
+		if d != "" && !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	for _, q := range dns.Questions {
+		add(q.Name)
+	}
+	for _, a := range dns.Answers {
+		add(a.Name)
+	}
+	return
+}
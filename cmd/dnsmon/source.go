@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pylls/defector/dnstap"
+	"github.com/pylls/defector/logging"
+)
+
+// sniff observes DNS on the interface nic until it fails
+func sniff(nic string, obs chan<- observation) error {
+	handle, err := pcap.OpenLive(nic, int32(*snaplen), false, pcap.BlockForever)
+	if err != nil {
+		return fmt.Errorf("failed to sniff on %s (%s)", nic, err)
+	}
+	defer handle.Close()
+	if err = handle.SetBPFFilter("port 53"); err != nil {
+		return fmt.Errorf("failed to set BPF filter (%s)", err)
+	}
+	logging.Infof("sniffing DNS on %s", nic)
+	observePackets(handle, handle.LinkType(), obs)
+	return nil
+}
+
+// replay observes the DNS in a pcap
+func replay(file string, obs chan<- observation) error {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return fmt.Errorf("failed to open pcap file %s (%s)", file, err)
+	}
+	defer handle.Close()
+	observePackets(handle, handle.LinkType(), obs)
+	return nil
+}
+
+func observePackets(src gopacket.PacketDataSource, link layers.LinkType,
+	obs chan<- observation) {
+	for packet := range gopacket.NewPacketSource(src, link).Packets() {
+		dns, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok || packet.NetworkLayer() == nil {
+			continue
+		}
+		client := packet.NetworkLayer().NetworkFlow().Src()
+		if dns.QR { // a response to the client
+			client = packet.NetworkLayer().NetworkFlow().Dst()
+		}
+		if domains := dnsDomains(dns); len(domains) > 0 {
+			obs <- observation{
+				time:    float64(packet.Metadata().Timestamp.UnixNano()) / 1e9,
+				source:  client.String(),
+				domains: domains,
+			}
+		}
+	}
+}
+
+// listenDNSTap observes the dnstap of every resolver connecting to addr, a
+// Unix socket path or host:port
+func listenDNSTap(addr string, obs chan<- observation) error {
+	network := "unix"
+	if strings.Contains(addr, ":") {
+		network = "tcp"
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for dnstap (%s)", err)
+	}
+	defer l.Close()
+	logging.Infof("reading dnstap on %s %s", network, addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept dnstap connection (%s)", err)
+		}
+		go func() {
+			defer conn.Close()
+			if err := observeDNSTap(dnstap.NewReader(conn, conn), obs); err != nil {
+				logging.Warnf("dnstap connection failed (%s)", err)
+			}
+		}()
+	}
+}
+
+func observeDNSTap(r *dnstap.Reader, obs chan<- observation) error {
+	for {
+		frame, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m, err := dnstap.Unmarshal(frame)
+		if err != nil {
+			logging.Warnf("%s", err)
+			continue
+		}
+		wire, t := m.QueryMessage, m.QueryTime
+		if m.IsResponse() {
+			wire, t = m.ResponseMessage, m.ResponseTime
+		}
+		dns := new(layers.DNS)
+		if wire == nil || dns.DecodeFromBytes(wire, gopacket.NilDecodeFeedback) != nil {
+			continue
+		}
+		if domains := dnsDomains(dns); len(domains) > 0 {
+			obs <- observation{
+				time:    float64(t.UnixNano()) / 1e9,
+				source:  m.QueryAddress.String(),
+				domains: domains,
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Package main implements dnsparquet, converting a data directory of ".dns"
+files (from extractdns) into a Parquet dataset for analysis in, e.g., Spark,
+pandas or DuckDB, and for dnsstats to load much faster than the many small
+files.
+
+	dnsparquet -o <out dir> <data dir>
+
+The dataset is partitioned by site: every -partition sites (by number) are
+written to "sites-<first>-<last>.parquet" in the out dir, with a row group
+per at least -rows rows, and all rows of a site in the same row group.  A
+row is a request, in the order of the .dns file, with the columns:
+
+	site      int32   the site of the sample
+	instance  int32   the instance of the sample
+	domain    string  the domain
+	ttl       int32   the TTL, as returned by the DNS server
+	ips       string  the IPs, comma-separated (empty if none)
+	time      double  the time in seconds since the epoch, 0 if not v2
+	epoch     int32   the epoch of the sample, 0 if not collected in epochs
+
+A sample without any requests is kept as a single row with an empty domain
+and a TTL of -1.  The samples of each site are in the order of the files in
+the data directory, as dnsstats reads them.
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/parquet"
+	"github.com/pylls/defector/provenance"
+)
+
+var (
+	out       = flag.String("o", "", "the dir to write the Parquet dataset to")
+	partition = flag.Int("partition", 1000, "the number of sites per Parquet file")
+	groupRows = flag.Int("rows", 100000, "the minimum number of rows per row group")
+
+	columns = []parquet.Column{
+		{Name: "site", Type: parquet.Int32},
+		{Name: "instance", Type: parquet.Int32},
+		{Name: "domain", Type: parquet.String},
+		{Name: "ttl", Type: parquet.Int32},
+		{Name: "ips", Type: parquet.String},
+		{Name: "time", Type: parquet.Double},
+		{Name: "epoch", Type: parquet.Int32},
+	}
+)
+
+// dataFile is a .dns file of an instance of a site
+type dataFile struct {
+	site, instance, epoch int
+	name                  string
+}
+
+// rows are the values of the columns of a row group
+type rows struct {
+	site, instance []int32
+	domain         []string
+	ttl            []int32
+	ips            []string
+	time           []float64
+	epoch          []int32
+}
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("dnsparquet")
+	provenance.Init("dnsparquet")
+	if len(flag.Args()) != 1 {
+		logging.Fatal("need to specify one data dir")
+	}
+	if *out == "" {
+		logging.Fatal("need to specify out dir with -o")
+	}
+	if *partition <= 0 || *groupRows <= 0 {
+		logging.Fatal("-partition and -rows must be positive")
+	}
+	files, err := listData(flag.Arg(0))
+	if err != nil {
+		logging.Fatalf("failed to read data dir (%s)", err)
+	}
+	if len(files) == 0 {
+		logging.Fatalf("no .dns files in %s", flag.Arg(0))
+	}
+	if err = os.MkdirAll(*out, 0755); err != nil {
+		logging.Fatalf("failed to create out dir (%s)", err)
+	}
+
+	total := 0
+	for start := 0; start < len(files); {
+		p := files[start].site / *partition
+		end := start
+		for end < len(files) && files[end].site / *partition == p {
+			end++
+		}
+		name := path.Join(*out, fmt.Sprintf("sites-%d-%d.parquet",
+			p**partition, (p+1)**partition-1))
+		n, err := writePartition(name, files[start:end])
+		if err != nil {
+			logging.Fatalf("failed to write %s (%s)", name, err)
+		}
+		logging.Infof("wrote %d rows of %d samples to %s", n, end-start, name)
+		total += n
+		start = end
+	}
+	logging.Infof("done, %d rows of %d samples", total, len(files))
+}
+
+// listData lists the .dns and .dns.gz files in dir by site, keeping the
+// order of the files of each site
+func listData(dir string) (files []dataFile, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		f, ok := epoch.ParseFile(info.Name())
+		if info.IsDir() || !ok || info.Name() != f.Sample+".dns" &&
+			info.Name() != f.Sample+".dns.gz" {
+			continue
+		}
+		files = append(files, dataFile{site: f.Site, instance: f.Instance,
+			epoch: f.Epoch, name: path.Join(dir, info.Name())})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].site < files[j].site
+	})
+	return
+}
+
+// writePartition writes the files, sorted by site, as a Parquet file
+func writePartition(name string, files []dataFile) (n int, err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	w, err := parquet.NewWriter(bw, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	var r rows
+	for i, file := range files {
+		if err = r.read(file); err != nil {
+			return n, fmt.Errorf("failed to read %s (%s)", file.name, err)
+		}
+		last := i == len(files)-1
+		if last || (len(r.site) >= *groupRows && files[i+1].site != file.site) {
+			n += len(r.site)
+			if err = w.WriteRowGroup([]interface{}{r.site, r.instance, r.domain,
+				r.ttl, r.ips, r.time, r.epoch}); err != nil {
+				return n, err
+			}
+			r = rows{}
+		}
+	}
+	if err = w.Close(); err != nil {
+		return n, err
+	}
+	if err = bw.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// read adds the requests of file to the rows
+func (r *rows) read(file dataFile) error {
+	in, err := gzfile.Open(file.name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	add := func(domain string, ttl int, ips string, t float64) {
+		r.site = append(r.site, int32(file.site))
+		r.instance = append(r.instance, int32(file.instance))
+		r.domain = append(r.domain, domain)
+		r.ttl = append(r.ttl, int32(ttl))
+		r.ips = append(r.ips, ips)
+		r.time = append(r.time, t)
+		r.epoch = append(r.epoch, int32(file.epoch))
+	}
+	scanner := dnsfile.NewScanner(in)
+	added := false
+	for scanner.Scan() {
+		req := scanner.Request()
+		add(req.Domain, req.TTL, strings.Join(req.IPs, ","), req.Time)
+		added = true
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if !added {
+		add("", -1, "", 0)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+)
+
+// anonymitySets returns, for each site, the size of its anonymity set: the
+// number of sites (itself included) that request every domain it requests.
+// A site with an anonymity set of one is identified by its set of domains,
+// even without a single unique domain.
+func anonymitySets(domainsPerSite map[int]map[string]bool,
+	seen map[string][]int) map[int]int {
+	sets := make(map[int]int)
+	for site, domains := range domainsPerSite {
+		// intersect the sites of every domain of the site
+		var candidates map[int]bool
+		for domain := range domains {
+			next := make(map[int]bool)
+			for _, s := range seen[domain] {
+				if candidates == nil || candidates[s] {
+					next[s] = true
+				}
+			}
+			candidates = next
+			if len(candidates) == 1 {
+				break // only the site itself left
+			}
+		}
+		if candidates == nil {
+			// no domains, every site requests them all
+			sets[site] = len(domainsPerSite)
+			continue
+		}
+		sets[site] = len(candidates)
+	}
+	return sets
+}
+
+// writeAnonymityCSV writes dir/anonymity.csv with the anonymity set size of
+// each site
+func writeAnonymityCSV(dir string, sets map[int]int) error {
+	var sites []int
+	for site := range sets {
+		sites = append(sites, site)
+	}
+	sort.Ints(sites)
+	out := "site,anonymitySet\n"
+	for _, site := range sites {
+		out += fmt.Sprintf("%d,%d\n", site, sets[site])
+	}
+	err := ioutil.WriteFile(path.Join(dir, "anonymity.csv"), []byte(out), 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write anonymity.csv (%s)", err)
+	}
+	return nil
+}
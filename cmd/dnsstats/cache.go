@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// cacheVersion changes whenever the format of the cache or how data is
+// loaded changes, invalidating all old caches
+const cacheVersion = 1
+
+// cache is a parsed dataset with every string stored once, referred to by
+// its index in Strings
+type cache struct {
+	Version int
+	Strings []string
+	Sites   []cachedSite
+}
+
+type cachedSite struct {
+	Site    int
+	Samples []cachedSample
+}
+
+type cachedSample struct {
+	Domains []int32
+	TTLs    []int32
+	IPs     [][]int32
+}
+
+// cacheKey hashes what decides the contents of a loaded dataset: its files
+// and the flags that change how they are parsed
+func cacheKey(files []dataFile) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "v%d s%d collapse %s\n", cacheVersion, *maxSamples,
+		*collapseMode)
+	if *excludeFile != "" {
+		e, err := ioutil.ReadFile(*excludeFile)
+		if err != nil {
+			return "", err
+		}
+		h.Write(e)
+	}
+	for _, f := range files {
+		info, err := os.Stat(f.name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", f.name, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeCache(name string, data map[int][]sample) error {
+	c := cache{Version: cacheVersion}
+	index := make(map[string]int32)
+	id := func(s string) int32 {
+		i, exists := index[s]
+		if !exists {
+			i = int32(len(c.Strings))
+			index[s] = i
+			c.Strings = append(c.Strings, s)
+		}
+		return i
+	}
+
+	var sites []int
+	for site := range data {
+		sites = append(sites, site)
+	}
+	sort.Ints(sites)
+	for _, site := range sites {
+		cs := cachedSite{Site: site}
+		for _, s := range data[site] {
+			var sam cachedSample
+			for _, req := range s.requests {
+				sam.Domains = append(sam.Domains, id(req.domain))
+				sam.TTLs = append(sam.TTLs, int32(req.ttl))
+				var ips []int32
+				for _, ip := range req.ips {
+					ips = append(ips, id(ip))
+				}
+				sam.IPs = append(sam.IPs, ips)
+			}
+			cs.Samples = append(cs.Samples, sam)
+		}
+		c.Sites = append(c.Sites, cs)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create cache (%s)", err)
+	}
+	if err = gob.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write cache (%s)", err)
+	}
+	return f.Close()
+}
+
+func readCache(name string) (map[int][]sample, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c cache
+	if err = gob.NewDecoder(f).Decode(&c); err != nil {
+		return nil, err
+	}
+	if c.Version != cacheVersion {
+		return nil, fmt.Errorf("cache version %d, expected %d", c.Version,
+			cacheVersion)
+	}
+
+	data := make(map[int][]sample, len(c.Sites))
+	for _, cs := range c.Sites {
+		samples := make([]sample, 0, len(cs.Samples))
+		for _, sam := range cs.Samples {
+			s := sample{requests: make([]request, len(sam.Domains))}
+			for i := range sam.Domains {
+				s.requests[i].domain = c.Strings[sam.Domains[i]]
+				s.requests[i].ttl = int(sam.TTLs[i])
+				for _, ip := range sam.IPs[i] {
+					s.requests[i].ips = append(s.requests[i].ips, c.Strings[ip])
+				}
+			}
+			samples = append(samples, s)
+		}
+		data[cs.Site] = samples
+	}
+	return data, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// netSet is a set of networks as sorted, non-overlapping IP ranges, so
+// finding if an IP is in any of them is a binary search instead of a
+// Contains() for every network.  IPv4 is stored in its 16-byte form.
+type netSet struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	first, last net.IP
+}
+
+func newNetSet(networks []net.IPNet) *netSet {
+	var ranges []ipRange
+	for _, n := range networks {
+		first := n.IP.Mask(n.Mask).To16()
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			// v4 mask, the v4-in-v6 prefix must match exactly
+			mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+		}
+		last := make(net.IP, net.IPv6len)
+		for i := range last {
+			last[i] = first[i] | ^mask[i]
+		}
+		ranges = append(ranges, ipRange{first: first, last: last})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+
+	// merge overlapping ranges
+	s := &netSet{}
+	for _, r := range ranges {
+		if l := len(s.ranges) - 1; l >= 0 &&
+			bytes.Compare(r.first, s.ranges[l].last) <= 0 {
+			if bytes.Compare(r.last, s.ranges[l].last) > 0 {
+				s.ranges[l].last = r.last
+			}
+			continue
+		}
+		s.ranges = append(s.ranges, r)
+	}
+	return s
+}
+
+// contains returns true if ip is in any of the networks of the set
+func (s *netSet) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// the first range that ends at or after ip
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].last, ip) >= 0
+	})
+	return i < len(s.ranges) && bytes.Compare(s.ranges[i].first, ip) <= 0
+}
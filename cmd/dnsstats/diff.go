@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pylls/defector/logging"
+)
+
+// diffReport compares two datasets of the same sites, e.g., collected a
+// month apart, to show how quickly DNS fingerprints go stale
+type diffReport struct {
+	Sites           int        `json:"sites"`           // in both datasets
+	Jaccard         summary    `json:"jaccard_percent"` // per site
+	UniqueBefore    int        `json:"unique_before"`
+	UniqueAfter     int        `json:"unique_after"`
+	UniqueKept      int        `json:"unique_kept"` // unique in both
+	CommonDomains   int        `json:"common_domains"`
+	TTLChanged      int        `json:"ttl_changed"` // of the common domains
+	MeanTTLDrift    float64    `json:"mean_ttl_drift"`
+	MeanAbsTTLDrift float64    `json:"mean_abs_ttl_drift"`
+	PerSite         []siteDiff `json:"per_site"`
+}
+
+type siteDiff struct {
+	Site         int      `json:"site"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	Jaccard      float64  `json:"jaccard"`
+	UniqueBefore int      `json:"unique_before"`
+	UniqueAfter  int      `json:"unique_after"`
+	UniqueKept   int      `json:"unique_kept"`
+}
+
+// siteDomains returns, for each site, the set of domains in all its samples
+func siteDomains(data map[int][]sample) map[int]map[string]bool {
+	out := make(map[int]map[string]bool)
+	for site, samples := range data {
+		out[site] = make(map[string]bool)
+		for _, s := range samples {
+			for _, req := range s.requests {
+				out[site][req.domain] = true
+			}
+		}
+	}
+	return out
+}
+
+// domainSiteCount returns on how many sites each domain is
+func domainSiteCount(domains map[int]map[string]bool) map[string]int {
+	count := make(map[string]int)
+	for _, set := range domains {
+		for domain := range set {
+			count[domain]++
+		}
+	}
+	return count
+}
+
+// meanTTLs returns the mean TTL of each domain
+func meanTTLs(data map[int][]sample) map[string]float64 {
+	sum := make(map[string]float64)
+	count := make(map[string]int)
+	for _, samples := range data {
+		for _, s := range samples {
+			for _, req := range s.requests {
+				sum[req.domain] += float64(req.ttl)
+				count[req.domain]++
+			}
+		}
+	}
+	for domain := range sum {
+		sum[domain] /= float64(count[domain])
+	}
+	return sum
+}
+
+func diff(before, after map[int][]sample) (r diffReport) {
+	domainsBefore, domainsAfter := siteDomains(before), siteDomains(after)
+	countBefore := domainSiteCount(domainsBefore)
+	countAfter := domainSiteCount(domainsAfter)
+
+	var sites []int
+	for site := range domainsBefore {
+		if _, exists := domainsAfter[site]; exists {
+			sites = append(sites, site)
+		}
+	}
+	sort.Ints(sites)
+	r.Sites = len(sites)
+
+	var jaccards []int // in percent, for summarize
+	for _, site := range sites {
+		a, b := domainsBefore[site], domainsAfter[site]
+		d := siteDiff{
+			Site:    site,
+			Jaccard: jaccard(a, b),
+		}
+		for domain := range a {
+			if !b[domain] {
+				d.Removed = append(d.Removed, domain)
+			}
+			if countBefore[domain] == 1 {
+				d.UniqueBefore++
+				if b[domain] && countAfter[domain] == 1 {
+					d.UniqueKept++
+				}
+			}
+		}
+		for domain := range b {
+			if !a[domain] {
+				d.Added = append(d.Added, domain)
+			}
+			if countAfter[domain] == 1 {
+				d.UniqueAfter++
+			}
+		}
+		sort.Strings(d.Added)
+		sort.Strings(d.Removed)
+		r.UniqueBefore += d.UniqueBefore
+		r.UniqueAfter += d.UniqueAfter
+		r.UniqueKept += d.UniqueKept
+		jaccards = append(jaccards, int(math.Round(d.Jaccard*100)))
+		r.PerSite = append(r.PerSite, d)
+	}
+	r.Jaccard = summarize(jaccards)
+
+	ttlBefore, ttlAfter := meanTTLs(before), meanTTLs(after)
+	var drift, absDrift float64
+	for domain, t := range ttlBefore {
+		u, exists := ttlAfter[domain]
+		if !exists {
+			continue
+		}
+		r.CommonDomains++
+		if t != u {
+			r.TTLChanged++
+		}
+		drift += u - t
+		absDrift += math.Abs(u - t)
+	}
+	if r.CommonDomains > 0 {
+		r.MeanTTLDrift = drift / float64(r.CommonDomains)
+		r.MeanAbsTTLDrift = absDrift / float64(r.CommonDomains)
+	}
+	return
+}
+
+func logDiff(r diffReport) {
+	logging.Infof("compared %d sites present in both datasets", r.Sites)
+	logging.Infof("\tdomain set Jaccard index per site (%%) mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+		r.Jaccard.Mean, r.Jaccard.Std, r.Jaccard.Median, r.Jaccard.Min, r.Jaccard.Max)
+	logging.Infof("\t%d unique domains before, %d after, %d unique in both (%.2f%% kept)",
+		r.UniqueBefore, r.UniqueAfter, r.UniqueKept,
+		float64(r.UniqueKept)/float64(r.UniqueBefore)*100)
+	logging.Infof("\t%d domains in both, %d with a different mean TTL",
+		r.CommonDomains, r.TTLChanged)
+	logging.Infof("\tmean TTL drift %.1f, mean absolute TTL drift %.1f",
+		r.MeanTTLDrift, r.MeanAbsTTLDrift)
+}
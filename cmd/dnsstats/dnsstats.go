@@ -1,24 +1,112 @@
 /*
 Package main implements a tool that calculates statistics around DNS from a
 dataset of observed DNS traffic when visiting websites as ranked by Alexa.
-The tool operates on ".dns" files from the extractdns tool.
+The tool operates on ".dns" files from the extractdns tool, where the times in
+v2 files (extractdns -time) are ignored.
+
+Sites using CDNs are found by the IPs of their domains, with the IP ranges of
+each provider given with -provider name=file (repeatable, defaults to the
+-cloudflare file).  Run "dnsstats fetch <dir>" to download the currently
+published ranges of CloudFlare, Fastly, Amazon and Google into dir.
+
+Run "dnsstats diff <before> <after>" to compare two datasets of the same
+sites, e.g., collected a month apart: it reports the churn of each site's
+domain set, how many unique domains stay unique, and how TTLs drift.
+
+Data collected over time with server -recollect is in epochs, named
+"<site>-<instance>-<epoch>.dns".  Only the samples of -trainepochs (e.g.,
+"0" or "0,2-4") are loaded, and "dnsstats diff" compares those of
+-trainepochs to those of -testepochs, which may be in the same dir:
+"dnsstats -trainepochs 0 -testepochs 3 diff <dir>".  Files without an
+epoch are of epoch 0.
+
+Run "dnsstats sweep <dir> [min:max ...]" to recompute the TTL statistics
+that matter for identifying sites for each given (min,max) TTL clamp of Tor
+(0 as max for no upper bound), quantifying what different caching policies
+would do to the attack.  The clamp used otherwise is set with -ttlmin and
+-ttlmax.
+
+Run "dnsstats threshold <dir> [T ...]" to report, for each TTL threshold T
+in seconds, how many sites have a unique domain with a TTL below T, so that
+an exit sees it looked up on every visit if the site is visited through the
+exit at most every T seconds, rather than only Tor's two bounds.  It also
+reports the theoretical probability that a visit to a site is observed at
+the exit, if the site is visited through the exit every T seconds on
+average: T/(T+ttl) for the lowest TTL of a unique domain of the site, and 0
+for sites without any.  The result is written to threshold.csv (in -csvdir,
+if set).  TTLs are clamped as with -t, so use -t=false for the TTLs as
+returned by the DNS server.
+
+Run "dnsstats gain <dir>" to rank all domains by their information gain
+about which site a sample is from, i.e., how much observing whether a
+domain is looked up narrows down the visited site, written to gain.csv (in
+-csvdir, if set) with the entropy of the site among the samples with the
+domain, and whether it is a third-party domain: not of the registrable
+domain of the primary domain (from -alexa) of any site it is on.  The -m
+most informative domains, and third-party domains, are logged.  These are
+the domains that make sites identifiable, and so the ones to pad or block
+in a defense.
+
+Run "dnsstats stability <dir>" for a leave-one-sample-out analysis of how
+many unique domains of each site are found in a held-out sample, and in how
+many of its samples each unique domain appears (written per site to
+stability.csv with -csvdir).
+
+With -etld1, the counts of domains, unique domains and anonymity sets, the
+most frequently requested domains, the family stats and the -topdir files
+(suffixed "-etld1") are also computed for registrable domains (eTLD+1,
+according to the Public Suffix List), next to those for fully qualified
+domain names, and the sweep, threshold, gain, stability and diff modes are computed for
+registrable domains instead.  With
+-exclude, domains matching any pattern in the given file (globs, or regular
+expressions prefixed with "re:") are dropped when loaded, so known noise such
+as OCSP, telemetry and captive-portal checks is ignored by every statistic.
+With -collapse, random per-session subdomains are normalized when loaded:
+"label" strips the leading label (but never below the eTLD+1) and "digits"
+replaces every run of digits with "#".
+
+All results are logged, and with -out also written as a JSON report.  With
+-csvdir, the values behind each computed distribution are written as one CSV
+file per metric.  With -cdfdir, the empirical CDFs of TTLs, domains per
+site, unique domains per site and the number of sites common domains are on
+are written as "value,count,cdf" CSV files, ready for plotting.  With
+-sitedir, a JSON report per site (its domains, unique domains, minimum TTLs,
+providers and how stable its domains are across samples) is written as
+<site>.json.  With -topdir, the unique domains of every site ranked by TTL
+and frequency, and the -topn domains with the highest information gain about
+the visited site, are written as CSV files for building blocklists or lists
+of domains to pad.
+
+Parsing a large dataset takes a long time.  With -cache, the parsed dataset
+is stored in the given folder, keyed by a hash of the names, sizes and
+modification times of its files and of the flags that change what is loaded
+(-s, -exclude and -collapse), so re-runs with, e.g., other -m or -t flags skip
+parsing.  TTLs are cached as returned by the DNS server and clamped after
+loading.
+
+A Parquet dataset from dnsparquet is read instead of the .dns files if the
+data dir has any .parquet files, which is much faster than parsing many
+small files and so is never cached.
 */
 package main
 
 import (
-	"bufio"
 	"encoding/csv"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"path"
-	"strconv"
 	"strings"
 
 	"github.com/montanaflynn/stats"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/domains"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
 )
 
 type sample struct {
@@ -31,113 +119,207 @@ type request struct {
 	ips    []string
 }
 
-const (
-	torMinTTL = 60
-	torMaxTTL = 30 * 60
-)
-
 var (
 	maxShow = flag.Int("m", 5,
 		"the maximum number of most frequently domains to show")
 	alexa = flag.String("alexa", "top-1m.csv",
 		"the Alexa top-1m file with domain names")
-	cloudflare = flag.String("cloudflare", "ips-v4", "the Cloudflare ipv4 blocks")
+	cloudflare = flag.String("cloudflare", "ips-v4",
+		"the Cloudflare IPv4 and/or IPv6 blocks (if no -provider is given)")
 	maxSamples = flag.Int("s", -1, "set a maximum number of samples to load")
 	torTTL     = flag.Bool("t", true, "set the DNS TTL to Tor [min,max]")
-
-	families = map[string][]string{
-		"CloudFlare": {"cloudflare"},
-		"Amazon":     {"amazon", "aws", "s3", "cloudfront", "ec2"},
-		"Google": {"google", "doubleclick", "gstatic", "android.com", "2mdn.net",
-			"cc-dt.com", "gvt1.com", "gvt2.com", "urchin.com", "youtube-nocookie.com",
-			"youtube.com", "youtubeeducation.com", "ytimg.com", "g.co", "goo.gl"},
-		"Facebook": {"facebook", "fbcdn"},
-		"Akamai":   {"akamai", "edgesuite", "edgekey", "srip", "akadns"},
-	}
+	torMinTTL  = flag.Int("ttlmin", 60, "the min TTL of Tor, with -t")
+	torMaxTTL  = flag.Int("ttlmax", 30*60, "the max TTL of Tor, with -t")
+	etld1      = flag.Bool("etld1", false,
+		"also count registrable domains (eTLD+1), and use them instead of FQDNs in other modes")
+	reportFile = flag.String("out", "", "write a JSON report to this file")
+	csvDir     = flag.String("csvdir", "",
+		"write a CSV file per metric with all values to this folder")
+	cdfDir = flag.String("cdfdir", "",
+		"write the empirical CDF and histogram of key metrics to this folder")
+	siteDir = flag.String("sitedir", "",
+		"write a detailed JSON report per site to this folder")
+
+	familiesFile = flag.String("families", "",
+		"JSON file, or YAML if named .yaml or .yml, with family definitions (if empty, the built-in families)")
+	asnFile = flag.String("asn", "",
+		"CSV file of \"cidr,asn\" lines for families defined by ASNs")
+
+	topDir = flag.String("topdir", "",
+		"write the ranked unique and most discriminating domains to this folder")
+	topN = flag.Int("topn", 100,
+		"the number of most discriminating domains to write with -topdir")
+	collapseMode = flag.String("collapse", "",
+		"collapse subdomains: \"label\" strips the leading label, \"digits\" digit runs")
+	cacheDir = flag.String("cache", "",
+		"cache loaded datasets in this folder, to skip parsing on re-runs")
+	excludeFile = flag.String("exclude", "",
+		"file with glob or re: patterns of domains to ignore, one per line")
+	trainEpochList = flag.String("trainepochs", "",
+		"the epochs to load, e.g., 0,2-4, or to compare from with diff (if empty, all)")
+	testEpochList = flag.String("testepochs", "",
+		"the epochs to compare to with diff (if empty, all)")
+
+	providers   = make(providerFiles)
+	exclude     *domains.Exclusions
+	collapse    *domains.Collapser
+	trainEpochs epoch.Set
+	testEpochs  epoch.Set
 )
 
 func main() {
-	flag.Parse()
+	flag.Var(providers, "provider",
+		"name=file[,file] with the IPv4 and/or IPv6 blocks of a provider (repeatable)")
+	provenance.RegisterFlags()
+	config.Parse("dnsstats")
+	provenance.Init("dnsstats")
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify data dir")
+		logging.Fatal("need to specify data dir")
 	}
-
-	log.Printf("getting list of files in %s", flag.Arg(0))
-	files, er := ioutil.ReadDir(flag.Arg(0))
-	if er != nil {
-		log.Fatalf("failed to read data dir (%s)", er)
+	if flag.Arg(0) == "fetch" {
+		if len(flag.Args()) < 2 {
+			logging.Fatal("need to specify dir to fetch provider ranges into")
+		}
+		fetch(flag.Arg(1))
+		return
 	}
-
-	log.Printf("OK, starting to read data from files...")
-
-	// read data
-	data := make(map[int][]sample)
-	for i := 0; i < len(files); i++ {
-		if !files[i].IsDir() && strings.HasSuffix(files[i].Name(), ".dns") {
-			site, err := strconv.Atoi(files[i].Name()[:strings.Index(files[i].Name(),
-				"-")])
-			if err != nil {
-				log.Fatalf("failed to parse site index from file %s (%s)",
-					files[i].Name(), err)
-			}
-			// only load as many samples as specified
-			if *maxSamples != -1 && len(data[site]) >= *maxSamples {
-				continue
-			}
-
-			f, err := os.Open(path.Join(flag.Arg(0), files[i].Name()))
-			if err != nil {
-				log.Fatalf("failed to open file (%s)", err)
+	if *excludeFile != "" {
+		var err error
+		if exclude, err = domains.ReadExclusions(*excludeFile); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	var err error
+	if collapse, err = domains.NewCollapser(*collapseMode); err != nil {
+		logging.Fatal(err)
+	}
+	if trainEpochs, err = epoch.Parse(*trainEpochList); err != nil {
+		logging.Fatal(err)
+	}
+	if testEpochs, err = epoch.Parse(*testEpochList); err != nil {
+		logging.Fatal(err)
+	}
+	if flag.Arg(0) == "sweep" {
+		if len(flag.Args()) < 2 {
+			logging.Fatal("need to specify data dir to sweep TTL clamps on")
+		}
+		logging.Infof("reading data with TTLs as returned by the DNS server")
+		*torTTL = false
+		clamps := flag.Args()[2:]
+		if len(clamps) == 0 {
+			clamps = defaultSweep
+		}
+		sweep(registrableLevel(loadData(flag.Arg(1), trainEpochs)), clamps)
+		return
+	}
+	if flag.Arg(0) == "threshold" {
+		if len(flag.Args()) < 2 {
+			logging.Fatal("need to specify data dir to sweep TTL thresholds on")
+		}
+		thresholds := flag.Args()[2:]
+		if len(thresholds) == 0 {
+			thresholds = defaultThresholds
+		}
+		threshold(registrableLevel(loadData(flag.Arg(1), trainEpochs)), thresholds)
+		return
+	}
+	if flag.Arg(0) == "gain" {
+		if len(flag.Args()) < 2 {
+			logging.Fatal("need to specify data dir to rank domains of")
+		}
+		data := registrableLevel(loadData(flag.Arg(1), trainEpochs))
+		sites, err := readAlexa(*alexa, len(data))
+		if err != nil {
+			logging.Fatalf("failed to read Alexa file (%s)", err)
+		}
+		if err = gainRank(data, sites); err != nil {
+			logging.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "stability" {
+		if len(flag.Args()) < 2 {
+			logging.Fatal("need to specify data dir to analyze")
+		}
+		result := stability(registrableLevel(loadData(flag.Arg(1), trainEpochs)))
+		logStability(result)
+		if *csvDir != "" {
+			if err := writeStability(*csvDir, result); err != nil {
+				logging.Fatal(err)
 			}
-
-			scanner := bufio.NewScanner(f)
-			var sam sample
-			for scanner.Scan() {
-				// format is: domain,ttl<,ip>
-				// where there are 0 or more ",ip"
-				tokens := strings.Split(scanner.Text(), ",")
-				ttl, err := strconv.Atoi(tokens[1])
-				if err != nil {
-					log.Fatalf("failed to parse TTL (%s)", err)
-				}
-				if *torTTL && ttl < torMinTTL {
-					ttl = torMinTTL
-				} else if *torTTL && ttl > torMaxTTL {
-					ttl = torMaxTTL
-				}
-				var ips []string
-				for j := 2; j < len(tokens); j++ {
-					ips = append(ips, tokens[j])
-				}
-				sam.requests = append(sam.requests, request{
-					domain: tokens[0],
-					ttl:    ttl,
-					ips:    ips,
-				})
+			logging.Infof("wrote stability.csv to %s", *csvDir)
+		}
+		return
+	}
+	if flag.Arg(0) == "diff" {
+		before, after := flag.Arg(1), flag.Arg(2)
+		if after == "" && trainEpochs != nil && testEpochs != nil {
+			after = before // compare epochs of the same dir
+		}
+		if before == "" || after == "" {
+			logging.Fatal("need to specify two data dirs, or one with epochs, to compare")
+		}
+		r := diff(registrableLevel(loadData(before, trainEpochs)),
+			registrableLevel(loadData(after, testEpochs)))
+		logDiff(r)
+		if *reportFile != "" {
+			if err := writeReport(r, *reportFile); err != nil {
+				logging.Fatal(err)
 			}
-			data[site] = append(data[site], sam)
-			f.Close()
+			logging.Infof("wrote report to %s", *reportFile)
 		}
+		return
 	}
+	if len(providers) == 0 {
+		providers.Set("CloudFlare=" + *cloudflare)
+	}
+
+	data := loadData(flag.Arg(0), trainEpochs)
 
-	log.Println("reading Alexa and CloudFlare files")
+	logging.Info("reading Alexa and provider files")
 	// the primary sites in the data dir
 	sites, err := readAlexa(*alexa, len(data))
 	if err != nil {
-		log.Fatalf("failed to read Alexa file (%s)", err)
+		logging.Fatalf("failed to read Alexa file (%s)", err)
+	}
+	// provider networks
+	networks := make(map[string]*netSet)
+	for name, files := range providers {
+		var blocks []net.IPNet
+		for _, file := range files {
+			n, err := readNetworks(file)
+			if err != nil {
+				logging.Fatalf("failed to read %s blocks (%s)", name, err)
+			}
+			blocks = append(blocks, n...)
+		}
+		networks[name] = newNetSet(blocks)
+	}
+
+	families := defaultFamilies
+	if *familiesFile != "" {
+		families, err = readFamilies(*familiesFile)
+		if err != nil {
+			logging.Fatal(err)
+		}
 	}
-	// cloudflare networks
-	networks, err := readCloudflare(*cloudflare)
+	asnNetworks, err := readASNs(*asnFile)
 	if err != nil {
-		log.Fatalf("failed to read CloudFlare IPv4 blocks (%s)", err)
+		logging.Fatal(err)
+	}
+	for i := range families {
+		if err = families[i].prepare(asnNetworks); err != nil {
+			logging.Fatal(err)
+		}
 	}
 
-	log.Println("computing data structures seen, ttlmap, and domainsPerSite")
+	logging.Info("computing data structures seen, ttlmap, and domainsPerSite")
 	var domainCountPerSite, domainTTLs []int
 	var mostSeenCount, sampleCount int
 	// for a domain, a list of sites where this domain was requested
 	seen := make(map[string][]int)
-	ttlmap := make(map[string][]int) // for a domain, a list of observed TTLs
+	ttlmap := make(map[string][]int)              // for a domain, a list of observed TTLs
+	domainIPs := make(map[string]map[string]bool) // for a domain, all its IPs
 	domainsPerSite := make(map[int]map[string]bool)
 
 	for site, samples := range data {
@@ -158,13 +340,19 @@ func main() {
 
 				domainTTLs = append(domainTTLs, request.ttl)
 				ttlmap[request.domain] = append(ttlmap[request.domain], request.ttl)
+				if domainIPs[request.domain] == nil {
+					domainIPs[request.domain] = make(map[string]bool)
+				}
+				for _, ip := range request.ips {
+					domainIPs[request.domain][ip] = true
+				}
 			}
 			domainCountPerSite = append(domainCountPerSite, domainCount)
 		}
 		domainsPerSite[site] = domains
 	}
 
-	log.Println("computing primaryDomainTTLs and missingPrimaryDomain")
+	logging.Info("computing primaryDomainTTLs and missingPrimaryDomain")
 	// primary domains stats
 	var primaryDomainTTLs []int
 	var missingPrimaryDomain int
@@ -177,7 +365,7 @@ func main() {
 		}
 	}
 
-	log.Println("computing uniqueDomains and uniqueDomainsTTL")
+	logging.Info("computing uniqueDomains and uniqueDomainsTTL")
 	uniqueDomains := make(map[int][]string)
 	uniqueDomainsTTL := make(map[int][]int)
 	var uniqueTTLs []int
@@ -206,7 +394,7 @@ func main() {
 		}
 	}
 
-	log.Println("computing more uniquestats")
+	logging.Info("computing more uniquestats")
 	var uniqueCount []int  // count the number of unique domains for each site
 	var uniqueMinTTL []int // the lowest TTL for a unique domain for each site
 	var uniqueMinBelowTorMinTTL int
@@ -227,10 +415,10 @@ func main() {
 		if minTTL > -1 {
 			uniqueMinTTL = append(uniqueMinTTL, minTTL)
 
-			if minTTL < torMinTTL {
+			if minTTL < *torMinTTL {
 				uniqueMinBelowTorMinTTL++
 			}
-			if minTTL > torMaxTTL {
+			if minTTL > *torMaxTTL {
 				uniqueMinAboveTorMaxTTL++
 			}
 		}
@@ -244,29 +432,24 @@ func main() {
 	}
 	umean, ustd, umedian, usum, umin, umax := miscStats(uniqueCount)
 
-	log.Println("looking for CloudFlare IPs")
-	// look for CloudFlare IPs
-	primarySitesWithCF := make(map[int]bool)
-	sitesWithCF := make(map[int]bool)
-	for site, samples := range data {
-		for _, s := range samples {
-			for _, r := range s.requests {
-				for _, p := range r.ips {
-					ip := net.ParseIP(p)
-					for _, n := range networks {
-						if n.Contains(ip) {
-							if strings.EqualFold(r.domain, sites[site-1][1]) {
-								primarySitesWithCF[site] = true
-							}
-							sitesWithCF[site] = true
-						}
-					}
-				}
-			}
+	logging.Info("computing anonymity sets")
+	anonymity := anonymitySets(domainsPerSite, seen)
+	var anonymitySizes []int
+	identifiedBySet := 0
+	for _, size := range anonymity {
+		anonymitySizes = append(anonymitySizes, size)
+		if size == 1 {
+			identifiedBySet++
 		}
 	}
 
-	log.Println("writing graphdata")
+	logging.Info("looking for provider IPs")
+	providerUsages := make(map[string]providerStats)
+	for name, n := range networks {
+		providerUsages[name] = providerUsage(data, sites, n)
+	}
+
+	logging.Info("writing graphdata")
 	var csvdata []byte
 	csvdata = append(csvdata, []byte("site,uniqueCount\n")...)
 	for i := 0; i < len(data); i++ {
@@ -276,11 +459,39 @@ func main() {
 
 	err = ioutil.WriteFile("uniquePerDomain.csv", csvdata, 0666)
 	if err != nil {
-		log.Fatalf("failed to write uniquePerDomain.csv (%s)", err)
+		logging.Fatalf("failed to write uniquePerDomain.csv (%s)", err)
+	}
+
+	logging.Info("done, time for results!")
+	rep := report{
+		Sites:             len(data),
+		Samples:           sampleCount,
+		Domains:           len(seen),
+		IncompletePcaps:   missingPrimaryDomain,
+		TorTTL:            *torTTL,
+		TorMinTTL:         *torMinTTL,
+		TorMaxTTL:         *torMaxTTL,
+		ETLD1:             *etld1,
+		PrimaryTTL:        summarize(primaryDomainTTLs),
+		RequestsPerSite:   summarize(domainCountPerSite),
+		TTL:               summarize(domainTTLs),
+		UniquePerSite:     summarize(uniqueCount),
+		SitesWithUnique:   len(uniqueMinTTL),
+		UniqueTTL:         summarize(uniqueTTLs),
+		UniqueMinTTL:      summarize(uniqueMinTTL),
+		CommonDomainSites: summarize(commonDomainSiteCount),
+		AnonymitySet:      summarize(anonymitySizes),
+		IdentifiedBySet:   identifiedBySet,
+		Providers:         providerUsages,
+		Families:          make(map[string]familyStats),
+	}
+	rep.Requests = int(rep.RequestsPerSite.Sum)
+	rep.UniqueDomains = int(rep.UniquePerSite.Sum)
+	if !*torTTL {
+		rep.UniqueMinBelowTorMin = uniqueMinBelowTorMinTTL
+		rep.UniqueMinAboveTorMax = uniqueMinAboveTorMaxTTL
 	}
 
-	log.Println("done, time for results!")
-
 	dmean, dstd, dmedian, dsum, dmin, dmax := miscStats(domainCountPerSite)
 	tmean, tstd, tmedian, _, tmin, tmax := miscStats(domainTTLs)
 	pmean, pstd, pmedian, _, pmin, pmax := miscStats(primaryDomainTTLs)
@@ -288,78 +499,183 @@ func main() {
 	uminTTLmean, uminTTLstd, uminTTLmedian, _, uminTTLmin, uminTTLmax := miscStats(uniqueMinTTL)
 	cmean, cstd, cmedian, _, cmin, cmax := miscStats(commonDomainSiteCount)
 
-	log.Printf("parsed %d sites with %d samples each, total of %.0f DNS requests and %d domains",
+	logging.Infof("parsed %d sites with %d samples each, total of %.0f DNS requests and %d domains",
 		len(data), sampleCount, dsum, len(seen))
-	log.Printf("the dataset has %d incomplete pcaps out of %d",
+	logging.Infof("the dataset has %d incomplete pcaps out of %d",
 		missingPrimaryDomain, len(data)*sampleCount)
 	if *torTTL {
-		log.Printf("DNS TTLs are set as over Tor [%d,%d]", torMinTTL, torMaxTTL)
+		logging.Infof("DNS TTLs are set as over Tor [%d,%d]", *torMinTTL, *torMaxTTL)
 	} else {
-		log.Printf("DNS TTLs are as returned by the DNS server")
+		logging.Infof("DNS TTLs are as returned by the DNS server")
 	}
-	log.Printf("primary sites DNS records TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("primary sites DNS records TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		pmean, pstd, pmedian, pmin, pmax)
-	log.Printf("number of DNS requests per site mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("number of DNS requests per site mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		dmean, dstd, dmedian, dmin, dmax)
-	log.Printf("DNS records TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("DNS records TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		tmean, tstd, tmedian, tmin, tmax)
-	log.Println("for WF-attacks on Tor using DNS:")
-	log.Printf("\t%d unique domains, per site mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Info("for WF-attacks on Tor using DNS:")
+	logging.Infof("\t%d unique domains, per site mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		int(usum), umean, ustd, umedian, umin, umax)
-	log.Printf("\tthere are %d sites with unique domains (%.1f%% of all sites)",
+	logging.Infof("\tthere are %d sites with unique domains (%.1f%% of all sites)",
 		len(uniqueMinTTL), float64(len(uniqueMinTTL))/float64(len(data))*100)
-	log.Printf("\tunique domain TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("\tunique domain TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		uTTLmean, uTTLstd, uTTLmedian, uTTLmin, uTTLmax)
-	log.Printf("\tunique domain _min_ TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("\tunique domain _min_ TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		uminTTLmean, uminTTLstd, uminTTLmedian, uminTTLmin, uminTTLmax)
 	if !*torTTL {
 		// can only compute this if we don't run on Tor TTLs
-		log.Printf("\t%d sites with unique domain TTLs below Tor's min TTL (%.2f%% of all sites)",
+		logging.Infof("\t%d sites with unique domain TTLs below Tor's min TTL (%.2f%% of all sites)",
 			uniqueMinBelowTorMinTTL, float64(uniqueMinBelowTorMinTTL)/float64(len(data))*100)
-		log.Printf("\t%d sites with unique domain TTLs above Tor's max TTL (%.2f%% of all sites)",
+		logging.Infof("\t%d sites with unique domain TTLs above Tor's max TTL (%.2f%% of all sites)",
 			uniqueMinAboveTorMaxTTL, float64(uniqueMinAboveTorMaxTTL)/float64(len(data))*100)
 	}
-	log.Printf("\tcommon domains appear on sites mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("\tcommon domains appear on sites mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		cmean, cstd, cmedian, cmin, cmax)
-
-	log.Printf("IP-addresses that belong to CloudFlare")
-	log.Printf("\tseen at %d primary sites (%.2f%% of all sites)",
-		len(primarySitesWithCF), float64(len(primarySitesWithCF))/float64(len(data))*100)
-	log.Printf("\tseen at %d sites in total (%.2f%% of all sites)",
-		len(sitesWithCF), float64(len(sitesWithCF))/float64(len(data))*100)
-	log.Printf("\t%d non-primary sites (%.2f%% of all sites)",
-		len(sitesWithCF)-len(primarySitesWithCF),
-		float64(len(sitesWithCF)-len(primarySitesWithCF))/float64(len(data))*100)
+	logging.Infof("\tanonymity set (sites requesting every domain of a site) mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+		rep.AnonymitySet.Mean, rep.AnonymitySet.Std, rep.AnonymitySet.Median,
+		rep.AnonymitySet.Min, rep.AnonymitySet.Max)
+	logging.Infof("\t%d sites are identified by their set of domains (%.1f%% of all sites)",
+		identifiedBySet, float64(identifiedBySet)/float64(len(data))*100)
+	var (
+		registrable map[int][]sample // with -etld1
+		regDomains  levelDomains
+	)
+	if *etld1 {
+		registrable = registrableLevel(data)
+		regDomains = newLevelDomains(registrable)
+		r := countLevel(registrable)
+		rep.Registrable = &r
+		logging.Info("for registrable domains (eTLD+1) instead of FQDNs:")
+		logging.Infof("\t%d domains (%d FQDNs), %d unique (%d FQDNs)",
+			r.Domains, len(seen), r.UniqueDomains, rep.UniqueDomains)
+		logging.Infof("\tthere are %d sites with unique domains (%.1f%% of all sites, %d for FQDNs)",
+			r.SitesWithUnique, float64(r.SitesWithUnique)/float64(len(data))*100,
+			len(uniqueMinTTL))
+		logging.Infof("\t%d sites are identified by their set of domains (%.1f%% of all sites, %d for FQDNs)",
+			r.IdentifiedBySet, float64(r.IdentifiedBySet)/float64(len(data))*100,
+			identifiedBySet)
+	}
+
+	for _, name := range providers.names() {
+		ps := providerUsages[name]
+		logging.Infof("IP-addresses that belong to %s", name)
+		logging.Infof("\tseen at %d primary sites (%.2f%% of all sites)",
+			ps.PrimarySites, float64(ps.PrimarySites)/float64(len(data))*100)
+		logging.Infof("\tseen at %d sites in total (%.2f%% of all sites)",
+			ps.Sites, float64(ps.Sites)/float64(len(data))*100)
+		logging.Infof("\t%d non-primary sites (%.2f%% of all sites)",
+			ps.Sites-ps.PrimarySites,
+			float64(ps.Sites-ps.PrimarySites)/float64(len(data))*100)
+		logging.Infof("\tIPv4 at %d sites (%d IPs), IPv6 at %d sites (%d IPs)",
+			ps.SitesV4, ps.IPsV4, ps.SitesV6, ps.IPsV6)
+	}
 
 	seenList := make([][]string, mostSeenCount+1)
 	for site, c := range seen {
 		seenList[len(c)] = append(seenList[len(c)], site)
 	}
-	log.Println("")
-	log.Printf("the %d most frequently requested domains", *maxShow)
+	logging.Info("")
+	logging.Infof("the %d most frequently requested domains", *maxShow)
 	maxIndex := len(seenList) - 1
 	shown := 0
 	maxSum := 0
-	for i := 0; shown < *maxShow; i++ {
+	for i := 0; shown < *maxShow && i <= maxIndex; i++ {
 		if len(seenList[maxIndex-i]) > 0 {
 			shown++
 			out := ""
+			var ttls []int
 			for j := 0; j < len(seenList[maxIndex-i]); j++ {
 				mean, std, median, _, min, max := miscStats(ttlmap[seenList[maxIndex-i][j]])
 				out = fmt.Sprintf("%s (TTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f)",
 					seenList[maxIndex-i][j], mean, std, median, min, max)
+				ttls = append(ttls, ttlmap[seenList[maxIndex-i][j]]...)
 			}
-			log.Printf("\t %d:\t %d\t %s", shown, maxIndex-i, out)
+			logging.Infof("\t %d:\t %d\t %s", shown, maxIndex-i, out)
 			maxSum += maxIndex - i
+			rep.TopDomains = append(rep.TopDomains, topDomain{
+				Rank:    shown,
+				Sites:   maxIndex - i,
+				Domains: seenList[maxIndex-i],
+				TTL:     summarize(ttls),
+			})
 		}
 	}
-	log.Printf("the top %d domains have %d requests (%.2f%% of total)",
+	logging.Infof("the top %d domains have %d requests (%.2f%% of total)",
 		*maxShow, maxSum, float64(maxSum)/dsum*100)
 
-	for family, keywords := range families {
-		log.Println("")
-		log.Printf("%s stats, keywords %s", family, keywords)
-		printFamily(seen, domainsPerSite, ttlmap, dsum, keywords)
+	for _, fam := range families {
+		logging.Info("")
+		logging.Infof("%s stats, keywords %s, %d networks", fam.Name, fam.Keywords,
+			len(fam.networks))
+		rep.Families[fam.Name] = printFamily(seen, domainsPerSite, ttlmap,
+			domainIPs, dsum, fam)
+	}
+	if *etld1 {
+		registrableDetails(rep.Registrable, regDomains, families)
+	}
+
+	if *reportFile != "" {
+		if err = writeReport(rep, *reportFile); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote report to %s", *reportFile)
+	}
+	if *csvDir != "" {
+		metrics := map[string][]int{
+			"requestsPerSite":   domainCountPerSite,
+			"ttl":               domainTTLs,
+			"primaryTTL":        primaryDomainTTLs,
+			"uniquePerSite":     uniqueCount,
+			"uniqueTTL":         uniqueTTLs,
+			"uniqueMinTTL":      uniqueMinTTL,
+			"commonDomainSites": commonDomainSiteCount,
+		}
+		for name, values := range metrics {
+			if err = writeMetricCSV(*csvDir, name, values); err != nil {
+				logging.Fatal(err)
+			}
+		}
+		if err = writeAnonymityCSV(*csvDir, anonymity); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote CSV files for %d metrics and anonymity sets to %s",
+			len(metrics), *csvDir)
+	}
+	if *cdfDir != "" {
+		var domainsPerSiteCount []int
+		for _, domains := range domainsPerSite {
+			domainsPerSiteCount = append(domainsPerSiteCount, len(domains))
+		}
+		cdfs := map[string][]int{
+			"ttl":               domainTTLs,
+			"domainsPerSite":    domainsPerSiteCount,
+			"uniquePerSite":     uniqueCount,
+			"commonDomainSites": commonDomainSiteCount,
+		}
+		for name, values := range cdfs {
+			if err = writeCDF(*cdfDir, name, values); err != nil {
+				logging.Fatal(err)
+			}
+		}
+		logging.Infof("wrote CDFs for %d metrics to %s", len(cdfs), *cdfDir)
+	}
+	if *topDir != "" {
+		err = writeTopDomains(*topDir, "", data, uniqueDomains, ttlmap, *topN)
+		if err == nil && *etld1 {
+			err = writeTopDomains(*topDir, "-etld1", registrable,
+				regDomains.uniqueDomains, regDomains.ttlmap, *topN)
+		}
+		if err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote top domains to %s", *topDir)
+	}
+	if *siteDir != "" {
+		if err = writeSiteReports(*siteDir, data, sites, seen, networks); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote %d site reports to %s", len(data), *siteDir)
 	}
 }
 
@@ -375,51 +691,47 @@ func miscStats(d []int) (mean, std, median, sum, min, max float64) {
 }
 
 func printFamily(seen map[string][]int, domainsPerSite map[int]map[string]bool,
-	ttlmap map[string][]int, totalRequests float64, keywords []string) {
+	ttlmap map[string][]int, domainIPs map[string]map[string]bool,
+	totalRequests float64, fam family) familyStats {
 	seesCount := 0
 	for _, domains := range domainsPerSite {
-		sees := false
 		for domain := range domains {
-			for _, name := range keywords {
-				if strings.Contains(domain, name) {
-					if !strings.Contains(domain, "ocsp") {
-						// ignore OCSP requests (here be dragons)
-						sees = true
-						break
-					}
-				}
-			}
-			if sees {
+			// ignore OCSP requests (here be dragons)
+			if !strings.Contains(domain, "ocsp") &&
+				fam.matches(domain, domainIPs[domain]) {
+				seesCount++
 				break
 			}
 		}
-		if sees {
-			seesCount++
-		}
 	}
 
 	var seenAtDomains []string
 	var requests int
 	for domain, c := range seen {
-		for _, name := range keywords {
-			if strings.Contains(domain, name) {
-				seenAtDomains = append(seenAtDomains, domain)
-				requests += len(c)
-				break
-			}
+		if fam.matches(domain, domainIPs[domain]) {
+			seenAtDomains = append(seenAtDomains, domain)
+			requests += len(c)
 		}
 	}
 	var ttls []int
 	for _, domain := range seenAtDomains {
 		ttls = append(ttls, ttlmap[domain]...)
 	}
-	log.Printf("\tfound on %d sites (%.2f%% of all sites)",
+	logging.Infof("\tfound on %d sites (%.2f%% of all sites)",
 		seesCount, float64(seesCount)/float64(len(domainsPerSite))*100)
-	log.Printf("\t%d unique domains with %d requests (%.2f%% of total)",
+	logging.Infof("\t%d unique domains with %d requests (%.2f%% of total)",
 		len(seenAtDomains), requests, float64(requests)/totalRequests*100)
 	mean, std, median, _, min, max := miscStats(ttls)
-	log.Printf("\tTTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+	logging.Infof("\tTTL mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
 		mean, std, median, min, max)
+
+	return familyStats{
+		Keywords: fam.Keywords,
+		Sites:    seesCount,
+		Domains:  len(seenAtDomains),
+		Requests: requests,
+		TTL:      summarize(ttls),
+	}
 }
 
 func readAlexa(alexafile string, count int) (sites [][]string, err error) {
@@ -436,21 +748,23 @@ func readAlexa(alexafile string, count int) (sites [][]string, err error) {
 	return sites[:count], nil
 }
 
-func readCloudflare(cloudflarefile string) (networks []net.IPNet, err error) {
-	f, err := os.Open(cloudflarefile)
+func readNetworks(networkfile string) (networks []net.IPNet, err error) {
+	f, err := os.Open(networkfile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file with cloudflare ipv4 blocks (%s)", err)
+		return nil, fmt.Errorf("failed to open file with network blocks (%s)", err)
 	}
+	defer f.Close()
 	r := csv.NewReader(f)
 	lines, err := r.ReadAll()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file with cloudflare ipv4 blocks (%s)", err)
+		return nil, fmt.Errorf("failed to read file with network blocks (%s)", err)
 	}
 
+	// both IPv4 and IPv6 CIDRs
 	for _, l := range lines {
-		_, n, err := net.ParseCIDR(l[0])
+		_, n, err := net.ParseCIDR(strings.TrimSpace(l[0]))
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse cloudflare ipv CIDR (%s)", err)
+			return nil, fmt.Errorf("failed to parse CIDR (%s)", err)
 		}
 		networks = append(networks, *n)
 	}
@@ -458,6 +772,17 @@ func readCloudflare(cloudflarefile string) (networks []net.IPNet, err error) {
 	return
 }
 
+// registrableDomain returns the eTLD+1 of domain, or domain itself if it
+// has none (e.g., it is a public suffix)
+func registrableDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	r, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return r
+}
+
 func appendIfNew(data []int, item int) []int {
 	for _, i := range data {
 		if i == item {
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pylls/defector/logging"
+)
+
+// levelCounts are the counts of domains and of how they identify sites at
+// one level of domains, e.g., registrable domains next to FQDNs
+type levelCounts struct {
+	Domains         int     `json:"domains"`
+	UniqueDomains   int     `json:"unique_domains"`
+	UniquePerSite   summary `json:"unique_per_site"`
+	SitesWithUnique int     `json:"sites_with_unique"`
+	AnonymitySet    summary `json:"anonymity_set"`
+	IdentifiedBySet int     `json:"identified_by_set"`
+
+	TopDomains []topDomain            `json:"top_domains,omitempty"`
+	Families   map[string]familyStats `json:"families,omitempty"`
+}
+
+// registrableLevel returns data with every domain replaced by its registrable
+// domain (eTLD+1) with -etld1, otherwise data as is
+func registrableLevel(data map[int][]sample) map[int][]sample {
+	if !*etld1 {
+		return data
+	}
+	registrable := make(map[string]string) // FQDN to eTLD+1, shared strings
+	out := make(map[int][]sample, len(data))
+	for site, samples := range data {
+		out[site] = make([]sample, len(samples))
+		for i, s := range samples {
+			requests := make([]request, len(s.requests))
+			for j, req := range s.requests {
+				r, ok := registrable[req.domain]
+				if !ok {
+					r = registrableDomain(req.domain)
+					registrable[req.domain] = r
+				}
+				req.domain = r
+				requests[j] = req
+			}
+			out[site][i] = sample{requests: requests}
+		}
+	}
+	return out
+}
+
+// countLevel counts the domains of data and how they identify sites
+func countLevel(data map[int][]sample) (c levelCounts) {
+	domainsPerSite := siteDomains(data)
+	seen := make(map[string][]int)
+	var sites []int
+	for site, domains := range domainsPerSite {
+		sites = append(sites, site)
+		for domain := range domains {
+			seen[domain] = append(seen[domain], site)
+		}
+	}
+	sort.Ints(sites) // for deterministic sums
+
+	var uniquePerSite []int
+	for _, site := range sites {
+		unique := 0
+		for domain := range domainsPerSite[site] {
+			if len(seen[domain]) == 1 {
+				unique++
+			}
+		}
+		uniquePerSite = append(uniquePerSite, unique)
+		c.UniqueDomains += unique
+		if unique > 0 {
+			c.SitesWithUnique++
+		}
+	}
+	var setSizes []int
+	for _, size := range anonymitySets(domainsPerSite, seen) {
+		setSizes = append(setSizes, size)
+		if size == 1 {
+			c.IdentifiedBySet++
+		}
+	}
+	c.Domains = len(seen)
+	c.UniquePerSite = summarize(uniquePerSite)
+	c.AnonymitySet = summarize(setSizes)
+	return
+}
+
+// levelDomains are the domains of data at one level, as main computes them
+// for FQDNs: the sites each domain is on, its TTLs and IPs, and the domains
+// and unique domains of each site
+type levelDomains struct {
+	seen           map[string][]int
+	ttlmap         map[string][]int
+	domainIPs      map[string]map[string]bool
+	domainsPerSite map[int]map[string]bool
+	uniqueDomains  map[int][]string
+	requests       int
+}
+
+func newLevelDomains(data map[int][]sample) (l levelDomains) {
+	l.seen = make(map[string][]int)
+	l.ttlmap = make(map[string][]int)
+	l.domainIPs = make(map[string]map[string]bool)
+	l.domainsPerSite = siteDomains(data)
+	l.uniqueDomains = make(map[int][]string)
+	for site, samples := range data {
+		for _, s := range samples {
+			for _, req := range s.requests {
+				l.seen[req.domain] = appendIfNew(l.seen[req.domain], site)
+				l.ttlmap[req.domain] = append(l.ttlmap[req.domain], req.ttl)
+				if l.domainIPs[req.domain] == nil {
+					l.domainIPs[req.domain] = make(map[string]bool)
+				}
+				for _, ip := range req.ips {
+					l.domainIPs[req.domain][ip] = true
+				}
+				l.requests++
+			}
+		}
+	}
+	for domain, sites := range l.seen {
+		if len(sites) == 1 {
+			l.uniqueDomains[sites[0]] = append(l.uniqueDomains[sites[0]], domain)
+		}
+	}
+	return
+}
+
+// topDomains returns the domains on the most sites, ranked by the number of
+// sites, with the domains on as many sites sharing a rank
+func (l levelDomains) topDomains(n int) (top []topDomain) {
+	bySites := make(map[int][]string)
+	for domain, sites := range l.seen {
+		bySites[len(sites)] = append(bySites[len(sites)], domain)
+	}
+	var counts []int
+	for count := range bySites {
+		counts = append(counts, count)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(counts)))
+	for i := 0; i < n && i < len(counts); i++ {
+		domains := bySites[counts[i]]
+		sort.Strings(domains)
+		var ttls []int
+		for _, domain := range domains {
+			ttls = append(ttls, l.ttlmap[domain]...)
+		}
+		top = append(top, topDomain{Rank: i + 1, Sites: counts[i],
+			Domains: domains, TTL: summarize(ttls)})
+	}
+	return
+}
+
+// registrableDetails adds the most frequently requested registrable domains
+// and the stats of families for them to c, logging them
+func registrableDetails(c *levelCounts, l levelDomains, families []family) {
+	logging.Info("")
+	logging.Infof("the %d most frequently requested registrable domains", *maxShow)
+	c.TopDomains = l.topDomains(*maxShow)
+	for _, t := range c.TopDomains {
+		logging.Infof("\t %d:\t %d\t %s", t.Rank, t.Sites, strings.Join(t.Domains, " "))
+	}
+	c.Families = make(map[string]familyStats)
+	for _, fam := range families {
+		logging.Info("")
+		logging.Infof("%s stats for registrable domains", fam.Name)
+		c.Families[fam.Name] = printFamily(l.seen, l.domainsPerSite, l.ttlmap,
+			l.domainIPs, float64(l.requests), fam)
+	}
+}
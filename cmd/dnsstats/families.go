@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/config"
+)
+
+// family is a group of domains belonging to the same provider, identified by
+// keywords in the domain and/or the networks (CIDRs or ASNs) of its IPs
+type family struct {
+	Name     string   `json:"name"`
+	Keywords []string `json:"keywords"`
+	CIDRs    []string `json:"cidrs,omitempty"`
+	ASNs     []int    `json:"asns,omitempty"`
+
+	networks []*net.IPNet
+}
+
+// defaultFamilies are used unless a families file is given
+var defaultFamilies = []family{
+	{Name: "CloudFlare", Keywords: []string{"cloudflare"}},
+	{Name: "Amazon", Keywords: []string{"amazon", "aws", "s3", "cloudfront", "ec2"}},
+	{Name: "Google", Keywords: []string{"google", "doubleclick", "gstatic",
+		"android.com", "2mdn.net", "cc-dt.com", "gvt1.com", "gvt2.com",
+		"urchin.com", "youtube-nocookie.com", "youtube.com", "youtubeeducation.com",
+		"ytimg.com", "g.co", "goo.gl"}},
+	{Name: "Facebook", Keywords: []string{"facebook", "fbcdn"}},
+	{Name: "Akamai", Keywords: []string{"akamai", "edgesuite", "edgekey", "srip",
+		"akadns"}},
+}
+
+// readFamilies reads a list of families, as JSON, e.g.,
+// [{"name": "Fastly", "keywords": ["fastly"], "cidrs": ["151.101.0.0/16"]}]
+// or, if the file is named ".yaml" or ".yml", as YAML (see parseFamiliesYAML)
+func readFamilies(familiesfile string) (families []family, err error) {
+	d, err := ioutil.ReadFile(familiesfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read families file (%s)", err)
+	}
+	switch path.Ext(familiesfile) {
+	case ".yaml", ".yml":
+		families, err = parseFamiliesYAML(d)
+	default:
+		err = json.Unmarshal(d, &families)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse families file (%s)", err)
+	}
+	return
+}
+
+// parseFamiliesYAML parses a YAML list of families, of the subset where each
+// family is a mapping of scalars and lists (in either style), as in the
+// configuration files of the config package:
+//
+//	# families.yaml
+//	- name: Fastly
+//	  keywords: [fastly]
+//	  cidrs:
+//	    - 151.101.0.0/16
+//	  asns: [54113]
+//
+// Unknown keys are an error, to catch typos.
+func parseFamiliesYAML(d []byte) (families []family, err error) {
+	key := "" // with a list on the lines that follow
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for n := 1; scanner.Scan(); n++ {
+		line := config.StripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		item := strings.HasPrefix(trimmed, "- ") || trimmed == "-"
+		if line[0] != ' ' && line[0] != '\t' {
+			if !item {
+				return nil, fmt.Errorf("line %d: expected a family starting with \"- \"", n)
+			}
+			// a new family, maybe with its first key on the same line
+			families = append(families, family{})
+			key, trimmed = "", strings.TrimSpace(trimmed[1:])
+			if trimmed == "" {
+				continue
+			}
+		} else if item {
+			if key == "" {
+				return nil, fmt.Errorf("line %d: list without a key", n)
+			}
+			values, err := config.ParseValue(strings.TrimSpace(trimmed[1:]))
+			if err == nil {
+				err = families[len(families)-1].set(key, values)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			continue
+		} else if len(families) == 0 {
+			return nil, fmt.Errorf("line %d: unexpected indentation", n)
+		}
+
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n)
+		}
+		k, value := strings.TrimSpace(trimmed[:i]), strings.TrimSpace(trimmed[i+1:])
+		key = ""
+		if value == "" {
+			key = k
+			continue
+		}
+		values, err := config.ParseValue(value)
+		if err == nil {
+			err = families[len(families)-1].set(k, values)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	return families, scanner.Err()
+}
+
+// set adds the values of key, as read from YAML, to the family
+func (f *family) set(key string, values []string) error {
+	switch key {
+	case "name":
+		if f.Name != "" || len(values) != 1 {
+			return fmt.Errorf("family has more than one name")
+		}
+		f.Name = values[0]
+	case "keywords":
+		f.Keywords = append(f.Keywords, values...)
+	case "cidrs":
+		f.CIDRs = append(f.CIDRs, values...)
+	case "asns":
+		for _, v := range values {
+			asn, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid ASN %s", v)
+			}
+			f.ASNs = append(f.ASNs, asn)
+		}
+	default:
+		return fmt.Errorf("unknown key %s of family", key)
+	}
+	return nil
+}
+
+// prepare parses the CIDRs of the family and adds the networks of its ASNs
+func (f *family) prepare(asnNetworks map[int][]*net.IPNet) error {
+	for _, c := range f.CIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("failed to parse CIDR %s of family %s (%s)",
+				c, f.Name, err)
+		}
+		f.networks = append(f.networks, n)
+	}
+	for _, asn := range f.ASNs {
+		f.networks = append(f.networks, asnNetworks[asn]...)
+	}
+	return nil
+}
+
+// matches returns true if the domain, or any IP it resolved to, belongs to
+// the family
+func (f family) matches(domain string, ips map[string]bool) bool {
+	for _, name := range f.Keywords {
+		if strings.Contains(domain, name) {
+			return true
+		}
+	}
+	if len(f.networks) == 0 {
+		return false
+	}
+	for p := range ips {
+		ip := net.ParseIP(p)
+		if ip == nil {
+			continue
+		}
+		for _, n := range f.networks {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readASNs reads a CSV file of "cidr,asn" lines mapping networks to ASNs
+func readASNs(asnfile string) (asnNetworks map[int][]*net.IPNet, err error) {
+	asnNetworks = make(map[int][]*net.IPNet)
+	if asnfile == "" {
+		return
+	}
+	f, err := os.Open(asnfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file with ASNs (%s)", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file with ASNs (%s)", err)
+	}
+	for _, l := range lines {
+		_, n, err := net.ParseCIDR(l[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CIDR in ASN file (%s)", err)
+		}
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(l[1]), "AS"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ASN in ASN file (%s)", err)
+		}
+		asnNetworks[asn] = append(asnNetworks[asn], n)
+	}
+	return
+}
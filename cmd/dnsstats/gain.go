@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/pylls/defector/logging"
+)
+
+// gainRank writes the ranking of all domains by their information gain
+// about which site a sample is from to gain.csv, with the entropy of the
+// site among the samples with the domain and whether the domain is a
+// third-party domain, i.e., not of the registrable domain of the primary
+// domain of any site it is on, and logs the most informative ones
+func gainRank(data map[int][]sample, sites [][]string) error {
+	perDomain := domainSamples(data)
+	gain := informationGain(data, perDomain)
+	domains := rankByGain(gain)
+
+	thirdParty := func(domain string) bool {
+		r := registrableDomain(domain)
+		for site := range perDomain[domain] {
+			if site-1 < len(sites) && registrableDomain(sites[site-1][1]) == r {
+				return false
+			}
+		}
+		return true
+	}
+	minTTL := make(map[string]int)
+	for _, samples := range data {
+		for _, s := range samples {
+			for _, req := range s.requests {
+				if m, ok := minTTL[req.domain]; !ok || req.ttl < m {
+					minTTL[req.domain] = req.ttl
+				}
+			}
+		}
+	}
+
+	out := "rank,domain,informationGain,entropy,sites,samples,thirdParty,minTTL\n"
+	logging.Infof("the %d most informative domains", *maxShow)
+	shown, shownThird := 0, 0
+	var third []string
+	for i, d := range domains {
+		samples := 0
+		for _, n := range perDomain[d] {
+			samples += n
+		}
+		tp := thirdParty(d)
+		out += fmt.Sprintf("%d,%s,%f,%f,%d,%d,%t,%d\n", i+1, d, gain[d],
+			entropy(perDomain[d], samples), len(perDomain[d]), samples, tp, minTTL[d])
+		if shown < *maxShow {
+			logging.Infof("\t%d: %s, %.4f bits, on %d sites", i+1, d, gain[d],
+				len(perDomain[d]))
+			shown++
+		}
+		if tp && shownThird < *maxShow {
+			third = append(third, fmt.Sprintf("\t%d: %s, %.4f bits, on %d sites",
+				i+1, d, gain[d], len(perDomain[d])))
+			shownThird++
+		}
+	}
+	logging.Infof("the %d most informative third-party domains", *maxShow)
+	for _, t := range third {
+		logging.Info(t)
+	}
+
+	name := path.Join(*csvDir, "gain.csv")
+	if err := ioutil.WriteFile(name, []byte(out), 0666); err != nil {
+		return fmt.Errorf("failed to write gain.csv (%s)", err)
+	}
+	logging.Infof("wrote the ranking of %d domains to %s", len(domains), name)
+	return nil
+}
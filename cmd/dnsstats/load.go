@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/intern"
+	"github.com/pylls/defector/logging"
+)
+
+// loadData lists, reads and clamps the TTLs of the samples of epochs in the
+// dataset in dir, read from its Parquet files if any, or else from its .dns
+// files using the cache if enabled
+func loadData(dir string, epochs epoch.Set) (data map[int][]sample) {
+	logging.Infof("getting list of files in %s", dir)
+	pfiles, err := listParquet(dir)
+	if err != nil {
+		logging.Fatalf("failed to read data dir (%s)", err)
+	}
+	if len(pfiles) > 0 {
+		logging.Infof("OK, starting to read data from %d Parquet files...", len(pfiles))
+		if data, err = readParquet(pfiles, *maxSamples, epochs); err != nil {
+			logging.Fatal(err)
+		}
+	} else {
+		data = loadFiles(dir, epochs)
+	}
+
+	if before, after := collapse.Stats(); before > 0 && collapse.Mode() != "" {
+		logging.Infof("collapsed %d distinct domains into %d (%s)", before, after,
+			collapse.Mode())
+	}
+	if *torTTL {
+		for _, samples := range data {
+			for _, s := range samples {
+				for i := range s.requests {
+					if s.requests[i].ttl < *torMinTTL {
+						s.requests[i].ttl = *torMinTTL
+					} else if s.requests[i].ttl > *torMaxTTL {
+						s.requests[i].ttl = *torMaxTTL
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// loadFiles reads the .dns files of epochs in dir, using the cache if
+// enabled
+func loadFiles(dir string, epochs epoch.Set) (data map[int][]sample) {
+	files, err := listData(dir, *maxSamples, epochs)
+	if err != nil {
+		logging.Fatalf("failed to read data dir (%s)", err)
+	}
+
+	var cacheFile string
+	if *cacheDir != "" {
+		key, err := cacheKey(files)
+		if err != nil {
+			logging.Fatalf("failed to compute cache key (%s)", err)
+		}
+		cacheFile = path.Join(*cacheDir, key+".cache")
+		data, err = readCache(cacheFile)
+		if err != nil {
+			logging.Infof("no usable cache %s (%s)", cacheFile, err)
+		} else {
+			logging.Infof("read %d sites from cache %s", len(data), cacheFile)
+		}
+	}
+	if data == nil {
+		logging.Infof("OK, starting to read data from %d files...", len(files))
+		data = readData(files)
+		if cacheFile != "" {
+			if err = writeCache(cacheFile, data); err != nil {
+				logging.Fatal(err)
+			}
+			logging.Infof("wrote cache %s", cacheFile)
+		}
+	}
+	return
+}
+
+// dataFile is a .dns file to load and the site it belongs to
+type dataFile struct {
+	site int
+	name string
+}
+
+// listData lists the .dns and .dns.gz files of epochs in dir, at most max
+// per site (unless max is -1), in the order they are found
+func listData(dir string, max int, epochs epoch.Set) (files []dataFile, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	count := make(map[int]int)
+	for _, info := range infos {
+		if info.IsDir() || !(strings.HasSuffix(info.Name(), ".dns") ||
+			strings.HasSuffix(info.Name(), ".dns.gz")) {
+			continue
+		}
+		site, err := strconv.Atoi(info.Name()[:strings.Index(info.Name(), "-")])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse site index from file %s (%s)",
+				info.Name(), err)
+		}
+		epoch, err := epoch.OfFile(info.Name())
+		if err != nil {
+			return nil, err
+		}
+		if !epochs.Has(epoch) {
+			continue
+		}
+		// only load as many samples as specified
+		if max != -1 && count[site] >= max {
+			continue
+		}
+		count[site]++
+		files = append(files, dataFile{site: site, name: path.Join(dir, info.Name())})
+	}
+	return
+}
+
+// readData parses files with one worker per CPU.  Samples are stored per
+// site in the same order as the files, so the result does not depend on
+// how the work was scheduled.
+func readData(files []dataFile) map[int][]sample {
+	samples := make([]sample, len(files))
+	in := intern.New() // shared by the workers, locked per shard
+
+	p := newProgress("reading files", len(files))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				sam, err := readSample(files[i].name, in)
+				if err != nil {
+					logging.Fatalf("failed to read file %s (%s)", files[i].name, err)
+				}
+				samples[i] = sam
+				p.add(1)
+			}
+		}()
+	}
+	for i := range files {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	p.finish()
+
+	// allocate each site's slice once at its final size
+	count := make(map[int]int)
+	for _, f := range files {
+		count[f.site]++
+	}
+	data := make(map[int][]sample, len(count))
+	for i, f := range files {
+		if data[f.site] == nil {
+			data[f.site] = make([]sample, 0, count[f.site])
+		}
+		data[f.site] = append(data[f.site], samples[i])
+	}
+	return data
+}
+
+func readSample(name string, in *intern.Table) (sam sample, err error) {
+	f, err := gzfile.Open(name)
+	if err != nil {
+		return sam, err
+	}
+	defer f.Close()
+
+	scanner := dnsfile.NewScanner(f)
+	for scanner.Scan() {
+		r := scanner.Request()
+		if exclude.Excluded(r.Domain) {
+			continue
+		}
+		var ips []string
+		if len(r.IPs) > 0 {
+			ips = make([]string, len(r.IPs))
+			for j, ip := range r.IPs {
+				ips[j] = in.Intern(ip)
+			}
+		}
+		sam.requests = append(sam.requests, request{
+			domain: in.Intern(collapse.Collapse(r.Domain)),
+			ttl:    r.TTL,
+			ips:    ips,
+		})
+	}
+	if err = scanner.Err(); err != nil {
+		return sam, err
+	}
+	// trim the spare capacity left by append
+	sam.requests = append([]request(nil), sam.requests...)
+	return sam, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/intern"
+	"github.com/pylls/defector/parquet"
+)
+
+// listParquet lists the .parquet files in dir, from dnsparquet
+func listParquet(dir string) (files []string, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".parquet") {
+			files = append(files, path.Join(dir, info.Name()))
+		}
+	}
+	return
+}
+
+// readParquet reads the samples of epochs in a dataset from dnsparquet, at
+// most max samples per site (unless max is -1), parsing domains as
+// readSample does.  The rows of a
+// sample are consecutive, and the samples of a site are in the order of
+// the .dns files they were exported from.
+func readParquet(files []string, max int, epochs epoch.Set) (map[int][]sample, error) {
+	data := make(map[int][]sample)
+	in := intern.New()
+	p := newProgress("reading parquet files", len(files))
+
+	var current *sample
+	lastSite, lastInstance, lastEpoch := int32(-1), int32(-1), int32(-1)
+	flush := func() {
+		if current != nil {
+			// trim the spare capacity left by append
+			current.requests = append([]request(nil), current.requests...)
+			data[int(lastSite)] = append(data[int(lastSite)], *current)
+			current = nil
+		}
+	}
+	for _, name := range files {
+		groups, err := readParquetFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s (%s)", name, err)
+		}
+		for _, g := range groups {
+			for i := range g.site {
+				if g.site[i] != lastSite || g.instance[i] != lastInstance ||
+					g.epoch[i] != lastEpoch {
+					flush()
+					lastSite, lastInstance, lastEpoch = g.site[i], g.instance[i], g.epoch[i]
+					if epochs.Has(int(lastEpoch)) &&
+						(max == -1 || len(data[int(lastSite)]) < max) {
+						current = new(sample)
+					}
+				}
+				if current == nil || g.domain[i] == "" || exclude.Excluded(g.domain[i]) {
+					continue
+				}
+				var ips []string
+				if g.ips[i] != "" {
+					ips = strings.Split(g.ips[i], ",")
+					for j := range ips {
+						ips[j] = in.Intern(ips[j])
+					}
+				}
+				current.requests = append(current.requests, request{
+					domain: in.Intern(collapse.Collapse(g.domain[i])),
+					ttl:    int(g.ttl[i]),
+					ips:    ips,
+				})
+			}
+		}
+		p.add(1)
+	}
+	flush()
+	p.finish()
+	return data, nil
+}
+
+// parquetRows are the columns of a row group that dnsstats uses
+type parquetRows struct {
+	site, instance, ttl, epoch []int32
+	domain, ips                []string
+}
+
+func readParquetFile(name string) (groups []parquetRows, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pf, err := parquet.Open(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for i, c := range pf.Columns {
+		index[c.Name] = i
+	}
+	for _, c := range []parquet.Column{
+		{Name: "site", Type: parquet.Int32},
+		{Name: "instance", Type: parquet.Int32},
+		{Name: "domain", Type: parquet.String},
+		{Name: "ttl", Type: parquet.Int32},
+		{Name: "ips", Type: parquet.String},
+	} {
+		i, exists := index[c.Name]
+		if !exists || pf.Columns[i].Type != c.Type {
+			return nil, fmt.Errorf("no %s column of the right type", c.Name)
+		}
+	}
+	for g := 0; g < pf.RowGroups(); g++ {
+		values, err := pf.ReadRowGroup(g)
+		if err != nil {
+			return nil, err
+		}
+		rows := parquetRows{
+			site:     values[index["site"]].([]int32),
+			instance: values[index["instance"]].([]int32),
+			domain:   values[index["domain"]].([]string),
+			ttl:      values[index["ttl"]].([]int32),
+			ips:      values[index["ips"]].([]string),
+		}
+		// datasets from before epochs were exported are all of epoch 0
+		rows.epoch = make([]int32, len(rows.site))
+		if i, exists := index["epoch"]; exists && pf.Columns[i].Type == parquet.Int32 {
+			rows.epoch = values[i].([]int32)
+		}
+		groups = append(groups, rows)
+	}
+	return
+}
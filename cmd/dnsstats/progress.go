@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pylls/defector/logging"
+)
+
+// progressInterval is how often a progress line is logged at most
+const progressInterval = 5 * time.Second
+
+// progress logs how far a long-running stage has come, with an ETA based on
+// the rate so far.  It is safe for concurrent use.
+type progress struct {
+	sync.Mutex
+	stage       string
+	done, total int
+	start, last time.Time
+}
+
+func newProgress(stage string, total int) *progress {
+	now := time.Now()
+	return &progress{stage: stage, total: total, start: now, last: now}
+}
+
+// add marks n more items as done
+func (p *progress) add(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.done += n
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval || p.done >= p.total {
+		return
+	}
+	p.last = now
+	elapsed := now.Sub(p.start)
+	eta := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+	logging.Infof("\t%s: %d/%d (%.1f%%), ETA %s", p.stage, p.done, p.total,
+		float64(p.done)/float64(p.total)*100, eta.Round(time.Second))
+}
+
+// finish logs the time the stage took
+func (p *progress) finish() {
+	logging.Infof("\t%s: done with %d in %s", p.stage, p.total,
+		time.Since(p.start).Round(time.Millisecond))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pylls/defector/logging"
+)
+
+// providerFiles is a repeatable flag of name=file[,file...] pairs
+type providerFiles map[string][]string
+
+func (p providerFiles) String() string {
+	var out []string
+	for name, files := range p {
+		out = append(out, name+"="+strings.Join(files, ","))
+	}
+	sort.Strings(out)
+	return strings.Join(out, " ")
+}
+
+func (p providerFiles) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expected name=file, got %s", value)
+	}
+	p[value[:i]] = append(p[value[:i]], strings.Split(value[i+1:], ",")...)
+	return nil
+}
+
+// names returns the sorted provider names
+func (p providerFiles) names() (names []string) {
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// providerUsage finds the sites that resolve (primary) domains to IPs in
+// the networks of a provider, looking at each site in parallel
+func providerUsage(data map[int][]sample, sites [][]string,
+	networks *netSet) (ps providerStats) {
+	type siteUsage struct {
+		primary, any, v4, v6 bool
+		ipsV4, ipsV6         int
+	}
+	work := make(chan int)
+	results := make(chan siteUsage)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range work {
+				var u siteUsage
+				for _, s := range data[site] {
+					for _, r := range s.requests {
+						for _, p := range r.ips {
+							ip := net.ParseIP(p)
+							if ip == nil || !networks.contains(ip) {
+								continue
+							}
+							if strings.EqualFold(r.domain, sites[site-1][1]) {
+								u.primary = true
+							}
+							u.any = true
+							if ip.To4() != nil {
+								u.v4 = true
+								u.ipsV4++
+							} else {
+								u.v6 = true
+								u.ipsV6++
+							}
+						}
+					}
+				}
+				results <- u
+			}
+		}()
+	}
+	go func() {
+		for site := range data {
+			work <- site
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+
+	p := newProgress("checking sites for provider IPs", len(data))
+	for u := range results {
+		p.add(1)
+		if u.primary {
+			ps.PrimarySites++
+		}
+		if u.any {
+			ps.Sites++
+		}
+		if u.v4 {
+			ps.SitesV4++
+		}
+		if u.v6 {
+			ps.SitesV6++
+		}
+		ps.IPsV4 += u.ipsV4
+		ps.IPsV6 += u.ipsV6
+	}
+	p.finish()
+	return
+}
+
+// published IP ranges of providers, parsed by fetchRanges
+var publishedRanges = []struct {
+	name, url string
+}{
+	{"CloudFlare", "https://www.cloudflare.com/ips-v4"},
+	{"CloudFlare", "https://www.cloudflare.com/ips-v6"},
+	{"Fastly", "https://api.fastly.com/public-ip-list"},
+	{"Amazon", "https://ip-ranges.amazonaws.com/ip-ranges.json"},
+	{"Google", "https://www.gstatic.com/ipranges/goog.json"},
+}
+
+// fetch downloads the currently published IP ranges of all known providers
+// into dir, one file per provider with one CIDR per line, as expected by
+// the -provider flag
+func fetch(dir string) {
+	ranges := make(map[string][]string)
+	for _, p := range publishedRanges {
+		logging.Infof("fetching %s ranges from %s", p.name, p.url)
+		cidrs, err := fetchRanges(p.url)
+		if err != nil {
+			logging.Fatalf("failed to fetch ranges for %s (%s)", p.name, err)
+		}
+		ranges[p.name] = append(ranges[p.name], cidrs...)
+	}
+
+	var flags []string
+	for name, cidrs := range ranges {
+		file := path.Join(dir, strings.ToLower(name)+".txt")
+		err := ioutil.WriteFile(file, []byte(strings.Join(cidrs, "\n")+"\n"), 0666)
+		if err != nil {
+			logging.Fatalf("failed to write %s (%s)", file, err)
+		}
+		logging.Infof("wrote %d ranges for %s to %s", len(cidrs), name, file)
+		flags = append(flags, "-provider "+name+"="+file)
+	}
+	sort.Strings(flags)
+	logging.Infof("use with: %s", strings.Join(flags, " "))
+}
+
+func fetchRanges(url string) (cidrs []string, err error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", resp.Status)
+	}
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(url, ".json") && !strings.Contains(url, "fastly") {
+		// plain list of CIDRs
+		return strings.Fields(string(d)), nil
+	}
+	var ranges struct {
+		// Fastly
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+		// Amazon and Google
+		Prefixes []struct {
+			IPPrefix   string `json:"ip_prefix"`
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err = json.Unmarshal(d, &ranges); err != nil {
+		return nil, err
+	}
+	cidrs = append(ranges.Addresses, ranges.IPv6Addresses...)
+	for _, p := range ranges.Prefixes {
+		cidrs = append(cidrs, p.IPPrefix+p.IPv4Prefix+p.IPv6Prefix)
+	}
+	for _, p := range ranges.IPv6Prefixes {
+		cidrs = append(cidrs, p.IPv6Prefix)
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// report is the machine-readable version of everything dnsstats logs
+type report struct {
+	Sites           int  `json:"sites"`
+	Samples         int  `json:"samples_per_site"`
+	Requests        int  `json:"requests"`
+	Domains         int  `json:"domains"`
+	IncompletePcaps int  `json:"incomplete_pcaps"`
+	TorTTL          bool `json:"tor_ttl"`
+	TorMinTTL       int  `json:"tor_min_ttl"`
+	TorMaxTTL       int  `json:"tor_max_ttl"`
+	ETLD1           bool `json:"etld1"` // with counts in Registrable
+
+	PrimaryTTL      summary `json:"primary_ttl"`
+	RequestsPerSite summary `json:"requests_per_site"`
+	TTL             summary `json:"ttl"`
+
+	UniqueDomains        int     `json:"unique_domains"`
+	UniquePerSite        summary `json:"unique_per_site"`
+	SitesWithUnique      int     `json:"sites_with_unique"`
+	UniqueTTL            summary `json:"unique_ttl"`
+	UniqueMinTTL         summary `json:"unique_min_ttl"`
+	UniqueMinBelowTorMin int     `json:"unique_min_below_tor_min,omitempty"`
+	UniqueMinAboveTorMax int     `json:"unique_min_above_tor_max,omitempty"`
+	CommonDomainSites    summary `json:"common_domain_sites"`
+	AnonymitySet         summary `json:"anonymity_set"`     // per site
+	IdentifiedBySet      int     `json:"identified_by_set"` // anonymity set 1
+
+	// the counts, top domains and families for registrable domains, next to
+	// those for FQDNs, with -etld1
+	Registrable *levelCounts `json:"registrable,omitempty"`
+
+	Providers map[string]providerStats `json:"providers"`
+
+	TopDomains []topDomain            `json:"top_domains"`
+	Families   map[string]familyStats `json:"families"`
+}
+
+type summary struct {
+	Mean   float64 `json:"mean"`
+	Std    float64 `json:"std"`
+	Median float64 `json:"median"`
+	Sum    float64 `json:"sum"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+type topDomain struct {
+	Rank    int      `json:"rank"`
+	Sites   int      `json:"sites"` // number of sites the domains are on
+	Domains []string `json:"domains"`
+	TTL     summary  `json:"ttl"` // of all the domains
+}
+
+// providerStats are for IPs in the networks of a provider (CDN)
+type providerStats struct {
+	PrimarySites int `json:"primary_sites"`
+	Sites        int `json:"sites"`
+	SitesV4      int `json:"sites_v4"`
+	SitesV6      int `json:"sites_v6"`
+	IPsV4        int `json:"ips_v4"`
+	IPsV6        int `json:"ips_v6"`
+}
+
+type familyStats struct {
+	Keywords []string `json:"keywords"`
+	Sites    int      `json:"sites"`
+	Domains  int      `json:"domains"`
+	Requests int      `json:"requests"`
+	TTL      summary  `json:"ttl"`
+}
+
+// summarize is miscStats for reports, empty data is all zeros (JSON has no NaN)
+func summarize(d []int) (s summary) {
+	if len(d) == 0 {
+		return
+	}
+	s.Mean, s.Std, s.Median, s.Sum, s.Min, s.Max = miscStats(d)
+	return
+}
+
+// writeReport writes r, a report or diffReport, as indented JSON
+func writeReport(r interface{}, name string) error {
+	d, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report (%s)", err)
+	}
+	err = ioutil.WriteFile(name, d, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write report %s (%s)", name, err)
+	}
+	return nil
+}
+
+// writeMetricCSV writes all values of a metric, one per line, to dir/name.csv
+func writeMetricCSV(dir, name string, values []int) error {
+	out := []byte(name + "\n")
+	for _, v := range values {
+		out = strconv.AppendInt(out, int64(v), 10)
+		out = append(out, '\n')
+	}
+	err := ioutil.WriteFile(path.Join(dir, name+".csv"), out, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write %s.csv (%s)", name, err)
+	}
+	return nil
+}
+
+// writeCDF writes the empirical distribution of values to dir/name.cdf.csv:
+// for every distinct value (ascending) how many times it occurs and the
+// fraction of all values that are less than or equal to it
+func writeCDF(dir, name string, values []int) error {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+
+	out := []byte("value,count,cdf\n")
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j] == sorted[i] {
+			j++
+		}
+		out = append(out, fmt.Sprintf("%d,%d,%f\n", sorted[i], j-i,
+			float64(j)/float64(len(sorted)))...)
+		i = j
+	}
+	err := ioutil.WriteFile(path.Join(dir, name+".cdf.csv"), out, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write %s.cdf.csv (%s)", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// siteReport is everything about a single site, to drill into why it is (or
+// is not) identifiable from its DNS requests
+type siteReport struct {
+	Site          int      `json:"site"`
+	Primary       string   `json:"primary_domain"`
+	Samples       int      `json:"samples"`
+	Domains       []string `json:"domains"`
+	UniqueDomains []string `json:"unique_domains"`
+	MinTTL        int      `json:"min_ttl"`
+	UniqueMinTTL  int      `json:"unique_min_ttl"` // -1 if no unique domains
+	Providers     []string `json:"providers"`      // with IPs in their networks
+
+	// stability across samples
+	DomainsPerSample []int    `json:"domains_per_sample"`
+	InAllSamples     []string `json:"in_all_samples"`
+	MeanJaccard      float64  `json:"mean_jaccard"` // between pairs of samples
+}
+
+// writeSiteReports writes dir/<site>.json for every site in data
+func writeSiteReports(dir string, data map[int][]sample, sites [][]string,
+	seen map[string][]int, networks map[string]*netSet) error {
+	for site, samples := range data {
+		r := siteReport{
+			Site:         site,
+			Samples:      len(samples),
+			MinTTL:       -1,
+			UniqueMinTTL: -1,
+		}
+		if site-1 < len(sites) {
+			r.Primary = sites[site-1][1]
+		}
+
+		all := make(map[string]int) // domain -> number of samples with it
+		providers := make(map[string]bool)
+		var sets []map[string]bool
+		for _, s := range samples {
+			set := make(map[string]bool)
+			for _, req := range s.requests {
+				set[req.domain] = true
+				if r.MinTTL == -1 || req.ttl < r.MinTTL {
+					r.MinTTL = req.ttl
+				}
+				if len(seen[req.domain]) == 1 &&
+					(r.UniqueMinTTL == -1 || req.ttl < r.UniqueMinTTL) {
+					r.UniqueMinTTL = req.ttl
+				}
+				for name, n := range networks {
+					if !providers[name] && anyInNetworks(req.ips, n) {
+						providers[name] = true
+					}
+				}
+			}
+			for domain := range set {
+				all[domain]++
+			}
+			sets = append(sets, set)
+			r.DomainsPerSample = append(r.DomainsPerSample, len(set))
+		}
+
+		for domain, count := range all {
+			r.Domains = append(r.Domains, domain)
+			if len(seen[domain]) == 1 {
+				r.UniqueDomains = append(r.UniqueDomains, domain)
+			}
+			if count == len(samples) {
+				r.InAllSamples = append(r.InAllSamples, domain)
+			}
+		}
+		for name := range providers {
+			r.Providers = append(r.Providers, name)
+		}
+		sort.Strings(r.Domains)
+		sort.Strings(r.UniqueDomains)
+		sort.Strings(r.InAllSamples)
+		sort.Strings(r.Providers)
+		r.MeanJaccard = meanJaccard(sets)
+
+		d, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode site report (%s)", err)
+		}
+		name := path.Join(dir, strconv.Itoa(site)+".json")
+		if err = ioutil.WriteFile(name, d, 0666); err != nil {
+			return fmt.Errorf("failed to write site report %s (%s)", name, err)
+		}
+	}
+	return nil
+}
+
+func anyInNetworks(ips []string, networks *netSet) bool {
+	for _, p := range ips {
+		if ip := net.ParseIP(p); ip != nil && networks.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// meanJaccard is the mean Jaccard index over all pairs of sets, 1 if there
+// are less than two sets
+func meanJaccard(sets []map[string]bool) float64 {
+	if len(sets) < 2 {
+		return 1
+	}
+	var sum float64
+	var pairs int
+	for i := 0; i < len(sets); i++ {
+		for j := i + 1; j < len(sets); j++ {
+			sum += jaccard(sets[i], sets[j])
+			pairs++
+		}
+	}
+	return sum / float64(pairs)
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	intersection := 0
+	for k := range a {
+		if b[k] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
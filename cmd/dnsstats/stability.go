@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/pylls/defector/logging"
+)
+
+// siteStability is how stable the unique domains of a site are across its
+// samples (instances)
+type siteStability struct {
+	site    int
+	unique  int   // unique domains, over all samples
+	inK     []int // index k: unique domains in exactly k samples
+	samples int
+	score   float64 // leave-one-sample-out, see stability()
+}
+
+// stability performs leave-one-sample-out analysis: for every sample index,
+// the unique domains of each site are found in all other samples and we
+// check how many of them show up in the held-out sample.  The score of a
+// site is the mean fraction found, i.e., how likely a fingerprint of unique
+// domains is to match a new visit.
+func stability(data map[int][]sample) (result []siteStability) {
+	maxSamples := 0
+	for _, samples := range data {
+		if len(samples) > maxSamples {
+			maxSamples = len(samples)
+		}
+	}
+
+	found := make(map[int]float64) // site -> sum of fractions found
+	folds := make(map[int]int)     // site -> folds with unique domains
+	p := newProgress("leaving out samples", maxSamples)
+	for fold := 0; fold < maxSamples; fold++ {
+		p.add(1)
+		heldOut := func(site, samp int) bool {
+			return samp == fold
+		}
+		unique := getUniqueDomains(data, heldOut)
+		for site, domains := range unique {
+			if fold >= len(data[site]) || len(domains) == 0 {
+				continue
+			}
+			// only the held-out sample of the site itself counts
+			inHeldOut := make(map[string]bool)
+			for _, req := range data[site][fold].requests {
+				inHeldOut[req.domain] = true
+			}
+			hits := 0
+			for _, domain := range domains {
+				if inHeldOut[domain] {
+					hits++
+				}
+			}
+			found[site] += float64(hits) / float64(len(domains))
+			folds[site]++
+		}
+	}
+	p.finish()
+
+	all := getUniqueDomains(data, func(int, int) bool { return false })
+	for site, samples := range data {
+		s := siteStability{
+			site:    site,
+			unique:  len(all[site]),
+			inK:     make([]int, len(samples)+1),
+			samples: len(samples),
+		}
+		for _, domain := range all[site] {
+			k := 0
+			for _, sam := range samples {
+				for _, req := range sam.requests {
+					if req.domain == domain {
+						k++
+						break
+					}
+				}
+			}
+			s.inK[k]++
+		}
+		if folds[site] > 0 {
+			s.score = found[site] / float64(folds[site])
+		}
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].site < result[j].site })
+	return
+}
+
+func logStability(result []siteStability) {
+	var scores, inAll []int // scores in percent, for summarize
+	for _, s := range result {
+		scores = append(scores, int(s.score*100))
+		inAll = append(inAll, s.inK[s.samples])
+	}
+	sc, ia := summarize(scores), summarize(inAll)
+	logging.Infof("leave-one-sample-out stability of %d sites", len(result))
+	logging.Infof("\tunique domains found in held-out sample (%%) per site mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+		sc.Mean, sc.Std, sc.Median, sc.Min, sc.Max)
+	logging.Infof("\tunique domains in every sample per site mean %.1f, std %.1f, median %.1f, min %.1f, max %.1f",
+		ia.Mean, ia.Std, ia.Median, ia.Min, ia.Max)
+}
+
+// writeStability writes dir/stability.csv with a line per site: its unique
+// domains, how many of them are in k of its n samples, and its score
+func writeStability(dir string, result []siteStability) error {
+	maxSamples := 0
+	for _, s := range result {
+		if s.samples > maxSamples {
+			maxSamples = s.samples
+		}
+	}
+	out := "site,samples,unique,score"
+	for k := 0; k <= maxSamples; k++ {
+		out += fmt.Sprintf(",in%d", k)
+	}
+	out += "\n"
+	for _, s := range result {
+		out += fmt.Sprintf("%d,%d,%d,%f", s.site, s.samples, s.unique, s.score)
+		for k := 0; k <= maxSamples; k++ {
+			n := 0
+			if k < len(s.inK) {
+				n = s.inK[k]
+			}
+			out += fmt.Sprintf(",%d", n)
+		}
+		out += "\n"
+	}
+	err := ioutil.WriteFile(path.Join(dir, "stability.csv"), []byte(out), 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write stability.csv (%s)", err)
+	}
+	return nil
+}
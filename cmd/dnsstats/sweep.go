@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/logging"
+)
+
+// defaultSweep are the (min,max) TTL clamps swept if none are given: Tor's
+// current policy and variations of its bounds
+var defaultSweep = []string{"0:0", "60:1800", "300:1800", "60:3600",
+	"300:3600", "600:3600", "1800:1800", "3600:3600"}
+
+// clamp is the TTL as cached by a resolver clamping to [min,max], where 0 as
+// max means no upper bound
+func clamp(ttl, min, max int) int {
+	if ttl < min {
+		return min
+	}
+	if max > 0 && ttl > max {
+		return max
+	}
+	return ttl
+}
+
+func parseClamp(s string) (min, max int, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected min:max, got %s", s)
+	}
+	if min, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse min TTL (%s)", err)
+	}
+	if max, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse max TTL (%s)", err)
+	}
+	if max > 0 && max < min {
+		return 0, 0, fmt.Errorf("max TTL %d is below min TTL %d", max, min)
+	}
+	return
+}
+
+// sweep recomputes the TTL statistics that matter for identifying sites for
+// each (min,max) clamp, on data loaded with unclamped TTLs
+func sweep(data map[int][]sample, clamps []string) {
+	count := domainSiteCount(siteDomains(data))
+
+	csv := "min,max,ttlMean,ttlMedian,uniqueTTLMean,uniqueMinTTLMean," +
+		"uniqueMinTTLMedian,uniqueMinTTLMax\n"
+	for _, c := range clamps {
+		min, max, err := parseClamp(c)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		var ttls, uniqueTTLs, uniqueMinTTL []int
+		for _, samples := range data {
+			siteMin := -1
+			for _, s := range samples {
+				for _, req := range s.requests {
+					ttl := clamp(req.ttl, min, max)
+					ttls = append(ttls, ttl)
+					if count[req.domain] == 1 {
+						uniqueTTLs = append(uniqueTTLs, ttl)
+						if siteMin == -1 || ttl < siteMin {
+							siteMin = ttl
+						}
+					}
+				}
+			}
+			if siteMin > -1 {
+				uniqueMinTTL = append(uniqueMinTTL, siteMin)
+			}
+		}
+		t, u, m := summarize(ttls), summarize(uniqueTTLs), summarize(uniqueMinTTL)
+		logging.Infof("TTL clamp [%d,%d]: TTL mean %.1f, median %.1f, unique domain TTL mean %.1f, unique _min_ TTL mean %.1f, median %.1f, max %.1f",
+			min, max, t.Mean, t.Median, u.Mean, m.Mean, m.Median, m.Max)
+		csv += fmt.Sprintf("%d,%d,%f,%f,%f,%f,%f,%f\n", min, max, t.Mean,
+			t.Median, u.Mean, m.Mean, m.Median, m.Max)
+	}
+
+	if *csvDir != "" {
+		err := ioutil.WriteFile(path.Join(*csvDir, "sweep.csv"), []byte(csv), 0666)
+		if err != nil {
+			logging.Fatalf("failed to write sweep.csv (%s)", err)
+		}
+		logging.Infof("wrote sweep to %s", path.Join(*csvDir, "sweep.csv"))
+	}
+}
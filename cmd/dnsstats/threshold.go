@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+
+	"github.com/pylls/defector/logging"
+)
+
+// defaultThresholds are the TTL thresholds (seconds) swept if none are given
+var defaultThresholds = []string{"10", "30", "60", "120", "300", "600", "1800",
+	"3600", "7200", "21600", "86400"}
+
+// uniqueMinTTLs returns the lowest TTL of a unique domain of every site with
+// unique domains
+func uniqueMinTTLs(data map[int][]sample) map[int]int {
+	count := domainSiteCount(siteDomains(data))
+	min := make(map[int]int)
+	for site, samples := range data {
+		for _, s := range samples {
+			for _, req := range s.requests {
+				if count[req.domain] != 1 {
+					continue
+				}
+				if m, ok := min[site]; !ok || req.ttl < m {
+					min[site] = req.ttl
+				}
+			}
+		}
+	}
+	return min
+}
+
+// observation is the probability that a visit to a site with a unique
+// domain of TTL ttl makes the exit resolve it, when the site is visited
+// through the exit every threshold seconds on average (Poisson): the domain
+// is cached for ttl seconds after each lookup, during which threshold/ttl
+// visits on average hit the cache
+func observation(ttl, threshold int) float64 {
+	if threshold <= 0 {
+		return 0
+	}
+	return float64(threshold) / float64(threshold+ttl)
+}
+
+// threshold reports for each TTL threshold how many sites have a unique
+// domain with a TTL below it, i.e., that are looked up again at the exit on
+// every visit if the site is visited at most every threshold seconds, and
+// the mean probability that a visit to a site is observed at the exit
+func threshold(data map[int][]sample, thresholds []string) {
+	min := uniqueMinTTLs(data)
+	logging.Infof("%d of %d sites have unique domains", len(min), len(data))
+
+	csv := "threshold,sites,sitesWithUnique,sitesBelow,fractionBelow,observation\n"
+	for _, t := range thresholds {
+		threshold, err := strconv.Atoi(t)
+		if err != nil || threshold < 0 {
+			logging.Fatalf("failed to parse TTL threshold %s", t)
+		}
+		below, p := 0, 0.0
+		for _, ttl := range min {
+			if ttl < threshold {
+				below++
+			}
+			p += observation(ttl, threshold)
+		}
+		fraction := float64(below) / float64(len(data))
+		p /= float64(len(data)) // sites without unique domains are never observed
+		logging.Infof("TTL threshold %ds: %d sites with a unique domain below (%.2f%% of all sites), observation probability %.3f",
+			threshold, below, fraction*100, p)
+		csv += fmt.Sprintf("%d,%d,%d,%d,%f,%f\n", threshold, len(data), len(min),
+			below, fraction, p)
+	}
+
+	name := path.Join(*csvDir, "threshold.csv")
+	if err := ioutil.WriteFile(name, []byte(csv), 0666); err != nil {
+		logging.Fatalf("failed to write threshold.csv (%s)", err)
+	}
+	logging.Infof("wrote threshold sweep to %s", name)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+)
+
+// domainSamples returns, for each domain, on how many samples of each site
+// it was requested
+func domainSamples(data map[int][]sample) map[string]map[int]int {
+	out := make(map[string]map[int]int)
+	for site, samples := range data {
+		for _, s := range samples {
+			done := make(map[string]bool)
+			for _, req := range s.requests {
+				if done[req.domain] {
+					continue
+				}
+				done[req.domain] = true
+				if out[req.domain] == nil {
+					out[req.domain] = make(map[int]int)
+				}
+				out[req.domain][site]++
+			}
+		}
+	}
+	return out
+}
+
+// entropy of a distribution given as counts summing to total
+func entropy(counts map[int]int, total int) (h float64) {
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			h -= p * math.Log2(p)
+		}
+	}
+	return
+}
+
+// informationGain returns the information gain (in bits) about which site a
+// sample is from, by observing if each domain is requested or not
+func informationGain(data map[int][]sample,
+	perDomain map[string]map[int]int) map[string]float64 {
+	siteSamples := make(map[int]int)
+	total := 0
+	for site, samples := range data {
+		siteSamples[site] = len(samples)
+		total += len(samples)
+	}
+	h := entropy(siteSamples, total)
+
+	gain := make(map[string]float64)
+	for domain, with := range perDomain {
+		without := make(map[int]int)
+		nWith := 0
+		for site, n := range siteSamples {
+			without[site] = n - with[site]
+			nWith += with[site]
+		}
+		nWithout := total - nWith
+		conditional := float64(nWith) / float64(total) * entropy(with, nWith)
+		if nWithout > 0 {
+			conditional += float64(nWithout) / float64(total) *
+				entropy(without, nWithout)
+		}
+		gain[domain] = h - conditional
+	}
+	return gain
+}
+
+// rankByGain returns the domains of gain from the highest information gain
+// to the lowest, by name for the same gain
+func rankByGain(gain map[string]float64) []string {
+	domains := make([]string, 0, len(gain))
+	for d := range gain {
+		domains = append(domains, d)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if gain[domains[i]] != gain[domains[j]] {
+			return gain[domains[i]] > gain[domains[j]]
+		}
+		return domains[i] < domains[j]
+	})
+	return domains
+}
+
+// writeTopDomains writes two CSV files to dir: uniqueDomains.csv with the
+// unique domains of every site, ranked by their lowest TTL (resolved the
+// most often) and then by the number of samples they are in, and
+// discriminating.csv with the n domains with the highest information gain,
+// with suffix before ".csv" (e.g., for registrable domains)
+func writeTopDomains(dir, suffix string, data map[int][]sample,
+	uniqueDomains map[int][]string, ttlmap map[string][]int, n int) error {
+	perDomain := domainSamples(data)
+	minTTL := func(domain string) int {
+		min := -1
+		for _, t := range ttlmap[domain] {
+			if min == -1 || t < min {
+				min = t
+			}
+		}
+		return min
+	}
+
+	var sites []int
+	for site := range data {
+		sites = append(sites, site)
+	}
+	sort.Ints(sites)
+	out := "site,rank,domain,minTTL,samples\n"
+	for _, site := range sites {
+		domains := append([]string(nil), uniqueDomains[site]...)
+		sort.Slice(domains, func(i, j int) bool {
+			ti, tj := minTTL(domains[i]), minTTL(domains[j])
+			if ti != tj {
+				return ti < tj
+			}
+			si, sj := perDomain[domains[i]][site], perDomain[domains[j]][site]
+			if si != sj {
+				return si > sj
+			}
+			return domains[i] < domains[j]
+		})
+		for i, d := range domains {
+			out += fmt.Sprintf("%d,%d,%s,%d,%d\n", site, i+1, d, minTTL(d),
+				perDomain[d][site])
+		}
+	}
+	name := "uniqueDomains" + suffix + ".csv"
+	err := ioutil.WriteFile(path.Join(dir, name), []byte(out), 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write %s (%s)", name, err)
+	}
+
+	gain := informationGain(data, perDomain)
+	domains := rankByGain(gain)
+	if n >= 0 && len(domains) > n {
+		domains = domains[:n]
+	}
+	out = "rank,domain,informationGain,sites,minTTL\n"
+	for i, d := range domains {
+		out += fmt.Sprintf("%d,%s,%f,%d,%d\n", i+1, d, gain[d],
+			len(perDomain[d]), minTTL(d))
+	}
+	name = "discriminating" + suffix + ".csv"
+	err = ioutil.WriteFile(path.Join(dir, name), []byte(out), 0666)
+	if err != nil {
+		return fmt.Errorf("failed to write %s (%s)", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pylls/defector/dnstap"
+	"github.com/pylls/defector/logging"
+)
+
+// extractDNSTap extracts the domains of every message in a dnstap file
+func extractDNSTap(file string) (domains []domain, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dnstap file %s (%s)", file, err)
+	}
+	defer f.Close()
+	r := dnstap.NewReader(f, nil)
+	for {
+		frame, err := r.Read()
+		if err == io.EOF {
+			return domains, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dnstap file %s (%s)", file, err)
+		}
+		m, err := dnstap.Unmarshal(frame)
+		if err != nil { // as a malformed packet in a pcap
+			logging.Warnf("skipping message in %s (%s)", file, err)
+			continue
+		}
+		wire, seen := m.QueryMessage, m.QueryTime
+		if m.IsResponse() {
+			wire, seen = m.ResponseMessage, m.ResponseTime
+		}
+		dns := new(layers.DNS)
+		if wire == nil || dns.DecodeFromBytes(wire, gopacket.NilDecodeFeedback) != nil {
+			continue // e.g., only the query of a response is logged
+		}
+		domains = addDNS(domains, dns, seen)
+	}
+}
+
+// listenDNSTap records every dnstap session sent to addr, a Unix socket
+// path or host:port, and extracts it once stopped
+func listenDNSTap(addr string) error {
+	network := "unix"
+	if strings.Contains(addr, ":") {
+		network = "tcp"
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for dnstap (%s)", err)
+	}
+	defer l.Close()
+	logging.Infof("reading dnstap on %s %s", network, addr)
+	for session := 0; ; session++ {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept dnstap connection (%s)", err)
+		}
+		file := path.Join(*output, fmt.Sprintf("%s-%d.dnstap",
+			time.Now().Format("20060102T150405"), session))
+		go func() {
+			defer conn.Close()
+			frames, err := record(dnstap.NewReader(conn, conn), file)
+			if err != nil {
+				logging.Warnf("dnstap session failed (%s)", err)
+			}
+			if frames > 0 {
+				extract(file)
+				logging.Infof("extracted %d messages of %s", frames, file)
+			}
+		}()
+	}
+}
+
+// record writes the frames of a dnstap session to file until it stops,
+// returning the number of frames
+func record(r *dnstap.Reader, file string) (frames int, err error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create dnstap file (%s)", err)
+	}
+	defer f.Close()
+	w, err := dnstap.NewWriter(f)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close() // also for a broken session, to extract what was sent
+	for {
+		frame, err := r.Read()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		if err = w.Write(frame); err != nil {
+			return frames, err
+		}
+		frames++
+	}
+}
@@ -1,36 +1,72 @@
 /*
 Package main implements a tool that extracts from DNS requests and responses in
 a pcap the observed domains, TTLs and IP-addresses. The result is written to
-".dns" files used by the dnsstats tool.
+".dns" files used by the dnsstats tool.  With -time, v2 .dns files are
+written instead: a "#v2" line followed by lines that start with the time each
+domain was first seen in the pcap, in seconds since the epoch.
+
+Resolvers often log dnstap instead: ".dnstap" files (Frame Streams, e.g.,
+from unbound or dnstap -w) in the dir are extracted the same way as pcaps,
+from every logged query and response, so log only client messages (of
+what clients look up) for the same .dns files as a capture at the client.
+With -dnstap, no dir is read: the Frame Streams socket (a path, or
+host:port for TCP) is listened on for resolvers to send dnstap to, and
+every session is written to -o as a .dnstap file named by the time it
+started, and extracted once the resolver stops it.
+
+Pcaps are decoded by the link type in their header: Ethernet (also with
+802.1Q VLAN tags), Linux cooked capture (e.g., of the "any" NIC), raw IP
+(e.g., inside containers or of tunnel NICs) and loopback, among others.
+DNS is also found inside MPLS, GRE, IP-in-IP, EtherIP and VXLAN
+encapsulation.  A warning is logged for a pcap with packets but no DNS,
+which is often a sign of an unsupported link type or encapsulation.
 */
 package main
 
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
 )
 
 var (
 	workerFactor = flag.Int("f", 2,
 		"the factor to multiply NumCPU with for creating workers")
 	output = flag.String("o", "", "folder to store results in")
+	timed  = flag.Bool("time", false,
+		"write v2 .dns files with the time each domain was first seen")
+	dnstapAddr = flag.String("dnstap", "",
+		"listen on this Frame Streams socket (path, or host:port for TCP) for dnstap")
 )
 
 func main() {
-	flag.Parse()
+	provenance.RegisterFlags()
+	config.Parse("extractdns")
+	provenance.Init("extractdns")
+	if *dnstapAddr != "" {
+		if *output == "" {
+			logging.Fatal("need to specify -o with -dnstap")
+		}
+		logging.Fatal(listenDNSTap(*dnstapAddr))
+	}
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify pcap dir")
+		logging.Fatal("need to specify pcap dir")
 	}
 	if *output == "" {
 		*output = flag.Arg(0)
@@ -38,7 +74,7 @@ func main() {
 
 	files, err := ioutil.ReadDir(flag.Arg(0))
 	if err != nil {
-		log.Fatalf("failed to read pcap dir (%s)", err)
+		logging.Fatalf("failed to read pcap dir (%s)", err)
 	}
 
 	work := make(chan string)
@@ -48,52 +84,70 @@ func main() {
 		go doWork(work, wg)
 	}
 
-	log.Printf("starting to extract (%d workers)...",
+	logging.Infof("starting to extract (%d workers)...",
 		runtime.NumCPU()**workerFactor)
 	extracted := 0
 	for i := 0; i < len(files); i++ {
-		if !files[i].IsDir() && strings.HasSuffix(files[i].Name(), ".pcap") {
-			fmt.Printf("\rextracted %d", extracted)
+		if !files[i].IsDir() && (strings.HasSuffix(files[i].Name(), ".pcap") ||
+			strings.HasSuffix(files[i].Name(), ".dnstap")) {
+			logging.Progress("extracted %d", extracted)
 			work <- files[i].Name()
 			extracted++
 		}
 	}
 	close(work)
 	wg.Wait()
-	fmt.Printf("\rextracted %d\n", extracted)
-	log.Println("done")
+	logging.EndProgress()
+	logging.Infof("done, extracted %d", extracted)
 }
 
 func doWork(input chan string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for file := range input {
-		extract(file)
+		extract(path.Join(flag.Arg(0), file))
 	}
 }
 
+// extract writes the .dns file of a pcap or dnstap file to -o
 func extract(file string) {
-	domains, err := extractDomains(path.Join(flag.Arg(0), file))
+	var domains []domain
+	var err error
+	if strings.HasSuffix(file, ".dnstap") {
+		domains, err = extractDNSTap(file)
+	} else {
+		domains, err = extractDomains(file)
+	}
 	if err != nil {
-		log.Fatalf("failed to extract DNS info (%s)", err)
+		logging.Fatalf("failed to extract DNS info (%s)", err)
 	}
-	f, err := os.Create(path.Join(*output, file[:len(file)-5]+".dns"))
+	name := strings.TrimSuffix(path.Base(file), path.Ext(file))
+	f, err := os.Create(path.Join(*output, name+".dns"))
 	if err != nil {
-		log.Fatalf("failed to create file to store result in (%s)", err)
+		logging.Fatalf("failed to create file to store result in (%s)", err)
+	}
+	if *timed {
+		if _, err = io.WriteString(f, dnsfile.Header+"\n"); err != nil {
+			logging.Fatalf("failed to write result to file (%s)", err)
+		}
 	}
 	for j := 0; j < len(domains); j++ {
 		result := fmt.Sprintf("%s,%d", domains[j].domain, domains[j].ttl)
+		if *timed {
+			result = fmt.Sprintf("%.6f,%s", float64(domains[j].seen.UnixNano())/1e9,
+				result)
+		}
 		for k := 0; k < len(domains[j].ips); k++ {
 			result += "," + domains[j].ips[k]
 		}
 
-		_, err = f.WriteString(fmt.Sprintf("%s\n", result))
+		_, err = fmt.Fprintf(f, "%s\n", result)
 		if err != nil {
-			log.Fatalf("failed to write result to file (%s)", err)
+			logging.Fatalf("failed to write result to file (%s)", err)
 		}
 	}
 	err = f.Close()
 	if err != nil {
-		log.Fatalf("failed to close file (%s)", err)
+		logging.Fatalf("failed to close file (%s)", err)
 	}
 }
 
@@ -101,6 +155,7 @@ type domain struct {
 	domain string
 	ttl    int
 	ips    []string
+	seen   time.Time // first seen
 }
 
 func extractDomains(pcapfile string) (domains []domain, err error) {
@@ -108,48 +163,78 @@ func extractDomains(pcapfile string) (domains []domain, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open pcap file %s (%s)", pcapfile, err)
 	}
-	source := gopacket.NewPacketSource(handle, layers.LinkTypeEthernet)
+	defer handle.Close()
+	source := gopacket.NewPacketSource(handle, packetDecoder(handle.LinkType()))
 
+	packets, found := 0, 0
 	for packet := range source.Packets() {
-		if packet.ApplicationLayer() != nil &&
-			packet.ApplicationLayer().LayerType() == layers.LayerTypeDNS {
-			dns := packet.ApplicationLayer().(*layers.DNS)
-			for i := 0; i < len(dns.Questions); i++ {
-				index := getIndex(string(dns.Questions[i].Name), domains)
-				if index == -1 {
-					var d domain
-					d.ttl = 0
-					d.domain = string(dns.Questions[i].Name)
-					domains = append(domains, d)
-				}
-			}
-			for i := 0; i < len(dns.Answers); i++ {
-				index := getIndex(string(dns.Answers[i].Name), domains)
-				if index == -1 {
-					var d domain
-					d.ttl = int(dns.Answers[i].TTL)
-					d.domain = string(dns.Answers[i].Name)
-					domains = append(domains, d)
-					index = len(domains) - 1
-				}
-
-				if domains[index].ttl == 0 {
-					domains[index].ttl = int(dns.Answers[i].TTL)
-				}
-				if dns.Answers[i].IP.String() != "<nil>" {
-					if !exists(dns.Answers[i].IP.String(), domains[index].ips) {
-						domains[index].ips = append(domains[index].ips,
-							dns.Answers[i].IP.String())
-					}
-				}
-			}
+		packets++
+		// the first DNS layer, also inside tunnels
+		if l := packet.Layer(layers.LayerTypeDNS); l != nil {
+			domains = addDNS(domains, l.(*layers.DNS), packet.Metadata().Timestamp)
+			found++
 		}
 	}
-	handle.Close()
+	if packets > 0 && found == 0 {
+		logging.Warnf("no DNS decoded from the %d packets in %s (link type %s)",
+			packets, pcapfile, handle.LinkType())
+	}
 
 	return
 }
 
+// packetDecoder returns the decoder of packets of the link type lt of a
+// pcap, where gopacket decodes 802.1Q (and QinQ), MPLS, GRE, IP-in-IP,
+// EtherIP and VXLAN encapsulation on its own
+func packetDecoder(lt layers.LinkType) gopacket.Decoder {
+	switch lt {
+	case 12, 14: // DLT_RAW depends on the platform, LINKTYPE_RAW in the pcap
+		return layers.LinkTypeRaw
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6
+	}
+	return lt
+}
+
+// addDNS adds the questions and answers of a DNS message seen at a time to
+// domains
+func addDNS(domains []domain, dns *layers.DNS, seen time.Time) []domain {
+	for i := 0; i < len(dns.Questions); i++ {
+		index := getIndex(string(dns.Questions[i].Name), domains)
+		if index == -1 {
+			var d domain
+			d.ttl = 0
+			d.domain = string(dns.Questions[i].Name)
+			d.seen = seen
+			domains = append(domains, d)
+		}
+	}
+	for i := 0; i < len(dns.Answers); i++ {
+		index := getIndex(string(dns.Answers[i].Name), domains)
+		if index == -1 {
+			var d domain
+			d.ttl = int(dns.Answers[i].TTL)
+			d.domain = string(dns.Answers[i].Name)
+			d.seen = seen
+			domains = append(domains, d)
+			index = len(domains) - 1
+		}
+
+		if domains[index].ttl == 0 {
+			domains[index].ttl = int(dns.Answers[i].TTL)
+		}
+		if dns.Answers[i].IP.String() != "<nil>" {
+			if !exists(dns.Answers[i].IP.String(), domains[index].ips) {
+				domains[index].ips = append(domains[index].ips,
+					dns.Answers[i].IP.String())
+			}
+		}
+	}
+	return domains
+}
+
 func getIndex(domain string, domains []domain) int {
 	for i, d := range domains {
 		if strings.EqualFold(d.domain, domain) {
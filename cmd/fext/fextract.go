@@ -1,199 +1,48 @@
 /*
-Package main implements feature extraction from packet traces (".cells" files).
-The output format is a fixed and optimized (to Tor) version of the one used by
-Wa-kNN (https://crysp.uwaterloo.ca/software/webfingerprint/).
+Package main implements feature extraction from packet traces (".cells" files)
+into ".feat" files read by the defector tool.  The feature set is selected
+with -set (see the features package), by default a fixed and optimized (to
+Tor) version of the one used by Wa-kNN
+(https://crysp.uwaterloo.ca/software/webfingerprint/).
+
+Each ".feat" file starts with a header line naming the feature set, since
+features from different sets (or versions of a set) are not comparable.
+
+To evaluate attacks against website fingerprinting defenses, -defense
+applies a simulated defense (see the defenses package) to each trace before
+extracting features: constant-rate padding at -rate cells per second in
+each direction for at least -mintime seconds ("constant"), WTF-PAD-style
+adaptive padding with -burst and -gap mean delays that stop with
+probability -stop ("adaptive"), or -injectpct percent random padding cells
+("inject").  The randomness of a trace derives from -seed and the name of
+its file, so the same features are extracted no matter the order.
 */
 package main
 
 import (
 	"bufio"
 	"flag"
+	"hash/fnv"
 	"io/ioutil"
-	"log"
-	"math"
-	"os"
+	"math/rand"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
-)
-
-// FeatureDelimiter is the delimiter in the output between features
-const FeatureDelimiter = " "
-
-func extract(times []float64, sizes []int) (features string, err error) {
-	// transmission size features
-	count := 0
-	for _, s := range sizes {
-		if s > 0 {
-			count++
-		}
-	}
-	features = strconv.Itoa(len(times))
-	features += FeatureDelimiter + strconv.Itoa(count)
-	features += FeatureDelimiter + strconv.Itoa(len(times)-count)
-	features += FeatureDelimiter +
-		strconv.FormatFloat((times[len(times)-1]-times[0]), 'f', -1, 64)
-
-	// position of the first 500 outgoing packets
-	count = 0
-	for i := 0; i < len(sizes); i++ {
-		if sizes[i] > 0 {
-			count++
-			features += FeatureDelimiter + strconv.Itoa(i)
-		}
-
-		if count == 500 {
-			break
-		}
-	}
-	for i := count; i < 500; i++ {
-		features += FeatureDelimiter + "'X'"
-	}
-
-	// difference in position between the first 500 outgoing packets
-	// and the next outgoing packet
-	count = 0
-	prevloc := 0
-	for i := 0; i < len(sizes); i++ {
-		if sizes[i] > 0 {
-			count++
-			features += FeatureDelimiter + strconv.Itoa(i-prevloc)
-			prevloc = i
-		}
-		if count == 500 {
-			break
-		}
-	}
-	for i := count; i < 500; i++ {
-		features += FeatureDelimiter + "'X'"
-	}
-
-	// packet distributions (where are the outgoing packets concentrated)
-	count = 0
-	for i := 0; i < len(sizes) && i < 3000; i++ {
-		if i%30 != 29 {
-			if sizes[i] > 0 {
-				count++
-			}
-		} else {
-			features += FeatureDelimiter + strconv.Itoa(count)
-			count = 0
-		}
-	}
-	for i := len(sizes) / 30; i < 100; i++ {
-		features += FeatureDelimiter + strconv.Itoa(0)
-	}
 
-	// Bursts (calc)
-	var bursts []int
-	outgoing := true // outgoing (positive) or incoming (negative)
-	count = 0        // number of packets in the direction
-	for i := 0; i < len(sizes); i++ {
-		if sizes[i] > 0 == outgoing {
-			// the packet goes in the same direction
-			count++
-		} else {
-			// changing direction
-			if count > 1 {
-				// a burt is only defined for a sequence of packets
-				bursts = append(bursts, count)
-			}
-			count = 1
-			outgoing = sizes[i] > 0 // set direction
-		}
-	}
-	max := -1
-	sum := 0
-	for i := 0; i < len(bursts); i++ {
-		sum += bursts[i]
-		if bursts[i] > max {
-			max = bursts[i]
-		}
-	}
-	// longest burst, mean size of burst, and number of bursts
-	features += FeatureDelimiter + strconv.Itoa(max)
-	if len(bursts) > 0 {
-		features += FeatureDelimiter + strconv.Itoa(sum/len(bursts))
-	} else {
-		features += FeatureDelimiter + strconv.Itoa(0)
-	}
-	features += FeatureDelimiter + strconv.Itoa(len(bursts))
-
-	// the number of bursts with lengths longer than 2,5,10,15,20,50
-	counts := make([]int, 6)
-	for i := 0; i < len(bursts); i++ {
-		if bursts[i] > 2 {
-			counts[0]++
-		}
-		if bursts[i] > 5 {
-			counts[1]++
-		}
-		if bursts[i] > 10 {
-			counts[2]++
-		}
-		if bursts[i] > 15 {
-			counts[3]++
-		}
-		if bursts[i] > 20 {
-			counts[4]++
-		}
-		if bursts[i] > 50 {
-			counts[5]++
-		}
-	}
-	for i := 0; i < len(counts); i++ {
-		features += FeatureDelimiter + strconv.Itoa(counts[i])
-	}
-
-	// the length of the first 100 bursts
-	for i := 0; i < 100; i++ {
-		if len(bursts) > i {
-			features += FeatureDelimiter + strconv.Itoa(bursts[i])
-		} else {
-			features += FeatureDelimiter + "'X'"
-		}
-	}
-
-	// the direction of the first 10 packets
-	// (we add MTU since -1 as feature is used internally)
-	for i := 0; i < 10; i++ {
-		if len(sizes) > i {
-			features += FeatureDelimiter + strconv.Itoa(sizes[i]+1500)
-		} else {
-			features += FeatureDelimiter + "'X'"
-		}
-	}
-
-	// interpacket timing: mean and standard deviation
-	var total, variance float64
-	current := times[0]
-	for i := 1; i < len(times); i++ {
-		total += times[i] - current
-		current = times[i]
-	}
-	mean := total / float64((len(times) - 1))
-
-	current = times[0]
-	for i := 1; i < len(times); i++ {
-		// -2 due to Bessel's correlation and interpacket timing def.
-		variance += (times[i] - current) * (times[i] - current) /
-			float64(len(times)-2)
-		current = times[i]
-	}
-
-	features += FeatureDelimiter + strconv.FormatFloat((mean), 'f', -1, 64)
-	features += FeatureDelimiter +
-		strconv.FormatFloat((math.Sqrt(variance)), 'f', -1, 64)
-
-	return
-}
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/defenses"
+	"github.com/pylls/defector/features"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
 
 func parse(filename string) {
-	file, err := os.Open(filename)
+	file, err := gzfile.Open(filename)
 	if err != nil {
-		log.Fatalf("failed to read file %s, got error %s", filename, err)
+		logging.Fatalf("failed to read file %s, got error %s", filename, err)
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
@@ -201,48 +50,112 @@ func parse(filename string) {
 	var times []float64
 	var sizes []int
 	for scanner.Scan() {
+		// extra columns (e.g., circuit IDs from torlogextract) are ignored
 		items := strings.Split(scanner.Text(), "\t")
-		if len(items) != 2 {
-			log.Fatalf("expected 2 items in line for filename %s, got %d",
+		if len(items) < 2 {
+			logging.Fatalf("expected at least 2 items in line for filename %s, got %d",
 				filename, len(items))
 		}
 
 		t, er := strconv.ParseFloat(items[0], 64)
 		if er != nil {
-			log.Fatalf("failed to parse time for filename %s, %s", filename, err)
+			logging.Fatalf("failed to parse time for filename %s, %s", filename, er)
 		}
 		times = append(times, t)
 
 		s, er := strconv.ParseInt(items[1], 10, 64)
 		if er != nil {
-			log.Fatalf("failed to parse size for filename %s, %s", filename, err)
+			logging.Fatalf("failed to parse size for filename %s, %s", filename, er)
 		}
 		sizes = append(sizes, int(s))
 	}
 
-	features, err := extract(times, sizes)
+	times, sizes, err = defense.Run(times, sizes, fileRand(filename))
+	if err != nil {
+		logging.Fatalf("failed to defend trace for filename %s, %s", filename, err)
+	}
+	feat, err := set.Run(times, sizes)
 	if err != nil {
-		log.Fatalf("failed to extract features for filename %s, %s", filename, err)
+		logging.Fatalf("failed to extract features for filename %s, %s", filename, err)
 	}
-	err = ioutil.WriteFile(strings.Replace(filename, *intype, *suffix, 1),
-		[]byte(features+FeatureDelimiter), 0666)
+	out := features.Format(feat) + features.Delimiter
+	if *header {
+		out = set.Header() + "\n" + out
+	}
+	err = ioutil.WriteFile(strings.Replace(strings.TrimSuffix(filename, ".gz"),
+		*intype, *suffix, 1), []byte(out), 0666)
 	if err != nil {
-		log.Fatalf("failed to write features file for filename %s, %s",
+		logging.Fatalf("failed to write features file for filename %s, %s",
 			filename, err)
 	}
 }
 
+// fileRand returns randomness for the trace in filename, the same for a
+// -seed no matter the order traces are parsed in
+func fileRand(filename string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(path.Base(filename)))
+	return rand.New(rand.NewSource(*seed ^ int64(h.Sum64())))
+}
+
 var (
 	suffix = flag.String("suffix", ".feat",
 		"the suffix for the resulting files with parsed features")
 	intype = flag.String("intype", ".cells",
 		"the suffix of the type of file to parse")
+	setName = flag.String("set", features.WaKNN.Name,
+		"the feature set to extract: "+strings.Join(features.Names(), ", "))
+	header = flag.Bool("header", true,
+		"write a header naming the feature set (disable for old tools)")
+
+	// simulated defenses
+	defenseName = flag.String("defense", "none",
+		"the defense to simulate on traces: none, constant, adaptive or inject")
+	rate = flag.Float64("rate", 50,
+		"cells per second in each direction for -defense constant")
+	minTime = flag.Float64("mintime", 10,
+		"the minimum seconds of padding for -defense constant")
+	burst = flag.Float64("burst", 0.05,
+		"the mean delay (s) before padding in bursts for -defense adaptive")
+	gap = flag.Float64("gap", 0.01,
+		"the mean delay (s) between padding in gaps for -defense adaptive")
+	stop = flag.Float64("stop", 0.1,
+		"the probability of no padding until the next cell for -defense adaptive")
+	injectPct = flag.Float64("injectpct", 50,
+		"percent of extra cells to inject for -defense inject")
+	seed = flag.Int64("seed", 1, "the seed for simulating defenses")
+
+	set     features.Set
+	defense defenses.Defense
 )
 
 func main() {
-	flag.Parse()
+	provenance.RegisterFlags()
+	config.Parse("fext")
+	provenance.Init("fext")
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify data dir")
+		logging.Fatal("need to specify data dir")
+	}
+	var err error
+	set, err = features.Get(*setName)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	switch *defenseName {
+	case "none":
+		defense = defenses.None
+	case "constant":
+		defense, err = defenses.Constant(*rate, *minTime)
+	case "adaptive":
+		defense, err = defenses.Adaptive(*burst, *gap, *stop)
+	case "inject":
+		defense, err = defenses.Inject(*injectPct)
+	default:
+		logging.Fatalf("unknown defense %s (none, constant, adaptive or inject)",
+			*defenseName)
+	}
+	if err != nil {
+		logging.Fatal(err)
 	}
 
 	// workers
@@ -258,16 +171,17 @@ func main() {
 		}()
 	}
 
-	log.Printf("getting list of files in %s", flag.Arg(0))
+	logging.Infof("getting list of files in %s", flag.Arg(0))
 	files, er := ioutil.ReadDir(flag.Arg(0))
 	if er != nil {
-		log.Fatalf("failed to read data dir (%s)", er)
+		logging.Fatalf("failed to read data dir (%s)", er)
 	}
-	log.Printf("OK, starting to parse...")
+	logging.Infof("OK, starting to parse...")
 
 	samples := 0
 	for i := 0; i < len(files); i++ {
-		if !files[i].IsDir() && strings.HasSuffix(files[i].Name(), *intype) {
+		if !files[i].IsDir() && (strings.HasSuffix(files[i].Name(), *intype) ||
+			strings.HasSuffix(files[i].Name(), *intype+".gz")) {
 			samples++
 			work <- path.Join(flag.Arg(0), files[i].Name())
 		}
@@ -276,6 +190,6 @@ func main() {
 	close(work)
 	wg.Wait()
 
-	log.Printf("done parsing %d samples in folder \"%s\", suffix \"%s\")",
-		samples, flag.Arg(0), *suffix)
+	logging.Infof("done parsing %d samples in folder \"%s\", suffix \"%s\", features %s, defense %s",
+		samples, flag.Arg(0), *suffix, set.Name, defense.Name)
 }
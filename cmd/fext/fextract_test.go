@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pylls/defector/defenses"
+	"github.com/pylls/defector/features"
+)
+
+// TestReference extracts the traces in testdata and compares the features
+// to the reference vectors in testdata/*.feat, written by the original fext
+// from before feature sets: wa-knn-v1 must not change, or old .feat files
+// are no longer comparable.  The traces cover more than 3000 cells and 500
+// outgoing cells (long, gzipped), fewer than 30 cells (short), and no bursts
+// (alternating).
+func TestReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	set, defense = features.WaKNN, defenses.None
+
+	for _, name := range []string{"long.cells.gz", "short.cells", "alternating.cells"} {
+		trace, err := ioutil.ReadFile(path.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path.Join(dir, name), trace, 0666); err != nil {
+			t.Fatal(err)
+		}
+		parse(path.Join(dir, name))
+
+		feat := strings.Replace(strings.TrimSuffix(name, ".gz"), ".cells", ".feat", 1)
+		got, err := ioutil.ReadFile(path.Join(dir, feat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(path.Join("testdata", feat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.SplitN(string(got), "\n", 2)
+		if len(lines) != 2 || lines[0] != set.Header() {
+			t.Fatalf("%s: no header %q", feat, set.Header())
+		}
+		if lines[1] != string(want) {
+			t.Errorf("%s: features differ from the reference", feat)
+		}
+	}
+}
+
+// TestWaKNN checks the vector of a short trace, worked out by hand
+func TestWaKNN(t *testing.T) {
+	sizes := []int{1, 1, -1, -1, -1, 1, -1, -1, -1, -1, -1, -1, 1, 1, 1, -1, -1, -1, -1, -1}
+	times := make([]float64, len(sizes))
+	for i := range times {
+		times[i] = float64(i) / 4
+	}
+	f, err := features.WaKNN.Run(times, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nan := math.NaN()
+	tests := []struct {
+		name  string
+		start int
+		want  []float64
+	}{
+		{"cells, outgoing, incoming, duration", 0, []float64{20, 6, 14, 4.75}},
+		{"outgoing positions", 4, []float64{0, 1, 5, 12, 13, 14, nan}},
+		{"outgoing position gaps", 504, []float64{0, 1, 4, 7, 1, 1, nan}},
+		{"outgoing per 30 cells", 1004, []float64{0, 0}},
+		// the last burst, still going at the end, is not counted
+		{"longest, mean and number of bursts", 1104, []float64{6, 3, 4}},
+		{"bursts longer than 2, 5, 10, 15, 20 and 50", 1107, []float64{3, 1, 0, 0, 0, 0}},
+		{"bursts", 1113, []float64{2, 3, 6, 3, nan}},
+		{"directions", 1213, []float64{1501, 1501, 1499, 1499, 1499, 1501, 1499, 1499, 1499, 1499}},
+		// as the original, the "std" is of the times, not their deviation
+		// from the mean, so it is not 0
+		{"interpacket time mean and std", 1223, []float64{0.25, math.Sqrt(19 * 0.25 * 0.25 / 18)}},
+	}
+	for _, test := range tests {
+		for i, want := range test.want {
+			got := f[test.start+i]
+			if got != want && !(math.IsNaN(got) && math.IsNaN(want)) {
+				t.Errorf("%s: feature %d is %v, want %v", test.name, test.start+i, got, want)
+			}
+		}
+	}
+}
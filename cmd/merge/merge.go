@@ -0,0 +1,327 @@
+/*
+Package main implements merge, combining data directories, e.g., of several
+server runs or vantage points, into one dataset.
+
+	merge -o <out dir> <dir> [<dir> ...]
+
+A sample is the files of an instance of a site, "<site>-<instance><suffix>"
+(e.g., a .pcap and the .dns and .cells extracted from it), or
+"<site>-<instance>-<epoch><suffix>" if collected in an epoch with server
+-recollect.  The sites and epochs keep their numbers, while the instances of
+each site in each epoch are renumbered from 0 in the order of the
+directories given, so that directories with overlapping instances can be
+merged.  With -instances, at most as many instances of each site are kept
+per epoch.
+
+A sample that duplicates an earlier sample of the same site and epoch is
+not merged:
+byte-identical if all its files are, or with -near, near-duplicate if its
+files are the same after ignoring what differs when the same visit is
+processed again: the times of .cells and .dns files and the order of .dns
+requests, where .feat files, extracted from the times, are ignored if there
+are .cells files.  Duplicates are reported and kept with -keepdups.
+
+Every merged file is recorded with its source and SHA-256 in the JSON
+-manifest, along with every duplicate.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+var (
+	out       = flag.String("o", "", "the dir to write the merged dataset to")
+	instances = flag.Int("instances", 0,
+		"the max number of instances to keep per site (0 for all)")
+	near         = flag.Bool("near", true, "also detect near-duplicate samples")
+	keepDups     = flag.Bool("keepdups", false, "merge duplicate samples anyway, only reporting them")
+	manifestFile = flag.String("manifest", "merge-manifest.json",
+		"write the provenance of every merged file as JSON to this file")
+)
+
+// manifest is the provenance of a merged dataset
+type manifest struct {
+	Time       time.Time     `json:"time"`
+	Sources    []string      `json:"sources"`
+	Out        string        `json:"out"`
+	Files      []mergedFile  `json:"files"`
+	Duplicates []duplicateOf `json:"duplicates"`
+}
+
+// mergedFile is a file in the merged dataset and where it is from
+type mergedFile struct {
+	Name   string `json:"name"`
+	Source string `json:"source"` // path of the file merged
+	SHA256 string `json:"sha256"`
+}
+
+// duplicateOf is a sample that duplicates an earlier one
+type duplicateOf struct {
+	Source string `json:"source"` // dir/site-instance[-epoch]
+	Of     string `json:"of"`     // dir/site-instance[-epoch] of the earlier sample
+	Kind   string `json:"kind"`   // identical or near
+	Merged bool   `json:"merged"` // with -keepdups
+}
+
+// sample is the files of an instance of a site in a source dir
+type sample struct {
+	dir    string
+	name   string // of the files without suffix, e.g., "1-0" or "1-0-2"
+	tagged bool   // if the name has an epoch
+	epoch.File
+	suffixes []string
+}
+
+func (s sample) id() string {
+	return path.Join(s.dir, s.name)
+}
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("merge")
+	provenance.Init("merge")
+	if *out == "" || flag.NArg() == 0 {
+		logging.Fatal("need to specify -o and the dirs to merge")
+	}
+	for _, dir := range flag.Args() {
+		if path.Clean(dir) == path.Clean(*out) {
+			logging.Fatalf("cannot merge %s into itself", dir)
+		}
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		logging.Fatalf("failed to create output dir (%s)", err)
+	}
+
+	// samples of each site and epoch, in the order of the dirs and then
+	// instances
+	groups := make(map[[2]int][]sample)
+	sites := make(map[int]bool)
+	for _, dir := range flag.Args() {
+		samples, err := listSamples(dir)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		for _, s := range samples {
+			key := [2]int{s.Site, s.Epoch}
+			groups[key] = append(groups[key], s)
+			sites[s.Site] = true
+		}
+		logging.Infof("found %d samples in %s", len(samples), dir)
+	}
+	var order [][2]int
+	for key := range groups {
+		order = append(order, key)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i][0] != order[j][0] {
+			return order[i][0] < order[j][0]
+		}
+		return order[i][1] < order[j][1]
+	})
+
+	m := manifest{
+		Time:       time.Now(),
+		Sources:    flag.Args(),
+		Out:        *out,
+		Files:      []mergedFile{},
+		Duplicates: []duplicateOf{},
+	}
+	merged := 0
+	for _, key := range order {
+		identical := make(map[string]string) // hash -> id of first sample
+		similar := make(map[string]string)
+		instance := 0
+		for _, s := range groups[key] {
+			if *instances > 0 && instance >= *instances {
+				break
+			}
+			exact, normal, err := hashSample(s)
+			if err != nil {
+				logging.Fatal(err)
+			}
+			dup := duplicateOf{Source: s.id(), Merged: *keepDups}
+			if of, exists := identical[exact]; exists {
+				dup.Of, dup.Kind = of, "identical"
+			} else if of, exists := similar[normal]; exists && *near {
+				dup.Of, dup.Kind = of, "near"
+			} else {
+				identical[exact] = s.id()
+				similar[normal] = s.id()
+			}
+			if dup.Kind != "" {
+				m.Duplicates = append(m.Duplicates, dup)
+				if !*keepDups {
+					continue
+				}
+			}
+
+			prefix := strconv.Itoa(s.Site) + "-" + strconv.Itoa(instance)
+			if s.tagged {
+				prefix += "-" + strconv.Itoa(s.Epoch)
+			}
+			for _, suffix := range s.suffixes {
+				name := prefix + suffix
+				f, err := copyFile(path.Join(s.dir, s.name+suffix), path.Join(*out, name))
+				if err != nil {
+					logging.Fatal(err)
+				}
+				f.Name = name
+				m.Files = append(m.Files, f)
+			}
+			instance++
+			merged++
+		}
+	}
+
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		logging.Fatalf("failed to encode manifest (%s)", err)
+	}
+	if err = ioutil.WriteFile(*manifestFile, d, 0666); err != nil {
+		logging.Fatalf("failed to write manifest (%s)", err)
+	}
+	logging.Infof("merged %d samples of %d sites into %s, %d duplicates, manifest in %s",
+		merged, len(sites), *out, len(m.Duplicates), *manifestFile)
+}
+
+// listSamples lists the samples in dir, ignoring files not named by the
+// site-instance[-epoch] convention
+func listSamples(dir string) (samples []sample, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data dir (%s)", err)
+	}
+	index := make(map[string]int) // by name
+	for _, info := range infos {
+		f, ok := epoch.ParseFile(info.Name())
+		if info.IsDir() || !ok {
+			continue
+		}
+		i, exists := index[f.Sample]
+		if !exists {
+			i = len(samples)
+			index[f.Sample] = i
+			samples = append(samples, sample{dir: dir, name: f.Sample,
+				tagged: strings.Count(f.Sample, "-") == 2, File: f})
+		}
+		samples[i].suffixes = append(samples[i].suffixes,
+			strings.TrimPrefix(info.Name(), f.Sample))
+	}
+	for i := range samples {
+		sort.Strings(samples[i].suffixes)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Site != samples[j].Site {
+			return samples[i].Site < samples[j].Site
+		}
+		if samples[i].Epoch != samples[j].Epoch {
+			return samples[i].Epoch < samples[j].Epoch
+		}
+		return samples[i].Instance < samples[j].Instance
+	})
+	return
+}
+
+// hashSample returns the hashes of the files of a sample as is, and
+// normalized for detecting near-duplicates
+func hashSample(s sample) (exact, normal string, err error) {
+	e, n := sha256.New(), sha256.New()
+	cells := false
+	for _, suffix := range s.suffixes {
+		cells = cells || strings.HasPrefix(suffix, ".cells")
+	}
+	for _, suffix := range s.suffixes {
+		name := path.Join(s.dir, s.name+suffix)
+		d, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read sample (%s)", err)
+		}
+		fmt.Fprintf(e, "%s %d\n", suffix, len(d))
+		e.Write(d)
+
+		kind := strings.TrimSuffix(suffix, ".gz")
+		if strings.HasSuffix(suffix, ".gz") {
+			if d, err = gzfile.ReadFile(name); err != nil {
+				return "", "", fmt.Errorf("failed to decompress %s (%s)", name, err)
+			}
+		}
+		switch kind {
+		case ".cells":
+			d = normalizeCells(d)
+		case ".dns":
+			d = normalizeDNS(d)
+		case ".feat":
+			if cells {
+				continue
+			}
+		}
+		fmt.Fprintf(n, "%s %d\n", kind, len(d))
+		n.Write(d)
+	}
+	return hex.EncodeToString(e.Sum(nil)), hex.EncodeToString(n.Sum(nil)), nil
+}
+
+// normalizeCells keeps the sizes of a trace, without times
+func normalizeCells(d []byte) []byte {
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		items := strings.Split(scanner.Text(), "\t")
+		if len(items) > 1 {
+			b.WriteString(items[1])
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// normalizeDNS sorts the requests of a .dns file, without the times of v2,
+// or returns d as is if it is malformed
+func normalizeDNS(d []byte) []byte {
+	var lines []string
+	scanner := dnsfile.NewScanner(bytes.NewReader(d))
+	for scanner.Scan() {
+		r := scanner.Request()
+		lines = append(lines, strings.Join(append([]string{r.Domain,
+			strconv.Itoa(r.TTL)}, r.IPs...), ","))
+	}
+	if scanner.Err() != nil {
+		return d
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// copyFile copies src to dst, returning the file for the manifest
+func copyFile(src, dst string) (mergedFile, error) {
+	d, err := ioutil.ReadFile(src)
+	if err != nil {
+		return mergedFile{}, fmt.Errorf("failed to read sample (%s)", err)
+	}
+	if err = ioutil.WriteFile(dst, d, 0666); err != nil {
+		return mergedFile{}, fmt.Errorf("failed to write sample (%s)", err)
+	}
+	sum := sha256.Sum256(d)
+	return mergedFile{Source: src, SHA256: hex.EncodeToString(sum[:])}, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// the colors of series, in order (colorblind-safe)
+var palette = []string{"#0072b2", "#d55e00", "#009e73", "#cc79a7",
+	"#e69f00", "#56b4e9", "#f0e442", "#000000"}
+
+// series is a line of a figure, optionally with a band from lo to hi
+type series struct {
+	name   string
+	x, y   []float64
+	lo, hi []float64 // nil if no band
+	step   bool      // draw as a step function, e.g., a CDF
+}
+
+// figure is a line plot with a legend
+type figure struct {
+	title, xLabel, yLabel string
+	logX                  bool
+	yMin, yMax            float64 // of the y axis if yMin < yMax, else fit to the data
+	series                []series
+}
+
+// margins of the plot area within the figure, in pixels
+const (
+	marginLeft   = 60
+	marginRight  = 20
+	marginTop    = 30
+	marginBottom = 45
+)
+
+// point is a point on a canvas, in pixels from the top left
+type point struct{ x, y float64 }
+
+// anchors of text, the point it is drawn at
+const (
+	anchorStart = iota
+	anchorMiddle
+	anchorEnd
+)
+
+// draw draws the figure on c of width x height pixels
+func (f *figure) draw(c *svgCanvas, width, height int) error {
+	if f.logX {
+		f.dropNonPositive()
+	}
+	x0, x1, y0, y1 := f.bounds()
+	if math.IsInf(x0, 0) {
+		return fmt.Errorf("no points to plot")
+	}
+	xTicks, yTicks := ticks(x0, x1, f.logX), ticks(y0, y1, false)
+	// extend the axes to whole ticks
+	x0, x1 = math.Min(x0, xTicks[0]), math.Max(x1, xTicks[len(xTicks)-1])
+	y0, y1 = math.Min(y0, yTicks[0]), math.Max(y1, yTicks[len(yTicks)-1])
+
+	w := float64(width - marginLeft - marginRight)
+	h := float64(height - marginTop - marginBottom)
+	px := func(x float64) float64 {
+		if f.logX {
+			return marginLeft + math.Log10(x/x0)/math.Log10(x1/x0)*w
+		}
+		return marginLeft + (x-x0)/(x1-x0)*w
+	}
+	py := func(y float64) float64 {
+		return marginTop + h - (y-y0)/(y1-y0)*h
+	}
+
+	if f.title != "" {
+		c.text(point{float64(width / 2), 20}, f.title, 14, anchorMiddle, false)
+	}
+
+	// grid, ticks and axes
+	for _, t := range xTicks {
+		c.line(point{px(t), marginTop}, point{px(t), marginTop + h}, "#dddddd", 1)
+		c.text(point{px(t), marginTop + h + 16}, formatTick(t), 12, anchorMiddle, false)
+	}
+	for _, t := range yTicks {
+		c.line(point{marginLeft, py(t)}, point{marginLeft + w, py(t)}, "#dddddd", 1)
+		c.text(point{marginLeft - 5, py(t) + 4}, formatTick(t), 12, anchorEnd, false)
+	}
+	c.rect(marginLeft, marginTop, w, h, "#000000")
+	c.text(point{marginLeft + w/2, float64(height - 8)}, f.xLabel, 12, anchorMiddle, false)
+	c.text(point{15, marginTop + h/2}, f.yLabel, 12, anchorMiddle, true)
+
+	// bands first, so that no line is hidden
+	for i, s := range f.series {
+		if s.lo == nil {
+			continue
+		}
+		var points []point
+		for j := range s.x {
+			points = append(points, point{px(s.x[j]), py(s.hi[j])})
+		}
+		for j := len(s.x) - 1; j >= 0; j-- {
+			points = append(points, point{px(s.x[j]), py(s.lo[j])})
+		}
+		c.polygon(points, palette[i%len(palette)], 0.2)
+	}
+	for i, s := range f.series {
+		var points []point
+		for j := range s.x {
+			if s.step && j > 0 {
+				points = append(points, point{px(s.x[j]), py(s.y[j-1])})
+			}
+			points = append(points, point{px(s.x[j]), py(s.y[j])})
+		}
+		c.polyline(points, palette[i%len(palette)], 2)
+		if !s.step && len(s.x) <= 50 {
+			for j := range s.x {
+				c.circle(point{px(s.x[j]), py(s.y[j])}, 3, palette[i%len(palette)])
+			}
+		}
+	}
+
+	// legend, top right inside the plot area
+	for i, s := range f.series {
+		y := float64(marginTop + 15 + 16*i)
+		c.line(point{marginLeft + w - 150, y - 4}, point{marginLeft + w - 130, y - 4},
+			palette[i%len(palette)], 2)
+		c.text(point{marginLeft + w - 125, y}, s.name, 12, anchorStart, false)
+	}
+	return nil
+}
+
+// dropNonPositive drops the points that a logarithmic x axis cannot show
+func (f *figure) dropNonPositive() {
+	for i, s := range f.series {
+		kept := series{name: s.name, step: s.step}
+		for j := range s.x {
+			if s.x[j] <= 0 {
+				continue
+			}
+			kept.x, kept.y = append(kept.x, s.x[j]), append(kept.y, s.y[j])
+			if s.lo != nil {
+				kept.lo, kept.hi = append(kept.lo, s.lo[j]), append(kept.hi, s.hi[j])
+			}
+		}
+		f.series[i] = kept
+	}
+}
+
+// bounds returns the range of the data, or of the y axis if set
+func (f *figure) bounds() (x0, x1, y0, y1 float64) {
+	x0, y0 = math.Inf(1), math.Inf(1)
+	x1, y1 = math.Inf(-1), math.Inf(-1)
+	for _, s := range f.series {
+		for j := range s.x {
+			x0, x1 = math.Min(x0, s.x[j]), math.Max(x1, s.x[j])
+			y0, y1 = math.Min(y0, s.y[j]), math.Max(y1, s.y[j])
+			if s.lo != nil {
+				y0, y1 = math.Min(y0, s.lo[j]), math.Max(y1, s.hi[j])
+			}
+		}
+	}
+	if f.yMin < f.yMax {
+		y0, y1 = f.yMin, f.yMax
+	}
+	if x0 == x1 {
+		x0, x1 = x0-1, x1+1
+	}
+	if y0 == y1 {
+		y0, y1 = y0-1, y1+1
+	}
+	return
+}
+
+// ticks returns about five evenly spaced round ticks from lo to hi, with
+// log the powers of ten in between
+func ticks(lo, hi float64, log bool) (t []float64) {
+	if log {
+		for e := math.Floor(math.Log10(lo)); e <= math.Ceil(math.Log10(hi)); e++ {
+			t = append(t, math.Pow(10, e))
+		}
+		return
+	}
+	base, step := math.Pow(10, math.Floor(math.Log10((hi-lo)/5))), 0.0
+	for _, m := range []float64{1, 2, 5, 10} {
+		if step = base * m; (hi-lo)/step <= 7 {
+			break
+		}
+	}
+	for i := math.Floor(lo / step); i <= math.Ceil(hi/step); i++ {
+		t = append(t, i*step)
+	}
+	return
+}
+
+func formatTick(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
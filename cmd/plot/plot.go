@@ -0,0 +1,307 @@
+/*
+Package main implements plot, rendering the CSV results of the other tools
+as the standard figures in SVG or PNG, without a separate plotting
+environment.
+
+	plot [-o fig.svg] [-format png] <csv> [<csv> ...]
+
+The kind of figure is picked by the header of the first CSV, or with -kind:
+
+  - "metric": a metric per attack against the percentage of exit
+    bandwidth, from the recall, precision and F1 CSVs of defector.  The 95%
+    confidence intervals of -bootstrap, or else the bands of -simreps, are
+    drawn around each attack.
+  - "cdf": the empirical CDFs of dnsstats -cdfdir, e.g., the TTLs or unique
+    domains per site, one line per CSV.  Use -logx for TTLs.
+  - "pr": the precision-recall curves of dns2site -prdir, one line per CSV
+    (classifier).
+
+With -kind metric, each CSV is a figure of its own, or with -o, all metrics
+are drawn in the same figure.  The figure of a CSV is written next to it as
+<csv name>.svg unless -o is given.  SVG is shown by browsers and converted
+by, e.g., rsvg-convert or Inkscape to PDF.  With -format png, or an -o
+ending in .png, the figure is converted to a PNG by rsvg-convert (librsvg),
+which has to be installed.  The figures are simple line plots, so they are
+drawn here instead of with a plotting library.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+var (
+	out    = flag.String("o", "", "the file to write the figure to (<csv name>.<format> if empty)")
+	format = flag.String("format", "", "the format of figures: svg or png (from -o if empty, else svg)")
+	kind   = flag.String("kind", "", "the kind of figure: metric, cdf or pr (from the CSV if empty)")
+	title  = flag.String("title", "", "the title of the figure")
+	logX   = flag.Bool("logx", false, "use a logarithmic x axis")
+	width  = flag.Int("width", 640, "the width of the figure in pixels")
+	height = flag.Int("height", 400, "the height of the figure in pixels")
+)
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("plot")
+	provenance.Init("plot")
+	if flag.NArg() == 0 {
+		logging.Fatal("need to specify CSV files to plot")
+	}
+	tables := make([][][]string, flag.NArg())
+	for i, file := range flag.Args() {
+		t, err := readCSV(file)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		tables[i] = t
+	}
+	ext := *format
+	if ext == "" {
+		ext = "svg"
+		if strings.HasSuffix(strings.ToLower(*out), ".png") {
+			ext = "png"
+		}
+	}
+	if ext != "svg" && ext != "png" {
+		logging.Fatalf("unknown format %q (svg or png)", ext)
+	}
+	k := *kind
+	if k == "" {
+		k = detectKind(tables[0][0])
+	}
+
+	var figures []figure
+	var files []string
+	switch k {
+	case "metric":
+		for i, t := range tables {
+			f, err := metricFigure(t, metricName(flag.Arg(i)))
+			if err != nil {
+				logging.Fatalf("failed to plot %s (%s)", flag.Arg(i), err)
+			}
+			figures = append(figures, f)
+			files = append(files, flag.Arg(i))
+		}
+		if *out != "" && len(figures) > 1 {
+			figures, files = []figure{combine(figures)}, files[:1]
+		}
+	case "cdf", "pr":
+		f := figure{xLabel: "value", yLabel: "CDF", yMin: 0, yMax: 1, logX: *logX}
+		if k == "pr" {
+			f.xLabel, f.yLabel = "recall", "precision"
+		}
+		for i, t := range tables {
+			var s series
+			var err error
+			if k == "cdf" {
+				s, err = cdfSeries(t)
+			} else {
+				s, err = prSeries(t)
+			}
+			if err != nil {
+				logging.Fatalf("failed to plot %s (%s)", flag.Arg(i), err)
+			}
+			s.name = seriesName(flag.Arg(i))
+			f.series = append(f.series, s)
+		}
+		if k == "cdf" && len(f.series) == 1 {
+			f.xLabel = f.series[0].name
+		}
+		figures, files = []figure{f}, []string{flag.Arg(0)}
+	default:
+		logging.Fatalf("unknown kind of figure %q (metric, cdf or pr)", k)
+	}
+
+	for i := range figures {
+		if *title != "" {
+			figures[i].title = *title
+		}
+		figures[i].logX = figures[i].logX || *logX
+		name := *out
+		if name == "" {
+			name = strings.TrimSuffix(files[i], ".csv") + "." + ext
+		}
+		if err := figures[i].write(name, *width, *height, ext == "png"); err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("wrote %s figure to %s", k, name)
+	}
+}
+
+// combine draws the metrics of several figures in one, naming every
+// series by its metric
+func combine(figures []figure) figure {
+	f := figures[0]
+	f.series = nil
+	var metrics []string
+	for _, g := range figures {
+		for _, s := range g.series {
+			s.name += " " + g.yLabel
+			f.series = append(f.series, s)
+		}
+		metrics = append(metrics, g.yLabel)
+	}
+	f.yLabel = strings.Join(metrics, ", ")
+	return f
+}
+
+func readCSV(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CSV (%s)", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	t, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s (%s)", file, err)
+	}
+	if len(t) < 2 {
+		return nil, fmt.Errorf("no data in %s", file)
+	}
+	return t, nil
+}
+
+// detectKind returns the kind of figure of a CSV by its header
+func detectKind(header []string) string {
+	switch {
+	case header[0] == "pct":
+		return "metric"
+	case strings.Join(header, ",") == "value,count,cdf":
+		return "cdf"
+	case header[0] == "threshold":
+		return "pr"
+	}
+	logging.Fatalf("unknown CSV with header %q, set -kind", strings.Join(header, ","))
+	return ""
+}
+
+// column returns the index of the column named name, -1 if none
+func column(header []string, name string) int {
+	for i, h := range header {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// floats parses column i of every row of t but the header
+func floats(t [][]string, i int) ([]float64, error) {
+	values := make([]float64, 0, len(t)-1)
+	for _, row := range t[1:] {
+		if i >= len(row) {
+			return nil, fmt.Errorf("short row %q", strings.Join(row, ","))
+		}
+		v, err := strconv.ParseFloat(row[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse value (%s)", err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// metricFigure plots every attack of a defector metric CSV against pct
+func metricFigure(t [][]string, metric string) (f figure, err error) {
+	f = figure{xLabel: "exit bandwidth (%)", yLabel: metric, yMin: 0, yMax: 1}
+	header := t[0]
+	x, err := floats(t, 0)
+	if err != nil {
+		return
+	}
+	for i, attack := range header[1:] {
+		if attack == "load" || isBand(attack) {
+			continue
+		}
+		s := series{name: attack, x: x}
+		if s.y, err = floats(t, i+1); err != nil {
+			return
+		}
+		for _, band := range []string{"", "sim"} { // bootstrap, else simreps
+			lo, hi := column(header, attack+"-"+band+"lo"), column(header, attack+"-"+band+"hi")
+			if lo != -1 && hi != -1 {
+				if s.lo, err = floats(t, lo); err != nil {
+					return
+				}
+				if s.hi, err = floats(t, hi); err != nil {
+					return
+				}
+				break
+			}
+		}
+		f.series = append(f.series, s)
+	}
+	return
+}
+
+// isBand returns if a column of a metric CSV is the bound of a band
+func isBand(name string) bool {
+	for _, suffix := range []string{"-lo", "-hi", "-simlo", "-simhi"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cdfSeries plots a dnsstats CDF as a step function
+func cdfSeries(t [][]string) (s series, err error) {
+	s.step = true
+	if s.x, err = floats(t, 0); err != nil {
+		return
+	}
+	s.y, err = floats(t, 2)
+	return
+}
+
+// prSeries plots a dns2site precision-recall curve, skipping thresholds
+// where precision is undefined
+func prSeries(t [][]string) (s series, err error) {
+	r, p := column(t[0], "recall"), column(t[0], "precision")
+	if r == -1 || p == -1 {
+		return s, fmt.Errorf("no recall and precision columns")
+	}
+	recall, err := floats(t, r)
+	if err != nil {
+		return
+	}
+	precision, err := floats(t, p)
+	if err != nil {
+		return
+	}
+	for i := range recall {
+		if recall[i] == recall[i] && precision[i] == precision[i] { // not NaN
+			s.x = append(s.x, recall[i])
+			s.y = append(s.y, precision[i])
+		}
+	}
+	return
+}
+
+// metricName returns the metric of a defector CSV, last in its name
+func metricName(file string) string {
+	name := seriesName(file)
+	return name[strings.LastIndex(name, "-")+1:]
+}
+
+// seriesName returns the name of a CSV without dir and suffixes, e.g.,
+// ttl for ttl.cdf.csv and bayes for bayes.pr.csv
+func seriesName(file string) string {
+	name := path.Base(file)
+	for _, suffix := range []string{".csv", ".cdf", ".pr"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os/exec"
+)
+
+// svgCanvas draws a figure as SVG
+type svgCanvas struct {
+	bytes.Buffer
+}
+
+// write renders the figure as a width x height SVG to file, or as a PNG
+// converted from it by rsvg-convert if png
+func (f *figure) write(file string, width, height int, png bool) error {
+	c := new(svgCanvas)
+	fmt.Fprintf(c, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" `+
+		`font-family="sans-serif" font-size="12">`+"\n", width, height)
+	fmt.Fprintf(c, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+	if err := f.draw(c, width, height); err != nil {
+		return fmt.Errorf("%s in %s", err, file)
+	}
+	c.WriteString("</svg>\n")
+
+	if png {
+		convert := exec.Command("rsvg-convert", "-f", "png", "-o", file)
+		convert.Stdin = &c.Buffer
+		if err := convert.Run(); err != nil {
+			return fmt.Errorf("failed to convert figure to PNG with rsvg-convert (%s)", err)
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(file, c.Bytes(), 0666); err != nil {
+		return fmt.Errorf("failed to write figure (%s)", err)
+	}
+	return nil
+}
+
+func (c *svgCanvas) points(points []point) string {
+	var b bytes.Buffer
+	for _, p := range points {
+		fmt.Fprintf(&b, "%.1f,%.1f ", p.x, p.y)
+	}
+	return b.String()
+}
+
+func (c *svgCanvas) line(a, b point, color string, width float64) {
+	fmt.Fprintf(c, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"`, a.x, a.y,
+		b.x, b.y, color)
+	if width != 1 {
+		fmt.Fprintf(c, ` stroke-width="%g"`, width)
+	}
+	c.WriteString("/>\n")
+}
+
+func (c *svgCanvas) polyline(points []point, color string, width float64) {
+	fmt.Fprintf(c, `<polyline points="%s" fill="none" stroke="%s" stroke-width="%g"/>`+"\n",
+		c.points(points), color, width)
+}
+
+func (c *svgCanvas) polygon(points []point, color string, opacity float64) {
+	fmt.Fprintf(c, `<polygon points="%s" fill="%s" fill-opacity="%g"/>`+"\n",
+		c.points(points), color, opacity)
+}
+
+func (c *svgCanvas) rect(x, y, w, h float64, color string) {
+	fmt.Fprintf(c, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="none" stroke="%s"/>`+"\n",
+		x, y, w, h, color)
+}
+
+func (c *svgCanvas) circle(p point, r float64, color string) {
+	fmt.Fprintf(c, `<circle cx="%.1f" cy="%.1f" r="%g" fill="%s"/>`+"\n", p.x, p.y, r, color)
+}
+
+func (c *svgCanvas) text(p point, s string, size, anchor int, vertical bool) {
+	c.WriteString("<text ")
+	if vertical {
+		fmt.Fprintf(c, `transform="translate(%.1f,%.1f) rotate(-90)"`, p.x, p.y)
+	} else {
+		fmt.Fprintf(c, `x="%.1f" y="%.1f"`, p.x, p.y)
+	}
+	switch anchor {
+	case anchorMiddle:
+		c.WriteString(` text-anchor="middle"`)
+	case anchorEnd:
+		c.WriteString(` text-anchor="end"`)
+	}
+	if size != 12 {
+		fmt.Fprintf(c, ` font-size="%d"`, size)
+	}
+	fmt.Fprintf(c, ">%s</text>\n", html.EscapeString(s))
+}
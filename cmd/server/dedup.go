@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pylls/defector/logging"
+)
+
+var (
+	aliases = make(map[string][]string) // site to the sites with the same page
+	aliasOf = make(map[string]string)   // alias site to the site collected
+)
+
+// normalizeURL returns the page of raw that is the same for URLs that only
+// differ by scheme, case of the host, a www. prefix, default port, trailing
+// slash or fragment
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err == nil && u.Scheme == "" && u.Host == "" { // a bare domain
+		u, err = url.Parse("//" + raw)
+	}
+	if err != nil {
+		return raw
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	page := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		page += "?" + u.RawQuery
+	}
+	return page
+}
+
+// followRedirects returns the final URL of every page, following redirects
+// with a GET, or the page itself if it cannot be fetched
+func followRedirects(pages [][]string, timeout time.Duration) []string {
+	final := make([]string, len(pages))
+	client := &http.Client{Timeout: timeout}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				final[i] = pages[i][1]
+				page, _ := url.Parse(pages[i][1])
+				if page.Scheme == "" {
+					page, _ = url.Parse(*scheme + "://" + pages[i][1])
+				}
+				resp, err := client.Get(page.String())
+				if err != nil {
+					logging.Debugf("failed to follow %s (%s)", page, err)
+					continue
+				}
+				resp.Body.Close()
+				final[i] = resp.Request.URL.String()
+			}
+		}()
+	}
+	for i := range pages {
+		work <- i
+		logging.Progress("\tfollowing redirects of %d/%d pages", i+1, len(pages))
+	}
+	close(work)
+	wg.Wait()
+	logging.EndProgress()
+	return final
+}
+
+// findAliases groups the pages by their normalized URL, where the first
+// page of each group is collected and the rest are its aliases, and writes
+// the aliases to aliases.csv in the datadir
+func findAliases(pages [][]string, follow bool) error {
+	urls := make([]string, len(pages))
+	for i := range pages {
+		urls[i] = pages[i][1]
+	}
+	if follow {
+		urls = followRedirects(pages, time.Duration(*timeout)*time.Second)
+	}
+	first := make(map[string]string) // normalized URL to site
+	var rows [][]string
+	for i := range pages {
+		site, page := pages[i][0], normalizeURL(urls[i])
+		if canonical, exists := first[page]; exists {
+			aliases[canonical] = append(aliases[canonical], site)
+			aliasOf[site] = canonical
+			rows = append(rows, []string{site, canonical, page})
+		} else {
+			first[page] = site
+		}
+	}
+
+	f, err := os.Create(path.Join(*datadir, "aliases.csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"alias", "site", "page"})
+	w.WriteAll(rows)
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	logging.Infof("found %d pages that are aliases of others, see aliases.csv", len(rows))
+	return f.Close()
+}
+
+// fanOut stores the data of the sample with id also for every alias of its
+// site that does not have it yet, returning the number stored
+func fanOut(id string, data []byte) (n int, err error) {
+	i := strings.Index(id, "-")
+	if i < 0 {
+		return 0, nil
+	}
+	for _, alias := range aliases[id[:i]] {
+		name := outputFileName(alias + id[i:])
+		if _, err = os.Stat(name); err == nil {
+			continue
+		}
+		if err = ioutil.WriteFile(name, data, 0666); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
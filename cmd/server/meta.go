@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"time"
+
+	pb "github.com/pylls/defector"
+)
+
+// result is the metadata of a result reported by a worker, as stored in
+// <id>.meta.json in the datadir
+type result struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Worker   string `json:"worker"`
+	Time     string `json:"time"`
+	Attempts int64  `json:"attempts"`
+	LoadTime int64  `json:"load_time_ms"`
+	Bytes    int64  `json:"bytes"`
+	Error    string `json:"error,omitempty"`
+	Failure  string `json:"failure"`
+	Delay    int64  `json:"delay_ms"`
+	Wait     int64  `json:"wait_ms"`
+}
+
+// succeeded returns if the work in the result is done, by the metadata of
+// the worker or, for a worker without metadata, by the length of the data
+func succeeded(in *pb.Browse) bool {
+	if m := in.GetMeta(); m != nil && m.Attempts > 0 {
+		return m.Error == "" && len(in.Data) > 0
+	}
+	return len(in.Data) >= *minDataLen
+}
+
+// writeMeta writes the metadata of the result in from worker, overwriting
+// that of any earlier result with the same ID
+func writeMeta(in *pb.Browse, worker string) error {
+	r := result{
+		ID:      in.ID,
+		URL:     in.URL,
+		Worker:  worker,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Bytes:   int64(len(in.Data)),
+		Failure: in.Failure.String(),
+	}
+	if m := in.GetMeta(); m != nil {
+		r.Attempts, r.LoadTime, r.Error = m.Attempts, m.LoadTime, m.Error
+		r.Delay, r.Wait = m.Delay, m.Wait
+		if m.Attempts > 0 {
+			r.Bytes = m.Bytes
+		}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(*datadir, path.Clean(in.ID)+".meta.json"),
+		append(data, '\n'), 0666)
+}
@@ -3,15 +3,41 @@ Package main implements a simple server to distribute URLs to worker clients
 (see tbdnsw and tbw) and to collect the resulting data.  The implementation
 uses locks excessively but worked just fine for around 500 workers on an old
 laptop.
+
+With -recollect, the server collects the pages again and again, for studying
+how fingerprints become stale over time: once all samples are collected, it
+waits for the interval and then distributes the pages anew, as the next
+epoch.  The IDs of samples, and so the names of the files, are then
+"<site>-<sample>-<epoch>", starting at epoch 0, and -epochs limits the
+number of epochs.  A restarted server continues with the last epoch in the
+data folder.
+
+Workers report samples where they detected a block page or a challenge such
+as a CAPTCHA instead of the page.  Such a sample is put back to be collected
+again, at most -retries times, after which it is stored anyway and flagged
+as "<id>,<url>,<failure>" in failures.csv in the data folder.
+
+Workers also report the metadata of every result: the attempts used, the
+wall-clock time of the last attempt, the bytes captured and, if the work
+failed, why.  A result is a sample if the worker reports no error and some
+data, and the metadata is stored as <id>.meta.json in the data folder next
+to the sample, or for the latest failure of work yet to be done.  For older
+workers without metadata, a result is a sample if it has at least -m bytes.
+
+Page lists often have the same page under several sites, e.g., with and
+without "www.".  With -dedup, pages are compared by their URL normalized to
+ignore the scheme, the case of the host, a "www." prefix, a default port, a
+trailing slash and the fragment, and with -follow after following redirects
+first.  Only the first of the same pages is collected, and its samples are
+stored for the others as well, its aliases, which are listed as
+"alias,site,page" in aliases.csv in the data folder.
 */
 package main
 
 import (
 	"encoding/csv"
 	"flag"
-	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/url"
 	"os"
@@ -26,6 +52,10 @@ import (
 	"google.golang.org/grpc"
 
 	"golang.org/x/net/context"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
 )
 
 const (
@@ -46,93 +76,113 @@ var (
 	alltraffic = flag.Bool("a", false,
 		"request that clients collect all traffic")
 	minDataLen = flag.Int("m", 25,
-		"the minimum number of bytes to accept as a data from a client")
+		"the minimum number of bytes to accept as data from a client without metadata")
 	outputSuffix = flag.String("o", ".pcap", "the suffix for the output files")
+	recollect    = flag.Duration("recollect", 0,
+		"collect all pages again this long after each epoch is done (0 means only once)")
+	epochs  = flag.Int("epochs", 0, "the number of epochs with -recollect (0 means forever)")
+	retries = flag.Int("retries", 2,
+		"the times to retry a sample with a block page or challenge before storing it flagged")
+	dedup = flag.Bool("dedup", false,
+		"collect pages with the same normalized URL once, storing the samples for all")
+	follow = flag.Bool("follow", false, "with -dedup, follow redirects before comparing URLs")
 
 	lock    sync.Mutex
 	work    map[string]*item
 	workers map[string]string
 	done    int
+	pages   [][]string
+	epoch   int
+	retried = make(map[string]int) // by ID, samples with a detected failure
 )
 
 func main() {
-	flag.Parse()
+	provenance.RegisterFlags()
+	config.Parse("server")
+	provenance.Init("server")
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify file with pages as argument")
+		logging.Fatal("need to specify file with pages as argument")
 	}
 
 	// make sure we can write to datadir
 	err := os.MkdirAll(*datadir, 0700)
 	if err != nil {
-		log.Fatalf("failed to create datadir (%s)", err)
+		logging.Fatalf("failed to create datadir (%s)", err)
 	}
 
 	// read pages and validate as URLs
 	f, err := os.Open(flag.Arg(0))
 	if err != nil {
-		log.Fatalf("failed to read file with pages (%s)", err)
+		logging.Fatalf("failed to read file with pages (%s)", err)
 	}
 	r := csv.NewReader(f)
-	pages, err := r.ReadAll()
+	pages, err = r.ReadAll()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
 	}
 	for i := 0; i < len(pages); i++ {
 		_, err = url.Parse(pages[i][1])
 		if err != nil {
-			log.Fatalf("failed to parse page as URL (%s)", err)
+			logging.Fatalf("failed to parse page as URL (%s)", err)
 		}
 	}
 	workers = make(map[string]string)
+	if *dedup {
+		if err = findAliases(pages, *follow); err != nil {
+			logging.Fatalf("failed to find aliases (%s)", err)
+		}
+	}
 
-	// create work
-	work = make(map[string]*item)
-	for s := 0; s < *samples; s++ {
-		for i := 0; i < len(pages); i++ {
-			page, _ := url.Parse(pages[i][1])
-			if page.Scheme == "" {
-				page.Scheme = *scheme
-			}
-			id := pages[i][0] + "-" + strconv.Itoa(s)
-			if _, err = os.Stat(outputFileName(id)); os.IsNotExist(err) {
-				// only perform work if we have to
-				work[id] = &item{
-					ID:  id,
-					URL: page.String(),
-				}
-			} else {
-				done++
-			}
+	if *recollect > 0 {
+		epoch, err = lastEpoch()
+		if err != nil {
+			logging.Fatalf("failed to find last epoch (%s)", err)
+		}
+		if *epochs > 0 && epoch >= *epochs {
+			epoch = *epochs - 1
 		}
 	}
+	createWork()
 
-	log.Printf("collecting %d sample(s) of %d sites over %s",
+	logging.Infof("collecting %d sample(s) of %d sites over %s",
 		*samples, len(pages), *scheme)
+	if *recollect > 0 {
+		logging.Infof("epoch %d, recollecting %s after each epoch", epoch, *recollect)
+	}
 	if *alltraffic {
-		log.Printf("%d seconds timeout, results in \"%s\", full capture in PCAPs",
+		logging.Infof("%d seconds timeout, results in \"%s\", full capture in PCAPs",
 			*timeout, *datadir)
 	} else {
-		log.Printf("%d seconds timeout, results in \"%s\", only capturing DNS in PCAPs",
+		logging.Infof("%d seconds timeout, results in \"%s\", only capturing DNS in PCAPs",
 			*timeout, *datadir)
 	}
 
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		logging.Fatalf("failed to listen: %v", err)
 	}
-	log.Printf("listening on %s", lis.Addr())
+	logging.Infof("listening on %s", lis.Addr())
 
 	// progress function
 	go func() {
 		total := len(pages) * *samples
 		for {
 			lock.Lock()
-			if done == total {
-				fmt.Println("")
-				log.Printf("finished")
-				os.Exit(0)
+			if done >= total {
+				logging.EndProgress()
+				if *recollect == 0 || (*epochs > 0 && epoch+1 >= *epochs) {
+					logging.Infof("finished")
+					os.Exit(0)
+				}
+				logging.Infof("finished epoch %d, recollecting in %s", epoch, *recollect)
+				lock.Unlock()
+				time.Sleep(*recollect)
+				lock.Lock()
+				epoch++
+				createWork()
+				logging.Infof("starting epoch %d", epoch)
 			}
-			fmt.Printf("\r %8d done (%3.1f%%), %8d left to distribute (%3d workers)",
+			logging.Progress(" %8d done (%3.1f%%), %8d left to distribute (%3d workers)",
 				done, float64(done)/float64(total)*100, len(work), len(workers))
 			lock.Unlock()
 			time.Sleep(1 * time.Second)
@@ -155,13 +205,30 @@ func (s *server) Work(c context.Context,
 	_, exists := workers[in.WorkerID]
 	if !exists {
 		workers[in.WorkerID] = in.WorkerID
-		fmt.Println("")
-		log.Printf("worker reporting for work: %s\n", in.WorkerID)
+		logging.Infof("worker reporting for work: %s", in.WorkerID)
 	}
 
 	// completed work?
 	if in.Browse.ID != "" {
-		if len(in.Browse.Data) >= *minDataLen {
+		if m := in.Browse.GetMeta(); m != nil {
+			logging.Debugf("%s paced by %s: %dms delay, %dms rate limited", in.Browse.ID,
+				in.WorkerID, m.Delay, m.Wait)
+		}
+		if err = writeMeta(in.Browse, in.WorkerID); err != nil {
+			logging.Warnf("failed to write metadata of %s (%s)", in.Browse.ID, err)
+		}
+		ok := succeeded(in.Browse)
+		if ok && in.Browse.Failure != pb.Failure_None &&
+			inEpoch(in.Browse.ID) && retried[in.Browse.ID] < *retries {
+			// put back work, the page was blocked or a challenge
+			retried[in.Browse.ID]++
+			logging.Warnf("%s page at %s (%s), retry %d", in.Browse.Failure,
+				in.Browse.URL, in.Browse.ID, retried[in.Browse.ID])
+			work[in.Browse.ID] = &item{
+				ID:  in.Browse.ID,
+				URL: in.Browse.URL,
+			}
+		} else if ok {
 			err = store(in.Browse)
 			if err != nil {
 				return
@@ -173,7 +240,11 @@ func (s *server) Work(c context.Context,
 				// report a completed work in time
 				delete(work, in.Browse.ID)
 			}
-		} else {
+		} else if inEpoch(in.Browse.ID) {
+			if m := in.Browse.GetMeta(); m != nil && m.Error != "" {
+				logging.Debugf("%s failed after %d attempts (%s)", in.Browse.ID,
+					m.Attempts, m.Error)
+			}
 			// put back work, toggling www. prefix
 			url := in.Browse.URL
 			if strings.HasPrefix(url, "www.") {
@@ -215,11 +286,110 @@ func store(in *pb.Browse) (err error) {
 			return
 		}
 	}
-	done++
+	if in.Failure != pb.Failure_None {
+		if err = flagFailure(in); err != nil {
+			return
+		}
+	}
+	n, err := fanOut(in.ID, in.Data)
+	if err != nil {
+		return
+	}
+	if inEpoch(in.ID) {
+		done += 1 + n
+	}
 
 	return nil
 }
 
+// flagFailure appends the failure of a stored sample to failures.csv
+func flagFailure(in *pb.Browse) error {
+	f, err := os.OpenFile(path.Join(*datadir, "failures.csv"),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{in.ID, in.URL, in.Failure.String()})
+	w.Flush()
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// createWork creates the work of the current epoch, skipping samples
+// already in the datadir
+func createWork() {
+	work = make(map[string]*item)
+	done = 0
+	for s := 0; s < *samples; s++ {
+		for i := 0; i < len(pages); i++ {
+			page, _ := url.Parse(pages[i][1])
+			if page.Scheme == "" {
+				page.Scheme = *scheme
+			}
+			id := pages[i][0] + "-" + strconv.Itoa(s)
+			if *recollect > 0 {
+				id += "-" + strconv.Itoa(epoch)
+			}
+			_, err := os.Stat(outputFileName(id))
+			if _, alias := aliasOf[pages[i][0]]; alias {
+				// stored when its site is, which comes first
+				if err == nil {
+					done++
+				}
+			} else if os.IsNotExist(err) {
+				// only perform work if we have to
+				work[id] = &item{
+					ID:  id,
+					URL: page.String(),
+				}
+			} else {
+				done++
+				if len(aliases[pages[i][0]]) > 0 {
+					// the server stopped before storing for all aliases
+					data, err := ioutil.ReadFile(outputFileName(id))
+					if err == nil {
+						_, err = fanOut(id, data)
+					}
+					if err != nil {
+						logging.Warnf("failed to store %s for aliases (%s)", id, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// inEpoch checks that the work with id is of the current epoch, and not late
+// work of a previous epoch
+func inEpoch(id string) bool {
+	return *recollect == 0 || strings.HasSuffix(id, "-"+strconv.Itoa(epoch))
+}
+
+// lastEpoch finds the last epoch with any sample in the datadir
+func lastEpoch() (last int, err error) {
+	infos, err := ioutil.ReadDir(*datadir)
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), *outputSuffix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(info.Name(), *outputSuffix), "-")
+		if len(parts) != 3 {
+			continue
+		}
+		if e, err := strconv.Atoi(parts[2]); err == nil && e > last {
+			last = e
+		}
+	}
+	return last, nil
+}
+
 func outputFileName(id string) string {
 	return path.Join(*datadir, path.Clean(id)+*outputSuffix)
 }
@@ -0,0 +1,182 @@
+/*
+Package main implements split, partitioning the samples of a data dir into
+folds for cross-validation, or into a train and test set, and writing the
+split manifest for classifiers to read with -split, e.g., dns2site.
+
+	split -folds 10 -sites 100 -o split.json <data dir>
+
+The samples of the data dir are the files named "<site>-<instance><suffix>",
+or "<site>-<instance>-<epoch><suffix>" for data collected in epochs (server
+-recollect), where sites up to -sites are monitored and the rest
+unmonitored.  Every epoch of an instance is a sample of its own.  The split
+is stratified and random from -seed: the instances of each monitored site
+are spread evenly over all folds, starting at a random fold, and the
+unmonitored sites are taken in order of their index (rank) in blocks of as
+many sites as folds, where each block is randomly spread over all folds,
+keeping every instance of an unmonitored site in the same fold.  Every fold
+so gets a similar share of each monitored site and a similar mix of popular
+and unpopular unmonitored sites.
+
+With -folds 0, the samples are split into a train and a test set, with
+-test the fraction to test on.  This is one fold of a k-fold split where k
+is 1/-test rounded, so the fraction is rounded to 1/k, with the samples of
+the other folds only trained on.
+
+The manifest records the hash of the samples of the data dir, so that
+classifiers can refuse to use the split for another dataset.
+*/
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+	"github.com/pylls/defector/split"
+)
+
+var (
+	folds = flag.Int("folds", 0,
+		"the number of folds for cross-validation (0 for a train/test split)")
+	test = flag.Float64("test", 0.2,
+		"the fraction of samples to test on with -folds 0")
+	sites = flag.Int("sites", 1000,
+		"the number of monitored sites, the rest are unmonitored")
+	seed = flag.Int64("seed", 0, "the seed for the random split (0 for time)")
+	out  = flag.String("o", "split.json", "the file to write the split to")
+)
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("split")
+	provenance.Init("split")
+	if flag.NArg() == 0 {
+		logging.Fatal("need to specify data dir")
+	}
+	if *folds < 0 {
+		logging.Fatal("-folds must not be negative")
+	}
+	k := *folds
+	if k == 0 {
+		if *test <= 0 || *test > 0.5 {
+			logging.Fatal("-test must be in (0, 0.5]")
+		}
+		k = int(math.Round(1 / *test))
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if err := provenance.Update(); err != nil {
+		logging.Fatal(err)
+	}
+
+	instances, err := listSamples(flag.Arg(0))
+	if err != nil {
+		logging.Fatal(err)
+	}
+	dataset, err := provenance.SampleHash(flag.Arg(0))
+	if err != nil {
+		logging.Fatal(err)
+	}
+	s := &split.Split{
+		Time:    time.Now(),
+		Dir:     flag.Arg(0),
+		Dataset: dataset,
+		Seed:    *seed,
+		Folds:   *folds,
+		Sites:   *sites,
+		Samples: assignFolds(instances, k, rand.New(rand.NewSource(*seed))),
+	}
+	if *folds == 0 { // keep fold 0 as the test set
+		s.Folds, s.Test = 1, 1/float64(k)
+		for sample, fold := range s.Samples {
+			if fold != 0 {
+				s.Samples[sample] = split.Train
+			}
+		}
+	}
+	if err = s.Write(*out); err != nil {
+		logging.Fatal(err)
+	}
+
+	tested := make([]int, s.Folds)
+	for _, fold := range s.Samples {
+		if fold != split.Train {
+			tested[fold]++
+		}
+	}
+	logging.Infof("split %d samples of %d sites (seed %d), testing %v per fold, in %s",
+		len(s.Samples), len(instances), *seed, tested, *out)
+}
+
+// listSamples lists the samples of each site in dir, sorted by instance
+// and epoch
+func listSamples(dir string) (map[int][]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	files := make(map[int][]epoch.File)
+	for _, info := range infos {
+		f, ok := epoch.ParseFile(info.Name())
+		if info.IsDir() || !ok || seen[f.Sample] {
+			continue
+		}
+		seen[f.Sample] = true
+		files[f.Site] = append(files[f.Site], f)
+	}
+	samples := make(map[int][]string, len(files))
+	for site, fs := range files {
+		sort.Slice(fs, func(i, j int) bool {
+			if fs[i].Instance != fs[j].Instance {
+				return fs[i].Instance < fs[j].Instance
+			}
+			return fs[i].Epoch < fs[j].Epoch
+		})
+		for _, f := range fs {
+			samples[site] = append(samples[site], f.Sample)
+		}
+	}
+	return samples, nil
+}
+
+// assignFolds assigns every sample to one of k folds, stratified as
+// described in the package documentation
+func assignFolds(instances map[int][]string, k int,
+	rng *rand.Rand) map[string]int {
+	var monitored, open []int
+	for site := range instances {
+		if site <= *sites {
+			monitored = append(monitored, site)
+		} else {
+			open = append(open, site)
+		}
+	}
+	sort.Ints(monitored)
+	sort.Ints(open)
+
+	assigned := make(map[string]int)
+	for _, site := range monitored {
+		start := rng.Intn(k)
+		for i, j := range rng.Perm(len(instances[site])) {
+			assigned[instances[site][j]] = (start + i) % k
+		}
+	}
+	for start := 0; start < len(open); start += k {
+		perm := rng.Perm(k)
+		for i := start; i < start+k && i < len(open); i++ {
+			for _, sample := range instances[open[i]] {
+				assigned[sample] = perm[i-start]
+			}
+		}
+	}
+	return assigned
+}
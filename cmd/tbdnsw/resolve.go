@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+)
+
+// observed is a domain as in a .dns file
+type observed struct {
+	domain string
+	ttl    int
+	ips    []string
+}
+
+var changesLock sync.Mutex
+
+// resolvePage resolves the domains previously observed for the site of the
+// work item id, "<site>-<instance>", and returns them as a .dns file
+func resolvePage(id string) ([]byte, error) {
+	site := id
+	if i := strings.Index(id, "-"); i > 0 {
+		site = id[:i]
+	}
+	previous, err := readObserved(*resolveDir, site)
+	if err != nil {
+		return nil, err
+	}
+	if len(previous) == 0 {
+		return nil, fmt.Errorf("no .dns files of site %s in %s", site, *resolveDir)
+	}
+
+	var current []observed
+	failed := 0
+	for _, p := range previous {
+		types := []layers.DNSType{layers.DNSTypeA}
+		for _, ip := range p.ips {
+			if strings.Contains(ip, ":") {
+				types = append(types, layers.DNSTypeAAAA)
+				break
+			}
+		}
+		for _, t := range types {
+			dns, err := query(p.domain, t)
+			if err != nil {
+				failed++
+				logging.Debugf("failed to resolve %s (%s)", p.domain, err)
+				continue
+			}
+			current = addAnswers(current, p.domain, dns)
+		}
+	}
+
+	changes := compareObserved(id, previous, current)
+	logging.Infof("resolved %d domains of site %s, %d failed, %d changed",
+		len(previous), site, failed, len(changes))
+	if *changesFile != "" && len(changes) > 0 {
+		if err = appendChanges(*changesFile, changes); err != nil {
+			logging.Warnf("%s", err)
+		}
+	}
+
+	var b bytes.Buffer
+	for _, o := range current {
+		b.WriteString(o.domain + "," + strconv.Itoa(o.ttl))
+		for _, ip := range o.ips {
+			b.WriteString("," + ip)
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes(), nil
+}
+
+// readObserved reads the distinct domains, in order of first appearance,
+// of the .dns files of site in dir, with the TTL and IPs last observed
+func readObserved(dir, site string) ([]observed, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dir of .dns files (%s)", err)
+	}
+	var domains []observed
+	index := make(map[string]int)
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, site+"-") || !(strings.HasSuffix(name, ".dns") ||
+			strings.HasSuffix(name, ".dns.gz")) {
+			continue
+		}
+		f, err := gzfile.Open(path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s (%s)", name, err)
+		}
+		scanner := dnsfile.NewScanner(f)
+		for scanner.Scan() {
+			req := scanner.Request()
+			o := observed{domain: strings.ToLower(req.Domain), ttl: req.TTL, ips: req.IPs}
+			if i, exists := index[o.domain]; exists {
+				domains[i] = o
+			} else {
+				index[o.domain] = len(domains)
+				domains = append(domains, o)
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s (%s)", name, err)
+		}
+	}
+	return domains, nil
+}
+
+// query asks the -resolver for records of type t of domain over UDP
+func query(domain string, t layers.DNSType) (*layers.DNS, error) {
+	q := &layers.DNS{
+		ID:        uint16(rand.Intn(1 << 16)),
+		RD:        true,
+		QDCount:   1,
+		Questions: []layers.DNSQuestion{{Name: []byte(domain), Type: t, Class: layers.DNSClassIN}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := q.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("udp", *resolver, *resolveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*resolveTimeout))
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 65535)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		dns := new(layers.DNS)
+		if err = dns.DecodeFromBytes(b[:n], gopacket.NilDecodeFeedback); err != nil {
+			return nil, err
+		}
+		if dns.ID != q.ID || !dns.QR {
+			continue // not our response
+		}
+		if dns.ResponseCode != layers.DNSResponseCodeNoErr {
+			return nil, fmt.Errorf("%s", dns.ResponseCode)
+		}
+		return dns, nil
+	}
+}
+
+// addAnswers adds the question and answers of a response for domain, as
+// extractdns does for the responses in a pcap
+func addAnswers(current []observed, domain string, dns *layers.DNS) []observed {
+	get := func(name string) int {
+		name = strings.ToLower(name)
+		for i := range current {
+			if current[i].domain == name {
+				return i
+			}
+		}
+		current = append(current, observed{domain: name})
+		return len(current) - 1
+	}
+	get(domain)
+	for _, a := range dns.Answers {
+		i := get(string(a.Name))
+		if current[i].ttl == 0 {
+			current[i].ttl = int(a.TTL)
+		}
+		if a.IP != nil {
+			ip := a.IP.String()
+			found := false
+			for _, known := range current[i].ips {
+				found = found || known == ip
+			}
+			if !found {
+				current[i].ips = append(current[i].ips, ip)
+			}
+		}
+	}
+	return current
+}
+
+// change is a domain whose TTL or IPs changed since it was last observed
+type change struct {
+	id, domain       string
+	oldTTL, newTTL   int
+	oldIPs, newIPs   string // sorted and space-separated
+	vanished, gained bool
+}
+
+// compareObserved returns the changes from previous to current
+func compareObserved(id string, previous, current []observed) (changes []change) {
+	ipSet := func(ips []string) string {
+		s := append([]string(nil), ips...)
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+	now := make(map[string]observed)
+	for _, o := range current {
+		now[o.domain] = o
+	}
+	before := make(map[string]bool)
+	for _, p := range previous {
+		before[p.domain] = true
+		c, exists := now[p.domain]
+		ch := change{id: id, domain: p.domain, oldTTL: p.ttl, oldIPs: ipSet(p.ips),
+			newTTL: c.ttl, newIPs: ipSet(c.ips), vanished: !exists}
+		if ch.vanished || ch.oldTTL != ch.newTTL || ch.oldIPs != ch.newIPs {
+			changes = append(changes, ch)
+		}
+	}
+	for _, o := range current {
+		if !before[o.domain] { // e.g., a new CNAME
+			changes = append(changes, change{id: id, domain: o.domain, oldTTL: -1,
+				newTTL: o.ttl, newIPs: ipSet(o.ips), gained: true})
+		}
+	}
+	return
+}
+
+// appendChanges appends changes as CSV to file, with a header if new
+func appendChanges(file string, changes []change) error {
+	changesLock.Lock()
+	defer changesLock.Unlock()
+	_, err := os.Stat(file)
+	header := os.IsNotExist(err)
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open changes file (%s)", err)
+	}
+	w := bufio.NewWriter(f)
+	if header {
+		fmt.Fprintln(w, "time,id,domain,change,oldttl,newttl,oldips,newips")
+	}
+	t := time.Now().Unix()
+	for _, c := range changes {
+		kind := "changed"
+		if c.vanished {
+			kind = "vanished"
+		} else if c.gained {
+			kind = "new"
+		}
+		fmt.Fprintf(w, "%d,%s,%s,%s,%d,%d,%s,%s\n", t, c.id, c.domain, kind,
+			c.oldTTL, c.newTTL, c.oldIPs, c.newIPs)
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write changes (%s)", err)
+	}
+	return f.Close()
+}
@@ -4,6 +4,32 @@ to browse to provided URLs using a specified Tor Browser.  While browsing,
 the client collects traffic into a PCAP-file that is returned to the server.
 For the DefecTor work we used this client with a Tor Browser that did not
 browse over the Tor network, enabling us to collect DNS requests and responses.
+
+With -resolve, the client does not browse at all: for each URL to browse, it
+resolves the domains previously observed for the site, in the ".dns" files of
+that site (from extractdns) in the given dir, against the -resolver, and
+returns the TTLs and IPs in the ".dns" format, so run the server with -o .dns.
+This is a cheap way of following how the DNS of the sites changes over time.
+The changed TTLs and IPs, and domains that no longer resolve or are new (e.g.,
+a new CNAME), are logged, and written as CSV to the -changes file if set.
+
+The PCAP-files have the link type of the capture on -nic: Ethernet (with or
+without VLAN tags) for most NICs, raw IP for tunnels, and Linux cooked
+capture (SLL) for "any", which captures on all NICs, e.g., in a container
+without knowing the name of its NIC.
+
+When browsing, the DNS requests are checked for domains of block pages and
+challenges such as CAPTCHAs in the -detect file (see the detect package),
+and with -challenges those built into the detect package, whatever traffic
+is collected, and any found is reported to the server as the failure of the
+sample.
+
+Browses are paced so that many workers do not hammer sites or trip rate
+limits: every browse waits -delay plus a random -jitter, and at most -rate
+browses per minute are made, in bursts of up to -burst.  The pacing applied
+is reported to the server with the result, as are the attempts used, the
+wall-clock time of the last attempt, the bytes collected and any error, which
+the server uses to tell whether the work is done.
 */
 package main
 
@@ -16,6 +42,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	pb "github.com/pylls/defector"
@@ -28,9 +55,14 @@ import (
 	"golang.org/x/net/context"
 
 	"flag"
-	"log"
 
 	"google.golang.org/grpc"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/detect"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/pacing"
+	"github.com/pylls/defector/provenance"
 )
 
 var (
@@ -41,22 +73,47 @@ var (
 	display = flag.String("display", "-screen 0 1024x768x24",
 		"the xvfb display to use")
 
-	nic        = flag.String("nic", "eth0", "the NIC to listen on for traffic")
+	nic        = flag.String("nic", "eth0", "the NIC to listen on for traffic (any for all)")
 	snaplen    = flag.Int("snaplen", 65536, "the snaplen to capture and write")
 	trafficAll = flag.Bool("all", false, "collect all traffic")
 	trafficTCP = flag.Bool("tcp", false, "collect only TCP traffic")
 
+	resolveDir = flag.String("resolve", "",
+		"resolve the domains of the .dns files in this dir instead of browsing")
+	resolver       = flag.String("resolver", "127.0.0.1:53", "the resolver to use with -resolve")
+	resolveTimeout = flag.Duration("resolvetimeout", 5*time.Second,
+		"the timeout of each query with -resolve")
+	changesFile = flag.String("changes", "",
+		"append the TTL and IP changes found with -resolve to this CSV file")
+	detectFile = flag.String("detect", "",
+		"file with block and challenge rules to detect, see the detect package")
+	challenges = flag.Bool("challenges", false,
+		"also detect the challenges built into the detect package, which some sites embed on every visit")
+	rate = flag.Float64("rate", 0,
+		"the maximum number of browses per minute (0 for no limit)")
+	burst  = flag.Int("burst", 1, "the number of browses allowed in a burst with -rate")
+	delay  = flag.Duration("delay", 0, "the delay before every browse")
+	jitter = flag.Duration("jitter", 0,
+		"a uniformly random extra delay of up to this before every browse")
+
 	tmpDir      = path.Join(os.TempDir(), "hotexp")
 	browser     = path.Join(tmpDir, "browser")
 	dataDirPath = "Browser/TorBrowser/Data"
 	serverIP    = ""
 	pcapData    bytes.Buffer
+	linkType    = layers.LinkTypeEthernet // of the capture and the pcaps written
+
+	detector    *detect.Detector
+	failureLock sync.Mutex
+	failure     pb.Failure // detected in the current sample
 )
 
 func main() {
-	flag.Parse()
+	provenance.RegisterFlags()
+	config.Parse("tbdnsw")
+	provenance.Init("tbdnsw")
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify server address")
+		logging.Fatal("need to specify server address")
 	}
 	os.Remove(tmpDir)
 	err := os.MkdirAll(tmpDir, 0755)
@@ -65,56 +122,75 @@ func main() {
 	}
 	defer os.Remove(tmpDir)
 
-	// copy entire browser to a temporary location
-	err = os.MkdirAll(browser, 0755)
-	if err != nil {
-		return
+	if detector, err = detect.New(*detectFile, *challenges); err != nil {
+		logging.Fatal(err)
 	}
-	cp := exec.Command("cp", "-rfT", *origBrowser, browser)
-	err = cp.Run()
-	if err != nil {
-		log.Fatalf("failed to copy to %s (%s)", browser, err)
+	if *resolveDir != "" {
+		if _, err = os.Stat(*resolveDir); err != nil {
+			logging.Fatalf("failed to find dir of .dns files (%s)", err)
+		}
+	} else {
+		// copy entire browser to a temporary location
+		err = os.MkdirAll(browser, 0755)
+		if err != nil {
+			return
+		}
+		cp := exec.Command("cp", "-rfT", *origBrowser, browser)
+		err = cp.Run()
+		if err != nil {
+			logging.Fatalf("failed to copy to %s (%s)", browser, err)
+		}
 	}
 
 	conn, err := grpc.Dial(flag.Arg(0), grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		logging.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 	client := pb.NewCollectClient(conn)
 	serverIP = strings.Split(flag.Arg(0), ":")[0]
 
 	// start traffic capture
-	handler, err := pcap.OpenLive(*nic, int32(*snaplen), false, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("failed to open capture (%s)", err)
-	}
-	defer handler.Close()
-	source := gopacket.NewPacketSource(handler, layers.LinkTypeEthernet)
 	sampleChan := make(chan bool)
 	defer close(sampleChan)
-	if *trafficAll {
-		log.Println("collect all traffic")
-		go collectAll(source.Packets(), sampleChan)
-	} else if *trafficTCP {
-		log.Println("collect TCP traffic")
-		go collectTCP(source.Packets(), sampleChan)
+	if *resolveDir != "" {
+		logging.Infof("resolve domains of %s with %s", *resolveDir, *resolver)
 	} else {
-		log.Println("collect DNS traffic")
-		go collectDNS(source.Packets(), sampleChan)
+		handler, err := pcap.OpenLive(*nic, int32(*snaplen), false, pcap.BlockForever)
+		if err != nil {
+			logging.Fatalf("failed to open capture (%s)", err)
+		}
+		defer handler.Close()
+		linkType, err = captureLinkType(handler)
+		if err != nil {
+			logging.Fatalf("failed to capture on %s (%s)", *nic, err)
+		}
+		logging.Infof("capture on %s with link type %s", *nic, linkType)
+		source := gopacket.NewPacketSource(handler, linkType)
+		if *trafficAll {
+			logging.Info("collect all traffic")
+			go collectAll(source.Packets(), sampleChan)
+		} else if *trafficTCP {
+			logging.Info("collect TCP traffic")
+			go collectTCP(source.Packets(), sampleChan)
+		} else {
+			logging.Info("collect DNS traffic")
+			go collectDNS(source.Packets(), sampleChan)
+		}
 	}
 
 	// base identity reported to server on IPs for easy remote access
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatalf("failed to get network interfaces (%s)", err)
+		logging.Fatalf("failed to get network interfaces (%s)", err)
 	}
 	identity := strconv.Itoa(int(time.Now().UnixNano())) + "\t"
 	for i := 0; i < len(addrs); i++ {
 		identity += addrs[i].String() + " "
 	}
 
-	// we start with no completed work, then get to work
+	// we start with no completed work, then get to work, paced
+	pacer := pacing.New(*rate, *burst, *delay, *jitter)
 	work := new(pb.Req)
 	work.WorkerID = identity
 	work.Browse = &pb.Browse{
@@ -124,29 +200,83 @@ func main() {
 		// report and get work
 		browse, err := client.Work(context.Background(), work)
 		if err != nil {
-			log.Printf("failed to work (%s)", err)
+			logging.Warnf("failed to work (%s)", err)
 			continue
 		}
 		work.Browse = browse
 		if browse.ID == "" {
 			time.Sleep(time.Duration(browse.Timeout) * time.Second)
-			log.Printf("no work, sleeping for %d", browse.Timeout)
+			logging.Infof("no work, sleeping for %d", browse.Timeout)
+			continue
+		}
+		d, w := pacer.Wait()
+		if w > 0 {
+			logging.Debugf("rate limited for %s", w)
+		}
+		browse.Meta = &pb.Meta{
+			Delay: int64(d / time.Millisecond),
+			Wait:  int64(w / time.Millisecond),
+		}
+		logging.Infof("starting work: %s", browse.URL)
+		if *resolveDir != "" {
+			start := time.Now()
+			browse.Data, err = resolvePage(browse.ID)
+			browse.Meta.Attempts = 1
+			browse.Meta.LoadTime = int64(time.Since(start) / time.Millisecond)
+			browse.Meta.Bytes = int64(len(browse.Data))
+			if err != nil {
+				logging.Warnf("failed to resolve (%s)", err)
+				browse.Meta.Error = err.Error()
+			}
 			continue
 		}
-		log.Printf("starting work: %s", browse.URL)
 
 		sampleChan <- browse.AllTraffic // overwrites pcap
 
-		err = browseTB(browse.URL, int(browse.Timeout))
+		attempts, load, err := browseTB(browse.URL, int(browse.Timeout))
+		browse.Data = pcapData.Bytes()
+		browse.Meta.Attempts = int64(attempts)
+		browse.Meta.LoadTime = int64(load / time.Millisecond)
+		browse.Meta.Bytes = int64(len(browse.Data))
 		if err != nil {
-			log.Printf("failed to browse (%s)", err)
+			logging.Warnf("failed to browse (%s)", err)
+			browse.Meta.Error = err.Error()
+		}
+		failureLock.Lock()
+		browse.Failure = failure
+		failureLock.Unlock()
+		if browse.Failure != pb.Failure_None {
+			logging.Warnf("detected %s page at %s", browse.Failure, browse.URL)
 		}
-		browse.Data = pcapData.Bytes()
 	}
 }
 
-func browseTB(url string, seconds int) (err error) {
-	for i := 0; i < *attempts; i++ {
+// detectDNS records the failure shown by the DNS questions of packet, if any
+func detectDNS(packet gopacket.Packet) {
+	l := packet.Layer(layers.LayerTypeDNS)
+	if l == nil {
+		return
+	}
+	for _, q := range l.(*layers.DNS).Questions {
+		if f := detector.Domain(string(q.Name)); f != pb.Failure_None {
+			failureLock.Lock()
+			failure = detect.Worst(failure, f)
+			failureLock.Unlock()
+		}
+	}
+}
+
+// resetFailure forgets the failure of the previous sample
+func resetFailure() {
+	failureLock.Lock()
+	failure = pb.Failure_None
+	failureLock.Unlock()
+}
+
+// browseTB browses to url, returning the attempts used and the time of the
+// last attempt
+func browseTB(url string, seconds int) (attempt int, load time.Duration, err error) {
+	for attempt = 1; attempt <= *attempts; attempt++ {
 		err = nil
 		time.Sleep(1 * time.Second)
 
@@ -175,7 +305,9 @@ func browseTB(url string, seconds int) (err error) {
 		tb.Stdout = &stdout
 		tb.Stderr = &stderr
 
+		start := time.Now()
 		tb.Run()
+		load = time.Since(start)
 		if pre >= pcapData.Len() {
 			err = fmt.Errorf("didn't get any data while attempting to browse, stdin (%s) and stderr (%s)",
 				stdout.String(), stderr.String())
@@ -186,7 +318,22 @@ func browseTB(url string, seconds int) (err error) {
 		time.Sleep(2 * time.Second)
 		return
 	}
-	return
+	return *attempts, load, err
+}
+
+// captureLinkType returns the link type of the capture on handler, e.g.,
+// Linux cooked capture (SLL) for the "any" NIC or raw IP for tunnels, where
+// VLAN tags are decoded as part of Ethernet
+func captureLinkType(handler *pcap.Handle) (layers.LinkType, error) {
+	switch lt := handler.LinkType(); lt {
+	case 12, 14: // DLT_RAW depends on the platform, but is LINKTYPE_RAW in pcaps
+		return layers.LinkTypeRaw, nil
+	case layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL, layers.LinkTypeRaw,
+		layers.LinkTypeNull, layers.LinkTypeLoop:
+		return lt, nil
+	default:
+		return lt, fmt.Errorf("unsupported link type %s", lt)
+	}
 }
 
 func collectDNS(pChan chan gopacket.Packet, sampleChan chan bool) {
@@ -197,20 +344,22 @@ func collectDNS(pChan chan gopacket.Packet, sampleChan chan bool) {
 		case _ = <-sampleChan:
 			// truncate pcap-data
 			pcapData.Reset()
+			resetFailure()
 			w = pcapgo.NewWriter(&pcapData)
 			// new pcap, must do this
-			err = w.WriteFileHeader(uint32(*snaplen), layers.LinkTypeEthernet)
+			err = w.WriteFileHeader(uint32(*snaplen), linkType)
 			if err != nil {
-				log.Fatalf("failed to write pcap header (%s)", err)
+				logging.Fatalf("failed to write pcap header (%s)", err)
 			}
 		case packet := <-pChan:
 			// parse packet
 			if w != nil {
+				detectDNS(packet)
 				if packet.ApplicationLayer() != nil &&
 					packet.ApplicationLayer().LayerType() == layers.LayerTypeDNS {
 					err := w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
 					if err != nil {
-						log.Fatalf("failed to write packet to pcap (%s)", err)
+						logging.Fatalf("failed to write packet to pcap (%s)", err)
 					}
 				}
 			}
@@ -226,18 +375,20 @@ func collectAll(pChan chan gopacket.Packet, sampleChan chan bool) {
 		case _ = <-sampleChan:
 			// truncate pcap-data
 			pcapData.Reset()
+			resetFailure()
 			w = pcapgo.NewWriter(&pcapData)
 			// new pcap, must do this
-			err = w.WriteFileHeader(uint32(*snaplen), layers.LinkTypeEthernet)
+			err = w.WriteFileHeader(uint32(*snaplen), linkType)
 			if err != nil {
-				log.Fatalf("failed to write pcap header (%s)", err)
+				logging.Fatalf("failed to write pcap header (%s)", err)
 			}
 		case packet := <-pChan:
 			// parse packet
 			if w != nil {
+				detectDNS(packet)
 				err := w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
 				if err != nil {
-					log.Fatalf("failed to write packet to pcap (%s)", err)
+					logging.Fatalf("failed to write packet to pcap (%s)", err)
 				}
 
 			}
@@ -253,15 +404,17 @@ func collectTCP(pChan chan gopacket.Packet, sampleChan chan bool) {
 		case _ = <-sampleChan:
 			// truncate pcap-data
 			pcapData.Reset()
+			resetFailure()
 			w = pcapgo.NewWriter(&pcapData)
 			// new pcap, must do this
-			err = w.WriteFileHeader(uint32(*snaplen), layers.LinkTypeEthernet)
+			err = w.WriteFileHeader(uint32(*snaplen), linkType)
 			if err != nil {
-				log.Fatalf("failed to write pcap header (%s)", err)
+				logging.Fatalf("failed to write pcap header (%s)", err)
 			}
 		case packet := <-pChan:
 			// parse packet
 			if w != nil {
+				detectDNS(packet)
 				var src, dst string
 				if packet.NetworkLayer() != nil {
 					src = packet.NetworkLayer().NetworkFlow().Src().String()
@@ -272,7 +425,7 @@ func collectTCP(pChan chan gopacket.Packet, sampleChan chan bool) {
 					!strings.Contains(src, serverIP) && !strings.Contains(dst, serverIP) {
 					err := w.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
 					if err != nil {
-						log.Fatalf("failed to write packet to pcap (%s)", err)
+						logging.Fatalf("failed to write packet to pcap (%s)", err)
 					}
 				}
 			}
@@ -5,6 +5,19 @@ the client collects all data from stdout and sends it to the server.
 For the DefecTor work, we used this client together with a patched Tor (as part
 of the Tor Browser) that logged cells and DNS-related events to stdout, enabling
 us to build a website fingerprinting dataset.
+
+The DNS resolutions logged by Tor ("DNSRESOLVED <domain> ...") are checked
+for domains of block pages and challenges such as CAPTCHAs in the -detect
+file (see the detect package), and with -challenges those built into the
+detect package, and any found is reported to the server as the failure of
+the sample.
+
+Browses are paced so that many workers do not hammer sites or trip rate
+limits: every browse waits -delay plus a random -jitter, and at most -rate
+browses per minute are made, in bursts of up to -burst.  The pacing applied
+is reported to the server with the result, as are the attempts used, the
+wall-clock time of the last attempt, the bytes collected and any error, which
+the server uses to tell whether the work is done.
 */
 package main
 
@@ -14,7 +27,6 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
@@ -27,6 +39,12 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/detect"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/pacing"
+	"github.com/pylls/defector/provenance"
 )
 
 var (
@@ -36,6 +54,16 @@ var (
 		"the 	location of the TB folder")
 	display = flag.String("display", "-screen 0 1024x768x24",
 		"the xvfb display to use")
+	detectFile = flag.String("detect", "",
+		"file with block and challenge rules to detect, see the detect package")
+	challenges = flag.Bool("challenges", false,
+		"also detect the challenges built into the detect package, which some sites embed on every visit")
+	rate = flag.Float64("rate", 0,
+		"the maximum number of browses per minute (0 for no limit)")
+	burst  = flag.Int("burst", 1, "the number of browses allowed in a burst with -rate")
+	delay  = flag.Duration("delay", 0, "the delay before every browse")
+	jitter = flag.Duration("jitter", 0,
+		"a uniformly random extra delay of up to this before every browse")
 
 	tmpDir         = path.Join(os.TempDir(), "hotexp")
 	browser        = path.Join(tmpDir, "browser")
@@ -48,9 +76,11 @@ var (
 )
 
 func main() {
-	flag.Parse()
+	provenance.RegisterFlags()
+	config.Parse("tbw")
+	provenance.Init("tbw")
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify server address")
+		logging.Fatal("need to specify server address")
 	}
 	os.Remove(tmpDir)
 	err := os.MkdirAll(tmpDir, 0755)
@@ -58,6 +88,10 @@ func main() {
 		return
 	}
 	defer os.Remove(tmpDir)
+	detector, err := detect.New(*detectFile, *challenges)
+	if err != nil {
+		logging.Fatal(err)
+	}
 
 	// copy entire browser to a temporary location
 	err = os.MkdirAll(browser, 0755)
@@ -67,12 +101,12 @@ func main() {
 	cp := exec.Command("cp", "-rfT", *origBrowser, browser)
 	err = cp.Run()
 	if err != nil {
-		log.Fatalf("failed to copy to %s (%s)", browser, err)
+		logging.Fatalf("failed to copy to %s (%s)", browser, err)
 	}
 
 	conn, err := grpc.Dial(flag.Arg(0), grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		logging.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 	client := pb.NewCollectClient(conn)
@@ -80,14 +114,15 @@ func main() {
 	// base identity reported to server on IPs for easy remote access
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatalf("failed to get network interfaces (%s)", err)
+		logging.Fatalf("failed to get network interfaces (%s)", err)
 	}
 	identity := strconv.Itoa(int(time.Now().UnixNano())) + "\t"
 	for i := 0; i < len(addrs); i++ {
 		identity += addrs[i].String() + " "
 	}
 
-	// we start with no completed work, then get to work
+	// we start with no completed work, then get to work, paced
+	pacer := pacing.New(*rate, *burst, *delay, *jitter)
 	work := new(pb.Req)
 	work.WorkerID = identity
 	work.Browse = &pb.Browse{
@@ -97,34 +132,68 @@ func main() {
 		// report and get work
 		browse, err := client.Work(context.Background(), work)
 		if err != nil {
-			log.Printf("failed to work (%s)", err)
+			logging.Warnf("failed to work (%s)", err)
 			continue
 		}
 		work.Browse = browse
 		if browse.ID == "" {
 			time.Sleep(time.Duration(browse.Timeout) * time.Second)
-			log.Printf("no work, sleeping for %d", browse.Timeout)
+			logging.Infof("no work, sleeping for %d", browse.Timeout)
 			continue
 		}
-		log.Printf("starting work: %s", browse.URL)
+		d, w := pacer.Wait()
+		if w > 0 {
+			logging.Debugf("rate limited for %s", w)
+		}
+		browse.Meta = &pb.Meta{
+			Delay: int64(d / time.Millisecond),
+			Wait:  int64(w / time.Millisecond),
+		}
+		logging.Infof("starting work: %s", browse.URL)
 
-		data, err := browseTB(browse.URL, int(browse.Timeout))
+		data, attempts, load, err := browseTB(browse.URL, int(browse.Timeout))
+		browse.Meta.Attempts = int64(attempts)
+		browse.Meta.LoadTime = int64(load / time.Millisecond)
+		browse.Meta.Bytes = int64(len(data))
 		if err != nil {
-			log.Printf("failed to browse (%s)", err)
+			logging.Warnf("failed to browse (%s)", err)
+			browse.Meta.Error = err.Error()
 			data = []byte("none")
 		}
 		browse.Data = data
+		browse.Failure = detectLog(detector, data)
+		if browse.Failure != pb.Failure_None {
+			logging.Warnf("detected %s page at %s", browse.Failure, browse.URL)
+		}
 	}
 }
 
-func browseTB(url string, seconds int) (data []byte, err error) {
-	for i := 0; i < *attempts; i++ {
+// detectLog returns the failure shown by the DNS resolutions in the Tor log
+func detectLog(d *detect.Detector, data []byte) (f pb.Failure) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == "DNSRESOLVED" {
+				f = detect.Worst(f, d.Domain(fields[i+1]))
+				break
+			}
+		}
+	}
+	return
+}
+
+// browseTB browses to url, returning the output of tb, the attempts used
+// and the time of the last attempt
+func browseTB(url string, seconds int) (data []byte, attempt int, load time.Duration,
+	err error) {
+	for attempt = 1; attempt <= *attempts; attempt++ {
 		err = nil
 		time.Sleep(1 * time.Second)
 
 		err = clean()
 		if err != nil {
-			log.Printf("%s", err)
+			logging.Warnf("%s", err)
 			continue
 		}
 
@@ -137,7 +206,9 @@ func browseTB(url string, seconds int) (data []byte, err error) {
 		tb.Stderr = &stderr
 
 		// fills stdout and stderr
+		start := time.Now()
 		tb.Run()
+		load = time.Since(start)
 
 		if !gotData(stdout) {
 			err = fmt.Errorf("didn't get enough data while attempting to browse, stdout (%s), stderr (%s)",
@@ -147,9 +218,9 @@ func browseTB(url string, seconds int) (data []byte, err error) {
 
 		// we need to wait for killing tb and any lagging data
 		time.Sleep(2 * time.Second)
-		return stdout.Bytes(), nil
+		return stdout.Bytes(), attempt, load, nil
 	}
-	return
+	return nil, *attempts, load, err
 }
 
 func clean() (err error) {
@@ -0,0 +1,284 @@
+/*
+Package main implements toplist, fetching a list of the most popular sites
+and normalizing it to "rank,domain" lines, as read by dnsstats -alexa and,
+sliced, as the file with pages of the server.
+
+	toplist [-source tranco] [-from 1001 -to 2000 -id 101] [-o top-1m.csv]
+
+With -source tranco, the latest Tranco list is fetched, or the list of -date
+(YYYY-MM-DD) or with the ID -list, see https://tranco-list.eu/.  With
+-source alexa, the archived Alexa top 1M list is fetched.  Any other source
+is a URL or file of a list, as CSV or a zip of a CSV.
+
+The list is normalized: domains are lowercased and stripped of any scheme,
+path, port and trailing dot, duplicates and invalid lines are dropped, and
+the remaining domains are ranked from 1 in order.  With -from and -to, only
+the sites of that range of ranks are written, and with -id, they are
+numbered from it instead of by rank, e.g., to collect an open world of
+sites numbered after the monitored ones.
+
+The source, the version of the list (the Tranco ID or Last-Modified of the
+download), when it was fetched and the SHA-256 of the raw and written lists
+are recorded in the JSON -manifest, to know which list a dataset is from.
+*/
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+const (
+	trancoURL = "https://tranco-list.eu/"
+	alexaURL  = "https://s3.amazonaws.com/alexa-static/top-1m.csv.zip"
+)
+
+var (
+	source = flag.String("source", "tranco",
+		"the list to fetch: tranco, alexa (archived) or a URL or file of a list")
+	date = flag.String("date", "",
+		"with -source tranco, fetch the list of this date (YYYY-MM-DD, latest if empty)")
+	listID = flag.String("list", "",
+		"with -source tranco, fetch the list with this ID")
+	from    = flag.Int("from", 1, "the first rank to write")
+	to      = flag.Int("to", 0, "the last rank to write (0 for all)")
+	firstID = flag.Int("id", 0,
+		"number the written sites from this instead of by rank (0 for rank)")
+	out          = flag.String("o", "top-1m.csv", "the file to write the list to")
+	manifestFile = flag.String("manifest", "toplist.json",
+		"write the version and provenance of the list as JSON to this file")
+	timeout = flag.Duration("timeout", 5*time.Minute, "the timeout of each download")
+)
+
+// manifest is the provenance of a written list
+type manifest struct {
+	Source    string    `json:"source"`
+	URL       string    `json:"url,omitempty"`
+	Version   string    `json:"version,omitempty"` // Tranco ID or Last-Modified
+	Fetched   time.Time `json:"fetched"`
+	RawSHA256 string    `json:"raw_sha256"` // of the list as fetched
+	Sites     int       `json:"sites"`      // in the normalized list
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	FirstID   int       `json:"first_id,omitempty"`
+	Out       string    `json:"out"`
+	SHA256    string    `json:"sha256"` // of the written list
+}
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("toplist")
+	provenance.Init("toplist")
+	if *from < 1 || (*to != 0 && *to < *from) {
+		logging.Fatal("need 1 <= -from <= -to (or -to 0)")
+	}
+	client := &http.Client{Timeout: *timeout}
+	m := manifest{Source: *source, Fetched: time.Now(), From: *from,
+		FirstID: *firstID, Out: *out}
+
+	var err error
+	switch *source {
+	case "tranco":
+		m.Version, err = trancoID(client, *listID, *date)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		m.URL = trancoURL + "download/" + m.Version + "/1000000"
+	case "alexa":
+		m.URL = alexaURL
+	default:
+		m.URL = *source
+	}
+	logging.Infof("fetching %s", m.URL)
+	raw, modified, err := fetch(client, m.URL)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if m.Version == "" {
+		m.Version = modified
+	}
+	sum := sha256.Sum256(raw)
+	m.RawSHA256 = hex.EncodeToString(sum[:])
+	if raw, err = unzip(raw); err != nil {
+		logging.Fatal(err)
+	}
+
+	domains, dropped, err := normalize(raw)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	m.Sites = len(domains)
+	m.To = *to
+	if m.To == 0 || m.To > len(domains) {
+		m.To = len(domains)
+	}
+	if *from > m.To {
+		logging.Fatalf("-from %d is past the %d sites of the list", *from, len(domains))
+	}
+
+	var b bytes.Buffer
+	for rank := *from; rank <= m.To; rank++ {
+		id := rank
+		if *firstID > 0 {
+			id = *firstID + rank - *from
+		}
+		fmt.Fprintf(&b, "%d,%s\n", id, domains[rank-1])
+	}
+	if err = ioutil.WriteFile(*out, b.Bytes(), 0666); err != nil {
+		logging.Fatalf("failed to write list (%s)", err)
+	}
+	sum = sha256.Sum256(b.Bytes())
+	m.SHA256 = hex.EncodeToString(sum[:])
+
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		logging.Fatalf("failed to encode manifest (%s)", err)
+	}
+	if err = ioutil.WriteFile(*manifestFile, d, 0666); err != nil {
+		logging.Fatalf("failed to write manifest (%s)", err)
+	}
+	logging.Infof("wrote ranks %d-%d of %d sites (%d lines dropped) of %s to %s",
+		*from, m.To, len(domains), dropped, *source, *out)
+}
+
+// trancoID returns the ID of the Tranco list with id, of date, or else the
+// latest list
+func trancoID(client *http.Client, id, date string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	if date == "" {
+		d, _, err := fetch(client, trancoURL+"top-1m-id")
+		return strings.TrimSpace(string(d)), err
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return "", fmt.Errorf("failed to parse date (%s)", err)
+	}
+	d, _, err := fetch(client, trancoURL+"api/lists/date/"+date)
+	if err != nil {
+		return "", err
+	}
+	var list struct {
+		ID string `json:"list_id"`
+	}
+	if err = json.Unmarshal(d, &list); err != nil || list.ID == "" {
+		return "", fmt.Errorf("failed to get the Tranco list of %s (%v)", date, err)
+	}
+	return list.ID, nil
+}
+
+// fetch reads a URL, or a file if not HTTP(S), returning the Last-Modified
+// of a download
+func fetch(client *http.Client, location string) ([]byte, string, error) {
+	if !strings.HasPrefix(location, "http://") &&
+		!strings.HasPrefix(location, "https://") {
+		d, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read list (%s)", err)
+		}
+		return d, "", nil
+	}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch %s (%s)", location, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch %s (%s)", location, resp.Status)
+	}
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch %s (%s)", location, err)
+	}
+	return d, resp.Header.Get("Last-Modified"), nil
+}
+
+// unzip returns the first file of a zip, or d as is if not a zip
+func unzip(d []byte) ([]byte, error) {
+	if !bytes.HasPrefix(d, []byte("PK\x03\x04")) {
+		return d, nil
+	}
+	z, err := zip.NewReader(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip (%s)", err)
+	}
+	if len(z.File) == 0 {
+		return nil, fmt.Errorf("empty zip")
+	}
+	f, err := z.File[0].Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s in zip (%s)", z.File[0].Name, err)
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// normalize parses a list of "rank,domain" (or only domain) lines in order
+// of rank, returning the normalized distinct domains and the number of
+// lines dropped
+func normalize(d []byte) (domains []string, dropped int, err error) {
+	r := csv.NewReader(bytes.NewReader(d))
+	r.FieldsPerRecord = -1
+	seen := make(map[string]bool)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to parse list (%s)", err)
+		}
+		domain := normalizeDomain(record[len(record)-1])
+		if len(record) > 1 {
+			if _, err := strconv.Atoi(strings.TrimSpace(record[0])); err != nil {
+				domain = "" // e.g., a header
+			}
+		}
+		if domain == "" || seen[domain] {
+			dropped++
+			continue
+		}
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+	if len(domains) == 0 {
+		return nil, dropped, fmt.Errorf("no sites in list")
+	}
+	return domains, dropped, nil
+}
+
+// normalizeDomain returns the lowercased host of an entry, or empty if it
+// is not a plausible domain
+func normalizeDomain(entry string) string {
+	d := strings.ToLower(strings.TrimSpace(entry))
+	if i := strings.Index(d, "://"); i != -1 {
+		d = d[i+3:]
+	}
+	if i := strings.IndexAny(d, "/?#"); i != -1 {
+		d = d[:i]
+	}
+	if i := strings.LastIndex(d, ":"); i != -1 {
+		d = d[:i]
+	}
+	d = strings.TrimSuffix(d, ".")
+	if d == "" || !strings.Contains(d, ".") || strings.ContainsAny(d, " \t,@") {
+		return ""
+	}
+	return d
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/pylls/defector/gzfile"
+)
+
+// create creates name, appending ".gz" and compressing if -z is set
+func create(name string) (io.WriteCloser, error) {
+	if !*compress {
+		return os.Create(name)
+	}
+	return gzfile.Create(name + ".gz")
+}
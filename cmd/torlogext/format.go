@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// logFormat describes how to find the events we care about in a torlog.
+// Instead of indexing fixed token positions, every event is matched by a
+// regular expression so that extra or moved fields don't corrupt output.
+// Fractional seconds are kept at whatever precision Tor logged them.
+type logFormat struct {
+	dateFormat   string         // layout for time.Parse, without fractions
+	timestamp    *regexp.Regexp // first submatch is the timestamp
+	bootstrapped *regexp.Regexp // Tor is ready, start extracting
+	cell         *regexp.Regexp // a logged cell, submatch is the cell type
+	outgoing     *regexp.Regexp // the cell is outgoing (else incoming)
+	dns          *regexp.Regexp // submatches: domain, ip, ttl
+	circ         *regexp.Regexp // first submatch is the circuit ID
+}
+
+var formats = map[string]logFormat{
+	// the patched Tor used for DefecTor, e.g.,
+	// "Aug 10 12:00:00.000 [notice] DNSRESOLVED example.com A 1.2.3.4 TTL 60"
+	"defector": {
+		dateFormat:   "Jan 2 15:04:05",
+		timestamp:    regexp.MustCompile(`^([A-Z][a-z]{2} +\d{1,2} \d{2}:\d{2}:\d{2}(?:\.\d{1,9})?)`),
+		bootstrapped: regexp.MustCompile(`Bootstrapped 100%`),
+		cell:         regexp.MustCompile(`\b([A-Z_]+)\(\d+\)`),
+		outgoing:     regexp.MustCompile(`\bOUTGOING\b`),
+		dns:          regexp.MustCompile(`\bDNSRESOLVED\s+(\S+)\s+\S+\s+(\S+)\s+\S+\s+(-?\d+)`),
+		circ:         regexp.MustCompile(`(?i)\bcirc(?:uit)?(?:_?id)?[=: ]+(\d+)`),
+	},
+	// as above, but with ISO dates as logged by newer Tor versions when
+	// configured with "LogTimeGranularity" and a non-syslog format
+	"iso": {
+		dateFormat:   "2006-01-02 15:04:05",
+		timestamp:    regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?:\.\d{1,9})?)`),
+		bootstrapped: regexp.MustCompile(`Bootstrapped 100%`),
+		cell:         regexp.MustCompile(`\b([A-Z_]+)\(\d+\)`),
+		outgoing:     regexp.MustCompile(`\bOUTGOING\b`),
+		dns:          regexp.MustCompile(`\bDNSRESOLVED\s+(\S+)\s+\S+\s+(\S+)\s+\S+\s+(-?\d+)`),
+		circ:         regexp.MustCompile(`(?i)\bcirc(?:uit)?(?:_?id)?[=: ]+(\d+)`),
+	},
+}
+
+func (f logFormat) getTime(line string) (t time.Time, err error) {
+	m := f.timestamp.FindStringSubmatch(line)
+	if m == nil {
+		return t, fmt.Errorf("no timestamp")
+	}
+	// syslog-style dates pad single-digit days with an extra space
+	ts := strings.Join(strings.Fields(m[1]), " ")
+	if len(ts) > 10 && ts[10] == 'T' {
+		ts = ts[:10] + " " + ts[11:]
+	}
+	return time.Parse(f.dateFormat, ts)
+}
+
+func (f logFormat) formatTime(t time.Time) string {
+	return t.Format(f.dateFormat + ".000000")
+}
+
+func (f logFormat) getCircuit(line string) string {
+	m := f.circ.FindStringSubmatch(line)
+	if m == nil {
+		return "0"
+	}
+	return m[1]
+}
+
+// monotonic returns t adjusted to never be before prev.  Syslog-style dates
+// lack a year, so a log spanning new year's eve jumps back almost a year: we
+// detect that and move t forward a year.  Any other step backwards (e.g., log
+// lines written out of order) is clamped to prev and reported as reordered.
+func monotonic(prev, t time.Time) (adjusted time.Time, reordered bool) {
+	if prev.IsZero() || !t.Before(prev) {
+		return t, false
+	}
+	if prev.Sub(t) > 300*24*time.Hour {
+		if t = t.AddDate(1, 0, 0); !t.Before(prev) {
+			return t, false
+		}
+	}
+	return prev, true
+}
@@ -1,27 +1,48 @@
 /*
-torlogextract extracts, from ".torlog" files (generated by our data collection):
+torlogextract extracts, from ".torlog" files (generated by our data collection,
+optionally gzip-compressed as ".torlog.gz"):
 - .dns files of observed DNS requests (same as the extractdns tool)
 - .cells files of celltraces in the Wa-kNN format (used by the fext tool)
+
+With -types, other relay cell types (e.g., SENDME, BEGIN, or DROP for
+circuit-level padding) and link-level PADDING cells are extracted as well as
+DATA cells, adding the cell type as the last column of the .cells file.
+
+With -z, the .dns and .cells files are written gzip-compressed (".dns.gz" and
+".cells.gz"), which the dnsstats, dns2site and fext tools read transparently.
+
+Unless -meta=false, a ".meta.json" file with a summary of each sample (see
+the meta struct) is also written, for sanity checks of datasets without
+re-parsing the torlogs.
+
+Resolutions of .onion addresses never hit DNS, so they are written to a
+separate ".onions" file (in the .dns format) unless -keeponions is set.
+
+With -circuits, the circuit ID of each cell is either added as a third column
+in the .cells file ("annotate") or each circuit is written to its own
+"<name>.c<circuit>.cells" file ("split"), so that background circuits can be
+separated from the circuit that loaded the page.
 */
 package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
-	"os"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-)
 
-const (
-	dateFormat = "Jan 2 15:04:05.000"
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
 )
 
 var (
@@ -29,20 +50,52 @@ var (
 		"the factor to multiply NumCPU with for creating workers")
 	output = flag.String("o", "",
 		"folder to store results in, if left empty, same as input")
+	circuits = flag.String("circuits", "",
+		"circuit-aware cells: \"\" (one trace), \"annotate\" or \"split\"")
+	types = flag.String("types", "DATA",
+		"comma-separated cell types to extract, e.g., DATA,SENDME,BEGIN,DROP,PADDING")
+	compress   = flag.Bool("z", false, "gzip-compress the output files")
+	writeMeta  = flag.Bool("meta", true, "write a .meta.json summary per sample")
+	keepOnions = flag.Bool("keeponions", false,
+		"keep .onion resolutions in the .dns files instead of .onions files")
+	formatName = flag.String("format", "defector",
+		"the torlog format: defector (syslog-style dates) or iso (ISO dates)")
+
+	format    logFormat
+	cellTypes map[string]bool
 )
 
 func main() {
-	flag.Parse()
+	provenance.RegisterFlags()
+	config.Parse("torlogext")
+	provenance.Init("torlogext")
 	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify torlog dir")
+		logging.Fatal("need to specify torlog dir")
 	}
 	if *output == "" {
 		*output = flag.Arg(0)
 	}
+	if *circuits != "" && *circuits != "annotate" && *circuits != "split" {
+		logging.Fatalf("invalid circuits argument")
+	}
+	var ok bool
+	format, ok = formats[*formatName]
+	if !ok {
+		logging.Fatalf("invalid format argument")
+	}
+	cellTypes = make(map[string]bool)
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			cellTypes[t] = true
+		}
+	}
+	if len(cellTypes) == 0 {
+		logging.Fatalf("invalid types argument")
+	}
 
 	files, err := ioutil.ReadDir(flag.Arg(0))
 	if err != nil {
-		log.Fatalf("failed to read torlog dir (%s)", err)
+		logging.Fatalf("failed to read torlog dir (%s)", err)
 	}
 
 	work := make(chan string)
@@ -52,20 +105,21 @@ func main() {
 		go doWork(work, wg)
 	}
 
-	log.Printf("starting to extract (%d workers)...",
+	logging.Infof("starting to extract (%d workers)...",
 		runtime.NumCPU()**workerFactor)
 	extracted := 0
 	for i := 0; i < len(files); i++ {
-		if !files[i].IsDir() && strings.HasSuffix(files[i].Name(), ".torlog") {
-			fmt.Printf("\rextracted %d", extracted)
+		if !files[i].IsDir() && (strings.HasSuffix(files[i].Name(), ".torlog") ||
+			strings.HasSuffix(files[i].Name(), ".torlog.gz")) {
+			logging.Progress("extracted %d", extracted)
 			work <- files[i].Name()
 			extracted++
 		}
 	}
 	close(work)
 	wg.Wait()
-	fmt.Printf("\rextracted %d\n", extracted)
-	log.Println("done")
+	logging.EndProgress()
+	logging.Infof("done, extracted %d", extracted)
 }
 
 func doWork(input chan string, wg *sync.WaitGroup) {
@@ -76,15 +130,57 @@ func doWork(input chan string, wg *sync.WaitGroup) {
 }
 
 func extract(file string) {
-	domains, cells, err := parse(path.Join(flag.Arg(0), file))
+	domains, cells, m, err := parse(path.Join(flag.Arg(0), file))
 	if err != nil {
-		log.Fatalf("failed to parse file (%s)", err)
+		logging.Fatalf("failed to parse file (%s)", err)
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(file, ".gz"), ".torlog")
+
+	// write .meta.json file
+	if *writeMeta {
+		d, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			logging.Fatalf("failed to encode meta data (%s)", err)
+		}
+		err = ioutil.WriteFile(path.Join(*output, name+".meta.json"), d, 0666)
+		if err != nil {
+			logging.Fatalf("failed to write meta data (%s)", err)
+		}
 	}
 
-	// write .dns file
-	f, err := os.Create(path.Join(*output, file[:len(file)-7]+".dns"))
+	// write .dns file, and .onions file for resolved onion addresses that
+	// never hit DNS
+	var onions []domain
+	if !*keepOnions {
+		var regular []domain
+		for _, d := range domains {
+			if isOnion(d.domain) {
+				onions = append(onions, d)
+			} else {
+				regular = append(regular, d)
+			}
+		}
+		domains = regular
+	}
+	writeDNS(path.Join(*output, name+".dns"), domains)
+	if len(onions) > 0 {
+		writeDNS(path.Join(*output, name+".onions"), onions)
+	}
+
+	// write .cells file(s)
+	if *circuits == "split" {
+		for circ, c := range splitCircuits(cells) {
+			writeCells(path.Join(*output, name+".c"+circ+".cells"), c)
+		}
+		return
+	}
+	writeCells(path.Join(*output, name+".cells"), cells)
+}
+
+func writeDNS(name string, domains []domain) {
+	f, err := create(name)
 	if err != nil {
-		log.Fatalf("failed to create file to store result in (%s)", err)
+		logging.Fatalf("failed to create file to store result in (%s)", err)
 	}
 	for j := 0; j < len(domains); j++ {
 		result := fmt.Sprintf("%s,%d", domains[j].domain, domains[j].ttl)
@@ -92,85 +188,184 @@ func extract(file string) {
 			result += "," + domains[j].ips[k]
 		}
 
-		_, err = f.WriteString(fmt.Sprintf("%s\n", result))
+		_, err = io.WriteString(f, result+"\n")
 		if err != nil {
-			log.Fatalf("failed to write result to file (%s)", err)
+			logging.Fatalf("failed to write result to file (%s)", err)
 		}
 	}
 	err = f.Close()
 	if err != nil {
-		log.Fatalf("failed to close file (%s)", err)
+		logging.Fatalf("failed to close file (%s)", err)
 	}
+}
 
-	// write .cells file
-	f, err = os.Create(path.Join(*output, file[:len(file)-7]+".cells"))
+func isOnion(domain string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(domain), "."),
+		".onion")
+}
+
+func writeCells(name string, cells []cell) {
+	f, err := create(name)
 	if err != nil {
-		log.Fatalf("failed to create file to store result in (%s)", err)
+		logging.Fatalf("failed to create file to store result in (%s)", err)
 	}
-	_, err = f.WriteString(cells)
-	if err != nil {
-		log.Fatalf("failed to write result to file (%s)", err)
+	for _, c := range cells {
+		result := fmt.Sprintf("%.6f\t%d", c.time, c.direction)
+		if *circuits == "annotate" {
+			result += "\t" + c.circ
+		}
+		// the type is only a column when other types than DATA are extracted
+		if len(cellTypes) != 1 || !cellTypes["DATA"] {
+			result += "\t" + c.cellType
+		}
+		_, err = io.WriteString(f, result+"\n")
+		if err != nil {
+			logging.Fatalf("failed to write result to file (%s)", err)
+		}
 	}
 	err = f.Close()
 	if err != nil {
-		log.Fatalf("failed to close file (%s)", err)
+		logging.Fatalf("failed to close file (%s)", err)
 	}
 }
 
+// splitCircuits groups cells by circuit, with times relative to the first
+// cell on each circuit
+func splitCircuits(cells []cell) (circs map[string][]cell) {
+	circs = make(map[string][]cell)
+	for _, c := range cells {
+		if len(circs[c.circ]) > 0 {
+			c.time -= circs[c.circ][0].time
+		}
+		circs[c.circ] = append(circs[c.circ], c)
+	}
+	for circ, c := range circs {
+		c[0].time = 0
+		circs[circ] = c
+	}
+	return
+}
+
 type domain struct {
 	domain string
 	ttl    int
 	ips    []string
 }
 
-func parse(torlogfile string) (domains []domain, cells string, err error) {
-	f, err := os.Open(torlogfile)
+type cell struct {
+	time      float64 // seconds since the first cell
+	direction int     // 1 for outgoing, -1 for incoming
+	circ      string  // circuit ID, "0" if not logged
+	cellType  string  // e.g., DATA or SENDME
+}
+
+// meta summarizes a parsed torlog, timestamps are as logged by Tor
+type meta struct {
+	Bootstrapped string  `json:"bootstrapped"`
+	FirstCell    string  `json:"first_cell"`
+	LastCell     string  `json:"last_cell"`
+	Duration     float64 `json:"duration"` // seconds from first to last cell
+	Cells        int     `json:"cells"`
+	Outgoing     int     `json:"outgoing"`
+	Incoming     int     `json:"incoming"`
+	Resolutions  int     `json:"dns_resolutions"`
+	Onions       int     `json:"onion_resolutions"` // part of Resolutions
+}
+
+func parse(torlogfile string) (domains []domain, cells []cell, m meta, err error) {
+	f, err := gzfile.Open(torlogfile)
 	if err != nil {
 		return
 	}
+	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
 	bootstrapped := false
 	var first *time.Time
+	var prev time.Time
+	reordered := 0
+	lineNum := 0
 	for scanner.Scan() {
-		tokens := strings.Split(scanner.Text(), " ")
+		lineNum++
+		line := scanner.Text()
 
-		if strings.Contains(scanner.Text(), "Bootstrapped 100%: Done") {
+		if !bootstrapped && format.bootstrapped.MatchString(line) {
 			bootstrapped = true
+			if t, err := format.getTime(line); err == nil {
+				m.Bootstrapped = format.formatTime(t)
+			}
+		}
+		if !bootstrapped {
+			continue
 		}
 
-		if bootstrapped && strings.Contains(scanner.Text(), "DATA(2)") {
+		if ct := format.cell.FindStringSubmatch(line); ct != nil && cellTypes[ct[1]] {
+			t, err := format.getTime(line)
+			if err != nil {
+				warn(torlogfile, lineNum, "failed to parse cell timestamp (%s)", err)
+				continue
+			}
+			var back bool
+			t, back = monotonic(prev, t)
+			if back {
+				reordered++
+			}
+			prev = t
 			if first == nil {
 				first = new(time.Time)
-				*first = getTime(tokens)
+				*first = t
 			}
-			if strings.Contains(scanner.Text(), "OUTGOING") {
-				cells += fmt.Sprintf("%.3f\t1\n", getTime(tokens).Sub(*first).Seconds())
+			c := cell{
+				time:      t.Sub(*first).Seconds(),
+				direction: -1,
+				circ:      format.getCircuit(line),
+				cellType:  ct[1],
+			}
+			if format.outgoing.MatchString(line) {
+				c.direction = 1
+				m.Outgoing++
 			} else {
-				cells += fmt.Sprintf("%.3f\t-1\n",
-					getTime(tokens).Sub(*first).Seconds())
+				m.Incoming++
+			}
+			cells = append(cells, c)
+			if m.FirstCell == "" {
+				m.FirstCell = format.formatTime(t)
 			}
+			m.LastCell = format.formatTime(t)
+			m.Duration = c.time
 		}
 
-		if bootstrapped && strings.Contains(scanner.Text(), "DNSRESOLVED") {
-			ttl, err := strconv.Atoi(tokens[9])
+		if strings.Contains(line, "DNSRESOLVED") {
+			d := format.dns.FindStringSubmatch(line)
+			if d == nil {
+				warn(torlogfile, lineNum, "failed to parse DNS resolution")
+				continue
+			}
+			ttl, err := strconv.Atoi(d[3])
 			if err != nil {
-				return nil, "", err
+				warn(torlogfile, lineNum, "failed to parse TTL (%s)", err)
+				continue
 			}
 			domains = append(domains, domain{
-				domain: tokens[5],
-				ips:    []string{tokens[7]},
+				domain: d[1],
+				ips:    []string{d[2]},
 				ttl:    ttl,
 			})
-
+			if isOnion(d[1]) {
+				m.Onions++
+			}
 		}
 	}
 
-	return
+	if reordered > 0 {
+		logging.Warnf("%s: clamped %d out-of-order cell timestamps",
+			torlogfile, reordered)
+	}
+	m.Cells = len(cells)
+	m.Resolutions = len(domains)
+	return domains, cells, m, scanner.Err()
 }
 
-func getTime(tokens []string) time.Time {
-	t, _ := time.Parse(dateFormat,
-		fmt.Sprintf("%s %s %s", tokens[0], tokens[1], tokens[2]))
-	return t
+func warn(file string, line int, format string, a ...interface{}) {
+	logging.Warnf("%s:%d: %s", file, line, fmt.Sprintf(format, a...))
 }
@@ -0,0 +1,529 @@
+/*
+Package main implements validate, checking a data directory of collected
+samples before experimenting on it, and reporting what to collect again.
+
+Every file is named "<site>-<instance><suffix>", with sites from 1 and
+instances from 0, as written by the server, or
+"<site>-<instance>-<epoch><suffix>" with server -recollect.  For each type
+of sample in the directory (".pcap", ".dns", ".cells", ".torlog", ".feat",
+optionally gzipped), validate checks that:
+  - in every epoch found, each of the first -sites sites has -instances
+    samples, and each of the next -open sites instance 0 (if -sites is 0,
+    every site found is expected to have -instances samples),
+  - pcaps parse, with at least one packet,
+  - .dns files parse and, with -pages, the file of pages given to the server,
+    contain the primary domain of their site, and
+  - .cells files parse and are monotone in time,
+  - .torlog files are not empty, and
+  - .feat files have a header and as many features as it says.
+
+Files that the tools write next to samples (".meta.json", ".onions",
+circuits split into "<name>.c<circuit>.cells", failures.csv and
+aliases.csv) are skipped, and any other file is reported as misnamed.
+
+The problems are written as JSON to -report (stdout if empty), and with
+-recollect, the pages of the sites with missing or corrupt samples are
+written in the format of -pages, to give to the server again after removing
+the corrupt samples.  The exit status is 1 if any problem is found.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/dnsfile"
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/features"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+var (
+	instances = flag.Int("instances", 0, "the number of instances per monitored site")
+	sites     = flag.Int("sites", 0,
+		"the number of monitored sites, from site 1 (0 for every site found)")
+	open = flag.Int("open", 0,
+		"the number of open-world sites after the monitored, with instance 0")
+	pagesFile = flag.String("pages", "",
+		"the \"rank,url\" file of pages given to the server, to check the primary domain of .dns files")
+	reportFile    = flag.String("report", "", "write the JSON report to this file (stdout if empty)")
+	recollectFile = flag.String("recollect", "",
+		"write the pages of sites with missing or corrupt samples to this file, with -pages")
+	workerFactor = flag.Int("f", 1,
+		"the factor to multiply NumCPU with for creating workers")
+
+	// the suffixes of samples, after "<site>-<instance>[-<epoch>]"
+	dataSuffix = regexp.MustCompile(`^(\.pcap|\.dns|\.cells|\.torlog|\.feat)(\.gz)?$`)
+	// files written next to samples that are not samples themselves
+	companionName  = regexp.MustCompile(`^\d+-\d+(-\d+)?(\.meta\.json|\.onions|\.c\d+\.cells)(\.gz)?$`)
+	companionFiles = map[string]bool{"failures.csv": true, "aliases.csv": true}
+)
+
+// report is the machine-readable result of validating a directory
+type report struct {
+	Time      time.Time `json:"time"`
+	Dir       string    `json:"dir"`
+	Instances int       `json:"instances"`
+	Sites     int       `json:"sites"`
+	Open      int       `json:"open"`
+	Files     int       `json:"files"` // checked
+	Problems  []problem `json:"problems"`
+}
+
+// problem is a missing, corrupt or misnamed sample
+type problem struct {
+	File     string `json:"file,omitempty"`
+	Site     int    `json:"site,omitempty"`
+	Instance int    `json:"instance"`
+	Epoch    int    `json:"epoch,omitempty"`
+	Type     string `json:"type,omitempty"` // pcap, dns, cells, torlog or feat
+	Problem  string `json:"problem"`        // missing, corrupt, naming or domain
+	Detail   string `json:"detail,omitempty"`
+}
+
+// page is a page given to the server, with its primary domains
+type page struct {
+	url     string
+	domains []string
+}
+
+// sample is a file named by the site-instance[-epoch] convention
+type sample struct {
+	name                  string
+	site, instance, epoch int
+	kind                  string
+}
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("validate")
+	provenance.Init("validate")
+	if flag.NArg() != 1 {
+		logging.Fatal("need to specify data dir")
+	}
+	if *instances <= 0 {
+		logging.Fatal("need to specify -instances")
+	}
+	if *recollectFile != "" && *pagesFile == "" {
+		logging.Fatal("-recollect needs -pages")
+	}
+	dir := flag.Arg(0)
+
+	var pages map[int]page
+	if *pagesFile != "" {
+		var err error
+		if pages, err = readPages(*pagesFile); err != nil {
+			logging.Fatal(err)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logging.Fatalf("failed to read data dir (%s)", err)
+	}
+	r := report{
+		Time:      time.Now(),
+		Dir:       dir,
+		Instances: *instances,
+		Sites:     *sites,
+		Open:      *open,
+		Problems:  []problem{},
+	}
+	var samples []sample
+	for _, info := range infos {
+		if info.IsDir() || companionFiles[info.Name()] ||
+			companionName.MatchString(info.Name()) {
+			continue
+		}
+		f, ok := epoch.ParseFile(info.Name())
+		var m []string
+		if ok {
+			m = dataSuffix.FindStringSubmatch(strings.TrimPrefix(info.Name(), f.Sample))
+		}
+		if m == nil {
+			r.Problems = append(r.Problems, problem{File: info.Name(),
+				Problem: "naming", Detail: "not site-instance[-epoch].{pcap,dns,cells,torlog,feat}[.gz]"})
+			continue
+		}
+		s := sample{name: info.Name(), site: f.Site, instance: f.Instance,
+			epoch: f.Epoch, kind: strings.TrimPrefix(m[1], ".")}
+		if s.site == 0 {
+			r.Problems = append(r.Problems, problem{File: info.Name(),
+				Problem: "naming", Detail: "sites are numbered from 1"})
+			continue
+		}
+		samples = append(samples, s)
+	}
+	r.Problems = append(r.Problems, missing(samples)...)
+
+	logging.Infof("checking %d samples in %s", len(samples), dir)
+	r.Files = len(samples)
+	r.Problems = append(r.Problems, check(dir, samples, pages)...)
+	sort.SliceStable(r.Problems, func(i, j int) bool {
+		if r.Problems[i].Site != r.Problems[j].Site {
+			return r.Problems[i].Site < r.Problems[j].Site
+		}
+		if r.Problems[i].Epoch != r.Problems[j].Epoch {
+			return r.Problems[i].Epoch < r.Problems[j].Epoch
+		}
+		if r.Problems[i].Instance != r.Problems[j].Instance {
+			return r.Problems[i].Instance < r.Problems[j].Instance
+		}
+		return r.Problems[i].Type < r.Problems[j].Type
+	})
+
+	d, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		logging.Fatalf("failed to encode report (%s)", err)
+	}
+	if *reportFile == "" {
+		fmt.Println(string(d))
+	} else if err = ioutil.WriteFile(*reportFile, d, 0666); err != nil {
+		logging.Fatalf("failed to write report (%s)", err)
+	}
+	if *recollectFile != "" {
+		if err = writeRecollect(*recollectFile, r.Problems, pages); err != nil {
+			logging.Fatal(err)
+		}
+	}
+
+	logging.Infof("found %d problems with %d samples", len(r.Problems), r.Files)
+	if len(r.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// missing returns the expected samples of each type found that are
+// missing, in every epoch found
+func missing(samples []sample) (problems []problem) {
+	have := make(map[string]map[[3]int]bool) // type -> site, instance, epoch
+	epochs := make(map[string]map[int]bool)  // type -> epochs found
+	maxSite := 0
+	for _, s := range samples {
+		if have[s.kind] == nil {
+			have[s.kind] = make(map[[3]int]bool)
+			epochs[s.kind] = make(map[int]bool)
+		}
+		have[s.kind][[3]int{s.site, s.instance, s.epoch}] = true
+		epochs[s.kind][s.epoch] = true
+		if s.site > maxSite {
+			maxSite = s.site
+		}
+	}
+
+	// the expected sites and their number of instances
+	expected := make(map[int]int)
+	if *sites == 0 {
+		for _, s := range samples {
+			expected[s.site] = *instances
+		}
+	} else {
+		for site := 1; site <= *sites; site++ {
+			expected[site] = *instances
+		}
+		for site := *sites + 1; site <= *sites+*open; site++ {
+			expected[site] = 1
+		}
+	}
+
+	var kinds []string
+	for kind := range have {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		var found []int
+		for e := range epochs[kind] {
+			found = append(found, e)
+		}
+		sort.Ints(found)
+		for _, e := range found {
+			for site := 1; site <= maxSite || site <= *sites+*open; site++ {
+				for instance := 0; instance < expected[site]; instance++ {
+					if !have[kind][[3]int{site, instance, e}] {
+						problems = append(problems, problem{Site: site, Instance: instance,
+							Epoch: e, Type: kind, Problem: "missing"})
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// check parses every sample with one worker per CPU
+func check(dir string, samples []sample,
+	pages map[int]page) (problems []problem) {
+	var lock sync.Mutex
+	work := make(chan sample)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < runtime.NumCPU()**workerFactor; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range work {
+				p, detail := checkSample(path.Join(dir, s.name), s, pages)
+				if p == "" {
+					continue
+				}
+				lock.Lock()
+				problems = append(problems, problem{File: s.name, Site: s.site,
+					Instance: s.instance, Epoch: s.epoch, Type: s.kind, Problem: p,
+					Detail: detail})
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, s := range samples {
+		work <- s
+	}
+	close(work)
+	wg.Wait()
+	return
+}
+
+// checkSample returns the problem with a sample and details, if any
+func checkSample(name string, s sample,
+	pages map[int]page) (string, string) {
+	f, err := gzfile.Open(name)
+	if err != nil {
+		return "corrupt", err.Error()
+	}
+	defer f.Close()
+
+	switch s.kind {
+	case "pcap":
+		err = checkPcap(f)
+	case "dns":
+		var domains []string
+		if domains, err = readDomains(f); err == nil && pages != nil {
+			if p, exists := pages[s.site]; exists && !contains(domains, p.domains) {
+				return "domain", fmt.Sprintf("no request for %s",
+					strings.Join(p.domains, " or "))
+			}
+		}
+	case "cells":
+		err = checkCells(f)
+	case "torlog":
+		err = checkTorlog(f)
+	case "feat":
+		err = checkFeat(f)
+	}
+	if err != nil {
+		return "corrupt", err.Error()
+	}
+	return "", ""
+}
+
+// checkPcap reads every packet of a pcap
+func checkPcap(f io.Reader) error {
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		return err
+	}
+	packets := 0
+	for {
+		if _, _, err = r.ReadPacketData(); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read packet %d (%s)", packets+1, err)
+		}
+		packets++
+	}
+	if packets == 0 {
+		return fmt.Errorf("no packets")
+	}
+	return nil
+}
+
+// readDomains parses a .dns file (v1 or v2) and returns its domains
+func readDomains(f io.Reader) (domains []string, err error) {
+	scanner := dnsfile.NewScanner(f)
+	for scanner.Scan() {
+		domains = append(domains, scanner.Request().Domain)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("no requests")
+	}
+	return
+}
+
+// checkCells parses a trace and checks that it is monotone in time
+func checkCells(f io.Reader) error {
+	scanner := bufio.NewScanner(f)
+	last := 0.0
+	line := 1
+	for ; scanner.Scan(); line++ {
+		items := strings.Split(scanner.Text(), "\t")
+		if len(items) < 2 {
+			return fmt.Errorf("expected at least 2 items on line %d, got %d",
+				line, len(items))
+		}
+		t, err := strconv.ParseFloat(items[0], 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse time on line %d (%s)", line, err)
+		}
+		if t < last {
+			return fmt.Errorf("time goes back on line %d (%g after %g)", line, t, last)
+		}
+		last = t
+		if _, err = strconv.ParseInt(items[1], 10, 64); err != nil {
+			return fmt.Errorf("failed to parse size on line %d (%s)", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if line == 1 {
+		return fmt.Errorf("no cells")
+	}
+	return nil
+}
+
+// checkTorlog checks that a Tor log has at least one line
+func checkTorlog(f io.Reader) error {
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("empty log")
+	}
+	return nil
+}
+
+// checkFeat parses the header of a feature file and checks that it has as
+// many features as the header says, each a number or missing
+func checkFeat(f io.Reader) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // a line of features may be long
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("no header")
+	}
+	_, count, err := features.ParseHeader(scanner.Text())
+	if err != nil {
+		return err
+	}
+	var values []string
+	if scanner.Scan() {
+		values = strings.Fields(scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(values) != count {
+		return fmt.Errorf("expected %d features, got %d", count, len(values))
+	}
+	for i, v := range values {
+		if _, err = strconv.ParseFloat(v, 64); err != nil && v != features.Missing {
+			return fmt.Errorf("failed to parse feature %d (%s)", i+1, err)
+		}
+	}
+	return nil
+}
+
+// contains returns if any domain is one of primary or a subdomain of it
+func contains(domains, primary []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		for _, p := range primary {
+			if d == p || strings.HasSuffix(d, "."+p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readPages reads the "rank,url" file of pages given to the server,
+// returning the primary domains of each site: the host of its URL, and
+// without "www." if it has it
+func readPages(name string) (map[int]page, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file with pages (%s)", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file with pages (%s)", err)
+	}
+	pages := make(map[int]page)
+	for _, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("expected rank,url in file with pages, got %q",
+				strings.Join(record, ","))
+		}
+		site, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rank in file with pages (%s)", err)
+		}
+		raw := record[1]
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw // as the server with -scheme
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse page as URL (%s)", err)
+		}
+		host := strings.ToLower(u.Hostname())
+		p := page{url: record[1], domains: []string{host}}
+		if trimmed := strings.TrimPrefix(host, "www."); trimmed != host {
+			p.domains = append(p.domains, trimmed)
+		}
+		pages[site] = p
+	}
+	return pages, nil
+}
+
+// writeRecollect writes the pages of every site with a problem, as given
+// in the file of pages
+func writeRecollect(name string, problems []problem,
+	pages map[int]page) error {
+	seen := make(map[int]bool)
+	out, n := "", 0
+	for _, p := range problems {
+		if p.Site == 0 || seen[p.Site] {
+			continue
+		}
+		seen[p.Site] = true
+		pg, exists := pages[p.Site]
+		if !exists {
+			logging.Infof("no page for site %d in %s", p.Site, *pagesFile)
+			continue
+		}
+		out += fmt.Sprintf("%d,%s\n", p.Site, pg.url)
+		n++
+	}
+	if err := ioutil.WriteFile(name, []byte(out), 0666); err != nil {
+		return fmt.Errorf("failed to write pages to recollect (%s)", err)
+	}
+	logging.Infof("wrote the pages of %d sites to recollect to %s", n, name)
+	return nil
+}
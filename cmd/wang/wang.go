@@ -0,0 +1,320 @@
+/*
+Package main implements wang, converting datasets between the layout of this
+repo and the batch directories of Wang's original kNN code
+(https://crysp.uwaterloo.ca/software/webfingerprint/), which many published
+website fingerprinting datasets use.
+
+In a batch directory, instance j of monitored site i (both from 0) is in the
+file "i-j" and open world site k (from 0) in the file "k", with the features
+extracted by Wang's fextractor in "i-jf" and "kf".  Traces are lines of
+"time\tdirection", as in ".cells" files, and features are separated by
+spaces without a header.
+
+	wang -to defector <batch dir> <out dir>
+
+imports a batch directory: monitored site i becomes site i+1 and open world
+site k becomes site n+k+1 with instance 0, where n is the number of
+monitored sites, so that defector reads them as is with -sites n.  Features
+get the header of -set, checking that they have as many features.
+
+	wang -to wang <data dir> <batch dir>
+
+exports -sites monitored sites from -roffset (as defector) and as many open
+world sites as found (at most -open, if set) by instance 0 of the other
+sites in order.  Use -instances to export at most as many instances of each
+monitored site.  Both traces and features are converted, gzipped or not.
+
+With -weights, the Wa-kNN weights learned by Wang's flearner, a line of
+one weight per feature, are converted instead:
+
+	wang -weights -to defector <flearner weights> <weights.json>
+
+writes them for defector -loadweights, the same weights for each of -folds
+folds learned in -r rounds, which defector loads for any dataset with
+-force (they are not learned on its folds).  Scaling the weights does not
+change the nearest neighbours, so how flearner scales them does not
+matter.
+
+	wang -weights -to wang <weights.json> <flearner weights>
+
+writes the weights of fold -fold of defector -saveweights as flearner does.
+
+Releases in other layouts, e.g., the pickled or NumPy arrays of deep
+learning attacks, are not read: convert them to a batch directory first.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/config"
+	"github.com/pylls/defector/features"
+	"github.com/pylls/defector/gzfile"
+	"github.com/pylls/defector/logging"
+	"github.com/pylls/defector/provenance"
+)
+
+const (
+	cellsSuffix = ".cells"
+	featSuffix  = ".feat"
+	wangFeat    = "f" // suffix of features in a batch directory
+)
+
+var (
+	to = flag.String("to", "",
+		"the layout to convert to: defector (import) or wang (export)")
+	setName = flag.String("set", features.WaKNN.Name,
+		"the feature set of imported features: "+strings.Join(features.Names(), ", "))
+	sites     = flag.Int("sites", 100, "the number of monitored sites to export")
+	instances = flag.Int("instances", 0,
+		"the max number of instances per monitored site to export (0 for all)")
+	open = flag.Int("open", 0,
+		"the max number of open world sites to export (0 for all)")
+	roffset = flag.Int("roffset", 0, "the offset to export monitored sites from")
+
+	weights = flag.Bool("weights", false,
+		"convert the Wa-kNN weights of flearner and defector instead of a dataset")
+	folds  = flag.Int("folds", 10, "the number of folds of imported weights, as defector -folds")
+	rounds = flag.Int("r", 2500,
+		"the rounds of weight learning of imported weights, as defector -r")
+	fold = flag.Int("fold", 0, "the fold of the weights to export")
+
+	wangName = regexp.MustCompile(`^(\d+)(-(\d+))?(f?)$`)
+	dataName = regexp.MustCompile(`^(\d+)-(\d+)(\.cells|\.feat)(\.gz)?$`)
+)
+
+func main() {
+	provenance.RegisterFlags()
+	config.Parse("wang")
+	provenance.Init("wang")
+	if flag.NArg() != 2 {
+		logging.Fatal("need to specify what to convert from (a dir, or weights) and to")
+	}
+	if *weights {
+		var err error
+		switch *to {
+		case "defector":
+			err = importWeights(flag.Arg(0), flag.Arg(1))
+		case "wang":
+			err = exportWeights(flag.Arg(0), flag.Arg(1))
+		default:
+			logging.Fatalf("unknown layout %q to convert to (defector or wang)", *to)
+		}
+		if err != nil {
+			logging.Fatal(err)
+		}
+		logging.Infof("converted weights from %s to %s", flag.Arg(0), flag.Arg(1))
+		return
+	}
+	if err := os.MkdirAll(flag.Arg(1), 0755); err != nil {
+		logging.Fatalf("failed to create output dir (%s)", err)
+	}
+
+	var (
+		n   int
+		err error
+	)
+	switch *to {
+	case "defector":
+		var set features.Set
+		set, err = features.Get(*setName)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		n, err = importBatch(flag.Arg(0), flag.Arg(1), set)
+	case "wang":
+		n, err = exportBatch(flag.Arg(0), flag.Arg(1))
+	default:
+		logging.Fatalf("unknown layout %q to convert to (defector or wang)", *to)
+	}
+	if err != nil {
+		logging.Fatal(err)
+	}
+	logging.Infof("converted %d files from %s to %s", n, flag.Arg(0), flag.Arg(1))
+}
+
+// batchFile is a trace or features in a batch directory, where instance is
+// -1 for open world sites
+type batchFile struct {
+	name     string
+	site     int
+	instance int
+	features bool
+}
+
+// importBatch converts the batch directory in to this repo's layout in out,
+// returning the number of files converted
+func importBatch(in, out string, set features.Set) (int, error) {
+	infos, err := ioutil.ReadDir(in)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read batch dir (%s)", err)
+	}
+	var files []batchFile
+	monitored := 0
+	for _, info := range infos {
+		m := wangName.FindStringSubmatch(info.Name())
+		if info.IsDir() || m == nil {
+			continue
+		}
+		f := batchFile{name: info.Name(), instance: -1, features: m[4] != ""}
+		f.site, _ = strconv.Atoi(m[1])
+		if m[3] != "" {
+			f.instance, _ = strconv.Atoi(m[3])
+			if f.site+1 > monitored {
+				monitored = f.site + 1
+			}
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("found no batch files in %s", in)
+	}
+
+	for _, f := range files {
+		d, err := ioutil.ReadFile(path.Join(in, f.name))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read batch file (%s)", err)
+		}
+		name := strconv.Itoa(f.site+1) + "-" + strconv.Itoa(f.instance)
+		if f.instance == -1 {
+			name = strconv.Itoa(monitored+f.site+1) + "-0"
+		}
+		if f.features {
+			count := len(strings.Fields(string(d)))
+			if count != set.Count {
+				return 0, fmt.Errorf("expected %d features for %s, got %d",
+					set.Count, f.name, count)
+			}
+			d = append([]byte(set.Header()+"\n"), d...)
+			name += featSuffix
+		} else {
+			if err = checkCells(d); err != nil {
+				return 0, fmt.Errorf("malformed trace %s (%s)", f.name, err)
+			}
+			name += cellsSuffix
+		}
+		if err = ioutil.WriteFile(path.Join(out, name), d, 0666); err != nil {
+			return 0, fmt.Errorf("failed to write file (%s)", err)
+		}
+	}
+	logging.Infof("imported %d monitored sites as sites 1-%d, open world sites from %d",
+		monitored, monitored, monitored+1)
+	return len(files), nil
+}
+
+// checkCells checks that every line of a trace has a time and a direction
+func checkCells(d []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	for line := 1; scanner.Scan(); line++ {
+		items := strings.Split(scanner.Text(), "\t")
+		if len(items) < 2 {
+			return fmt.Errorf("expected at least 2 items on line %d, got %d",
+				line, len(items))
+		}
+		if _, err := strconv.ParseFloat(items[0], 64); err != nil {
+			return fmt.Errorf("failed to parse time on line %d (%s)", line, err)
+		}
+		if _, err := strconv.ParseInt(items[1], 10, 64); err != nil {
+			return fmt.Errorf("failed to parse direction on line %d (%s)", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// dataFile is a file in this repo's layout
+type dataFile struct {
+	name           string
+	site, instance int
+	features       bool
+}
+
+// exportBatch converts the ".cells" and ".feat" files in in to a batch
+// directory out, returning the number of files converted
+func exportBatch(in, out string) (int, error) {
+	infos, err := ioutil.ReadDir(in)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data dir (%s)", err)
+	}
+	var files []dataFile
+	for _, info := range infos {
+		m := dataName.FindStringSubmatch(info.Name())
+		if info.IsDir() || m == nil {
+			continue
+		}
+		f := dataFile{name: info.Name(), features: m[3] == featSuffix}
+		f.site, _ = strconv.Atoi(m[1])
+		f.instance, _ = strconv.Atoi(m[2])
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].site != files[j].site {
+			return files[i].site < files[j].site
+		}
+		return files[i].instance < files[j].instance
+	})
+
+	// number open world sites in order, as defector reads them
+	openIndex := make(map[int]int)
+	for _, f := range files {
+		if monitored(f.site) || f.instance != 0 {
+			continue
+		}
+		if _, exists := openIndex[f.site]; !exists &&
+			(*open == 0 || len(openIndex) < *open) {
+			openIndex[f.site] = len(openIndex)
+		}
+	}
+
+	n := 0
+	for _, f := range files {
+		var name string
+		if monitored(f.site) {
+			if *instances > 0 && f.instance >= *instances {
+				continue
+			}
+			name = strconv.Itoa(f.site-*roffset-1) + "-" + strconv.Itoa(f.instance)
+		} else if k, exists := openIndex[f.site]; exists && f.instance == 0 {
+			name = strconv.Itoa(k)
+		} else {
+			continue
+		}
+
+		d, err := gzfile.ReadFile(path.Join(in, f.name))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read data file (%s)", err)
+		}
+		if f.features {
+			// Wang's kNN reads no header
+			if bytes.HasPrefix(d, []byte(features.HeaderPrefix)) {
+				if end := bytes.IndexByte(d, '\n'); end != -1 {
+					d = d[end+1:]
+				} else {
+					d = nil
+				}
+			}
+			name += wangFeat
+		}
+		if err = ioutil.WriteFile(path.Join(out, name), d, 0666); err != nil {
+			return 0, fmt.Errorf("failed to write file (%s)", err)
+		}
+		n++
+	}
+	logging.Infof("exported %d monitored sites from %d and %d open world sites",
+		*sites, *roffset+1, len(openIndex))
+	return n, nil
+}
+
+// monitored returns if site is one of the -sites monitored sites to export
+func monitored(site int) bool {
+	return site > *roffset && site <= *roffset+*sites
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/features"
+)
+
+// savedWeights are the Wa-kNN weights of every fold, as defector writes
+// them with -saveweights and reads them with -loadweights
+type savedWeights struct {
+	Dataset      string      `json:"dataset"`
+	FeatureSet   string      `json:"feature_set"`
+	Folds        int         `json:"folds"`
+	Split        string      `json:"split,omitempty"`
+	WeightRounds int         `json:"weight_rounds"`
+	Weights      [][]float64 `json:"weights"` // per fold
+}
+
+// importWeights converts the weights learned by Wang's flearner in in,
+// whitespace-separated with one per feature, to weights for defector
+// -loadweights in out, the same weights for each of -folds folds
+func importWeights(in, out string) error {
+	d, err := ioutil.ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("failed to read weights (%s)", err)
+	}
+	// defector checks that there is a weight per feature when loading
+	fields := strings.Fields(string(d))
+	if len(fields) == 0 {
+		return fmt.Errorf("no weights in %s", in)
+	}
+	w := make([]float64, len(fields))
+	for i, f := range fields {
+		if w[i], err = strconv.ParseFloat(f, 64); err != nil {
+			return fmt.Errorf("failed to parse weight %d in %s (%s)", i+1, in, err)
+		}
+	}
+
+	// no dataset, as the weights are not learned by defector
+	s := savedWeights{
+		FeatureSet:   features.WaKNN.Name,
+		Folds:        *folds,
+		WeightRounds: *rounds,
+	}
+	for fold := 0; fold < *folds; fold++ {
+		s.Weights = append(s.Weights, w)
+	}
+	if d, err = json.Marshal(s); err != nil {
+		return fmt.Errorf("failed to encode weights (%s)", err)
+	}
+	if err = ioutil.WriteFile(out, d, 0666); err != nil {
+		return fmt.Errorf("failed to write weights (%s)", err)
+	}
+	return nil
+}
+
+// exportWeights writes the weights of fold -fold of defector -saveweights in
+// in to out as flearner writes them, on one line separated by spaces
+func exportWeights(in, out string) error {
+	d, err := ioutil.ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("failed to read weights (%s)", err)
+	}
+	var s savedWeights
+	if err = json.Unmarshal(d, &s); err != nil {
+		return fmt.Errorf("failed to parse weights %s (%s)", in, err)
+	}
+	if *fold < 0 || *fold >= len(s.Weights) {
+		return fmt.Errorf("no fold %d in %s of %d folds", *fold, in, len(s.Weights))
+	}
+	values := make([]string, len(s.Weights[*fold]))
+	for i, w := range s.Weights[*fold] {
+		values[i] = strconv.FormatFloat(w, 'f', -1, 64)
+	}
+	if err = ioutil.WriteFile(out, []byte(strings.Join(values, " ")+"\n"), 0666); err != nil {
+		return fmt.Errorf("failed to write weights (%s)", err)
+	}
+	return nil
+}
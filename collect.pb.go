@@ -11,6 +11,7 @@ It is generated from these files:
 It has these top-level messages:
 	Req
 	Browse
+	Meta
 */
 package defector
 
@@ -34,6 +35,33 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
+// Failure is why the data of a work item is not of the page.
+type Failure int32
+
+const (
+	Failure_None Failure = 0
+	// a block page, e.g., of a geo-block or censorship
+	Failure_Blocked Failure = 1
+	// a challenge, e.g., a CAPTCHA or Cloudflare's browser check
+	Failure_Challenge Failure = 2
+)
+
+var Failure_name = map[int32]string{
+	0: "None",
+	1: "Blocked",
+	2: "Challenge",
+}
+var Failure_value = map[string]int32{
+	"None":      0,
+	"Blocked":   1,
+	"Challenge": 2,
+}
+
+func (x Failure) String() string {
+	return proto.EnumName(Failure_name, int32(x))
+}
+func (Failure) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
 type Req struct {
 	WorkerID string  `protobuf:"bytes,1,opt,name=WorkerID,json=workerID" json:"WorkerID,omitempty"`
 	Browse   *Browse `protobuf:"bytes,2,opt,name=Browse,json=browse" json:"Browse,omitempty"`
@@ -53,12 +81,16 @@ func (m *Req) GetBrowse() *Browse {
 
 // Browse is a work item.
 // If ID == "", then no work has been done (request) or is needed (reply).
+// A worker sets Failure if it detected that the page was not what was asked
+// for, e.g., a block page or a challenge.
 type Browse struct {
-	ID         string `protobuf:"bytes,1,opt,name=ID,json=iD" json:"ID,omitempty"`
-	URL        string `protobuf:"bytes,2,opt,name=URL,json=uRL" json:"URL,omitempty"`
-	Timeout    int64  `protobuf:"varint,3,opt,name=Timeout,json=timeout" json:"Timeout,omitempty"`
-	Data       []byte `protobuf:"bytes,4,opt,name=Data,json=data,proto3" json:"Data,omitempty"`
-	AllTraffic bool   `protobuf:"varint,5,opt,name=AllTraffic,json=allTraffic" json:"AllTraffic,omitempty"`
+	ID         string  `protobuf:"bytes,1,opt,name=ID,json=iD" json:"ID,omitempty"`
+	URL        string  `protobuf:"bytes,2,opt,name=URL,json=uRL" json:"URL,omitempty"`
+	Timeout    int64   `protobuf:"varint,3,opt,name=Timeout,json=timeout" json:"Timeout,omitempty"`
+	Data       []byte  `protobuf:"bytes,4,opt,name=Data,json=data,proto3" json:"Data,omitempty"`
+	AllTraffic bool    `protobuf:"varint,5,opt,name=AllTraffic,json=allTraffic" json:"AllTraffic,omitempty"`
+	Failure    Failure `protobuf:"varint,6,opt,name=Failure,json=failure,enum=defector.Failure" json:"Failure,omitempty"`
+	Meta       *Meta   `protobuf:"bytes,7,opt,name=Meta,json=meta" json:"Meta,omitempty"`
 }
 
 func (m *Browse) Reset()                    { *m = Browse{} }
@@ -66,9 +98,40 @@ func (m *Browse) String() string            { return proto.CompactTextString(m)
 func (*Browse) ProtoMessage()               {}
 func (*Browse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
+func (m *Browse) GetMeta() *Meta {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+// Meta is how a worker did the work of a Browse, set in its result.
+// A result without an Error is a sample.
+type Meta struct {
+	// the delay (with jitter) before browsing, in milliseconds
+	Delay int64 `protobuf:"varint,1,opt,name=Delay,json=delay" json:"Delay,omitempty"`
+	// the wait for the rate limit of the worker, in milliseconds
+	Wait int64 `protobuf:"varint,2,opt,name=Wait,json=wait" json:"Wait,omitempty"`
+	// the attempts used, at least 1
+	Attempts int64 `protobuf:"varint,3,opt,name=Attempts,json=attempts" json:"Attempts,omitempty"`
+	// the wall-clock time of the last attempt, in milliseconds
+	LoadTime int64 `protobuf:"varint,4,opt,name=LoadTime,json=loadTime" json:"LoadTime,omitempty"`
+	// the bytes captured
+	Bytes int64 `protobuf:"varint,5,opt,name=Bytes,json=bytes" json:"Bytes,omitempty"`
+	// why the work failed, empty if it did not
+	Error string `protobuf:"bytes,6,opt,name=Error,json=error" json:"Error,omitempty"`
+}
+
+func (m *Meta) Reset()                    { *m = Meta{} }
+func (m *Meta) String() string            { return proto.CompactTextString(m) }
+func (*Meta) ProtoMessage()               {}
+func (*Meta) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
 func init() {
 	proto.RegisterType((*Req)(nil), "defector.Req")
 	proto.RegisterType((*Browse)(nil), "defector.Browse")
+	proto.RegisterType((*Meta)(nil), "defector.Meta")
+	proto.RegisterEnum("defector.Failure", Failure_name, Failure_value)
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -146,20 +209,29 @@ var _Collect_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("collect.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 227 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x64, 0x90, 0x31, 0x4f, 0xc3, 0x30,
-	0x10, 0x85, 0x71, 0x1c, 0x92, 0xf4, 0xa0, 0xa8, 0xba, 0xc9, 0xea, 0x80, 0xac, 0x4c, 0x66, 0xc9,
-	0x50, 0xf8, 0x03, 0x40, 0x16, 0x44, 0xa7, 0x53, 0x11, 0xb3, 0xeb, 0x5e, 0xa4, 0x08, 0x23, 0x53,
-	0xe3, 0xaa, 0xfc, 0x7c, 0x44, 0x42, 0xc3, 0xc0, 0x74, 0x7a, 0x4f, 0x77, 0x4f, 0xef, 0x3b, 0x98,
-	0xbb, 0xe0, 0x3d, 0xbb, 0xd4, 0x7c, 0xc4, 0x90, 0x02, 0x56, 0x3b, 0xee, 0xd8, 0xa5, 0x10, 0xeb,
-	0x67, 0x90, 0xc4, 0x7b, 0x5c, 0x42, 0xf5, 0x1a, 0xe2, 0x1b, 0xc7, 0xa7, 0x56, 0x09, 0x2d, 0xcc,
-	0x8c, 0xaa, 0xe3, 0xaf, 0x46, 0x03, 0xc5, 0x43, 0x0c, 0xc7, 0x4f, 0x56, 0x99, 0x16, 0xe6, 0x62,
-	0xb5, 0x68, 0x4e, 0xd7, 0xcd, 0xe8, 0x53, 0xb1, 0x1d, 0x66, 0xfd, 0x75, 0xda, 0xc4, 0x2b, 0xc8,
-	0xa6, 0xa4, 0xac, 0x6f, 0x71, 0x01, 0xf2, 0x85, 0xd6, 0x43, 0xc0, 0x8c, 0xe4, 0x81, 0xd6, 0xa8,
-	0xa0, 0xdc, 0xf4, 0xef, 0x1c, 0x0e, 0x49, 0x49, 0x2d, 0x8c, 0xa4, 0x32, 0x8d, 0x12, 0x11, 0xf2,
-	0xd6, 0x26, 0xab, 0x72, 0x2d, 0xcc, 0x25, 0xe5, 0x3b, 0x9b, 0x2c, 0x5e, 0x03, 0xdc, 0x7b, 0xbf,
-	0x89, 0xb6, 0xeb, 0x7a, 0xa7, 0xce, 0xb5, 0x30, 0x15, 0x81, 0x9d, 0x9c, 0xd5, 0x1d, 0x94, 0x8f,
-	0x23, 0x21, 0xde, 0x40, 0xfe, 0x83, 0x82, 0xf3, 0xbf, 0x9a, 0xc4, 0xfb, 0xe5, 0xbf, 0xd6, 0xf5,
-	0xd9, 0xb6, 0x18, 0xbe, 0x71, 0xfb, 0x1d, 0x00, 0x00, 0xff, 0xff, 0x08, 0x63, 0xe5, 0xcc, 0x1e,
-	0x01, 0x00, 0x00,
+	// 376 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0x03, 0x65, 0x52, 0x4d, 0x4f, 0x02, 0x31,
+	0x10, 0x65, 0x3f, 0xd8, 0x5d, 0x06, 0x21, 0xeb, 0xc4, 0xc3, 0x86, 0x83, 0x31, 0x7b, 0x42, 0x4d,
+	0x30, 0x41, 0xff, 0x00, 0xb0, 0x9a, 0x18, 0xd1, 0x43, 0x83, 0xe1, 0x5c, 0xd8, 0xa2, 0x1b, 0x0a,
+	0xd5, 0x52, 0x42, 0xf8, 0x1f, 0xfe, 0x29, 0xff, 0x95, 0x6d, 0x77, 0x81, 0x83, 0x97, 0x76, 0xde,
+	0x7b, 0xd3, 0xce, 0xbc, 0x4e, 0xa1, 0x35, 0x17, 0x9c, 0xb3, 0xb9, 0xea, 0x7d, 0x49, 0xa1, 0x04,
+	0x46, 0x39, 0x5b, 0x68, 0x24, 0x64, 0xfa, 0x02, 0x1e, 0x61, 0xdf, 0xd8, 0x81, 0x68, 0x2a, 0xe4,
+	0x92, 0xc9, 0xe7, 0x2c, 0x71, 0xae, 0x9c, 0x6e, 0x83, 0x44, 0xbb, 0x0a, 0x63, 0x17, 0x82, 0xa1,
+	0x14, 0xbb, 0x0d, 0x4b, 0x5c, 0xad, 0x34, 0xfb, 0x71, 0xef, 0x70, 0xba, 0x57, 0xf2, 0x24, 0x98,
+	0xd9, 0x3d, 0xfd, 0x75, 0x0e, 0xa9, 0xd8, 0x06, 0xf7, 0x78, 0x95, 0x5b, 0x64, 0x18, 0x83, 0xf7,
+	0x4e, 0xc6, 0xf6, 0x86, 0x06, 0xf1, 0xb6, 0x64, 0x8c, 0x09, 0x84, 0x93, 0x62, 0xc5, 0xc4, 0x56,
+	0x25, 0x9e, 0x66, 0x3d, 0x12, 0xaa, 0x12, 0x22, 0x82, 0x9f, 0x51, 0x45, 0x13, 0x5f, 0xd3, 0x67,
+	0xc4, 0xcf, 0x75, 0x8c, 0x97, 0x00, 0x03, 0xce, 0x27, 0x92, 0x2e, 0x16, 0xc5, 0x3c, 0xa9, 0x6b,
+	0x25, 0x22, 0x40, 0x8f, 0x0c, 0xde, 0x42, 0xf8, 0x44, 0x0b, 0xbe, 0x95, 0x2c, 0x09, 0xb4, 0xd8,
+	0xee, 0x9f, 0x9f, 0xba, 0xac, 0x04, 0x12, 0x2e, 0xca, 0x00, 0x53, 0xf0, 0x5f, 0x99, 0x2e, 0x10,
+	0x5a, 0x3f, 0xed, 0x53, 0xa6, 0x61, 0x89, 0xbf, 0xd2, 0x6b, 0xfa, 0xe3, 0x94, 0x49, 0x78, 0x01,
+	0xf5, 0x8c, 0x71, 0xba, 0xb7, 0x66, 0x3c, 0x52, 0xcf, 0x0d, 0x30, 0x3d, 0x4e, 0x69, 0xa1, 0xac,
+	0x21, 0x8f, 0xf8, 0x3b, 0x1d, 0x9b, 0x47, 0x1c, 0x28, 0xc5, 0x56, 0x5f, 0x6a, 0x53, 0x59, 0x8a,
+	0x68, 0x85, 0x8d, 0x36, 0x16, 0x34, 0x37, 0x8e, 0xad, 0x2f, 0xad, 0xf1, 0x0a, 0x9b, 0x0a, 0xc3,
+	0xbd, 0x62, 0x1b, 0x6b, 0x4b, 0x57, 0x98, 0x19, 0x60, 0xd8, 0x47, 0x29, 0x85, 0xb4, 0x7e, 0x1a,
+	0xa4, 0xce, 0x0c, 0xb8, 0xb9, 0x3b, 0xfa, 0xc4, 0x08, 0xfc, 0x37, 0xb1, 0x66, 0x71, 0x0d, 0x9b,
+	0x10, 0x0e, 0xb9, 0x98, 0x2f, 0x59, 0x1e, 0x3b, 0xd8, 0x82, 0xc6, 0xe8, 0x53, 0xbf, 0x0c, 0x5b,
+	0x7f, 0xb0, 0xd8, 0xed, 0x3f, 0x40, 0x38, 0x2a, 0x67, 0x8f, 0xd7, 0xba, 0x67, 0x3d, 0x54, 0x6c,
+	0x9d, 0x0c, 0xeb, 0xd9, 0x77, 0xfe, 0xcd, 0x33, 0xad, 0xcd, 0x02, 0xfb, 0x4f, 0xee, 0xff, 0x00,
+	0x04, 0xf4, 0xab, 0x9b, 0x38, 0x02, 0x00, 0x00,
 }
@@ -0,0 +1,370 @@
+/*
+Package config implements configuration files shared by all the tools, so
+that the parameters that must match across the stages of an experiment
+(e.g., the number of sites, instances and open-world sites, or the clamping
+of TTLs) are defined once.  Flags given on the command line override the
+values of the configuration file.
+
+A configuration file sets flags by name, either for every tool that has the
+flag, or in a section named after a tool for that tool only, which takes
+precedence.  It is YAML, or TOML if named ".toml", of which the subset of
+flat sections of scalars and lists is read:
+
+	# experiment.yaml
+	sites: 100
+	instances: 40
+	open: 10000
+	ttlmin: 60
+	dnsstats:
+	  provider:
+	    - cloudflare=ips-v4
+	    - fastly=fastly.txt
+
+	# experiment.toml
+	sites = 100
+	[dnsstats]
+	provider = ["cloudflare=ips-v4", "fastly=fastly.txt"]
+
+A list sets a flag once per element, for flags that may be repeated.  Flags
+for every tool that a tool does not have are ignored, while unknown flags in
+the section of a tool are an error, to catch typos.
+*/
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pylls/defector/logging"
+)
+
+// Env is the environment variable with the configuration file, if not
+// given with -config.
+const Env = "DEFECTOR_CONFIG"
+
+// Config is a parsed configuration file.
+type Config struct {
+	file     string
+	shared   map[string][]string
+	sections map[string]map[string][]string
+}
+
+// Parse parses the command line flags like flag.Parse, and then sets every
+// flag of the tool command not given on the command line from the
+// configuration file given with -config, or else in $DEFECTOR_CONFIG if set.
+// The flags of the logging package are parsed too, and logging initialized.
+func Parse(command string) {
+	file := flag.String("config", "",
+		"the configuration file with flags, YAML or TOML (default $"+Env+")")
+	logging.RegisterFlags()
+	flag.Parse()
+	if *file == "" {
+		*file = os.Getenv(Env)
+	}
+	if *file != "" {
+		c, err := Load(*file)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		if err = c.Apply(flag.CommandLine, command); err != nil {
+			logging.Fatal(err)
+		}
+	}
+	if err := logging.Init(); err != nil {
+		logging.Fatal(err)
+	}
+}
+
+// Load reads the configuration file.
+func Load(file string) (*Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file (%s)", err)
+	}
+	defer f.Close()
+	c := &Config{
+		file:     file,
+		shared:   make(map[string][]string),
+		sections: make(map[string]map[string][]string),
+	}
+	if strings.HasSuffix(file, ".toml") {
+		err = c.parseTOML(bufio.NewScanner(f))
+	} else {
+		err = c.parseYAML(bufio.NewScanner(f))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s (%s)", file, err)
+	}
+	return c, nil
+}
+
+// Apply sets the flags of command in fs that have not been set, the shared
+// values first and then those of the section of command.
+func (c *Config) Apply(fs *flag.FlagSet, command string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	values := make(map[string][]string)
+	for name, v := range c.shared {
+		if fs.Lookup(name) != nil {
+			values[name] = v
+		}
+	}
+	for name, v := range c.sections[command] {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag -%s for %s in config file %s",
+				name, command, c.file)
+		}
+		values[name] = v
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[name] || name == "config" {
+			continue
+		}
+		for _, v := range values[name] {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value %q for flag -%s in config file %s (%s)",
+					v, name, c.file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// set sets key in section, or the shared values if section is ""
+func (c *Config) set(section, key string, values []string) error {
+	m := c.shared
+	if section != "" {
+		if m = c.sections[section]; m == nil {
+			m = make(map[string][]string)
+			c.sections[section] = m
+		}
+	} else if _, exists := c.sections[key]; exists {
+		return fmt.Errorf("%s is both a flag and a section", key)
+	}
+	if _, exists := m[key]; exists {
+		return fmt.Errorf("%s is set twice", key)
+	}
+	m[key] = values
+	return nil
+}
+
+func (c *Config) parseYAML(scanner *bufio.Scanner) error {
+	// a key without a value is a section if followed by indented keys, or
+	// else a list of the "- " lines that follow
+	section, pending, pendingSection := "", "", ""
+	var list []string
+	inList := false
+	endPending := func() error {
+		if pending == "" {
+			return nil
+		}
+		var err error
+		switch {
+		case inList:
+			err = c.set(pendingSection, pending, list)
+		case pendingSection != "":
+			err = fmt.Errorf("%s has no value", pending)
+		case c.sections[pending] == nil: // an empty section
+			c.sections[pending] = make(map[string][]string)
+		}
+		pending, list, inList = "", nil, false
+		return err
+	}
+
+	for n := 1; scanner.Scan(); n++ {
+		line := StripComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if pending == "" {
+				return fmt.Errorf("line %d: list without a key", n)
+			}
+			v, err := scalar(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return fmt.Errorf("line %d: %s", n, err)
+			}
+			list, inList = append(list, v), true
+			continue
+		}
+
+		i := strings.Index(trimmed, ":")
+		if i <= 0 {
+			return fmt.Errorf("line %d: expected \"key: value\"", n)
+		}
+		key, value := strings.TrimSpace(trimmed[:i]), strings.TrimSpace(trimmed[i+1:])
+		if !indented {
+			section = ""
+		} else if section == "" {
+			if pending == "" || pendingSection != "" || inList {
+				return fmt.Errorf("line %d: unexpected indentation", n)
+			}
+			section, pending = pending, "" // the pending key was a section
+			if _, exists := c.shared[section]; exists {
+				return fmt.Errorf("line %d: %s is both a flag and a section", n, section)
+			}
+			if _, exists := c.sections[section]; exists {
+				return fmt.Errorf("line %d: section %s is repeated", n, section)
+			}
+			c.sections[section] = make(map[string][]string)
+		}
+		if err := endPending(); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if value == "" {
+			pending, pendingSection = key, section
+			continue
+		}
+		values, err := ParseValue(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if err = c.set(section, key, values); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return endPending()
+}
+
+func (c *Config) parseTOML(scanner *bufio.Scanner) error {
+	section := ""
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(StripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.Contains(line, ".") {
+				return fmt.Errorf("line %d: invalid section %s", n, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if _, exists := c.shared[section]; exists {
+				return fmt.Errorf("line %d: %s is both a flag and a section", n, section)
+			}
+			if _, exists := c.sections[section]; exists {
+				return fmt.Errorf("line %d: section %s is repeated", n, section)
+			}
+			c.sections[section] = make(map[string][]string)
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return fmt.Errorf("line %d: expected \"key = value\"", n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if value == "" {
+			return fmt.Errorf("line %d: %s has no value", n, key)
+		}
+		values, err := ParseValue(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if err = c.set(section, key, values); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseValue parses a scalar or a list on one line, "[a, b]", as the values
+// of a configuration file, for tools reading other files of the same subset.
+func ParseValue(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		v, err := scalar(value)
+		return []string{v}, err
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated list %s", value)
+	}
+	var values []string
+	for _, e := range splitList(value[1 : len(value)-1]) {
+		if e = strings.TrimSpace(e); e == "" {
+			continue // e.g., a trailing comma
+		}
+		v, err := scalar(e)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// scalar unquotes a string in double quotes (with escapes) or single quotes
+// (where a doubled single quote is one), and returns anything else as is
+func scalar(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'"):
+		return "", fmt.Errorf("unterminated string %s", s)
+	}
+	return s, nil
+}
+
+// splitList splits the elements of a list at commas outside of quotes
+func splitList(s string) (elements []string) {
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' && quote == '"' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == ',':
+			elements = append(elements, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(elements, s[start:])
+}
+
+// StripComment removes a comment, a # at the start of the line or after
+// whitespace, outside of quotes.
+func StripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0:
+			if line[i] == '\\' && quote == '"' {
+				i++
+			} else if line[i] == quote {
+				quote = 0
+			}
+		case line[i] == '"' || line[i] == '\'':
+			quote = line[i]
+		case line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bufio"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parse(toml bool, text string) (*Config, error) {
+	c := &Config{
+		file:     "test",
+		shared:   make(map[string][]string),
+		sections: make(map[string]map[string][]string),
+	}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	if toml {
+		return c, c.parseTOML(scanner)
+	}
+	return c, c.parseYAML(scanner)
+}
+
+type values map[string][]string
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		toml     bool
+		text     string
+		shared   values
+		sections map[string]values
+	}{
+		{"yaml scalars", false, "sites: 100\nttlmin: 60\n",
+			values{"sites": {"100"}, "ttlmin": {"60"}}, map[string]values{}},
+		{"yaml section", false, "sites: 100\ndnsstats:\n  m: 5\n  t: false\nopen: 10\n",
+			values{"sites": {"100"}, "open": {"10"}},
+			map[string]values{"dnsstats": {"m": {"5"}, "t": {"false"}}}},
+		{"yaml empty section", false, "dns2site:\nsites: 1\n",
+			values{"sites": {"1"}}, map[string]values{"dns2site": {}}},
+		{"yaml block list", false, "dnsstats:\n  provider:\n    - cloudflare=ips-v4\n    - \"fastly=fastly.txt\"\n",
+			values{}, map[string]values{"dnsstats": {"provider": {"cloudflare=ips-v4", "fastly=fastly.txt"}}}},
+		{"yaml top-level block list", false, "provider:\n- a\n- b\n",
+			values{"provider": {"a", "b"}}, map[string]values{}},
+		{"yaml flow list", false, "provider: [a, 'b,c', \"d\",]\n",
+			values{"provider": {"a", "b,c", "d"}}, map[string]values{}},
+		{"yaml quoting", false, "a: \"x # y\"\nb: 'it''s'\nc: \"tab\\there\"\nd: plain text\n",
+			values{"a": {"x # y"}, "b": {"it's"}, "c": {"tab\there"}, "d": {"plain text"}},
+			map[string]values{}},
+		{"yaml comments", false, "# experiment\n---\nsites: 100 # monitored\nurl: a#b\n\n  # indented comment\n",
+			values{"sites": {"100"}, "url": {"a#b"}}, map[string]values{}},
+		{"toml", true, "# experiment\nsites = 100\n\n[dnsstats]\nprovider = [\"cloudflare=ips-v4\", 'fastly=fastly.txt'] # two\nm = \"5\"\n[dns2site]\n",
+			values{"sites": {"100"}},
+			map[string]values{"dnsstats": {"provider": {"cloudflare=ips-v4", "fastly=fastly.txt"}, "m": {"5"}},
+				"dns2site": {}}},
+	}
+	for _, test := range tests {
+		c, err := parse(test.toml, test.text)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values(c.shared), test.shared) {
+			t.Errorf("%s: shared %v, want %v", test.name, c.shared, test.shared)
+		}
+		sections := make(map[string]values)
+		for name, s := range c.sections {
+			sections[name] = s
+		}
+		if !reflect.DeepEqual(sections, test.sections) {
+			t.Errorf("%s: sections %v, want %v", test.name, sections, test.sections)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		toml bool
+		text string
+		want string // in the error
+	}{
+		{"yaml set twice", false, "sites: 1\nsites: 2\n", "line 2: sites is set twice"},
+		{"yaml set twice in section", false, "s:\n  m: 1\n  m: 2\n", "line 3: m is set twice"},
+		{"yaml flag and section", false, "s: 1\ns:\n  m: 1\n", "line 3: s is both a flag and a section"},
+		{"yaml repeated section", false, "s:\n  m: 1\nt: 1\ns:\n  n: 1\n", "line 5: section s is repeated"},
+		{"yaml list without key", false, "- a\n", "line 1: list without a key"},
+		{"yaml no colon", false, "sites 100\n", "line 1: expected \"key: value\""},
+		{"yaml indentation", false, "sites: 1\n  m: 1\n", "line 2: unexpected indentation"},
+		{"yaml no value in section", false, "s:\n  m:\n  n: 1\n", "line 3: m has no value"},
+		{"yaml unterminated string", false, "a: \"x\n", "line 1: unterminated string"},
+		{"yaml unterminated list", false, "a: [x, y\n", "line 1: unterminated list"},
+		{"toml set twice", true, "sites = 1\nsites = 2\n", "line 2: sites is set twice"},
+		{"toml set twice in section", true, "[s]\nm = 1\nm = 2\n", "line 3: m is set twice"},
+		{"toml flag and section", true, "s = 1\n[s]\n", "line 2: s is both a flag and a section"},
+		{"toml repeated section", true, "[s]\n[t]\n[s]\n", "line 3: section s is repeated"},
+		{"toml nested section", true, "[s.t]\n", "line 1: invalid section"},
+		{"toml no equals", true, "sites: 1\n", "line 1: expected \"key = value\""},
+		{"toml no value", true, "sites =\n", "line 1: sites has no value"},
+	}
+	for _, test := range tests {
+		_, err := parse(test.toml, test.text)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	c, err := parse(false, "sites: 100\nopen: 10\nother: x\ndnsstats:\n  m: 5\n  provider: [a, b]\n  sites: 200\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("dnsstats", flag.ContinueOnError)
+	sites := fs.Int("sites", 0, "")
+	open := fs.Int("open", 0, "")
+	m := fs.Int("m", 0, "")
+	var providers []string
+	fs.Func("provider", "", func(s string) error {
+		providers = append(providers, s)
+		return nil
+	})
+	if err = fs.Parse([]string{"-open", "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Apply(fs, "dnsstats"); err != nil {
+		t.Fatal(err)
+	}
+	// the section overrides the shared values, the command line both, and
+	// shared flags the tool does not have are ignored
+	if *sites != 200 || *open != 20 || *m != 5 {
+		t.Errorf("sites %d, open %d, m %d, want 200, 20 and 5", *sites, *open, *m)
+	}
+	if !reflect.DeepEqual(providers, []string{"a", "b"}) {
+		t.Errorf("providers %v, want [a b]", providers)
+	}
+
+	// unknown flags in the section of a tool are an error
+	fs = flag.NewFlagSet("dnsstats", flag.ContinueOnError)
+	fs.Int("m", 0, "")
+	err = c.Apply(fs, "dnsstats")
+	if err == nil || !strings.Contains(err.Error(), "unknown flag -provider for dnsstats") {
+		t.Errorf("error %v, want an unknown flag", err)
+	}
+
+	fs = flag.NewFlagSet("dnsstats", flag.ContinueOnError)
+	fs.Int("sites", 0, "")
+	fs.Int("m", 0, "")
+	fs.Func("provider", "", func(string) error { return nil })
+	c.sections["dnsstats"]["m"] = []string{"five"}
+	if err = c.Apply(fs, "dnsstats"); err == nil ||
+		!strings.Contains(err.Error(), "invalid value \"five\" for flag -m") {
+		t.Errorf("error %v, want an invalid value", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, text := range map[string]string{
+		"experiment.yaml": "sites: 100\n",
+		"experiment.toml": "sites = 100\n",
+	} {
+		file := dir + "/" + name
+		if err = ioutil.WriteFile(file, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+		c, err := Load(file)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(c.shared["sites"], []string{"100"}) {
+			t.Errorf("%s: sites is %v", name, c.shared["sites"])
+		}
+	}
+	if _, err = Load(dir + "/missing.yaml"); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
@@ -0,0 +1,54 @@
+package defenses
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Adaptive is adaptive padding in the style of WTF-PAD by Juarez et al.,
+// independently in each direction and without delaying real cells.  After
+// a real cell, the defense is in burst mode and waits for a delay drawn
+// from an exponential distribution with mean burst seconds: if no real cell
+// is sent before, it sends padding and goes to gap mode, where it keeps
+// sending padding after delays with mean gap seconds until a real cell is
+// sent.  Each delay is instead infinite, i.e., no padding until the next
+// real cell, with probability stop.
+func Adaptive(burst, gap, stop float64) (Defense, error) {
+	if burst <= 0 || gap <= 0 || stop <= 0 || stop > 1 {
+		return Defense{}, fmt.Errorf("invalid adaptive padding (burst %g, gap %g, stop %g)",
+			burst, gap, stop)
+	}
+	return Defense{
+		Name: fmt.Sprintf("adaptive-%g-%g-%g", burst, gap, stop),
+		Apply: func(times []float64, sizes []int,
+			rng *rand.Rand) ([]float64, []int) {
+			cells := split(times, sizes)
+			delay := func(mean float64) float64 {
+				if rng.Float64() < stop {
+					return math.Inf(1)
+				}
+				return rng.ExpFloat64() * mean
+			}
+			for _, out := range []bool{true, false} {
+				size := -1
+				if out {
+					size = 1
+				}
+				own := direction(times, sizes, out)
+				for i, t := range own {
+					// padding ends at the next real cell, or the end of the trace
+					end := times[len(times)-1]
+					if i+1 < len(own) {
+						end = own[i+1]
+					}
+					for d := delay(burst); t+d < end; d = delay(gap) {
+						t += d
+						cells = append(cells, cell{time: t, size: size, padding: true})
+					}
+				}
+			}
+			return merge(cells)
+		},
+	}, nil
+}
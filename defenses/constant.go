@@ -0,0 +1,46 @@
+package defenses
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Constant is constant-rate padding as in BuFLO by Dyer et al.: in each
+// direction a cell is sent every 1/rate seconds, a real cell if one is
+// waiting and otherwise padding, until all real cells are sent and at
+// least minTime seconds have passed.  Real cells are delayed to the next
+// slot.
+func Constant(rate, minTime float64) (Defense, error) {
+	if rate <= 0 || minTime < 0 {
+		return Defense{}, fmt.Errorf("invalid constant-rate padding (rate %g, min time %g)",
+			rate, minTime)
+	}
+	return Defense{
+		Name: fmt.Sprintf("constant-%g-%g", rate, minTime),
+		Apply: func(times []float64, sizes []int,
+			rng *rand.Rand) ([]float64, []int) {
+			var cells []cell
+			for _, out := range []bool{true, false} {
+				size := -1
+				if out {
+					size = 1
+				}
+				queue := direction(times, sizes, out)
+				next := 0 // the next real cell to send
+				for slot := 0; ; slot++ {
+					t := float64(slot) / rate
+					if next == len(queue) && t >= minTime {
+						break
+					}
+					if next < len(queue) && queue[next] <= t {
+						cells = append(cells, cell{time: t, size: size})
+						next++
+					} else {
+						cells = append(cells, cell{time: t, size: size, padding: true})
+					}
+				}
+			}
+			return merge(cells)
+		},
+	}, nil
+}
@@ -0,0 +1,89 @@
+/*
+Package defenses simulates website fingerprinting defenses on cell traces,
+to evaluate attacks against defended traces.  A trace is given as in the
+features package: times (seconds since the first cell) and sizes (1 for
+outgoing and -1 for incoming cells).
+
+A defense adds padding cells to a trace and may delay its real cells.  It
+never drops or reorders the real cells of a direction, so the defended
+trace is what an attacker on the path between the client and the guard
+would see.
+*/
+package defenses
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Defense is a simulated defense.
+type Defense struct {
+	Name  string // name and parameters, e.g., "inject-50"
+	Apply func(times []float64, sizes []int, rng *rand.Rand) ([]float64, []int)
+}
+
+// None is no defense, returning the trace as is.
+var None = Defense{
+	Name: "none",
+	Apply: func(times []float64, sizes []int, rng *rand.Rand) ([]float64, []int) {
+		return times, sizes
+	},
+}
+
+// Run applies the defense to a trace, checking that the trace is usable.
+// The defended trace is ordered by time, with real cells before padding
+// at the same time.
+func (d Defense) Run(times []float64, sizes []int,
+	rng *rand.Rand) ([]float64, []int, error) {
+	if len(times) == 0 || len(times) != len(sizes) {
+		return nil, nil, fmt.Errorf("need a non-empty trace (got %d times and %d sizes)",
+			len(times), len(sizes))
+	}
+	t, s := d.Apply(times, sizes, rng)
+	return t, s, nil
+}
+
+// cell is a cell of a trace being defended
+type cell struct {
+	time    float64
+	size    int
+	padding bool
+}
+
+// split returns the cells of a trace, all real
+func split(times []float64, sizes []int) []cell {
+	cells := make([]cell, len(times))
+	for i := range times {
+		cells[i] = cell{time: times[i], size: sizes[i]}
+	}
+	return cells
+}
+
+// merge orders cells by time, with real cells before padding at the same
+// time, and returns them as a trace
+func merge(cells []cell) (times []float64, sizes []int) {
+	sort.SliceStable(cells, func(i, j int) bool {
+		if cells[i].time != cells[j].time {
+			return cells[i].time < cells[j].time
+		}
+		return !cells[i].padding && cells[j].padding
+	})
+	times = make([]float64, len(cells))
+	sizes = make([]int, len(cells))
+	for i, c := range cells {
+		times[i], sizes[i] = c.time, c.size
+	}
+	return
+}
+
+// direction returns the times of the cells of a trace in one direction,
+// outgoing if out
+func direction(times []float64, sizes []int, out bool) (dir []float64) {
+	for i := range times {
+		if sizes[i] > 0 == out {
+			dir = append(dir, times[i])
+		}
+	}
+	return
+}
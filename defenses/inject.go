@@ -0,0 +1,32 @@
+package defenses
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Inject adds pct percent padding cells at uniformly random times over the
+// trace, each in the direction of a uniformly random cell of the trace so
+// the ratio of outgoing to incoming cells is kept.
+func Inject(pct float64) (Defense, error) {
+	if pct < 0 || math.IsInf(pct, 0) || math.IsNaN(pct) {
+		return Defense{}, fmt.Errorf("invalid cell injection (pct %g)", pct)
+	}
+	return Defense{
+		Name: fmt.Sprintf("inject-%g", pct),
+		Apply: func(times []float64, sizes []int,
+			rng *rand.Rand) ([]float64, []int) {
+			cells := split(times, sizes)
+			n := int(math.Round(float64(len(times)) * pct / 100))
+			for i := 0; i < n; i++ {
+				cells = append(cells, cell{
+					time:    times[0] + rng.Float64()*(times[len(times)-1]-times[0]),
+					size:    sizes[rng.Intn(len(sizes))],
+					padding: true,
+				})
+			}
+			return merge(cells)
+		},
+	}, nil
+}
@@ -0,0 +1,112 @@
+/*
+Package detect finds block pages and challenges (e.g., CAPTCHAs and
+Cloudflare's browser check) in visits to sites, by the domains that only
+such pages use, so that workers can report samples of the wrong content to
+the server rather than have them pollute a dataset as valid-looking traffic.
+
+A rules file has a rule per line, "block <domain>" or "challenge <domain>",
+matching the domain and all its subdomains, where empty lines and lines
+starting with # are ignored.  The built-in Challenges are only detected if
+asked for: many sites embed, e.g., reCAPTCHA or hCaptcha on every visit
+(on a login form, say), and every such visit would then be retried by the
+server.  A detected failure is a reason to try again rather than proof
+that the page is wrong.
+*/
+package detect
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	pb "github.com/pylls/defector"
+)
+
+// Challenges are the domains of common challenges, detected if asked for.
+var Challenges = []string{
+	"challenges.cloudflare.com", // Cloudflare Turnstile and browser check
+	"hcaptcha.com",
+	"recaptcha.net",
+	"captcha-delivery.com", // DataDome
+	"arkoselabs.com",       // FunCaptcha
+	"captcha.px-cdn.net",   // PerimeterX (HUMAN)
+	"geetest.com",
+}
+
+// Detector detects failures by domain.
+type Detector struct {
+	rules map[string]pb.Failure // by domain
+}
+
+// New returns a detector of the rules in file, if not empty, and of the
+// built-in Challenges if challenges is set.
+func New(file string, challenges bool) (*Detector, error) {
+	d := &Detector{rules: make(map[string]pb.Failure)}
+	if challenges {
+		for _, domain := range Challenges {
+			d.rules[domain] = pb.Failure_Challenge
+		}
+	}
+	if file == "" {
+		return d, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open detection rules (%s)", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of %s: expected \"block|challenge <domain>\"",
+				n, file)
+		}
+		domain := strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		switch fields[0] {
+		case "block":
+			d.rules[domain] = pb.Failure_Blocked
+		case "challenge":
+			d.rules[domain] = pb.Failure_Challenge
+		default:
+			return nil, fmt.Errorf("line %d of %s: unknown failure %q", n, file, fields[0])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read detection rules (%s)", err)
+	}
+	return d, nil
+}
+
+// Domain returns the failure a request for domain shows, if any, checking
+// the domain and then every parent domain.
+func (d *Detector) Domain(domain string) pb.Failure {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if f, ok := d.rules[domain]; ok {
+			return f
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return pb.Failure_None
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Worst returns the failure of a and b that matters most: a block page is
+// worse than a challenge, as trying again rarely helps.
+func Worst(a, b pb.Failure) pb.Failure {
+	if a == pb.Failure_Blocked || b == pb.Failure_Blocked {
+		return pb.Failure_Blocked
+	}
+	if a == pb.Failure_Challenge || b == pb.Failure_Challenge {
+		return pb.Failure_Challenge
+	}
+	return pb.Failure_None
+}
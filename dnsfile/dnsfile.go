@@ -0,0 +1,118 @@
+/*
+Package dnsfile reads the .dns files of the DNS requests of a visit, as
+written by extractdns, with a request per line:
+
+	domain,ttl<,ip>
+
+where there are 0 or more ",ip".  A v2 .dns file starts with a Header line
+and every line after it starts with the time the domain was first seen in
+seconds since the epoch: time,domain,ttl<,ip>.
+*/
+package dnsfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Header is the first line of a v2 .dns file.
+const Header = "#v2"
+
+// Request is a line of a .dns file.
+type Request struct {
+	Time   float64 // 0 in v1 files
+	Domain string
+	TTL    int
+	IPs    []string
+}
+
+// Scanner reads the requests of a .dns file, one at a time.
+type Scanner struct {
+	// BareDomains accepts lines with only a domain, as requests with TTL 0,
+	// e.g., for domains observed without a TTL.
+	BareDomains bool
+
+	scanner *bufio.Scanner
+	line    int
+	timed   bool
+	req     Request
+	err     error
+}
+
+// NewScanner returns a scanner of the requests in r.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{scanner: bufio.NewScanner(r)}
+}
+
+// Scan reads the next request, returning false at the end of the file or on
+// an error, see Err.
+func (s *Scanner) Scan() bool {
+	if s.err != nil || !s.scanner.Scan() {
+		return false
+	}
+	s.line++
+	if s.line == 1 && s.scanner.Text() == Header {
+		s.timed = true
+		if !s.scanner.Scan() {
+			return false
+		}
+		s.line++
+	}
+	s.req, s.err = s.parse(s.scanner.Text())
+	return s.err == nil
+}
+
+func (s *Scanner) parse(line string) (req Request, err error) {
+	tokens := strings.Split(line, ",")
+	if s.timed {
+		if req.Time, err = strconv.ParseFloat(tokens[0], 64); err != nil {
+			return req, fmt.Errorf("failed to parse time on line %d (%s)", s.line, err)
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 || tokens[0] == "" ||
+		len(tokens) < 2 && !(s.BareDomains && len(tokens) == 1) {
+		return req, fmt.Errorf("malformed line %d %q", s.line, line)
+	}
+	req.Domain = tokens[0]
+	if len(tokens) == 1 {
+		return req, nil
+	}
+	if req.TTL, err = strconv.Atoi(tokens[1]); err != nil {
+		return req, fmt.Errorf("failed to parse TTL on line %d (%s)", s.line, err)
+	}
+	if len(tokens) > 2 {
+		req.IPs = tokens[2:]
+	}
+	return req, nil
+}
+
+// Request returns the request read by the last call to Scan.
+func (s *Scanner) Request() Request {
+	return s.req
+}
+
+// Timed returns if the file is a v2 .dns file, once Scan has been called.
+func (s *Scanner) Timed() bool {
+	return s.timed
+}
+
+// Err returns the first error reading the file.
+func (s *Scanner) Err() error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.scanner.Err()
+}
+
+// ReadAll reads all requests in r.
+func ReadAll(r io.Reader) (reqs []Request, err error) {
+	s := NewScanner(r)
+	for s.Scan() {
+		reqs = append(reqs, s.Request())
+	}
+	return reqs, s.Err()
+}
@@ -0,0 +1,57 @@
+package dnsfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadAll(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []Request
+		err  bool
+	}{
+		{"empty", "", nil, false},
+		{"v1", "a.com,60\nb.com,0,1.2.3.4,5.6.7.8\n", []Request{
+			{Domain: "a.com", TTL: 60},
+			{Domain: "b.com", IPs: []string{"1.2.3.4", "5.6.7.8"}},
+		}, false},
+		{"v2", Header + "\n1.5,a.com,60,1.2.3.4\n", []Request{
+			{Time: 1.5, Domain: "a.com", TTL: 60, IPs: []string{"1.2.3.4"}},
+		}, false},
+		{"only header", Header + "\n", nil, false},
+		{"bad time", Header + "\nx,a.com,60\n", nil, true},
+		{"bad TTL", "a.com,x\n", nil, true},
+		{"no TTL", "a.com\n", nil, true},
+		{"no domain", ",60\n", nil, true},
+		{"v2 without domain", Header + "\n1.5\n", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ReadAll(strings.NewReader(test.file))
+		if (err != nil) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBareDomains(t *testing.T) {
+	s := NewScanner(strings.NewReader("a.com\nb.com,60"))
+	s.BareDomains = true
+	var got []Request
+	for s.Scan() {
+		got = append(got, s.Request())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Request{{Domain: "a.com"}, {Domain: "b.com", TTL: 60}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
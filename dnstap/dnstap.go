@@ -0,0 +1,312 @@
+/*
+Package dnstap implements reading dnstap (http://dnstap.info/), the DNS
+messages logged by resolvers such as Unbound, BIND and Knot, from Frame
+Streams sockets and files, without the generated protobuf code.
+
+Frame Streams carries frames, each a big-endian 32-bit length followed by
+the data, where a length of 0 starts a control frame.  On a socket, the
+writer (the resolver) sends READY, the reader replies ACCEPT, and the
+writer sends START, the data frames and STOP, to which the reader replies
+FINISH.  A file is the same without READY, ACCEPT and FINISH.
+*/
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// ContentType is of dnstap frames.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// control frame types
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	fieldContentType = 0x01
+
+	maxFrame = 1 << 20 // far larger than any DNS message
+)
+
+// Reader reads the data frames of a Frame Stream.
+type Reader struct {
+	r io.Reader
+	w io.Writer // nil if unidirectional, e.g., a file
+}
+
+// NewReader returns a Reader of the Frame Stream r, replying on w if
+// bidirectional (a socket), or nil if not (a file).
+func NewReader(r io.Reader, w io.Writer) *Reader {
+	return &Reader{r: r, w: w}
+}
+
+// Read returns the next data frame, or io.EOF at the end of the stream.
+func (r *Reader) Read() ([]byte, error) {
+	for {
+		length, err := r.readUint32()
+		if err != nil {
+			return nil, err
+		}
+		if length > maxFrame {
+			return nil, fmt.Errorf("frame of %d bytes is too large", length)
+		}
+		if length > 0 {
+			frame := make([]byte, length)
+			if _, err = io.ReadFull(r.r, frame); err != nil {
+				return nil, unexpected(err)
+			}
+			return frame, nil
+		}
+
+		// control frame
+		if length, err = r.readUint32(); err != nil {
+			return nil, unexpected(err)
+		}
+		if length < 4 || length > maxFrame {
+			return nil, fmt.Errorf("invalid control frame of %d bytes", length)
+		}
+		control := make([]byte, length)
+		if _, err = io.ReadFull(r.r, control); err != nil {
+			return nil, unexpected(err)
+		}
+		switch binary.BigEndian.Uint32(control) {
+		case controlReady:
+			if r.w != nil {
+				if err = r.writeControl(controlAccept); err != nil {
+					return nil, err
+				}
+			}
+		case controlStart:
+		case controlStop:
+			if r.w != nil {
+				if err = r.writeControl(controlFinish); err != nil {
+					return nil, err
+				}
+			}
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("unexpected control frame %d",
+				binary.BigEndian.Uint32(control))
+		}
+	}
+}
+
+func (r *Reader) readUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r.r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// writeControl replies with a control frame
+func (r *Reader) writeControl(control uint32) error {
+	if _, err := r.w.Write(controlFrame(control)); err != nil {
+		return fmt.Errorf("failed to write control frame (%s)", err)
+	}
+	return nil
+}
+
+// controlFrame returns a control frame, with the dnstap content type
+// unless STOP or FINISH, which have no fields
+func controlFrame(control uint32) []byte {
+	if control == controlStop || control == controlFinish {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint32(b[4:], 4)
+		binary.BigEndian.PutUint32(b[8:], control)
+		return b
+	}
+	b := make([]byte, 20, 20+len(ContentType))
+	binary.BigEndian.PutUint32(b[4:], uint32(12+len(ContentType)))
+	binary.BigEndian.PutUint32(b[8:], control)
+	binary.BigEndian.PutUint32(b[12:], fieldContentType)
+	binary.BigEndian.PutUint32(b[16:], uint32(len(ContentType)))
+	return append(b, ContentType...)
+}
+
+// Writer writes a unidirectional Frame Stream, e.g., a file.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter starts a Frame Stream of dnstap frames on w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := w.Write(controlFrame(controlStart)); err != nil {
+		return nil, fmt.Errorf("failed to write control frame (%s)", err)
+	}
+	return &Writer{w: w}, nil
+}
+
+// Write writes a data frame.
+func (w *Writer) Write(frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	if _, err := w.w.Write(length[:]); err != nil {
+		return fmt.Errorf("failed to write frame (%s)", err)
+	}
+	if _, err := w.w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write frame (%s)", err)
+	}
+	return nil
+}
+
+// Close ends the Frame Stream, without closing the underlying writer.
+func (w *Writer) Close() error {
+	if _, err := w.w.Write(controlFrame(controlStop)); err != nil {
+		return fmt.Errorf("failed to write control frame (%s)", err)
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Message types, as in dnstap.proto.
+const (
+	AuthQuery         = 1
+	AuthResponse      = 2
+	ResolverQuery     = 3
+	ResolverResponse  = 4
+	ClientQuery       = 5
+	ClientResponse    = 6
+	ForwarderQuery    = 7
+	ForwarderResponse = 8
+	StubQuery         = 9
+	StubResponse      = 10
+	ToolQuery         = 11
+	ToolResponse      = 12
+)
+
+// Message is a logged DNS message, where the query address is of the
+// client of the resolver for client messages, and of the resolver itself
+// for resolver messages to authoritative servers.
+type Message struct {
+	Type                          int
+	QueryAddress, ResponseAddress net.IP
+	QueryPort, ResponsePort       int
+	QueryTime, ResponseTime       time.Time // zero if not logged
+	QueryMessage, ResponseMessage []byte    // DNS wire format, nil if not logged
+}
+
+// IsResponse returns if the message is a response.
+func (m *Message) IsResponse() bool {
+	return m.Type%2 == 0
+}
+
+// Unmarshal parses a data frame, a Dnstap protobuf, returning its message.
+func Unmarshal(frame []byte) (*Message, error) {
+	var m *Message
+	err := fields(frame, func(field int, v uint64, b []byte) error {
+		if field != 14 { // message, ignoring identity, version, extra and type
+			return nil
+		}
+		var err error
+		m, err = unmarshalMessage(b)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dnstap (%s)", err)
+	}
+	if m == nil {
+		return nil, fmt.Errorf("failed to parse dnstap (no message)")
+	}
+	return m, nil
+}
+
+func unmarshalMessage(d []byte) (*Message, error) {
+	m := new(Message)
+	var qsec, qnsec, rsec, rnsec uint64
+	err := fields(d, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			m.Type = int(v)
+		case 4:
+			m.QueryAddress = net.IP(b)
+		case 5:
+			m.ResponseAddress = net.IP(b)
+		case 6:
+			m.QueryPort = int(v)
+		case 7:
+			m.ResponsePort = int(v)
+		case 8:
+			qsec = v
+		case 9:
+			qnsec = v
+		case 10:
+			m.QueryMessage = b
+		case 12:
+			rsec = v
+		case 13:
+			rnsec = v
+		case 14:
+			m.ResponseMessage = b
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if qsec > 0 {
+		m.QueryTime = time.Unix(int64(qsec), int64(qnsec))
+	}
+	if rsec > 0 {
+		m.ResponseTime = time.Unix(int64(rsec), int64(rnsec))
+	}
+	return m, nil
+}
+
+// fields calls f with every field of the protobuf d: the value of varint and
+// fixed fields, or the bytes of length-delimited fields
+func fields(d []byte, f func(field int, v uint64, b []byte) error) error {
+	for len(d) > 0 {
+		key, n := binary.Uvarint(d)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		d = d[n:]
+		var v uint64
+		var b []byte
+		switch key & 7 { // wire type
+		case 0: // varint
+			if v, n = binary.Uvarint(d); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			d = d[n:]
+		case 1: // 64-bit
+			if len(d) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			v, d = binary.LittleEndian.Uint64(d), d[8:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(d)
+			if n <= 0 || length > math.MaxInt32 || uint64(len(d)-n) < length {
+				return errors.New("invalid length")
+			}
+			b, d = d[n:n+int(length)], d[n+int(length):]
+		case 5: // 32-bit
+			if len(d) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			v, d = uint64(binary.LittleEndian.Uint32(d)), d[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := f(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package domains
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+var digits = regexp.MustCompile(`[0-9]+`)
+
+// Collapser normalizes domains so random per-session subdomains, e.g.,
+// shard-1234.example.net, don't inflate how unique domains are.  It keeps
+// track of how many distinct domains there were before and after.
+type Collapser struct {
+	sync.Mutex
+	mode  string
+	names map[string]string // original -> collapsed
+}
+
+// NewCollapser returns a collapser in mode, "label" or "digits" (see
+// Collapse), or one that keeps domains as they are for "".
+func NewCollapser(mode string) (*Collapser, error) {
+	switch mode {
+	case "", "label", "digits":
+	default:
+		return nil, fmt.Errorf("unknown collapse mode %q (label or digits)", mode)
+	}
+	return &Collapser{mode: mode, names: make(map[string]string)}, nil
+}
+
+// Collapse returns domain normalized: with "label" the leading label is
+// stripped unless that leaves less than the registrable domain (eTLD+1),
+// with "digits" every run of digits is replaced by a single "#".
+func (c *Collapser) Collapse(domain string) string {
+	if c == nil || c.mode == "" {
+		return domain
+	}
+	c.Lock()
+	defer c.Unlock()
+	if n, exists := c.names[domain]; exists {
+		return n
+	}
+
+	n := domain
+	switch c.mode {
+	case "label":
+		d := strings.TrimSuffix(strings.ToLower(domain), ".")
+		if r, err := publicsuffix.EffectiveTLDPlusOne(d); err == nil && r != d {
+			n = d[strings.Index(d, ".")+1:]
+		}
+	case "digits":
+		n = digits.ReplaceAllString(domain, "#")
+	}
+	c.names[domain] = n
+	return n
+}
+
+// Mode returns the mode of the collapser, "" if nil.
+func (c *Collapser) Mode() string {
+	if c == nil {
+		return ""
+	}
+	return c.mode
+}
+
+// Stats returns the number of distinct domains before and after collapsing.
+func (c *Collapser) Stats() (before, after int) {
+	c.Lock()
+	defer c.Unlock()
+	collapsed := make(map[string]bool)
+	for _, n := range c.names {
+		collapsed[n] = true
+	}
+	return len(c.names), len(collapsed)
+}
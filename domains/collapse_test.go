@@ -0,0 +1,42 @@
+package domains
+
+import "testing"
+
+func TestCollapse(t *testing.T) {
+	tests := []struct {
+		mode, domain, want string
+	}{
+		{"", "shard-1234.example.net", "shard-1234.example.net"},
+		{"label", "shard-1234.example.net", "example.net"},
+		{"label", "a.b.example.co.uk.", "b.example.co.uk"},
+		{"label", "example.co.uk", "example.co.uk"},
+		{"label", "Example.NET", "Example.NET"},
+		{"digits", "shard-1234.cdn42.example.net", "shard-#.cdn#.example.net"},
+		{"digits", "example.net", "example.net"},
+	}
+	for _, test := range tests {
+		c, err := NewCollapser(test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Collapse(test.domain); got != test.want {
+			t.Errorf("%s %s: got %s, want %s", test.mode, test.domain, got, test.want)
+		}
+	}
+	if _, err := NewCollapser("suffix"); err == nil {
+		t.Error("made a collapser of an unknown mode")
+	}
+}
+
+func TestCollapseStats(t *testing.T) {
+	c, _ := NewCollapser("digits")
+	for _, d := range []string{"a1.example.net", "a2.example.net", "a2.example.net", "b.example.net"} {
+		c.Collapse(d)
+	}
+	if before, after := c.Stats(); before != 3 || after != 2 {
+		t.Errorf("stats are %d and %d, want 3 and 2", before, after)
+	}
+	if c.Mode() != "digits" || (*Collapser)(nil).Mode() != "" {
+		t.Errorf("mode is %q", c.Mode())
+	}
+}
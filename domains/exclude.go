@@ -0,0 +1,75 @@
+/*
+Package domains implements how dnsstats and dns2site treat the domains they
+read: excluding those that say nothing of the site visited, and collapsing
+random per-session subdomains.
+*/
+package domains
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Exclusions are domains to ignore (e.g., OCSP, telemetry and captive-portal
+// checks), read from a file with one pattern per line.  A pattern is a glob
+// as in path.Match, e.g., "*.ocsp.*", or a regular expression if prefixed
+// with "re:".  Empty lines and lines starting with # are ignored.
+type Exclusions struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// ReadExclusions reads the exclusions in the file name.
+func ReadExclusions(name string) (*Exclusions, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exclusion file (%s)", err)
+	}
+	defer f.Close()
+
+	e := &Exclusions{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "re:") {
+			r, err := regexp.Compile(line[3:])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse exclusion %q (%s)", line, err)
+			}
+			e.regexps = append(e.regexps, r)
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("failed to parse exclusion %q (%s)", line, err)
+		}
+		e.globs = append(e.globs, strings.ToLower(line))
+	}
+	return e, scanner.Err()
+}
+
+// Excluded returns true if domain matches any pattern, a nil set matches
+// none.
+func (e *Exclusions) Excluded(domain string) bool {
+	if e == nil {
+		return false
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for _, g := range e.globs {
+		if ok, _ := path.Match(g, domain); ok {
+			return true
+		}
+	}
+	for _, r := range e.regexps {
+		if r.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package domains
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExclusions(t *testing.T) {
+	f, err := ioutil.TempFile("", "exclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# OCSP and telemetry\n\n*.ocsp.*\n  Detectportal.firefox.com \nre:^telemetry[0-9]*\\.\n")
+	f.Close()
+
+	e, err := ReadExclusions(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]bool{
+		"r3.ocsp.example.com":       true,
+		"detectportal.firefox.com.": true,
+		"DETECTPORTAL.FIREFOX.COM":  true,
+		"telemetry12.example.com":   true,
+		"ocsp.example.com":          false,
+		"example.com":               false,
+		"mytelemetry.example.com":   false,
+	} {
+		if got := e.Excluded(domain); got != want {
+			t.Errorf("%s: excluded is %v, want %v", domain, got, want)
+		}
+	}
+	if (*Exclusions)(nil).Excluded("r3.ocsp.example.com") {
+		t.Error("nil exclusions exclude a domain")
+	}
+}
+
+func TestExclusionsInvalid(t *testing.T) {
+	for _, pattern := range []string{"[a-", "re:(a"} {
+		f, err := ioutil.TempFile("", "exclude")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(pattern + "\n")
+		f.Close()
+		if _, err = ReadExclusions(f.Name()); err == nil {
+			t.Errorf("read invalid pattern %q", pattern)
+		}
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Package epoch implements the epochs of data collected over time with server
+-recollect, where the data files of a sample are named
+"<site>-<instance>-<epoch><suffix>", and files without an epoch,
+"<site>-<instance><suffix>", are of epoch 0.
+*/
+package epoch
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Set is the epochs selected by a flag, e.g., "0,2-4", where nil selects
+// all.
+type Set map[int]bool
+
+// Parse parses the epochs of a flag, where "" is nil.
+func Parse(spec string) (Set, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	e := make(Set)
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid epoch %q (%s)", part, err)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid epoch %q (%s)", part, err)
+			}
+		}
+		if first < 0 || last < first {
+			return nil, fmt.Errorf("invalid epochs %q", part)
+		}
+		for i := first; i <= last; i++ {
+			e[i] = true
+		}
+	}
+	return e, nil
+}
+
+// Has returns if epoch is selected.
+func (e Set) Has(epoch int) bool {
+	return e == nil || e[epoch]
+}
+
+// OfFile parses the epoch of the data file name.
+func OfFile(name string) (int, error) {
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	parts := strings.Split(name, "-")
+	if len(parts) < 3 {
+		return 0, nil
+	}
+	epoch, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse epoch from file %s (%s)", name, err)
+	}
+	return epoch, nil
+}
+
+var fileName = regexp.MustCompile(`^((\d+)-(\d+)(?:-(\d+))?)\.`)
+
+// File is a data file of a sample.
+type File struct {
+	Site, Instance, Epoch int
+	// Sample is the name of the sample, the name of the file without its
+	// suffix, which is the same for the .dns, .pcap and features files of
+	// a visit.
+	Sample string
+}
+
+// ParseFile parses the data file name, returning false if it is not named
+// as a data file.
+func ParseFile(name string) (f File, ok bool) {
+	m := fileName.FindStringSubmatch(name)
+	if m == nil {
+		return f, false
+	}
+	var err error
+	if f.Site, err = strconv.Atoi(m[2]); err != nil {
+		return f, false
+	}
+	if f.Instance, err = strconv.Atoi(m[3]); err != nil {
+		return f, false
+	}
+	if m[4] != "" {
+		if f.Epoch, err = strconv.Atoi(m[4]); err != nil {
+			return f, false
+		}
+	}
+	f.Sample = m[1]
+	return f, true
+}
@@ -0,0 +1,51 @@
+package epoch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Set
+		err  bool
+	}{
+		{"", nil, false},
+		{"3", Set{3: true}, false},
+		{"0, 2-4", Set{0: true, 2: true, 3: true, 4: true}, false},
+		{"4-2", nil, true},
+		{"-1", nil, true},
+		{"x", nil, true},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.spec)
+		if (err != nil) != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v (%v), want %v", test.spec, got, err, test.want)
+		}
+	}
+	if !Set(nil).Has(7) {
+		t.Error("nil set does not have every epoch")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want File
+		ok   bool
+	}{
+		{"3-14.dns", File{Site: 3, Instance: 14, Sample: "3-14"}, true},
+		{"3-14-2.dns.gz", File{Site: 3, Instance: 14, Epoch: 2, Sample: "3-14-2"}, true},
+		{"3-14-2.pcap", File{Site: 3, Instance: 14, Epoch: 2, Sample: "3-14-2"}, true},
+		{"3-14", File{}, false},
+		{"split.json", File{}, false},
+		{"3-x.dns", File{}, false},
+	}
+	for _, test := range tests {
+		got, ok := ParseFile(test.name)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: got %+v %v, want %+v %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
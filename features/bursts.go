@@ -0,0 +1,40 @@
+package features
+
+import "math"
+
+// burstsFirst is the number of leading bursts included in Bursts.
+const burstsFirst = 50
+
+// Bursts is a feature set of burst statistics: the number, longest, mean and
+// standard deviation of outgoing and incoming bursts, followed by the signed
+// lengths of the first burstsFirst bursts.
+var Bursts = Set{
+	Name:    "bursts-v1",
+	Count:   8 + burstsFirst,
+	Extract: bursts,
+}
+
+func bursts(times []float64, sizes []int) (features []float64, err error) {
+	all := getBursts(sizes)
+	var in, out []float64
+	for _, b := range all {
+		if b > 0 {
+			out = append(out, float64(b))
+		} else {
+			in = append(in, float64(-b))
+		}
+	}
+	for _, bs := range [][]float64{out, in} {
+		mean, std := meanStd(bs)
+		features = append(features, float64(len(bs)), maxOf(bs), mean, std)
+	}
+
+	for i := 0; i < burstsFirst; i++ {
+		if i < len(all) {
+			features = append(features, float64(all[i]))
+		} else {
+			features = append(features, math.NaN())
+		}
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package features
+
+// CellSize is the size in bytes of a cell, used as the packet size for
+// feature sets defined on sizes rather than cell counts.
+const CellSize = 512
+
+// cumulPoints is the number of points interpolated in CUMUL.
+const cumulPoints = 100
+
+// CUMUL is the feature set of the CUMUL attack by Panchenko et al.: the cell
+// counts and total sizes in each direction followed by cumulPoints points
+// sampled from the cumulative sum of sizes.
+var CUMUL = Set{
+	Name:    "cumul-v1",
+	Count:   4 + cumulPoints,
+	Extract: cumul,
+}
+
+func cumul(times []float64, sizes []int) (features []float64, err error) {
+	var in, out int
+	// the cumulative sum of absolute (a) and signed (c) sizes
+	a := make([]float64, len(sizes)+1)
+	c := make([]float64, len(sizes)+1)
+	for i, s := range sizes {
+		if s > 0 {
+			out++
+		} else {
+			in++
+		}
+		a[i+1] = a[i] + float64(abs(s)*CellSize)
+		c[i+1] = c[i] + float64(s*CellSize)
+	}
+	features = append(features, float64(in), float64(out),
+		float64(in*CellSize), float64(out*CellSize))
+
+	// linearly interpolate c at evenly spaced points along a
+	j := 0
+	for p := 1; p <= cumulPoints; p++ {
+		x := a[len(a)-1] * float64(p) / float64(cumulPoints)
+		for j < len(a)-2 && a[j+1] < x {
+			j++
+		}
+		if a[j+1] == a[j] {
+			features = append(features, c[j+1])
+			continue
+		}
+		features = append(features,
+			c[j]+(c[j+1]-c[j])*(x-a[j])/(a[j+1]-a[j]))
+	}
+	return
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,167 @@
+/*
+Package features implements feature extraction from cell traces for website
+fingerprinting attacks.  A trace is given as times (seconds since the first
+cell) and sizes (1 for outgoing and -1 for incoming cells).
+
+Features are extracted by one of several feature sets, selected by name.
+Since features from different sets (or versions of a set) are not comparable,
+the name of the set is recorded in the header of each ".feat" file.
+*/
+package features
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Delimiter is the delimiter in ".feat" files between features.
+	Delimiter = " "
+	// Missing is how a missing feature value (NaN) is written.
+	Missing = "'X'"
+	// HeaderPrefix starts the header line of a ".feat" file.
+	HeaderPrefix = "#"
+)
+
+// Set is a feature set.
+type Set struct {
+	Name    string // name and version, e.g., "wa-knn-v1"
+	Count   int    // number of features extracted
+	Extract func(times []float64, sizes []int) ([]float64, error)
+}
+
+// Sets are all available feature sets by name.
+var Sets = map[string]Set{
+	WaKNN.Name:   WaKNN,
+	CUMUL.Name:   CUMUL,
+	KFPTime.Name: KFPTime,
+	Bursts.Name:  Bursts,
+}
+
+// Get returns the feature set with the given name.
+func Get(name string) (Set, error) {
+	s, ok := Sets[name]
+	if !ok {
+		return s, fmt.Errorf("unknown feature set %s (have %s)",
+			name, strings.Join(Names(), ", "))
+	}
+	return s, nil
+}
+
+// Names returns the sorted names of all feature sets.
+func Names() (names []string) {
+	for name := range Sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Run extracts features from a trace, checking that the trace is usable and
+// that the right number of features were extracted.
+func (s Set) Run(times []float64, sizes []int) ([]float64, error) {
+	if len(times) == 0 || len(times) != len(sizes) {
+		return nil, fmt.Errorf("need a non-empty trace (got %d times and %d sizes)",
+			len(times), len(sizes))
+	}
+	f, err := s.Extract(times, sizes)
+	if err != nil {
+		return nil, err
+	}
+	if len(f) != s.Count {
+		return nil, fmt.Errorf("extracted %d features, expected %d for %s",
+			len(f), s.Count, s.Name)
+	}
+	return f, nil
+}
+
+// Header returns the header line (without newline) for ".feat" files.
+func (s Set) Header() string {
+	return fmt.Sprintf("%s %s %d", HeaderPrefix, s.Name, s.Count)
+}
+
+// ParseHeader parses a header line from Header.
+func ParseHeader(line string) (name string, count int, err error) {
+	tokens := strings.Fields(strings.TrimPrefix(line, HeaderPrefix))
+	if !strings.HasPrefix(line, HeaderPrefix) || len(tokens) != 2 {
+		return "", 0, fmt.Errorf("invalid feature header \"%s\"", line)
+	}
+	count, err = strconv.Atoi(tokens[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid feature count in header (%s)", err)
+	}
+	return tokens[0], count, nil
+}
+
+// Format formats features as in ".feat" files, writing NaN as Missing.
+func Format(features []float64) string {
+	out := make([]string, len(features))
+	for i, f := range features {
+		if math.IsNaN(f) {
+			out[i] = Missing
+		} else {
+			out[i] = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	}
+	return strings.Join(out, Delimiter)
+}
+
+// getBursts returns the lengths of all bursts (sequences of more than one
+// cell in the same direction), negative for incoming bursts.
+func getBursts(sizes []int) (bursts []int) {
+	outgoing := true // outgoing (positive) or incoming (negative)
+	count := 0       // number of packets in the direction
+	for i := 0; i < len(sizes); i++ {
+		if sizes[i] > 0 == outgoing {
+			// the packet goes in the same direction
+			count++
+		} else {
+			// changing direction
+			if count > 1 {
+				// a burst is only defined for a sequence of packets
+				if outgoing {
+					bursts = append(bursts, count)
+				} else {
+					bursts = append(bursts, -count)
+				}
+			}
+			count = 1
+			outgoing = sizes[i] > 0 // set direction
+		}
+	}
+	return
+}
+
+func meanStd(values []float64) (mean, std float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		std += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(std / float64(len(values)))
+}
+
+func maxOf(values []float64) (max float64) {
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	return
+}
+
+// percentile returns the p-th percentile (0-100) of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p/100*float64(len(sorted)-1)+0.5)]
+}
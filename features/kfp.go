@@ -0,0 +1,44 @@
+package features
+
+import "sort"
+
+// KFPTime is the timing subset of the k-fingerprinting (k-FP) features by
+// Hayes and Danezis: statistics of inter-arrival times and quartiles of the
+// transmission time, each for all, incoming and outgoing cells.
+var KFPTime = Set{
+	Name:    "kfp-time-v1",
+	Count:   24,
+	Extract: kfpTime,
+}
+
+func kfpTime(times []float64, sizes []int) (features []float64, err error) {
+	var in, out []float64
+	for i, t := range times {
+		if sizes[i] > 0 {
+			out = append(out, t)
+		} else {
+			in = append(in, t)
+		}
+	}
+
+	// inter-arrival times: max, mean, std and 75th percentile
+	for _, ts := range [][]float64{times, in, out} {
+		var iat []float64
+		for i := 1; i < len(ts); i++ {
+			iat = append(iat, ts[i]-ts[i-1])
+		}
+		mean, std := meanStd(iat)
+		sort.Float64s(iat)
+		features = append(features, maxOf(iat), mean, std, percentile(iat, 75))
+	}
+
+	// transmission time: 25th, 50th, 75th and 100th percentile
+	for _, ts := range [][]float64{times, in, out} {
+		sorted := append([]float64(nil), ts...)
+		sort.Float64s(sorted)
+		for _, p := range []float64{25, 50, 75, 100} {
+			features = append(features, percentile(sorted, p))
+		}
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package features
+
+import "math"
+
+// WaKNN is the feature set of the Wa-kNN attack by Wang et al., fixed and
+// optimized for Tor cells (https://crysp.uwaterloo.ca/software/webfingerprint/).
+var WaKNN = Set{
+	Name:    "wa-knn-v1",
+	Count:   1225,
+	Extract: waKNN,
+}
+
+func waKNN(times []float64, sizes []int) (features []float64, err error) {
+	missing := math.NaN()
+
+	// transmission size features
+	count := 0
+	for _, s := range sizes {
+		if s > 0 {
+			count++
+		}
+	}
+	features = append(features, float64(len(times)), float64(count),
+		float64(len(times)-count), times[len(times)-1]-times[0])
+
+	// position of the first 500 outgoing packets
+	count = 0
+	for i := 0; i < len(sizes); i++ {
+		if sizes[i] > 0 {
+			count++
+			features = append(features, float64(i))
+		}
+
+		if count == 500 {
+			break
+		}
+	}
+	for i := count; i < 500; i++ {
+		features = append(features, missing)
+	}
+
+	// difference in position between the first 500 outgoing packets
+	// and the next outgoing packet
+	count = 0
+	prevloc := 0
+	for i := 0; i < len(sizes); i++ {
+		if sizes[i] > 0 {
+			count++
+			features = append(features, float64(i-prevloc))
+			prevloc = i
+		}
+		if count == 500 {
+			break
+		}
+	}
+	for i := count; i < 500; i++ {
+		features = append(features, missing)
+	}
+
+	// packet distributions (where are the outgoing packets concentrated)
+	count = 0
+	for i := 0; i < len(sizes) && i < 3000; i++ {
+		if i%30 != 29 {
+			if sizes[i] > 0 {
+				count++
+			}
+		} else {
+			features = append(features, float64(count))
+			count = 0
+		}
+	}
+	for i := len(sizes) / 30; i < 100; i++ {
+		features = append(features, 0)
+	}
+
+	// bursts, regardless of direction
+	bursts := getBursts(sizes)
+	for i := range bursts {
+		if bursts[i] < 0 {
+			bursts[i] = -bursts[i]
+		}
+	}
+	max := -1
+	sum := 0
+	for i := 0; i < len(bursts); i++ {
+		sum += bursts[i]
+		if bursts[i] > max {
+			max = bursts[i]
+		}
+	}
+	// longest burst, mean size of burst, and number of bursts
+	features = append(features, float64(max))
+	if len(bursts) > 0 {
+		features = append(features, float64(sum/len(bursts)))
+	} else {
+		features = append(features, 0)
+	}
+	features = append(features, float64(len(bursts)))
+
+	// the number of bursts with lengths longer than 2,5,10,15,20,50
+	for _, limit := range []int{2, 5, 10, 15, 20, 50} {
+		count = 0
+		for i := 0; i < len(bursts); i++ {
+			if bursts[i] > limit {
+				count++
+			}
+		}
+		features = append(features, float64(count))
+	}
+
+	// the length of the first 100 bursts
+	for i := 0; i < 100; i++ {
+		if len(bursts) > i {
+			features = append(features, float64(bursts[i]))
+		} else {
+			features = append(features, missing)
+		}
+	}
+
+	// the direction of the first 10 packets
+	// (we add MTU since -1 as feature is used internally)
+	for i := 0; i < 10; i++ {
+		if len(sizes) > i {
+			features = append(features, float64(sizes[i]+1500))
+		} else {
+			features = append(features, missing)
+		}
+	}
+
+	// interpacket timing: mean and standard deviation
+	var total, variance float64
+	current := times[0]
+	for i := 1; i < len(times); i++ {
+		total += times[i] - current
+		current = times[i]
+	}
+	mean := total / float64((len(times) - 1))
+
+	current = times[0]
+	for i := 1; i < len(times); i++ {
+		// -2 due to Bessel's correlation and interpacket timing def.
+		variance += (times[i] - current) * (times[i] - current) /
+			float64(len(times)-2)
+		current = times[i]
+	}
+	features = append(features, mean, math.Sqrt(variance))
+
+	return
+}
@@ -0,0 +1,72 @@
+/*
+Package gzfile opens the files of a data dir, e.g., .dns, .cells and
+.torlog files, transparently decompressing those that are gzip-compressed,
+named with a ".gz" suffix, and creates compressed ones.
+*/
+package gzfile
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type reader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r reader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
+
+// Open opens name, transparently decompressing it if it ends with ".gz".
+func Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil || !strings.HasSuffix(name, ".gz") {
+		return f, err
+	}
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return reader{r, f}, nil
+}
+
+// ReadFile reads all of name, decompressing it if it ends with ".gz".
+func ReadFile(name string) ([]byte, error) {
+	r, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type writer struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (w writer) Close() error {
+	err := w.Writer.Close()
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// Create creates name, gzip-compressing what is written to it, where name
+// should end with ".gz".
+func Create(name string) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return writer{gzip.NewWriter(f), f}, nil
+}
@@ -0,0 +1,52 @@
+package gzfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	want := "a.com,60\nb.com,0\n"
+
+	plain := path.Join(dir, "1-0.dns")
+	if err = ioutil.WriteFile(plain, []byte(want), 0666); err != nil {
+		t.Fatal(err)
+	}
+	compressed := path.Join(dir, "1-1.dns.gz")
+	w, err := Create(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := ioutil.ReadFile(compressed); string(raw) == want {
+		t.Error("the .gz file is not compressed")
+	}
+
+	for _, name := range []string{plain, compressed} {
+		got, err := ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if _, err = Open(path.Join(dir, "2-0.dns.gz")); err == nil {
+		t.Error("opened a file that does not exist")
+	}
+	if _, err = Open(plain + ".gz"); err == nil {
+		t.Error("opened a missing .gz file")
+	}
+}
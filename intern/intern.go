@@ -0,0 +1,165 @@
+/*
+Package intern interns strings, e.g., the domains and IPs of a dataset, as
+integer IDs, so that each distinct string is stored once no matter how many
+times it is read, and sets of them are compared as IDs instead of by hashing
+strings.
+
+A Table is safe for concurrent use.  Strings are spread over shards by their
+hash, each with its own lock, so workers loading a dataset in parallel
+rarely wait for each other.  IDs are only meaningful within the Table that
+gave them, so anything written to disk should use the strings.
+*/
+package intern
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// shardBits are the low bits of an ID that name its shard
+const shardBits = 5
+
+// Table maps strings to IDs and back.
+type Table struct {
+	shards [1 << shardBits]shard
+}
+
+type shard struct {
+	sync.RWMutex
+	ids   map[string]uint32 // to the index in names
+	names []string
+}
+
+// New returns an empty table.
+func New() *Table {
+	t := new(Table)
+	for i := range t.shards {
+		t.shards[i].ids = make(map[string]uint32)
+	}
+	return t
+}
+
+func shardOf(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32() & (1<<shardBits - 1)
+}
+
+// ID returns the ID of s, interning s if it is new.
+func (t *Table) ID(s string) uint32 {
+	id, _ := t.intern(s)
+	return id
+}
+
+// Intern returns the single copy of s kept by the table.
+func (t *Table) Intern(s string) string {
+	_, name := t.intern(s)
+	return name
+}
+
+func (t *Table) intern(s string) (id uint32, name string) {
+	i := shardOf(s)
+	sh := &t.shards[i]
+	sh.RLock()
+	index, exists := sh.ids[s]
+	if exists {
+		name = sh.names[index]
+	}
+	sh.RUnlock()
+	if !exists {
+		sh.Lock()
+		if index, exists = sh.ids[s]; !exists {
+			index = uint32(len(sh.names))
+			sh.ids[s] = index
+			sh.names = append(sh.names, s)
+		}
+		name = sh.names[index]
+		sh.Unlock()
+	}
+	return index<<shardBits | i, name
+}
+
+// Lookup returns the ID of s and if s is interned, without interning it.
+func (t *Table) Lookup(s string) (id uint32, ok bool) {
+	i := shardOf(s)
+	sh := &t.shards[i]
+	sh.RLock()
+	index, ok := sh.ids[s]
+	sh.RUnlock()
+	return index<<shardBits | i, ok
+}
+
+// Name returns the string of id.
+func (t *Table) Name(id uint32) string {
+	sh := &t.shards[id&(1<<shardBits-1)]
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.names[id>>shardBits]
+}
+
+// Len returns the number of interned strings.
+func (t *Table) Len() (n int) {
+	for i := range t.shards {
+		t.shards[i].RLock()
+		n += len(t.shards[i].names)
+		t.shards[i].RUnlock()
+	}
+	return
+}
+
+// Set is a sorted set of IDs.  The strings of a sample are a small part of
+// all strings, so a sorted slice is far smaller than a bitset over every ID.
+type Set []uint32
+
+// NewSet returns the set of ids, which may be in any order and repeat.
+func NewSet(ids []uint32) Set {
+	s := append(Set(nil), ids...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	distinct := s[:0]
+	for i, id := range s {
+		if i == 0 || id != s[i-1] {
+			distinct = append(distinct, id)
+		}
+	}
+	return distinct
+}
+
+// Has returns if id is in the set.
+func (s Set) Has(id uint32) bool {
+	i := sort.Search(len(s), func(i int) bool { return s[i] >= id })
+	return i < len(s) && s[i] == id
+}
+
+// Intersect returns the IDs in both s and o.
+func (s Set) Intersect(o Set) Set {
+	var out Set
+	for i, j := 0, 0; i < len(s) && j < len(o); {
+		switch {
+		case s[i] < o[j]:
+			i++
+		case s[i] > o[j]:
+			j++
+		default:
+			out = append(out, s[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// Minus returns the IDs of s not in o.
+func (s Set) Minus(o Set) Set {
+	var out Set
+	j := 0
+	for _, id := range s {
+		for j < len(o) && o[j] < id {
+			j++
+		}
+		if j == len(o) || o[j] != id {
+			out = append(out, id)
+		}
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package intern
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	table := New()
+	a, b := table.ID("a.example.com"), table.ID("b.example.com")
+	if a == b {
+		t.Fatalf("distinct strings got the same ID %d", a)
+	}
+	if id := table.ID("a.example.com"); id != a {
+		t.Errorf("interned again as %d, want %d", id, a)
+	}
+	if name := table.Name(b); name != "b.example.com" {
+		t.Errorf("name of %d is %q", b, name)
+	}
+	if s := table.Intern("b.example.com"); s != "b.example.com" {
+		t.Errorf("interned %q", s)
+	}
+	if _, ok := table.Lookup("c.example.com"); ok {
+		t.Error("looked up a string that is not interned")
+	}
+	if id, ok := table.Lookup("a.example.com"); !ok || id != a {
+		t.Errorf("lookup is %d %v, want %d true", id, ok, a)
+	}
+	if table.Len() != 2 {
+		t.Errorf("len is %d, want 2", table.Len())
+	}
+}
+
+func TestTableConcurrent(t *testing.T) {
+	table := New()
+	const workers, strings = 8, 1000
+	ids := make([][]uint32, workers)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < strings; i++ {
+				ids[w] = append(ids[w], table.ID(strconv.Itoa(i)))
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 1; w < workers; w++ {
+		if !reflect.DeepEqual(ids[w], ids[0]) {
+			t.Fatalf("worker %d got other IDs than worker 0", w)
+		}
+	}
+	for i, id := range ids[0] {
+		if name := table.Name(id); name != strconv.Itoa(i) {
+			t.Errorf("name of %d is %q, want %d", id, name, i)
+		}
+	}
+	if table.Len() != strings {
+		t.Errorf("len is %d, want %d", table.Len(), strings)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := NewSet([]uint32{5, 1, 3, 5, 1})
+	if want := (Set{1, 3, 5}); !reflect.DeepEqual(s, want) {
+		t.Fatalf("set is %v, want %v", s, want)
+	}
+	for id, want := range map[uint32]bool{0: false, 1: true, 3: true, 4: false, 5: true, 6: false} {
+		if s.Has(id) != want {
+			t.Errorf("has %d is %v, want %v", id, !want, want)
+		}
+	}
+	tests := []struct {
+		o                Set
+		intersect, minus Set
+	}{
+		{nil, nil, Set{1, 3, 5}},
+		{Set{1, 3, 5}, Set{1, 3, 5}, nil},
+		{Set{0, 3, 4, 6}, Set{3}, Set{1, 5}},
+		{Set{5, 7}, Set{5}, Set{1, 3}},
+	}
+	for _, test := range tests {
+		if got := s.Intersect(test.o); !reflect.DeepEqual(got, test.intersect) {
+			t.Errorf("%v intersect %v is %v, want %v", s, test.o, got, test.intersect)
+		}
+		if got := s.Minus(test.o); !reflect.DeepEqual(got, test.minus) {
+			t.Errorf("%v minus %v is %v, want %v", s, test.o, got, test.minus)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Package logging implements the leveled logging of all the tools, to stderr
+as text (as the standard log package) or as JSON lines, one object with the
+time, level and message per line, for collecting the logs of runs in, e.g.,
+docker.
+
+The flags -loglevel (debug, info, warn or error) and -logformat (text or
+json) are registered by RegisterFlags, as is -quiet, unless the tool has its
+own.  Messages below the level are dropped.  Progress lines, overwriting
+each other with carriage returns, are only written as text to a terminal:
+otherwise, e.g., under nohup, in docker or as JSON, the latest progress is
+logged as info every ProgressInterval.  With -quiet, there is no progress
+at all.
+
+Anything logged with the standard log package, e.g., by dependencies, is
+logged as info once Init is called.
+*/
+package logging
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressInterval is how often progress is logged at most, if not to a
+// terminal.
+const ProgressInterval = 30 * time.Second
+
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var (
+	levelFlag, formatFlag *string
+
+	lock     sync.Mutex
+	minLevel = levelInfo
+	asJSON   bool
+	quiet    bool
+	terminal bool
+
+	progressLen  int       // of the progress line on the terminal, 0 if none
+	progressLast time.Time // when progress was last logged, if not a terminal
+)
+
+// RegisterFlags registers the flags of logging on flag.CommandLine.
+func RegisterFlags() {
+	levelFlag = flag.String("loglevel", "info",
+		"the minimum level to log: debug, info, warn or error")
+	formatFlag = flag.String("logformat", "text", "the format of logs: text or json")
+	if flag.Lookup("quiet") == nil {
+		flag.Bool("quiet", false, "don't log any progress (useful for not spamming docker log)")
+	}
+}
+
+// Init configures logging from the parsed flags, if registered, and logs
+// anything logged with the standard log package as info.
+func Init() error {
+	lock.Lock()
+	defer lock.Unlock()
+	if levelFlag != nil {
+		found := false
+		for l, name := range levelNames {
+			if strings.ToLower(*levelFlag) == name {
+				minLevel, found = level(l), true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown -loglevel %s", *levelFlag)
+		}
+	}
+	if formatFlag != nil {
+		switch *formatFlag {
+		case "text":
+		case "json":
+			asJSON = true
+		default:
+			return fmt.Errorf("unknown -logformat %s", *formatFlag)
+		}
+	}
+	if f := flag.Lookup("quiet"); f != nil {
+		quiet = f.Value.String() == "true"
+	}
+	if info, err := os.Stderr.Stat(); err == nil {
+		terminal = info.Mode()&os.ModeCharDevice != 0
+	}
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// stdWriter logs the lines of the standard log package as info
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	output(levelInfo, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// Debugf logs at the debug level, with arguments as fmt.Printf.
+func Debugf(format string, v ...interface{}) {
+	output(levelDebug, fmt.Sprintf(format, v...))
+}
+
+// Infof logs at the info level, with arguments as fmt.Printf.
+func Infof(format string, v ...interface{}) {
+	output(levelInfo, fmt.Sprintf(format, v...))
+}
+
+// Info logs at the info level, with arguments as fmt.Println.
+func Info(v ...interface{}) {
+	output(levelInfo, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Warnf logs at the warn level, with arguments as fmt.Printf.
+func Warnf(format string, v ...interface{}) {
+	output(levelWarn, fmt.Sprintf(format, v...))
+}
+
+// Errorf logs at the error level, with arguments as fmt.Printf.
+func Errorf(format string, v ...interface{}) {
+	output(levelError, fmt.Sprintf(format, v...))
+}
+
+// Fatalf logs at the error level, with arguments as fmt.Printf, and exits
+// with status 1.
+func Fatalf(format string, v ...interface{}) {
+	output(levelError, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// Fatal logs at the error level, with arguments as fmt.Print, and exits
+// with status 1.
+func Fatal(v ...interface{}) {
+	output(levelError, fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// Progress shows how far a long-running stage has come, with arguments as
+// fmt.Printf, overwriting the previous progress on a terminal.
+func Progress(format string, v ...interface{}) {
+	lock.Lock()
+	if quiet {
+		lock.Unlock()
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	if !terminal || asJSON || minLevel > levelInfo {
+		now := time.Now()
+		if progressLast.IsZero() {
+			progressLast = now // only log stages that take a while
+		}
+		if now.Sub(progressLast) < ProgressInterval {
+			lock.Unlock()
+			return
+		}
+		progressLast = now
+		lock.Unlock()
+		output(levelInfo, strings.TrimSpace(msg))
+		return
+	}
+	defer lock.Unlock()
+	pad := ""
+	if len(msg) < progressLen {
+		pad = strings.Repeat(" ", progressLen-len(msg))
+	}
+	fmt.Fprintf(os.Stderr, "\r%s%s", msg, pad)
+	progressLen = len(msg)
+}
+
+// EndProgress ends the progress line on a terminal, so that the last
+// progress stays visible.
+func EndProgress() {
+	lock.Lock()
+	defer lock.Unlock()
+	endProgress()
+}
+
+func endProgress() {
+	if progressLen > 0 {
+		fmt.Fprintln(os.Stderr)
+		progressLen = 0
+	}
+}
+
+// entry is a line logged as JSON
+type entry struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+}
+
+func output(l level, msg string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if l < minLevel {
+		return
+	}
+	endProgress()
+	now := time.Now()
+	if asJSON {
+		b, err := json.Marshal(entry{Time: now, Level: levelNames[l], Msg: msg})
+		if err != nil { // never for strings
+			panic(err)
+		}
+		os.Stderr.Write(append(b, '\n'))
+		return
+	}
+	prefix := ""
+	switch l {
+	case levelDebug:
+		prefix = "debug: "
+	case levelWarn:
+		prefix = "warning: "
+	case levelError:
+		prefix = "error: "
+	}
+	fmt.Fprintf(os.Stderr, "%s %s%s\n", now.Format("2006/01/02 15:04:05"), prefix, msg)
+}
@@ -0,0 +1,139 @@
+/*
+Package metrics implements the metrics of classifying monitored and
+unmonitored sites in an open world, as used by both the website
+fingerprinting attacks of defector and the DNS classifiers of dns2site.  See
+http://www.cs.kau.se/pulls/hot/measurements/ for the definitions.
+
+Classification is typically evaluated in k folds, with a Confusion per
+fold.  The metrics of several folds are the mean of the metric of each
+fold, not the metric of the summed counts.  A fold where a metric is
+undefined (zero divided by zero, e.g., the precision of a fold with no
+positives) counts as 0 in the mean.
+*/
+package metrics
+
+import "math"
+
+// Confusion counts the outcomes of classifying instances, where the
+// positives are the monitored sites.
+type Confusion struct {
+	TP  int // true positive: the right monitored site
+	FPP int // false-positive-to-positive: the wrong monitored site
+	FNP int // false-negative-to-positive: monitored for an unmonitored site
+	FN  int // false negative: unmonitored for a monitored site
+	TN  int // true negative: unmonitored for an unmonitored site
+}
+
+// Classify returns the outcome of classifying an instance of class
+// trueClass as output, where unmonitored is the class of all unmonitored
+// sites and every other class is a monitored site.
+func Classify(output, trueClass, unmonitored int) (c Confusion) {
+	switch {
+	case output == trueClass && trueClass != unmonitored:
+		c.TP++
+	case output == trueClass:
+		c.TN++
+	case output == unmonitored:
+		c.FN++
+	case trueClass == unmonitored:
+		c.FNP++
+	default:
+		c.FPP++
+	}
+	return
+}
+
+// Add adds the counts of o to c.
+func (c *Confusion) Add(o Confusion) {
+	c.TP += o.TP
+	c.FPP += o.FPP
+	c.FNP += o.FNP
+	c.FN += o.FN
+	c.TN += o.TN
+}
+
+// Total returns the number of classified instances.
+func (c Confusion) Total() int {
+	return c.TP + c.FPP + c.FNP + c.FN + c.TN
+}
+
+// Recall returns TPR = TP / (TP + FN + FPP), NaN if undefined.
+func (c Confusion) Recall() float64 {
+	return ratio(c.TP, c.TP+c.FN+c.FPP)
+}
+
+// Precision returns TP / (TP + FPP + FNP), NaN if undefined.
+func (c Confusion) Precision() float64 {
+	return ratio(c.TP, c.TP+c.FPP+c.FNP)
+}
+
+// FPR returns FP / non-monitored = (FPP + FNP) / (TN + FNP), NaN if
+// undefined.  FPP is counted as a false positive, but the instances it is
+// of are monitored, so the FPR may be above 1.
+func (c Confusion) FPR() float64 {
+	return ratio(c.FPP+c.FNP, c.TN+c.FNP)
+}
+
+// F1 returns the harmonic mean of precision and recall, NaN if either is
+// undefined.
+func (c Confusion) F1() float64 {
+	p, r := c.Precision(), c.Recall()
+	if math.IsNaN(p) || math.IsNaN(r) {
+		return math.NaN()
+	}
+	return 2 * ((p * r) / (p + r)) // NaN if both are 0
+}
+
+// Accuracy returns (TP + TN) / everything, NaN if undefined.
+func (c Confusion) Accuracy() float64 {
+	return ratio(c.TP+c.TN, c.Total())
+}
+
+func ratio(a, b int) float64 {
+	return float64(a) / float64(b) // NaN for 0/0, as b is never negative
+}
+
+// Sum returns the counts of all folds summed.
+func Sum(folds []Confusion) (sum Confusion) {
+	for _, f := range folds {
+		sum.Add(f)
+	}
+	return
+}
+
+// Mean returns the mean of metric over folds, where undefined metrics
+// count as 0.  It is NaN for no folds.
+func Mean(metric func(Confusion) float64, folds []Confusion) float64 {
+	var sum float64
+	for _, f := range folds {
+		if m := metric(f); !math.IsNaN(m) {
+			sum += m
+		}
+	}
+	return sum / float64(len(folds))
+}
+
+// Recall returns the mean recall of folds.
+func Recall(folds []Confusion) float64 {
+	return Mean(Confusion.Recall, folds)
+}
+
+// Precision returns the mean precision of folds.
+func Precision(folds []Confusion) float64 {
+	return Mean(Confusion.Precision, folds)
+}
+
+// FPR returns the mean FPR of folds.
+func FPR(folds []Confusion) float64 {
+	return Mean(Confusion.FPR, folds)
+}
+
+// F1 returns the mean F1 score of folds.
+func F1(folds []Confusion) float64 {
+	return Mean(Confusion.F1, folds)
+}
+
+// Accuracy returns the mean accuracy of folds.
+func Accuracy(folds []Confusion) float64 {
+	return Mean(Confusion.Accuracy, folds)
+}
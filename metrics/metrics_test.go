@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+const unmonitored = -1
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name              string
+		output, trueClass int
+		want              Confusion
+	}{
+		{"right monitored site", 3, 3, Confusion{TP: 1}},
+		{"wrong monitored site", 4, 3, Confusion{FPP: 1}},
+		{"monitored for unmonitored", 3, unmonitored, Confusion{FNP: 1}},
+		{"unmonitored for monitored", unmonitored, 3, Confusion{FN: 1}},
+		{"unmonitored for unmonitored", unmonitored, unmonitored, Confusion{TN: 1}},
+	}
+	for _, test := range tests {
+		if got := Classify(test.output, test.trueClass, unmonitored); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// equal compares floats, where NaN equals NaN
+func equal(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestConfusionMetrics(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name                                 string
+		c                                    Confusion
+		recall, precision, fpr, f1, accuracy float64
+	}{
+		{"empty", Confusion{}, nan, nan, nan, nan, nan},
+		{"perfect", Confusion{TP: 5, TN: 5}, 1, 1, 0, 1, 1},
+		{"mixed", Confusion{TP: 6, FPP: 1, FNP: 2, FN: 1, TN: 10},
+			6.0 / 8, 6.0 / 9, 3.0 / 12, 2 * (6.0 / 8 * 6.0 / 9) / (6.0/8 + 6.0/9),
+			16.0 / 20},
+		{"no positives", Confusion{FN: 2, TN: 3}, 0, nan, 0, nan, 3.0 / 5},
+		{"only negatives", Confusion{TN: 4}, nan, nan, 0, nan, 1},
+		{"p+r=0", Confusion{FPP: 1, FN: 1, FNP: 1}, 0, 0, 2, nan, 0},
+		{"FPR above 1", Confusion{FPP: 3, TN: 1}, 0, 0, 3, nan, 1.0 / 4},
+	}
+	for _, test := range tests {
+		c := test.c
+		for _, m := range []struct {
+			metric    string
+			got, want float64
+		}{
+			{"recall", c.Recall(), test.recall},
+			{"precision", c.Precision(), test.precision},
+			{"FPR", c.FPR(), test.fpr},
+			{"F1", c.F1(), test.f1},
+			{"accuracy", c.Accuracy(), test.accuracy},
+		} {
+			if !equal(m.got, m.want) {
+				t.Errorf("%s: %s is %v, want %v", test.name, m.metric, m.got, m.want)
+			}
+		}
+	}
+}
+
+func TestMean(t *testing.T) {
+	folds := []Confusion{
+		{TP: 1, FN: 1},          // recall 0.5, precision 1
+		{TP: 1},                 // recall 1, precision 1
+		{TN: 2},                 // recall and precision undefined, count as 0
+		{FPP: 1, FNP: 1, TN: 2}, // recall 0, precision 0
+	}
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"recall", Recall(folds), 1.5 / 4},
+		{"precision", Precision(folds), 2.0 / 4},
+		{"FPR", FPR(folds), (0 + 0 + 0 + 2.0/3) / 4},
+		{"F1", F1(folds), (2.0/3 + 1) / 4},
+		{"accuracy", Accuracy(folds), (0.5 + 1 + 1 + 0.5) / 4},
+		{"no folds", Mean(Confusion.Recall, nil), math.NaN()},
+		{"only undefined", Precision([]Confusion{{}, {TN: 1}}), 0},
+	}
+	for _, test := range tests {
+		if !equal(test.got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestSum(t *testing.T) {
+	got := Sum([]Confusion{{TP: 1, FN: 2}, {FPP: 3, FNP: 4, TN: 5}})
+	want := Confusion{TP: 1, FPP: 3, FNP: 4, FN: 2, TN: 5}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got.Total() != 15 {
+		t.Errorf("total is %d, want 15", got.Total())
+	}
+}
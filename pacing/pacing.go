@@ -0,0 +1,75 @@
+/*
+Package pacing implements the pacing of browses by workers, so that a large
+fleet of workers does not hammer the sites it visits or trip rate limits:
+a delay with random jitter before every browse, and a token bucket limiting
+the number of browses per minute with bursts.
+*/
+package pacing
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Pacer paces browses.
+type Pacer struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second, 0 for no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+	delay  time.Duration
+	jitter time.Duration
+	rng    *rand.Rand
+}
+
+// New returns a pacer that delays each browse by delay and a uniformly
+// random part of jitter, and allows at most perMinute browses per minute
+// (if positive) with bursts of up to burst browses.
+func New(perMinute float64, burst int, delay, jitter time.Duration) *Pacer {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Pacer{
+		rate:   perMinute / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		delay:  delay,
+		jitter: jitter,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Wait blocks until the next browse may start, returning the delay (with
+// jitter) and how long it then waited for the rate limit.
+func (p *Pacer) Wait() (delay, wait time.Duration) {
+	p.lock.Lock()
+	delay = p.delay
+	if p.jitter > 0 {
+		delay += time.Duration(p.rng.Int63n(int64(p.jitter)))
+	}
+	p.lock.Unlock()
+	time.Sleep(delay)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.rate <= 0 {
+		return
+	}
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	if p.tokens < 1 {
+		wait = time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+		time.Sleep(wait)
+		p.tokens = 1
+		p.last = time.Now()
+	}
+	p.tokens--
+	return
+}
@@ -0,0 +1,453 @@
+/*
+Package parquet implements a minimal writer and reader of Apache Parquet
+files, as read by Spark, pandas (pyarrow) and DuckDB, for exporting
+datasets to analyze elsewhere and for loading them faster than many small
+files.
+
+Only flat schemas of required columns are supported, of the types Int32,
+Int64, Double and String (UTF-8).  Values are written PLAIN-encoded in
+one data page per column and row group, compressed with gzip, and the
+reader reads such pages, also uncompressed, but no dictionaries, nulls or
+nested columns.
+*/
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Type is the type of a column.
+type Type int
+
+// The types of columns, as the physical types of Parquet.
+const (
+	Int32  Type = 1
+	Int64  Type = 2
+	Double Type = 5
+	String Type = 6 // BYTE_ARRAY annotated as UTF8
+)
+
+// Column is a required column of a schema.
+type Column struct {
+	Name string
+	Type Type
+}
+
+const (
+	magic = "PAR1"
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	pageData       = 0
+	pageDictionary = 2
+
+	convertedUTF8 = 0
+	required      = 0
+)
+
+// Writer writes a Parquet file, a row group at a time.
+type Writer struct {
+	w         io.Writer
+	offset    int64
+	columns   []Column
+	rowGroups []rowGroup
+	rows      int64
+}
+
+type rowGroup struct {
+	rows    int64
+	size    int64 // uncompressed bytes of all columns
+	columns []columnChunk
+}
+
+type columnChunk struct {
+	offset               int64 // of the data page
+	values               int64
+	uncompressed, stored int64 // sizes including the page header
+}
+
+// NewWriter starts a Parquet file with columns on w.
+func NewWriter(w io.Writer, columns []Column) (*Writer, error) {
+	for _, c := range columns {
+		switch c.Type {
+		case Int32, Int64, Double, String:
+		default:
+			return nil, fmt.Errorf("unsupported type of column %s", c.Name)
+		}
+	}
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, offset: int64(len(magic)), columns: columns}, nil
+}
+
+// WriteRowGroup writes a row group of the values of each column, in the
+// order of the schema: []int32, []int64, []float64 or []string by type,
+// all of the same length.
+func (w *Writer) WriteRowGroup(values []interface{}) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("got %d columns, expected %d", len(values), len(w.columns))
+	}
+	rg := rowGroup{rows: -1}
+	for i, c := range w.columns {
+		plain, n, err := encodePlain(c, values[i])
+		if err != nil {
+			return err
+		}
+		if rg.rows != -1 && int64(n) != rg.rows {
+			return fmt.Errorf("column %s has %d values, expected %d", c.Name, n, rg.rows)
+		}
+		rg.rows = int64(n)
+
+		var compressed bytes.Buffer
+		z := gzip.NewWriter(&compressed)
+		if _, err = z.Write(plain); err != nil {
+			return err
+		}
+		if err = z.Close(); err != nil {
+			return err
+		}
+		header := newThriftWriter()
+		header.i32(1, pageData)
+		header.i32(2, int32(len(plain)))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5) // DataPageHeader
+		header.i32(1, int32(n))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := columnChunk{
+			offset:       w.offset,
+			values:       int64(n),
+			uncompressed: int64(header.Len() + len(plain)),
+			stored:       int64(header.Len() + compressed.Len()),
+		}
+		if err = w.write(header.Bytes()); err != nil {
+			return err
+		}
+		if err = w.write(compressed.Bytes()); err != nil {
+			return err
+		}
+		rg.columns = append(rg.columns, chunk)
+		rg.size += chunk.uncompressed
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+	w.rows += rg.rows
+	return nil
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+// Close writes the metadata of the file, without closing the underlying
+// writer.
+func (w *Writer) Close() error {
+	m := newThriftWriter()
+	m.i32(1, 1) // version
+	m.list(2, tStruct, len(w.columns)+1)
+	m.beginStruct(0) // the root of the schema
+	m.binary(4, "schema")
+	m.i32(5, int32(len(w.columns)))
+	m.endStruct()
+	for _, c := range w.columns {
+		m.beginStruct(0)
+		m.i32(1, int32(c.Type))
+		m.i32(3, required)
+		m.binary(4, c.Name)
+		if c.Type == String {
+			m.i32(6, convertedUTF8)
+		}
+		m.endStruct()
+	}
+	m.i64(3, w.rows)
+	m.list(4, tStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		m.beginStruct(0)
+		m.list(1, tStruct, len(rg.columns))
+		for i, chunk := range rg.columns {
+			m.beginStruct(0)
+			m.i64(2, chunk.offset) // file_offset
+			m.beginStruct(3)       // ColumnMetaData
+			m.i32(1, int32(w.columns[i].Type))
+			m.list(2, tI32, 2)
+			m.varint(zigzag(encodingPlain))
+			m.varint(zigzag(encodingRLE))
+			m.list(3, tBinary, 1)
+			m.varint(uint64(len(w.columns[i].Name)))
+			m.WriteString(w.columns[i].Name)
+			m.i32(4, codecGzip)
+			m.i64(5, chunk.values)
+			m.i64(6, chunk.uncompressed)
+			m.i64(7, chunk.stored)
+			m.i64(9, chunk.offset) // data_page_offset
+			m.endStruct()
+			m.endStruct()
+		}
+		m.i64(2, rg.size)
+		m.i64(3, rg.rows)
+		m.endStruct()
+	}
+	m.binary(6, "defector parquet")
+	m.endStruct()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(m.Len()))
+	for _, b := range [][]byte{m.Bytes(), length[:], []byte(magic)} {
+		if err := w.write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodePlain(c Column, values interface{}) (b []byte, n int, err error) {
+	switch c.Type {
+	case Int32:
+		v, ok := values.([]int32)
+		if !ok {
+			break
+		}
+		b = make([]byte, 4*len(v))
+		for i, x := range v {
+			binary.LittleEndian.PutUint32(b[4*i:], uint32(x))
+		}
+		return b, len(v), nil
+	case Int64:
+		v, ok := values.([]int64)
+		if !ok {
+			break
+		}
+		b = make([]byte, 8*len(v))
+		for i, x := range v {
+			binary.LittleEndian.PutUint64(b[8*i:], uint64(x))
+		}
+		return b, len(v), nil
+	case Double:
+		v, ok := values.([]float64)
+		if !ok {
+			break
+		}
+		b = make([]byte, 8*len(v))
+		for i, x := range v {
+			binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(x))
+		}
+		return b, len(v), nil
+	case String:
+		v, ok := values.([]string)
+		if !ok {
+			break
+		}
+		size := 0
+		for _, s := range v {
+			size += 4 + len(s)
+		}
+		b = make([]byte, 0, size)
+		var length [4]byte
+		for _, s := range v {
+			binary.LittleEndian.PutUint32(length[:], uint32(len(s)))
+			b = append(append(b, length[:]...), s...)
+		}
+		return b, len(v), nil
+	}
+	return nil, 0, fmt.Errorf("wrong type of values %T for column %s", values, c.Name)
+}
+
+// File is an open Parquet file.
+type File struct {
+	Columns []Column
+	Rows    int64
+	r       io.ReaderAt
+	groups  []thriftStruct
+}
+
+var errUnsupported = errors.New("unsupported Parquet file")
+
+// Open reads the metadata of the Parquet file r of size bytes.
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	if size < 12 {
+		return nil, errors.New("not a Parquet file")
+	}
+	tail := make([]byte, 8)
+	if _, err := r.ReadAt(tail, size-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != magic {
+		return nil, errors.New("not a Parquet file")
+	}
+	length := int64(binary.LittleEndian.Uint32(tail))
+	if length > size-12 {
+		return nil, errors.New("invalid Parquet metadata length")
+	}
+	meta := make([]byte, length)
+	if _, err := r.ReadAt(meta, size-8-length); err != nil {
+		return nil, err
+	}
+	m, err := (&thriftReader{Reader: bytes.NewReader(meta)}).readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Parquet metadata (%s)", err)
+	}
+
+	f := &File{Rows: m.int(3), r: r}
+	schema := m.list(2)
+	if len(schema) == 0 {
+		return nil, errUnsupported
+	}
+	for _, e := range schema[1:] {
+		s, _ := e.(thriftStruct)
+		if s == nil || s.int(3) != required || s[5] != nil {
+			return nil, fmt.Errorf("%s (only required, flat columns)", errUnsupported)
+		}
+		c := Column{Name: s.str(4), Type: Type(s.int(1))}
+		switch c.Type {
+		case Int32, Int64, Double, String:
+		default:
+			return nil, fmt.Errorf("%s (type %d of column %s)", errUnsupported, c.Type, c.Name)
+		}
+		f.Columns = append(f.Columns, c)
+	}
+	for _, g := range m.list(4) {
+		s, _ := g.(thriftStruct)
+		if s == nil || len(s.list(1)) != len(f.Columns) {
+			return nil, errors.New("invalid Parquet row group")
+		}
+		f.groups = append(f.groups, s)
+	}
+	return f, nil
+}
+
+// RowGroups returns the number of row groups.
+func (f *File) RowGroups() int {
+	return len(f.groups)
+}
+
+// ReadRowGroup returns the values of each column of row group i, typed as
+// for WriteRowGroup.
+func (f *File) ReadRowGroup(i int) ([]interface{}, error) {
+	values := make([]interface{}, len(f.Columns))
+	for j, chunk := range f.groups[i].list(1) {
+		meta := chunk.(thriftStruct).strct(3)
+		if meta == nil {
+			return nil, errors.New("no column metadata")
+		}
+		if meta.int(1) != int64(f.Columns[j].Type) {
+			return nil, fmt.Errorf("invalid type of column %s", f.Columns[j].Name)
+		}
+		if _, dict := meta[11]; dict {
+			return nil, fmt.Errorf("%s (dictionary of column %s)", errUnsupported,
+				f.Columns[j].Name)
+		}
+		d := make([]byte, meta.int(7))
+		if _, err := f.r.ReadAt(d, meta.int(9)); err != nil {
+			return nil, err
+		}
+		plain, err := readPages(d, meta.int(4), meta.int(5))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read column %s (%s)", f.Columns[j].Name, err)
+		}
+		if values[j], err = decodePlain(f.Columns[j].Type, plain, meta.int(5)); err != nil {
+			return nil, fmt.Errorf("failed to read column %s (%s)", f.Columns[j].Name, err)
+		}
+	}
+	return values, nil
+}
+
+// readPages returns the PLAIN values of the data pages in d
+func readPages(d []byte, codec, values int64) ([]byte, error) {
+	var plain []byte
+	r := &thriftReader{Reader: bytes.NewReader(d)}
+	for read := int64(0); read < values; {
+		h, err := r.readStruct()
+		if err != nil {
+			return nil, err
+		}
+		size := h.int(3)
+		if size < 0 || size > int64(r.Len()) {
+			return nil, errors.New("invalid page size")
+		}
+		page := make([]byte, size)
+		if _, err = io.ReadFull(r, page); err != nil {
+			return nil, err
+		}
+		dp := h.strct(5)
+		if h.int(1) != pageData || dp == nil || dp.int(2) != encodingPlain {
+			return nil, fmt.Errorf("%s (page type %d)", errUnsupported, h.int(1))
+		}
+		switch codec {
+		case codecUncompressed:
+		case codecGzip:
+			z, err := gzip.NewReader(bytes.NewReader(page))
+			if err != nil {
+				return nil, err
+			}
+			if page, err = ioutil.ReadAll(z); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%s (codec %d)", errUnsupported, codec)
+		}
+		plain = append(plain, page...)
+		read += dp.int(1)
+	}
+	return plain, nil
+}
+
+func decodePlain(t Type, b []byte, n int64) (interface{}, error) {
+	short := errors.New("too few values")
+	switch t {
+	case Int32:
+		if int64(len(b)) < 4*n {
+			return nil, short
+		}
+		v := make([]int32, n)
+		for i := range v {
+			v[i] = int32(binary.LittleEndian.Uint32(b[4*i:]))
+		}
+		return v, nil
+	case Int64, Double:
+		if int64(len(b)) < 8*n {
+			return nil, short
+		}
+		if t == Int64 {
+			v := make([]int64, n)
+			for i := range v {
+				v[i] = int64(binary.LittleEndian.Uint64(b[8*i:]))
+			}
+			return v, nil
+		}
+		v := make([]float64, n)
+		for i := range v {
+			v[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+		}
+		return v, nil
+	default: // String
+		v := make([]string, n)
+		for i := range v {
+			if len(b) < 4 {
+				return nil, short
+			}
+			l := int(binary.LittleEndian.Uint32(b))
+			if l > len(b)-4 {
+				return nil, short
+			}
+			v[i], b = string(b[4:4+l]), b[4+l:]
+		}
+		return v, nil
+	}
+}
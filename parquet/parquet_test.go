@@ -0,0 +1,157 @@
+package parquet
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math"
+	"path"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "write testdata/golden.parquet again")
+
+var testColumns = []Column{
+	{Name: "site", Type: Int32},
+	{Name: "ts", Type: Int64},
+	{Name: "score", Type: Double},
+	{Name: "domain", Type: String},
+}
+
+// testGroups are the values of each row group of the test files
+var testGroups = [][]interface{}{
+	{[]int32{1, -2, math.MaxInt32}, []int64{0, -1, 1 << 40},
+		[]float64{0.5, -1.25, 1e300}, []string{"example.com", "", "åäö.example"}},
+	{[]int32{7, 8}, []int64{9, 10}, []float64{3, 4}, []string{"a.example", "b.example"}},
+}
+
+func write(t *testing.T, columns []Column, groups [][]interface{}) []byte {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range groups {
+		if err = w.WriteRowGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// check reads the Parquet file d and compares it to columns and groups
+func check(t *testing.T, d []byte, columns []Column, groups [][]interface{}) {
+	f, err := Open(bytes.NewReader(d), int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.Columns, columns) {
+		t.Errorf("columns are %v, want %v", f.Columns, columns)
+	}
+	rows := int64(0)
+	for _, g := range groups {
+		rows += int64(reflect.ValueOf(g[0]).Len())
+	}
+	if f.Rows != rows {
+		t.Errorf("%d rows, want %d", f.Rows, rows)
+	}
+	if f.RowGroups() != len(groups) {
+		t.Fatalf("%d row groups, want %d", f.RowGroups(), len(groups))
+	}
+	for i, want := range groups {
+		got, err := f.ReadRowGroup(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("row group %d is %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	check(t, write(t, testColumns, testGroups), testColumns, testGroups)
+
+	// no row groups, and row groups without rows
+	check(t, write(t, testColumns, nil), testColumns, nil)
+	empty := [][]interface{}{{[]int32{}, []int64{}, []float64{}, []string{}}}
+	check(t, write(t, testColumns, empty), testColumns, empty)
+
+	// many rows of one column, spanning several gzip blocks
+	many := make([]string, 100000)
+	for i := range many {
+		many[i] = string(rune('a'+i%26)) + ".example"
+	}
+	one := []Column{{Name: "domain", Type: String}}
+	check(t, write(t, one, [][]interface{}{{many}}), one, [][]interface{}{{many}})
+}
+
+// TestGolden checks that files are written as they were when
+// testdata/golden.parquet was written, so what is read elsewhere from files
+// of earlier versions is also what is read from new files.  Regenerate it
+// with "go test -update" after a deliberate change of the format.
+func TestGolden(t *testing.T) {
+	golden := path.Join("testdata", "golden.parquet")
+	d := write(t, testColumns, testGroups)
+	if *update {
+		if err := ioutil.WriteFile(golden, d, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, want, testColumns, testGroups)
+	if !bytes.Equal(d, want) {
+		t.Errorf("wrote %d bytes that differ from the %d bytes of %s", len(d), len(want),
+			golden)
+	}
+}
+
+// TestForeign reads testdata/foreign.parquet, laid out as parquet-cpp
+// writes files, see testdata/foreign.py.
+func TestForeign(t *testing.T) {
+	d, err := ioutil.ReadFile(path.Join("testdata", "foreign.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, d, testColumns, testGroups)
+}
+
+func TestWriterErrors(t *testing.T) {
+	if _, err := NewWriter(new(bytes.Buffer), []Column{{Name: "b", Type: 0}}); err == nil {
+		t.Error("made a writer of a column of an unsupported type")
+	}
+	w, err := NewWriter(new(bytes.Buffer), testColumns[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range [][]interface{}{
+		{[]int32{1}},                // too few columns
+		{[]int32{1}, []int64{1, 2}}, // columns of different lengths
+		{[]int32{1}, []int32{1}},    // wrong type of values
+	} {
+		if err = w.WriteRowGroup(g); err == nil {
+			t.Errorf("wrote invalid row group %v", g)
+		}
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	d := write(t, testColumns, testGroups)
+	for name, b := range map[string][]byte{
+		"empty":        nil,
+		"no magic":     append(append([]byte{}, d[:len(d)-4]...), "PAR0"...),
+		"long footer":  append(append([]byte{}, d[:len(d)-8]...), 0xff, 0xff, 0xff, 0x0f, 'P', 'A', 'R', '1'),
+		"only a magic": []byte("PAR1PAR1"),
+	} {
+		if _, err := Open(bytes.NewReader(b), int64(len(b))); err == nil {
+			t.Errorf("%s: opened an invalid file", name)
+		}
+	}
+}
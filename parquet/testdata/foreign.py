@@ -0,0 +1,134 @@
+#!/usr/bin/env python3
+"""Writes foreign.parquet, a Parquet file laid out as parquet-cpp (pyarrow)
+writes it but encoded here from the Parquet and Thrift specs, without the
+parquet package: uncompressed pages, two data pages in a column chunk,
+statistics, logical types, key-value metadata and column orders, all of
+which the reader must read or skip.
+
+    python3 foreign.py > foreign.parquet
+"""
+import struct
+import sys
+
+BOOL_TRUE, BOOL_FALSE, BYTE, I16, I32, I64, DOUBLE, BINARY, LIST, SET, MAP, STRUCT = range(1, 13)
+
+
+def varint(v):
+    out = b""
+    while True:
+        b = v & 0x7F
+        v >>= 7
+        if v:
+            out += bytes([b | 0x80])
+        else:
+            return out + bytes([b])
+
+
+def zigzag(v):
+    return varint((v << 1) ^ (v >> 63))
+
+
+def value(typ, v):
+    if typ in (I16, I32, I64):
+        return zigzag(v)
+    if typ == DOUBLE:
+        return struct.pack("<d", v)
+    if typ == BINARY:
+        v = v.encode() if isinstance(v, str) else v
+        return varint(len(v)) + v
+    if typ == STRUCT:
+        return encode(v)
+    if typ == LIST:
+        elem, items = v
+        head = bytes([len(items) << 4 | elem]) if len(items) < 15 else \
+            bytes([0xF0 | elem]) + varint(len(items))
+        return head + b"".join(value(elem, i) for i in items)
+    raise ValueError(typ)
+
+
+def encode(fields):
+    """encodes a struct of (id, type, value) fields, in order of id"""
+    out, last = b"", 0
+    for fid, typ, v in fields:
+        if typ == bool:
+            typ, v = (BOOL_TRUE if v else BOOL_FALSE), None
+        delta = fid - last
+        out += bytes([delta << 4 | typ]) if 0 < delta <= 15 else bytes([typ]) + zigzag(fid)
+        if v is not None:
+            out += value(typ, v)
+        last = fid
+    return out + b"\x00"
+
+
+INT32, INT64, DOUBLE_T, BYTE_ARRAY = 1, 2, 5, 6
+PLAIN, RLE = 0, 3
+columns = [("site", INT32, "<i"), ("ts", INT64, "<q"),
+           ("score", DOUBLE_T, "<d"), ("domain", BYTE_ARRAY, None)]
+groups = [
+    [[1, -2, 2147483647], [0, -1, 1 << 40], [0.5, -1.25, 1e300],
+     ["example.com", "", "åäö.example"]],
+    [[7, 8], [9, 10], [3.0, 4.0], ["a.example", "b.example"]],
+]
+
+
+def plain(typ, fmt, vs):
+    if typ == BYTE_ARRAY:
+        return b"".join(struct.pack("<I", len(v.encode())) + v.encode() for v in vs)
+    return b"".join(struct.pack(fmt, v) for v in vs)
+
+
+def stats(typ, fmt, vs):
+    lo, hi = min(vs), max(vs)
+    enc = (lambda v: v.encode()) if typ == BYTE_ARRAY else (lambda v: struct.pack(fmt, v))
+    return [(3, I64, 0), (5, BINARY, enc(hi)), (6, BINARY, enc(lo))]
+
+
+out = b"PAR1"
+row_groups = []
+for rows in groups:
+    chunks, size = [], 0
+    for (name, typ, fmt), vs in zip(columns, rows):
+        start = len(out)
+        # the first column chunk of every row group has a page per value
+        pages = [[v] for v in vs] if name == "site" else [vs]
+        for page in pages:
+            data = plain(typ, fmt, page)
+            header = encode([
+                (1, I32, 0), (2, I32, len(data)), (3, I32, len(data)),
+                (5, STRUCT, [(1, I32, len(page)), (2, I32, PLAIN), (3, I32, RLE),
+                             (4, I32, RLE), (5, STRUCT, stats(typ, fmt, page))]),
+            ])
+            out += header + data
+        n = len(out) - start
+        size += n
+        chunks.append([
+            (2, I64, start),
+            (3, STRUCT, [
+                (1, I32, typ), (2, LIST, (I32, [PLAIN, RLE])),
+                (3, LIST, (BINARY, [name])), (4, I32, 0),
+                (5, I64, len(vs)), (6, I64, n), (7, I64, n),
+                (9, I64, start), (12, STRUCT, stats(typ, fmt, vs)),
+            ]),
+        ])
+    row_groups.append([
+        (1, LIST, (STRUCT, chunks)), (2, I64, size), (3, I64, len(rows[0])),
+        (5, I64, chunks[0][0][2]), (6, I64, size), (7, I16, len(row_groups)),
+    ])
+
+schema = [[(4, BINARY, "schema"), (5, I32, len(columns))]]
+for name, typ, _ in columns:
+    element = [(1, I32, typ), (3, I32, 0), (4, BINARY, name)]
+    if typ == BYTE_ARRAY:
+        element += [(6, I32, 0), (10, STRUCT, [(1, STRUCT, [])])]
+    schema.append(element)
+meta = encode([
+    (1, I32, 2),
+    (2, LIST, (STRUCT, schema)),
+    (3, I64, sum(len(g[0]) for g in groups)),
+    (4, LIST, (STRUCT, row_groups)),
+    (5, LIST, (STRUCT, [[(1, BINARY, "origin"), (2, BINARY, "foreign.py")]])),
+    (6, BINARY, "parquet-cpp-arrow version 14.0.2"),
+    (7, LIST, (STRUCT, [[(1, STRUCT, [])] for _ in columns])),
+])
+out += meta + struct.pack("<I", len(meta)) + b"PAR1"
+sys.stdout.buffer.write(out)
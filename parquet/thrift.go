@@ -0,0 +1,243 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// types of the Thrift compact protocol, the encoding of Parquet metadata
+const (
+	tBoolTrue  = 1
+	tBoolFalse = 2
+	tByte      = 3
+	tI16       = 4
+	tI32       = 5
+	tI64       = 6
+	tDouble    = 7
+	tBinary    = 8
+	tList      = 9
+	tSet       = 10
+	tMap       = 11
+	tStruct    = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol
+type thriftWriter struct {
+	bytes.Buffer
+	last []int // the last field ID of each open struct
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int{0}}
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) field(id int, typ byte) {
+	top := len(t.last) - 1
+	if delta := id - t.last[top]; delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta<<4) | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last[top] = id
+}
+
+func (t *thriftWriter) i32(id int, v int32) {
+	t.field(id, tI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int, v int64) {
+	t.field(id, tI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int, s string) {
+	t.field(id, tBinary)
+	t.varint(uint64(len(s)))
+	t.WriteString(s)
+}
+
+// list starts a list field of n elements of typ, to be written directly
+// (or with beginStruct(0) for structs)
+func (t *thriftWriter) list(id int, typ byte, n int) {
+	t.field(id, tList)
+	if n < 15 {
+		t.WriteByte(byte(n<<4) | typ)
+	} else {
+		t.WriteByte(0xf0 | typ)
+		t.varint(uint64(n))
+	}
+}
+
+// beginStruct starts a struct field, or a struct in a list with id 0
+func (t *thriftWriter) beginStruct(id int) {
+	if id != 0 {
+		t.field(id, tStruct)
+	}
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) endStruct() {
+	t.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// thriftStruct is a decoded struct: field ID -> value, where a value is an
+// int64 (also for bools, bytes and i16), float64, []byte, []interface{} or
+// thriftStruct
+type thriftStruct map[int]interface{}
+
+func (s thriftStruct) int(id int) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftStruct) str(id int) string {
+	v, _ := s[id].([]byte)
+	return string(v)
+}
+
+func (s thriftStruct) list(id int) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+func (s thriftStruct) strct(id int) thriftStruct {
+	v, _ := s[id].(thriftStruct)
+	return v
+}
+
+// thriftReader decodes the Thrift compact protocol
+type thriftReader struct {
+	*bytes.Reader
+	depth int
+}
+
+var errThrift = errors.New("invalid thrift")
+
+func (t *thriftReader) varint() (uint64, error) {
+	return binary.ReadUvarint(t)
+}
+
+func (t *thriftReader) zigzag() (int64, error) {
+	v, err := t.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (t *thriftReader) readStruct() (thriftStruct, error) {
+	if t.depth++; t.depth > 64 {
+		return nil, errThrift
+	}
+	defer func() { t.depth-- }()
+	s := make(thriftStruct)
+	id := 0
+	for {
+		b, err := t.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		if delta := int(b >> 4); delta != 0 {
+			id += delta
+		} else {
+			v, err := t.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int(v)
+		}
+		typ := b & 0x0f
+		switch typ {
+		case tBoolTrue:
+			s[id] = int64(1)
+		case tBoolFalse:
+			s[id] = int64(0)
+		default:
+			if s[id], err = t.readValue(typ); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (t *thriftReader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case tBoolTrue, tBoolFalse, tByte: // a byte in lists
+		b, err := t.ReadByte()
+		return int64(b), err
+	case tI16, tI32, tI64:
+		return t.zigzag()
+	case tDouble:
+		var b [8]byte
+		if _, err := io.ReadFull(t, b[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	case tBinary:
+		n, err := t.varint()
+		if err != nil || n > uint64(t.Len()) {
+			return nil, errThrift
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(t, b)
+		return b, err
+	case tList, tSet:
+		h, err := t.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n := uint64(h >> 4)
+		if n == 15 {
+			if n, err = t.varint(); err != nil {
+				return nil, err
+			}
+		}
+		if n > uint64(t.Len()) {
+			return nil, errThrift
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = t.readValue(h & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case tMap: // skipped, not used by Parquet
+		n, err := t.varint()
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		kv, err := t.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err = t.readValue(kv >> 4); err != nil {
+				return nil, err
+			}
+			if _, err = t.readValue(kv & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case tStruct:
+		return t.readStruct()
+	}
+	return nil, fmt.Errorf("unknown thrift type %d", typ)
+}
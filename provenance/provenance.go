@@ -0,0 +1,300 @@
+/*
+Package provenance implements the manifests that record how the results of
+a tool were produced, for reproducing and checking experiments: the tool
+and its version, the command line and the value of every flag (including
+seeds once resolved), and the hashes of the input datasets.
+
+Every tool writes a manifest with -provenance, and with -verify checks that
+the datasets of a manifest are still what they were, with the flags of
+RegisterFlags handled by Init once parsed.  The version is set when building:
+
+	go install -ldflags "-X github.com/pylls/defector/provenance.Version=$(git describe --always --dirty)" ...defector/cmd...
+
+A dataset is a data dir, identified by two hashes: of its samples, the
+"<site>-<instance>" names of its files, or "<site>-<instance>-<epoch>" for
+data collected in epochs, which are the same for the features, .dns and
+.pcap files of the same visits, and of its content, the names and bytes of
+all its files.  Results of classifiers can only be compared, or combined,
+if they are of the same samples.
+*/
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pylls/defector/epoch"
+	"github.com/pylls/defector/logging"
+)
+
+// Version is the version of the tools, set with -ldflags when building.
+var Version = "dev"
+
+// Manifest is the provenance of a run of a tool.
+type Manifest struct {
+	Tool     string            `json:"tool"`
+	Version  string            `json:"version"`
+	Time     time.Time         `json:"time"`
+	Args     []string          `json:"args"`
+	Flags    map[string]string `json:"flags"` // every flag, also defaults
+	Datasets []Dataset         `json:"datasets,omitempty"`
+}
+
+// Dataset is an input data dir.
+type Dataset struct {
+	Dir     string `json:"dir"`
+	Files   int    `json:"files"`
+	Samples string `json:"samples"` // SampleHash of the dir
+	Content string `json:"content"` // ContentHash of the dir
+}
+
+var (
+	lock    sync.Mutex
+	current *Manifest // of this run, nil unless recording
+	file    string
+)
+
+var manifestFlag, verifyFlag *string
+
+// RegisterFlags registers -provenance and -verify on flag.CommandLine.
+func RegisterFlags() {
+	manifestFlag = flag.String("provenance", "",
+		"write the provenance (version, flags and dataset hashes) of the run to this file")
+	verifyFlag = flag.String("verify", "",
+		"verify the datasets of this provenance manifest and exit")
+}
+
+// Init handles the flags of RegisterFlags, once parsed, for tool.  With
+// -verify, the datasets of a manifest are verified and the tool exits.  With
+// -provenance, the provenance of the run is recorded in a manifest, with the
+// data dirs given as arguments as its datasets.
+func Init(tool string) {
+	if verifyFlag != nil && *verifyFlag != "" {
+		verifyManifest(*verifyFlag)
+		os.Exit(0)
+	}
+	if manifestFlag != nil && *manifestFlag != "" {
+		var dirs []string
+		for _, arg := range flag.Args() {
+			if info, err := os.Stat(arg); err == nil && info.IsDir() {
+				dirs = append(dirs, arg)
+			}
+		}
+		if err := Start(tool, *manifestFlag, dirs...); err != nil {
+			logging.Fatal(err)
+		}
+	}
+}
+
+func verifyManifest(file string) {
+	m, err := Read(file)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	logging.Infof("verifying %d datasets of %s (%s %s, %s)", len(m.Datasets), file,
+		m.Tool, m.Version, m.Time.Format(time.RFC3339))
+	changed, err := m.Verify()
+	if err != nil {
+		logging.Fatal(err)
+	}
+	if len(changed) > 0 {
+		logging.Fatalf("datasets changed: %s", strings.Join(changed, ", "))
+	}
+	logging.Info("all datasets are unchanged")
+}
+
+// Start records the provenance of this run of tool to manifest, hashing
+// the datasets in dirs.
+func Start(tool, manifest string, dirs ...string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	current = &Manifest{
+		Tool:    tool,
+		Version: Version,
+		Time:    time.Now(),
+		Args:    os.Args[1:],
+	}
+	file = manifest
+	for _, dir := range dirs {
+		d, err := HashDataset(dir)
+		if err != nil {
+			return err
+		}
+		current.Datasets = append(current.Datasets, d)
+	}
+	return write()
+}
+
+// AddDataset adds the dataset in dir to the manifest of this run, if
+// recording.
+func AddDataset(dir string) error {
+	lock.Lock()
+	defer lock.Unlock()
+	if current == nil {
+		return nil
+	}
+	for _, d := range current.Datasets {
+		if d.Dir == dir {
+			return nil
+		}
+	}
+	d, err := HashDataset(dir)
+	if err != nil {
+		return err
+	}
+	current.Datasets = append(current.Datasets, d)
+	return write()
+}
+
+// Update records the current values of the flags in the manifest of this
+// run, if recording, e.g., after a seed of 0 is replaced by a random seed.
+func Update() error {
+	lock.Lock()
+	defer lock.Unlock()
+	if current == nil {
+		return nil
+	}
+	return write()
+}
+
+func write() error {
+	current.Flags = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		current.Flags[f.Name] = f.Value.String()
+	})
+	return current.Write(file)
+}
+
+// Write writes the manifest as JSON to file.
+func (m *Manifest) Write(file string) error {
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest (%s)", err)
+	}
+	if err = ioutil.WriteFile(file, d, 0666); err != nil {
+		return fmt.Errorf("failed to write manifest (%s)", err)
+	}
+	return nil
+}
+
+// Read reads a manifest from file.
+func Read(file string) (*Manifest, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest (%s)", err)
+	}
+	m := new(Manifest)
+	if err = json.Unmarshal(d, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s (%s)", file, err)
+	}
+	return m, nil
+}
+
+// Verify hashes the datasets of the manifest again, returning the dirs of
+// those that changed.
+func (m *Manifest) Verify() (changed []string, err error) {
+	for _, d := range m.Datasets {
+		now, err := HashDataset(d.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if now.Samples != d.Samples || now.Content != d.Content {
+			changed = append(changed, d.Dir)
+		}
+	}
+	return
+}
+
+// HashDataset hashes the data dir.
+func HashDataset(dir string) (d Dataset, err error) {
+	d.Dir = dir
+	names, err := files(dir)
+	if err != nil {
+		return d, err
+	}
+	d.Files = len(names)
+	d.Samples = sampleHash(names)
+	d.Content, err = contentHash(dir, names)
+	return
+}
+
+// SampleHash hashes the distinct samples of the data dir, so that it is
+// cheap to compute and the same for the same samples of any kind of file.
+func SampleHash(dir string) (string, error) {
+	names, err := files(dir)
+	if err != nil {
+		return "", err
+	}
+	return sampleHash(names), nil
+}
+
+// ContentHash hashes the names and contents of all files in dir.
+func ContentHash(dir string) (string, error) {
+	names, err := files(dir)
+	if err != nil {
+		return "", err
+	}
+	return contentHash(dir, names)
+}
+
+// files lists the names of the files in dir, sorted
+func files(dir string) (names []string, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dataset %s (%s)", dir, err)
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return // ReadDir sorts by name
+}
+
+func sampleHash(names []string) string {
+	samples := make(map[string]bool)
+	for _, name := range names {
+		if f, ok := epoch.ParseFile(name); ok {
+			samples[f.Sample] = true
+		}
+	}
+	sorted := make([]string, 0, len(samples))
+	for s := range samples {
+		sorted = append(sorted, s)
+	}
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, s := range sorted {
+		fmt.Fprintln(h, s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func contentHash(dir string, names []string) (string, error) {
+	h := sha256.New()
+	for _, name := range names {
+		f, err := os.Open(path.Join(dir, name))
+		if err != nil {
+			return "", fmt.Errorf("failed to hash dataset %s (%s)", dir, err)
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to hash dataset %s (%s)", dir, err)
+		}
+		fmt.Fprintf(h, "%s %x\n", name, fh.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
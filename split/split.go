@@ -0,0 +1,79 @@
+/*
+Package split implements split manifests, assigning every sample of a
+dataset to the fold it is tested in, as written by the split tool and read
+by classifiers to evaluate on the same folds.
+
+A sample is named by its site and instance, "<site>-<instance>", or with
+its epoch, "<site>-<instance>-<epoch>", as in the names of the files in a
+data dir.  In k-fold cross-validation, a sample is trained on in every fold
+but the one it is tested in.  A train/test split is a split with one fold,
+where the samples in fold Train are only trained on.
+*/
+package split
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// Train is the fold of samples that are only trained on.
+const Train = -1
+
+// Split assigns samples to folds.
+type Split struct {
+	Time    time.Time      `json:"time"`
+	Dir     string         `json:"dir"`               // the data dir split
+	Dataset string         `json:"dataset,omitempty"` // provenance.SampleHash of Dir
+	Seed    int64          `json:"seed"`              // of the random assignment
+	Folds   int            `json:"folds"`             // 1 for a train/test split
+	Test    float64        `json:"test,omitempty"`
+	Sites   int            `json:"sites"` // sites above are unmonitored
+	Samples map[string]int `json:"samples"`
+}
+
+// Name returns the name of instance of site.
+func Name(site, instance int) string {
+	return strconv.Itoa(site) + "-" + strconv.Itoa(instance)
+}
+
+// Fold returns the fold sample is tested in, and if it is in the split.
+func (s *Split) Fold(sample string) (fold int, ok bool) {
+	fold, ok = s.Samples[sample]
+	return
+}
+
+// Read reads a split manifest from file.
+func Read(file string) (*Split, error) {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read split (%s)", err)
+	}
+	s := new(Split)
+	if err = json.Unmarshal(d, s); err != nil {
+		return nil, fmt.Errorf("failed to parse split (%s)", err)
+	}
+	if s.Folds < 1 {
+		return nil, fmt.Errorf("invalid split with %d folds", s.Folds)
+	}
+	for sample, fold := range s.Samples {
+		if fold < Train || fold >= s.Folds {
+			return nil, fmt.Errorf("invalid fold %d of sample %s", fold, sample)
+		}
+	}
+	return s, nil
+}
+
+// Write writes the split manifest to file.
+func (s *Split) Write(file string) error {
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode split (%s)", err)
+	}
+	if err = ioutil.WriteFile(file, d, 0666); err != nil {
+		return fmt.Errorf("failed to write split (%s)", err)
+	}
+	return nil
+}